@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+
+	"github.com/google/subcommands"
+)
+
+// Build implements subcommands.Command for the "build" command.
+// This command runs an entire image build, as described by a build spec file,
+// in a single invocation.
+type Build struct {
+	specPath string
+}
+
+// Name implements subcommands.Command.Name.
+func (*Build) Name() string {
+	return "build"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*Build) Synopsis() string {
+	return "Build a COS image from a build spec file."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*Build) Usage() string {
+	return `build [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (b *Build) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&b.specPath, "spec", "", "Path to a YAML or JSON build spec file describing the source image, "+
+		"build context, customization steps and output image.")
+}
+
+// Execute implements subcommands.Command.Execute. It runs each build step
+// described by the build spec in order.
+func (b *Build) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if b.specPath == "" {
+		log.Println("'spec' must be set")
+		return subcommands.ExitFailure
+	}
+	files := args[0].(*fs.Files)
+	spec, err := loadBuildSpec(b.specPath)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	cmds, err := spec.commands()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	for _, c := range cmds {
+		flags := flag.NewFlagSet(c.cmd.Name(), flag.ContinueOnError)
+		c.cmd.SetFlags(flags)
+		if err := flags.Parse(c.args); err != nil {
+			log.Printf("invalid build spec for %s: %v", c.cmd.Name(), err)
+			files.CleanupAllPersistent()
+			return subcommands.ExitFailure
+		}
+		log.Printf("Running %s %v", c.cmd.Name(), c.args)
+		if ret := c.cmd.Execute(ctx, flags, args...); ret != subcommands.ExitSuccess {
+			log.Printf("%s failed", c.cmd.Name())
+			files.CleanupAllPersistent()
+			return ret
+		}
+	}
+	return subcommands.ExitSuccess
+}
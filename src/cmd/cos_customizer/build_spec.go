@@ -0,0 +1,350 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/subcommands"
+	"gopkg.in/yaml.v2"
+)
+
+// buildSpec is a declarative description of an entire image build. It is
+// consumed by the "build" command, and can be written in YAML or JSON.
+//
+// Every part of the spec maps onto the flags of an existing build step, so a
+// build spec produces exactly the same image build as the equivalent sequence
+// of Cloud Build steps.
+type buildSpec struct {
+	// BuildContext is the path to the build context. Relative paths are
+	// resolved against the directory containing the spec file.
+	BuildContext string `yaml:"buildContext"`
+	// BuildContexts are the paths to several build contexts that are merged,
+	// with later ones taking precedence. They are resolved in the same way as
+	// BuildContext, and can't be used together with it.
+	BuildContexts []string        `yaml:"buildContexts"`
+	GCSBucket     string          `yaml:"gcsBucket"`
+	GCSWorkdir    string          `yaml:"gcsWorkdir"`
+	SourceImage   sourceImageSpec `yaml:"sourceImage"`
+	Steps         []stepSpec      `yaml:"steps"`
+	OutputImage   outputImageSpec `yaml:"outputImage"`
+	Builder       builderSpec     `yaml:"builder"`
+}
+
+// sourceImageSpec mirrors the source image flags of "start-image-build".
+type sourceImageSpec struct {
+	Project    string `yaml:"project"`
+	Name       string `yaml:"name"`
+	Milestone  int    `yaml:"milestone"`
+	Family     string `yaml:"family"`
+	Constraint string `yaml:"constraint"`
+	// LocalImage is resolved in the same way as buildSpec.BuildContext.
+	LocalImage string `yaml:"localImage"`
+}
+
+// stepSpec is a single customization step. Exactly one of its fields must be
+// set. Field names match the names of the corresponding build steps.
+type stepSpec struct {
+	RunScript         *runScriptSpec       `yaml:"run-script"`
+	InstallGPU        *installGPUSpec      `yaml:"install-gpu"`
+	SealOEM           *struct{}            `yaml:"seal-oem"`
+	DisableAutoUpdate *struct{}            `yaml:"disable-auto-update"`
+	InstallPackages   *installPackagesSpec `yaml:"anthos-installer-install"`
+}
+
+type runScriptSpec struct {
+	Script string            `yaml:"script"`
+	Env    map[string]string `yaml:"env"`
+}
+
+type installGPUSpec struct {
+	Version    string `yaml:"version"`
+	MD5Sum     string `yaml:"md5sum"`
+	InstallDir string `yaml:"installDir"`
+	GPUType    string `yaml:"gpuType"`
+	GPUCount   int    `yaml:"gpuCount"`
+	// DepsDir is resolved in the same way as buildSpec.BuildContext.
+	DepsDir string `yaml:"depsDir"`
+}
+
+type installPackagesSpec struct {
+	PkgSpecURL string `yaml:"pkgspecURL"`
+}
+
+// outputImageSpec mirrors the output image flags of "finish-image-build".
+type outputImageSpec struct {
+	Project                string            `yaml:"project"`
+	Name                   string            `yaml:"name"`
+	Suffix                 string            `yaml:"suffix"`
+	Family                 string            `yaml:"family"`
+	DeprecateOldImages     bool              `yaml:"deprecateOldImages"`
+	OldImageTTL            int               `yaml:"oldImageTTL"`
+	Labels                 map[string]string `yaml:"labels"`
+	Licenses               []string          `yaml:"licenses"`
+	InheritLabels          bool              `yaml:"inheritLabels"`
+	ExportURI              string            `yaml:"exportURI"`
+	ExportFormat           string            `yaml:"exportFormat"`
+	ShareWith              []string          `yaml:"shareWith"`
+	CopyTo                 []string          `yaml:"copyTo"`
+	CopyDeprecateOld       bool              `yaml:"copyDeprecateOldImages"`
+	GuestOSFeatures        []string          `yaml:"guestOSFeatures"`
+	InheritGuestOSFeatures bool              `yaml:"inheritGuestOSFeatures"`
+}
+
+// builderSpec mirrors the builder flags of "finish-image-build".
+type builderSpec struct {
+	Project    string `yaml:"project"`
+	Zone       string `yaml:"zone"`
+	DiskSizeGB int    `yaml:"diskSizeGB"`
+	OEMSize    string `yaml:"oemSize"`
+	Timeout    string `yaml:"timeout"`
+	// LocalOutputDir is resolved in the same way as buildSpec.BuildContext.
+	LocalOutputDir string   `yaml:"localOutputDir"`
+	MachineType    string   `yaml:"machineType"`
+	Network        string   `yaml:"network"`
+	Subnet         string   `yaml:"subnet"`
+	NoExternalIP   bool     `yaml:"noExternalIP"`
+	ServiceAccount string   `yaml:"serviceAccount"`
+	Scopes         []string `yaml:"scopes"`
+	NetworkTags    []string `yaml:"networkTags"`
+	BootDiskType   string   `yaml:"bootDiskType"`
+	ShieldedVM     bool     `yaml:"shieldedVM"`
+	ConfidentialVM bool     `yaml:"confidentialVM"`
+	// TimelineFile is resolved in the same way as buildSpec.BuildContext.
+	TimelineFile string `yaml:"timelineFile"`
+}
+
+// specCommand is a build step, along with the flags it should be invoked with.
+type specCommand struct {
+	cmd  subcommands.Command
+	args []string
+}
+
+// loadBuildSpec reads a build spec from the given file. Unknown fields are
+// rejected so that typos don't silently change the build.
+func loadBuildSpec(path string) (*buildSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &buildSpec{}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("error parsing build spec %q: %v", path, err)
+	}
+	if spec.BuildContext != "" && len(spec.BuildContexts) != 0 {
+		return nil, fmt.Errorf("error parsing build spec %q: buildContext and buildContexts can't both be set", path)
+	}
+	spec.resolvePaths(filepath.Dir(path))
+	return spec, nil
+}
+
+// resolvePaths makes the local paths in the spec relative to dir.
+func (s *buildSpec) resolvePaths(dir string) {
+	if s.BuildContext == "" && len(s.BuildContexts) == 0 {
+		s.BuildContext = "."
+	}
+	if s.BuildContext != "" {
+		s.BuildContexts = []string{s.BuildContext}
+	}
+	for i, buildContext := range s.BuildContexts {
+		if !filepath.IsAbs(buildContext) {
+			s.BuildContexts[i] = filepath.Join(dir, buildContext)
+		}
+	}
+	if s.SourceImage.LocalImage != "" && !filepath.IsAbs(s.SourceImage.LocalImage) {
+		s.SourceImage.LocalImage = filepath.Join(dir, s.SourceImage.LocalImage)
+	}
+	if s.Builder.LocalOutputDir != "" && !filepath.IsAbs(s.Builder.LocalOutputDir) {
+		s.Builder.LocalOutputDir = filepath.Join(dir, s.Builder.LocalOutputDir)
+	}
+	if s.Builder.TimelineFile != "" && !filepath.IsAbs(s.Builder.TimelineFile) {
+		s.Builder.TimelineFile = filepath.Join(dir, s.Builder.TimelineFile)
+	}
+	for _, step := range s.Steps {
+		if step.InstallGPU != nil && step.InstallGPU.DepsDir != "" && !filepath.IsAbs(step.InstallGPU.DepsDir) {
+			step.InstallGPU.DepsDir = filepath.Join(dir, step.InstallGPU.DepsDir)
+		}
+	}
+}
+
+// flagArgs accumulates command line flags, skipping empty values so that flag
+// defaults apply.
+type flagArgs []string
+
+func (f *flagArgs) str(name, value string) {
+	if value != "" {
+		*f = append(*f, fmt.Sprintf("-%s=%s", name, value))
+	}
+}
+
+func (f *flagArgs) integer(name string, value int) {
+	if value != 0 {
+		*f = append(*f, fmt.Sprintf("-%s=%d", name, value))
+	}
+}
+
+func (f *flagArgs) boolean(name string, value bool) {
+	if value {
+		*f = append(*f, "-"+name+"="+strconv.FormatBool(value))
+	}
+}
+
+// pairs adds one flag per map entry. Entries are sorted for predictable output.
+// Map flags split their values on commas, so keys and values can't contain
+// them.
+func (f *flagArgs) pairs(name string, m map[string]string) error {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.Contains(k, ",") || strings.Contains(m[k], ",") {
+			return fmt.Errorf("%s entry %q=%q must not contain commas", name, k, m[k])
+		}
+		*f = append(*f, fmt.Sprintf("-%s=%s=%s", name, k, m[k]))
+	}
+	return nil
+}
+
+// list adds a single flag with the given values, separated by commas. List
+// flags split their values on commas, so the values can't contain them.
+func (f *flagArgs) list(name string, values []string) error {
+	for _, v := range values {
+		if strings.Contains(v, ",") {
+			return fmt.Errorf("%s entry %q must not contain commas", name, v)
+		}
+	}
+	f.str(name, strings.Join(values, ","))
+	return nil
+}
+
+func (s *stepSpec) command() (specCommand, error) {
+	var cmds []specCommand
+	if s.RunScript != nil {
+		var args flagArgs
+		args.str("script", s.RunScript.Script)
+		if err := args.pairs("env", s.RunScript.Env); err != nil {
+			return specCommand{}, err
+		}
+		cmds = append(cmds, specCommand{&RunScript{}, args})
+	}
+	if s.InstallGPU != nil {
+		var args flagArgs
+		args.str("version", s.InstallGPU.Version)
+		args.str("md5sum", s.InstallGPU.MD5Sum)
+		args.str("install-dir", s.InstallGPU.InstallDir)
+		args.str("gpu-type", s.InstallGPU.GPUType)
+		args.integer("gpu-count", s.InstallGPU.GPUCount)
+		args.str("deps-dir", s.InstallGPU.DepsDir)
+		cmds = append(cmds, specCommand{&InstallGPU{}, args})
+	}
+	if s.SealOEM != nil {
+		cmds = append(cmds, specCommand{&SealOEM{}, nil})
+	}
+	if s.DisableAutoUpdate != nil {
+		cmds = append(cmds, specCommand{&DisableAutoUpdate{}, nil})
+	}
+	if s.InstallPackages != nil {
+		var args flagArgs
+		args.str("pkgspec-url", s.InstallPackages.PkgSpecURL)
+		cmds = append(cmds, specCommand{&InstallPackage{}, args})
+	}
+	if len(cmds) != 1 {
+		return specCommand{}, fmt.Errorf("each step must configure exactly one of run-script, install-gpu, seal-oem, " +
+			"disable-auto-update, anthos-installer-install")
+	}
+	return cmds[0], nil
+}
+
+// commands translates the build spec into the sequence of build steps that
+// implement it.
+func (s *buildSpec) commands() ([]specCommand, error) {
+	var start flagArgs
+	for _, buildContext := range s.BuildContexts {
+		start.str("build-context", buildContext)
+	}
+	start.str("gcs-bucket", s.GCSBucket)
+	start.str("gcs-workdir", s.GCSWorkdir)
+	start.str("image-project", s.SourceImage.Project)
+	start.str("image-name", s.SourceImage.Name)
+	start.integer("image-milestone", s.SourceImage.Milestone)
+	start.str("image-family", s.SourceImage.Family)
+	start.str("image-constraint", s.SourceImage.Constraint)
+	start.str("local-source-image", s.SourceImage.LocalImage)
+	cmds := []specCommand{{&StartImageBuild{}, start}}
+	for i, step := range s.Steps {
+		cmd, err := step.command()
+		if err != nil {
+			return nil, fmt.Errorf("invalid step %d: %v", i, err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	var finish flagArgs
+	finish.str("image-project", s.OutputImage.Project)
+	finish.str("image-name", s.OutputImage.Name)
+	finish.str("image-suffix", s.OutputImage.Suffix)
+	finish.str("image-family", s.OutputImage.Family)
+	finish.boolean("deprecate-old-images", s.OutputImage.DeprecateOldImages)
+	finish.integer("old-image-ttl", s.OutputImage.OldImageTTL)
+	if err := finish.pairs("labels", s.OutputImage.Labels); err != nil {
+		return nil, err
+	}
+	if err := finish.list("licenses", s.OutputImage.Licenses); err != nil {
+		return nil, err
+	}
+	finish.boolean("inherit-labels", s.OutputImage.InheritLabels)
+	finish.str("export-uri", s.OutputImage.ExportURI)
+	finish.str("export-format", s.OutputImage.ExportFormat)
+	if err := finish.list("share-with", s.OutputImage.ShareWith); err != nil {
+		return nil, err
+	}
+	if err := finish.list("copy-to", s.OutputImage.CopyTo); err != nil {
+		return nil, err
+	}
+	finish.boolean("copy-deprecate-old-images", s.OutputImage.CopyDeprecateOld)
+	if err := finish.list("guest-os-features", s.OutputImage.GuestOSFeatures); err != nil {
+		return nil, err
+	}
+	finish.boolean("inherit-guest-os-features", s.OutputImage.InheritGuestOSFeatures)
+	finish.str("zone", s.Builder.Zone)
+	finish.str("project", s.Builder.Project)
+	finish.integer("disk-size-gb", s.Builder.DiskSizeGB)
+	finish.str("oem-size", s.Builder.OEMSize)
+	finish.str("timeout", s.Builder.Timeout)
+	finish.str("local-output-dir", s.Builder.LocalOutputDir)
+	finish.str("timeline-file", s.Builder.TimelineFile)
+	finish.str("machine-type", s.Builder.MachineType)
+	finish.str("network", s.Builder.Network)
+	finish.str("subnet", s.Builder.Subnet)
+	finish.boolean("no-external-ip", s.Builder.NoExternalIP)
+	finish.str("service-account", s.Builder.ServiceAccount)
+	if err := finish.list("scopes", s.Builder.Scopes); err != nil {
+		return nil, err
+	}
+	if err := finish.list("network-tags", s.Builder.NetworkTags); err != nil {
+		return nil, err
+	}
+	finish.str("boot-disk-type", s.Builder.BootDiskType)
+	finish.boolean("shielded-vm", s.Builder.ShieldedVM)
+	finish.boolean("confidential-vm", s.Builder.ConfidentialVM)
+	cmds = append(cmds, specCommand{&FinishImageBuild{}, finish})
+	return cmds, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeBuildSpec(t *testing.T, contents string) string {
+	t.Helper()
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	path := filepath.Join(tmpDir, "spec.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuildSpecCommands(t *testing.T) {
+	var testData = []struct {
+		testName string
+		spec     string
+		want     map[string][]string
+		wantCmds []string
+	}{
+		{
+			testName: "Minimal",
+			spec: `
+gcsBucket: b
+gcsWorkdir: d
+sourceImage: {project: cos-cloud, name: cos-stable-89-16108-403-22}
+outputImage: {project: p, name: out}
+builder: {project: p, zone: z}
+`,
+			wantCmds: []string{"start-image-build", "finish-image-build"},
+			want: map[string][]string{
+				"start-image-build": {"-build-context=<dir>", "-gcs-bucket=b", "-gcs-workdir=d",
+					"-image-project=cos-cloud", "-image-name=cos-stable-89-16108-403-22"},
+				"finish-image-build": {"-image-project=p", "-image-name=out", "-zone=z", "-project=p"},
+			},
+		},
+		{
+			testName: "Steps",
+			spec: `
+buildContext: ctx
+gcsBucket: b
+gcsWorkdir: d
+sourceImage: {project: cos-cloud, milestone: 89}
+steps:
+- run-script: {script: preload.sh, env: {B: b, A: a}}
+- install-gpu: {version: 450.51.06, gpuType: nvidia-tesla-t4, gpuCount: 2, depsDir: deps}
+- disable-auto-update: {}
+- seal-oem: {}
+outputImage:
+  project: p
+  suffix: -custom
+  family: f
+  deprecateOldImages: true
+  labels: {k2: v2, k1: v1}
+  licenses: [l1, l2]
+  exportURI: gs://b/out.vmdk
+  exportFormat: vmdk
+  shareWith: [project:p2, group:g@example.com]
+  copyTo: [p3, p4/us]
+  copyDeprecateOldImages: true
+  guestOSFeatures: [GVNIC]
+  inheritGuestOSFeatures: true
+builder: {project: p, zone: z, diskSizeGB: 20, oemSize: 1G, timeout: 2h, machineType: n1-standard-4,
+  subnet: sub, noExternalIP: true, serviceAccount: sa@p.iam.gserviceaccount.com, scopes: [cloud-platform],
+  networkTags: [t1, t2], bootDiskType: pd-ssd, shieldedVM: true}
+`,
+			wantCmds: []string{"start-image-build", "run-script", "install-gpu", "disable-auto-update", "seal-oem",
+				"finish-image-build"},
+			want: map[string][]string{
+				"start-image-build": {"-build-context=<dir>/ctx", "-gcs-bucket=b", "-gcs-workdir=d",
+					"-image-project=cos-cloud", "-image-milestone=89"},
+				"run-script":  {"-script=preload.sh", "-env=A=a", "-env=B=b"},
+				"install-gpu": {"-version=450.51.06", "-gpu-type=nvidia-tesla-t4", "-gpu-count=2", "-deps-dir=<dir>/deps"},
+				"finish-image-build": {"-image-project=p", "-image-suffix=-custom", "-image-family=f",
+					"-deprecate-old-images=true", "-labels=k1=v1", "-labels=k2=v2", "-licenses=l1,l2", "-export-uri=gs://b/out.vmdk",
+					"-export-format=vmdk", "-share-with=project:p2,group:g@example.com",
+					"-copy-to=p3,p4/us", "-copy-deprecate-old-images=true", "-guest-os-features=GVNIC",
+					"-inherit-guest-os-features=true", "-zone=z",
+					"-project=p", "-disk-size-gb=20", "-oem-size=1G", "-timeout=2h", "-machine-type=n1-standard-4",
+					"-subnet=sub", "-no-external-ip=true", "-service-account=sa@p.iam.gserviceaccount.com",
+					"-scopes=cloud-platform", "-network-tags=t1,t2", "-boot-disk-type=pd-ssd", "-shielded-vm=true"},
+			},
+		},
+		{
+			testName: "Constraint",
+			spec: `
+sourceImage: {project: cos-cloud, constraint: "channel=stable,milestone>=101,<105"}
+outputImage: {project: p, name: out}
+builder: {project: p, zone: z}
+`,
+			wantCmds: []string{"start-image-build", "finish-image-build"},
+			want: map[string][]string{
+				"start-image-build": {"-build-context=<dir>", "-image-project=cos-cloud",
+					"-image-constraint=channel=stable,milestone>=101,<105"},
+				"finish-image-build": {"-image-project=p", "-image-name=out", "-zone=z", "-project=p"},
+			},
+		},
+		{
+			testName: "BuildContexts",
+			spec: `
+buildContexts: [common, /abs/overrides]
+sourceImage: {project: cos-cloud, name: cos-stable-89-16108-403-22}
+outputImage: {project: p, name: out}
+builder: {project: p, zone: z}
+`,
+			wantCmds: []string{"start-image-build", "finish-image-build"},
+			want: map[string][]string{
+				"start-image-build": {"-build-context=<dir>/common", "-build-context=/abs/overrides",
+					"-image-project=cos-cloud", "-image-name=cos-stable-89-16108-403-22"},
+				"finish-image-build": {"-image-project=p", "-image-name=out", "-zone=z", "-project=p"},
+			},
+		},
+		{
+			testName: "Local",
+			spec: `
+sourceImage: {localImage: cos.tar.gz}
+outputImage: {name: out}
+builder: {localOutputDir: out, timelineFile: timeline.json}
+`,
+			wantCmds: []string{"start-image-build", "finish-image-build"},
+			want: map[string][]string{
+				"start-image-build": {"-build-context=<dir>", "-local-source-image=<dir>/cos.tar.gz"},
+				"finish-image-build": {"-image-name=out", "-local-output-dir=<dir>/out",
+					"-timeline-file=<dir>/timeline.json"},
+			},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			path := writeBuildSpec(t, input.spec)
+			spec, err := loadBuildSpec(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmds, err := spec.commands()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotCmds []string
+			for _, c := range cmds {
+				gotCmds = append(gotCmds, c.cmd.Name())
+				var want []string
+				for _, arg := range input.want[c.cmd.Name()] {
+					want = append(want, strings.ReplaceAll(arg, "<dir>", filepath.Dir(path)))
+				}
+				if diff := cmp.Diff([]string(c.args), want); diff != "" {
+					t.Errorf("commands(): %s args mismatch: diff (-got, +want): %s", c.cmd.Name(), diff)
+				}
+			}
+			if diff := cmp.Diff(gotCmds, input.wantCmds); diff != "" {
+				t.Errorf("commands(): commands mismatch: diff (-got, +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestBuildSpecInvalid(t *testing.T) {
+	var testData = []struct {
+		testName string
+		spec     string
+	}{
+		{
+			testName: "UnknownField",
+			spec:     "sourceImage: {project: p, nmae: n}",
+		},
+		{
+			testName: "TwoStepKinds",
+			spec:     "steps: [{run-script: {script: s}, seal-oem: {}}]",
+		},
+		{
+			testName: "EmptyStep",
+			spec:     "steps: [{}]",
+		},
+		{
+			testName: "BuildContextAndBuildContexts",
+			spec:     "{buildContext: a, buildContexts: [b]}",
+		},
+		{
+			testName: "CommaInEnv",
+			spec:     `steps: [{run-script: {script: s, env: {HOSTS: "a,b"}}}]`,
+		},
+		{
+			testName: "CommaInLabel",
+			spec:     `outputImage: {labels: {"a,b": c}}`,
+		},
+		{
+			testName: "CommaInList",
+			spec:     `outputImage: {shareWith: ["user:a,b@example.com"]}`,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			spec, err := loadBuildSpec(writeBuildSpec(t, input.spec))
+			if err == nil {
+				_, err = spec.commands()
+			}
+			if err == nil {
+				t.Errorf("build spec %q: got nil error, want error", input.spec)
+			}
+		})
+	}
+}
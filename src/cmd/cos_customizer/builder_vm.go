@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/gce"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// scopePrefix is the prefix of Google API OAuth scopes. Scopes given without
+// it are expanded, so that 'cloud-platform' can be used as a shorthand.
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// bootDiskTypes lists the disk types that the builder VM boot disk can use.
+var bootDiskTypes = []string{"pd-standard", "pd-balanced", "pd-ssd", "pd-extreme"}
+
+// storageScopes lists the scopes that allow the builder VM to read the build
+// context from GCS.
+var storageScopes = []string{
+	scopePrefix + "devstorage.read_only",
+	scopePrefix + "devstorage.read_write",
+	scopePrefix + "devstorage.full_control",
+	scopePrefix + "cloud-platform",
+}
+
+// confidentialMachineFamilies lists the prefixes of the machine types that
+// support Confidential VMs with AMD SEV.
+var confidentialMachineFamilies = []string{"n2d-", "c2d-", "c3d-"}
+
+var (
+	// machineTypeRegex matches predefined and custom machine type names, like
+	// e2-standard-4 or n2-custom-4-8192.
+	machineTypeRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)+$`)
+	// resourceRegex matches the names and partial URLs of networks and
+	// subnetworks, like my-net or projects/host/regions/us-west1/subnetworks/my-subnet.
+	resourceRegex = regexp.MustCompile(`^([-a-z0-9]+/)*[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	// networkTagRegex matches valid network tags.
+	networkTagRegex = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+)
+
+// expandScopes gets the full URLs of the given scopes.
+func expandScopes(scopes []string) []string {
+	var expanded []string
+	for _, s := range scopes {
+		if !strings.Contains(s, "://") {
+			s = scopePrefix + s
+		}
+		expanded = append(expanded, s)
+	}
+	return expanded
+}
+
+// hasStorageScope checks if the given scopes allow reading from GCS.
+func hasStorageScope(scopes []string) bool {
+	for _, s := range scopes {
+		for _, storageScope := range storageScopes {
+			if s == storageScope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gpuMachineType checks if GPUs that don't come with accelerator-optimized
+// machine types can be attached to the given machine type. An empty machine
+// type means the default, which is an N1 machine type.
+func gpuMachineType(machineType string) bool {
+	return machineType == "" || strings.HasPrefix(machineType, "n1-") || strings.HasPrefix(machineType, "custom-")
+}
+
+// confidentialMachineType checks if the given machine type supports
+// Confidential VMs.
+func confidentialMachineType(machineType string) bool {
+	for _, family := range confidentialMachineFamilies {
+		if strings.HasPrefix(machineType, family) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGuestOSFeature checks if the given image has the given guest OS feature.
+func hasGuestOSFeature(image *compute.Image, feature string) bool {
+	for _, f := range image.GuestOsFeatures {
+		if f.Type == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSourceImage checks that the builder VM can boot from a disk created
+// from the given source image, given the Shielded VM and Confidential VM
+// flags.
+func (f *FinishImageBuild) validateSourceImage(image *compute.Image) error {
+	switch {
+	case f.shieldedVM && !hasGuestOSFeature(image, "UEFI_COMPATIBLE"):
+		return fmt.Errorf("'shielded-vm' requires a source image with the UEFI_COMPATIBLE guest OS feature, "+
+			"but %s doesn't have it", image.Name)
+	case f.confidentialVM && !hasGuestOSFeature(image, "SEV_CAPABLE"):
+		return fmt.Errorf("'confidential-vm' requires a source image with the SEV_CAPABLE guest OS feature, "+
+			"but %s doesn't have it", image.Name)
+	default:
+		return nil
+	}
+}
+
+// usesBuilderVMFlags checks if any of the flags that configure the builder VM
+// on GCE are set.
+func (f *FinishImageBuild) usesBuilderVMFlags() bool {
+	return f.machineType != "" || f.network != "" || f.subnet != "" || f.noExternalIP || f.serviceAccount != "" ||
+		len(f.scopes.l) != 0 || len(f.networkTags.l) != 0 || f.bootDiskType != "" || f.shieldedVM || f.confidentialVM
+}
+
+// validateBuilderVM validates the flags that configure the builder VM.
+func (f *FinishImageBuild) validateBuilderVM() error {
+	for _, tag := range f.networkTags.l {
+		if !networkTagRegex.MatchString(tag) {
+			return fmt.Errorf("invalid network tag %q in 'network-tags'", tag)
+		}
+	}
+	for _, scope := range f.scopes.l {
+		if scope == "" || strings.ContainsAny(scope, " \t") {
+			return fmt.Errorf("invalid scope %q in 'scopes'", scope)
+		}
+	}
+	switch {
+	case f.machineType != "" && !machineTypeRegex.MatchString(f.machineType):
+		return fmt.Errorf("invalid 'machine-type' %q", f.machineType)
+	case f.network != "" && !resourceRegex.MatchString(f.network):
+		return fmt.Errorf("invalid 'network' %q", f.network)
+	case f.subnet != "" && !resourceRegex.MatchString(f.subnet):
+		return fmt.Errorf("invalid 'subnet' %q", f.subnet)
+	case f.serviceAccount != "" && !strings.Contains(f.serviceAccount, "@"):
+		return fmt.Errorf("'service-account' must be a service account email, got %q", f.serviceAccount)
+	case len(f.scopes.l) != 0 && !hasStorageScope(expandScopes(f.scopes.l)):
+		return fmt.Errorf("'scopes' must include one of %s, so that the builder VM can read the build context "+
+			"from GCS", strings.Join(storageScopes, ", "))
+	case f.bootDiskType != "" && !contains(bootDiskTypes, f.bootDiskType):
+		return fmt.Errorf("'boot-disk-type' must be one of %s, got %q", strings.Join(bootDiskTypes, ", "), f.bootDiskType)
+	case f.confidentialVM && !confidentialMachineType(f.machineType):
+		return fmt.Errorf("'confidential-vm' requires a 'machine-type' from one of the machine families %s, got %q",
+			strings.Join(confidentialMachineFamilies, ", "), f.machineType)
+	default:
+		return nil
+	}
+}
+
+// validateGPU checks that the GPUs in the build config can be used with the
+// builder VM flags.
+func (f *FinishImageBuild) validateGPU(buildConfig *config.Build) error {
+	if buildConfig.GPUType == "" {
+		return nil
+	}
+	accelerator := config.FindAccelerator(buildConfig.GPUType)
+	switch {
+	case accelerator == nil:
+		return fmt.Errorf("GPU type %q is not supported; must be one of %s", buildConfig.GPUType,
+			strings.Join(config.AcceleratorTypes(), ", "))
+	case f.confidentialVM:
+		return fmt.Errorf("GPUs can't be attached to Confidential VMs")
+	case !accelerator.BuiltIn() && !gpuMachineType(f.machineType):
+		return fmt.Errorf("%s GPUs can only be attached to N1 machine types, got 'machine-type' %q",
+			accelerator.Type, f.machineType)
+	case accelerator.BuiltIn() && accelerator.MachineTypes[f.machineType] == 0:
+		var machineTypes []string
+		for machineType := range accelerator.MachineTypes {
+			machineTypes = append(machineTypes, machineType)
+		}
+		sort.Strings(machineTypes)
+		return fmt.Errorf("%s GPUs require a 'machine-type' from %s, got %q", accelerator.Type,
+			strings.Join(machineTypes, ", "), f.machineType)
+	case accelerator.BuiltIn() && accelerator.MachineTypes[f.machineType] != buildConfig.GPUs():
+		return fmt.Errorf("machine type %s has %d %s GPUs, but the image build uses %d", f.machineType,
+			accelerator.MachineTypes[f.machineType], accelerator.Type, buildConfig.GPUs())
+	default:
+		return nil
+	}
+}
+
+// validateAcceleratorType checks that the GPU type of the build config is
+// offered in the zone of the builder VM, with enough GPUs per VM.
+func validateAcceleratorType(svc *compute.Service, buildConfig *config.Build) error {
+	if buildConfig.GPUType == "" {
+		return nil
+	}
+	acceleratorType, err := gce.AcceleratorType(svc, buildConfig.Project, buildConfig.Zone, buildConfig.GPUType)
+	if err != nil {
+		return err
+	}
+	switch {
+	case acceleratorType == nil:
+		return fmt.Errorf("GPU type %s is not offered in zone %s", buildConfig.GPUType, buildConfig.Zone)
+	case acceleratorType.MaximumCardsPerInstance != 0 && int64(buildConfig.GPUs()) > acceleratorType.MaximumCardsPerInstance:
+		return fmt.Errorf("at most %d %s GPUs can be attached to a VM in zone %s, but the image build uses %d",
+			acceleratorType.MaximumCardsPerInstance, buildConfig.GPUType, buildConfig.Zone, buildConfig.GPUs())
+	default:
+		return nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/preloader"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+const (
+	// debugPollInterval is how often a finish-image-build command that keeps
+	// a builder VM for debugging checks if the VM was cleaned up by
+	// 'cleanup-debug'.
+	debugPollInterval = time.Minute
+	// debugCleanupTimeout bounds the cleanup of a debug session. The cleanup
+	// uses its own context, since it also runs after the command is
+	// interrupted.
+	debugCleanupTimeout = 10 * time.Minute
+)
+
+// debugInstanceName generates a unique name for a builder VM that is kept for
+// debugging.
+func debugInstanceName() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "cos-customizer-debug-" + hex.EncodeToString(b), nil
+}
+
+// runDebugSession keeps the builder VM of a failed image build for the given
+// duration, or until the context is canceled or the VM is deleted by
+// 'cleanup-debug', and then cleans up the debug session. The builder VM of a
+// successful image build is cleaned up right away.
+func runDebugSession(ctx context.Context, svc *compute.Service, gcsClient *storage.Client,
+	session *preloader.DebugSession, failed bool, d time.Duration) {
+	if failed {
+		// The image build can fail before the builder VM is created, in which
+		// case there is nothing to debug.
+		if exists, err := session.Exists(svc); err != nil || exists {
+			log.Printf("Image build failed.\n%sIt will be cleaned up in %v.", session.Instructions(), d)
+			waitDebugSession(ctx, svc, session, d)
+		}
+	}
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), debugCleanupTimeout)
+	defer cancel()
+	if err := session.Cleanup(cleanupCtx, svc, gcsClient); err != nil {
+		log.Printf("Failed to clean up debug session %s: %v", session.Instance, err)
+		return
+	}
+	log.Printf("Cleaned up debug session %s", session.Instance)
+}
+
+// waitDebugSession waits for the given duration, or until the context is
+// canceled or the builder VM of the debug session no longer exists.
+func waitDebugSession(ctx context.Context, svc *compute.Service, session *preloader.DebugSession,
+	d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	ticker := time.NewTicker(debugPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			exists, err := session.Exists(svc)
+			if err != nil {
+				log.Printf("Failed to check builder VM %s: %v", session.Instance, err)
+				continue
+			}
+			if !exists {
+				return
+			}
+		}
+	}
+}
+
+// CleanupDebug implements subcommands.Command for the "cleanup-debug" command.
+// This command cleans up builder VMs that were kept for debugging by
+// 'finish-image-build -debug-on-failure', along with their disks and build
+// inputs in GCS. It doesn't use the state of an image build process, and can be
+// run at any time.
+type CleanupDebug struct {
+	project  string
+	zone     string
+	instance string
+}
+
+// Name implements subcommands.Command.Name.
+func (*CleanupDebug) Name() string {
+	return "cleanup-debug"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*CleanupDebug) Synopsis() string {
+	return "Clean up builder VMs that were kept for debugging failed image builds."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*CleanupDebug) Usage() string {
+	return `cleanup-debug -project=<project> -zone=<zone> [-instance=<instance>]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (c *CleanupDebug) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.project, "project", "", "Project containing the builder VMs.")
+	f.StringVar(&c.zone, "zone", "", "Zone containing the builder VMs.")
+	f.StringVar(&c.instance, "instance", "", "Name of the builder VM to clean up. If unset, all builder VMs that "+
+		"were kept for debugging in the zone are cleaned up.")
+}
+
+func (c *CleanupDebug) validate() error {
+	switch {
+	case c.project == "":
+		return fmt.Errorf("'project' must be set")
+	case c.zone == "":
+		return fmt.Errorf("'zone' must be set")
+	}
+	return nil
+}
+
+// Execute implements subcommands.Command.Execute. It cleans up the builder VMs
+// that were kept for debugging.
+func (c *CleanupDebug) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if err := c.validate(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if gcsClient != nil {
+		defer gcsClient.Close()
+	}
+	sessions, err := preloader.DebugSessions(ctx, svc, c.project, c.zone)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	var found bool
+	for _, session := range sessions {
+		if c.instance != "" && session.Instance != c.instance {
+			continue
+		}
+		found = true
+		if err := session.Cleanup(ctx, svc, gcsClient); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		log.Printf("Cleaned up debug session %s", session.Instance)
+	}
+	if c.instance != "" && !found {
+		log.Printf("builder VM %s was not kept for debugging in project %s, zone %s", c.instance, c.project, c.zone)
+		return subcommands.ExitFailure
+	}
+	if !found {
+		log.Printf("No builder VMs were kept for debugging in project %s, zone %s", c.project, c.zone)
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/preloader"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// insertBuilderVM creates a builder VM with a boot disk, like a builder VM that
+// is kept for debugging.
+func insertBuilderVM(t *testing.T, svc *compute.Service, name string, debug bool) {
+	t.Helper()
+	instance := &compute.Instance{
+		Name: name,
+		Disks: []*compute.AttachedDisk{
+			{InitializeParams: &compute.AttachedDiskInitializeParams{DiskName: name + "-boot"}},
+		},
+	}
+	if debug {
+		gcsDir := "gs://b/" + name
+		instance.Labels = map[string]string{preloader.DebugLabel: "true"}
+		instance.Metadata = &compute.Metadata{Items: []*compute.MetadataItems{{Key: "cos-customizer-debug",
+			Value: &gcsDir}}}
+	}
+	if _, err := svc.Instances.Insert("p", "z", instance).Do(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupDebugCommand(t *testing.T) {
+	var testData = []struct {
+		testName      string
+		flags         []string
+		want          subcommands.ExitStatus
+		wantInstances []string
+	}{
+		{
+			testName:      "All",
+			flags:         []string{"-project=p", "-zone=z"},
+			want:          subcommands.ExitSuccess,
+			wantInstances: []string{"other"},
+		},
+		{
+			testName:      "Instance",
+			flags:         []string{"-project=p", "-zone=z", "-instance=debug-1"},
+			want:          subcommands.ExitSuccess,
+			wantInstances: []string{"debug-2", "other"},
+		},
+		{
+			testName:      "NotDebugInstance",
+			flags:         []string{"-project=p", "-zone=z", "-instance=other"},
+			want:          subcommands.ExitFailure,
+			wantInstances: []string{"debug-1", "debug-2", "other"},
+		},
+		{
+			testName:      "NoZone",
+			flags:         []string{"-project=p"},
+			want:          subcommands.ExitFailure,
+			wantInstances: []string{"debug-1", "debug-2", "other"},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			gce, svc := fakes.GCEForTest(t, "p")
+			gcs := fakes.GCSForTest(t)
+			insertBuilderVM(t, svc, "debug-1", true)
+			insertBuilderVM(t, svc, "debug-2", true)
+			insertBuilderVM(t, svc, "other", false)
+			gcs.Objects["/b/debug-1/cos-customizer/user_build_context.tar"] = []byte("context")
+			clients := ServiceClients(func(context.Context, bool) (*compute.Service, *storage.Client, error) {
+				return svc, gcs.Client, nil
+			})
+			cleanupDebug := &CleanupDebug{}
+			flagSet := &flag.FlagSet{}
+			cleanupDebug.SetFlags(flagSet)
+			if err := flagSet.Parse(input.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := cleanupDebug.Execute(context.Background(), flagSet, nil, clients); got != input.want {
+				t.Fatalf("CleanupDebug.Execute(%v): got %v, want %v", input.flags, got, input.want)
+			}
+			var gotInstances []string
+			for _, instance := range gce.Instances {
+				gotInstances = append(gotInstances, instance.Name)
+			}
+			if strings.Join(gotInstances, ",") != strings.Join(input.wantInstances, ",") {
+				t.Errorf("CleanupDebug.Execute(%v): got instances %v, want %v", input.flags, gotInstances,
+					input.wantInstances)
+			}
+			if len(gce.Disks) != len(input.wantInstances) {
+				t.Errorf("CleanupDebug.Execute(%v): got %d disks, want %d", input.flags, len(gce.Disks),
+					len(input.wantInstances))
+			}
+			_, ok := gcs.Objects["/b/debug-1/cos-customizer/user_build_context.tar"]
+			if want := strings.Contains(strings.Join(input.wantInstances, ","), "debug-1"); ok != want {
+				t.Errorf("CleanupDebug.Execute(%v): build inputs exist: %v, want %v", input.flags, ok, want)
+			}
+		})
+	}
+}
+
+func TestRunDebugSession(t *testing.T) {
+	gce, svc := fakes.GCEForTest(t, "p")
+	gcs := fakes.GCSForTest(t)
+	insertBuilderVM(t, svc, "debug", true)
+	session := &preloader.DebugSession{Project: "p", Zone: "z", Instance: "debug", Disks: []string{"debug-boot"}}
+	start := time.Now()
+	runDebugSession(context.Background(), svc, gcs.Client, session, true, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("runDebugSession: returned after %v, want the builder VM to be kept for 100ms", elapsed)
+	}
+	if len(gce.Instances) != 0 || len(gce.Disks) != 0 {
+		t.Errorf("runDebugSession: got instances %v and disks %v, want none", gce.Instances, gce.Disks)
+	}
+}
@@ -16,11 +16,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
@@ -31,27 +35,91 @@ import (
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/tools/partutil"
 
 	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
 )
 
+// maxImageLabels is the maximum number of labels that a GCE image can have.
+const maxImageLabels = 64
+
+// temporaryImageName generates the name that an image is built under before it
+// replaces an existing image. Tests replace it to predict the name.
+var temporaryImageName = gce.TemporaryImageName
+
+// Behaviors of finish-image-build when the output image already exists.
+const (
+	ifExistsSkip    = "skip"
+	ifExistsFail    = "fail"
+	ifExistsReplace = "replace"
+	ifExistsSuffix  = "suffix"
+)
+
+var ifExistsModes = []string{ifExistsSkip, ifExistsFail, ifExistsReplace, ifExistsSuffix}
+
+// exitSkipped is the exit status of finish-image-build when the image build is
+// skipped because the result image already exists. It is distinct from the
+// statuses of the subcommands package, so that callers can tell a skipped build
+// apart from both a successful and a failed one.
+const exitSkipped subcommands.ExitStatus = 3
+
+// guestOSFeatureTypes lists the guest OS features that can be set on the
+// output image.
+var guestOSFeatureTypes = []string{
+	"UEFI_COMPATIBLE",
+	"SECURE_BOOT",
+	"SEV_CAPABLE",
+	"SEV_SNP_CAPABLE",
+	"SEV_LIVE_MIGRATABLE",
+	"GVNIC",
+	"MULTI_IP_SUBNET",
+	"VIRTIO_SCSI_MULTIQUEUE",
+	"IDPF",
+}
+
 // FinishImageBuild implements subcommands.Command for the "finish-image-build" command.
 // This command finishes an image build by converting saved image configurations into
 // an actual GCE image.
 type FinishImageBuild struct {
-	imageProject   string
-	zone           string
-	project        string
-	imageName      string
-	imageSuffix    string
-	imageFamily    string
-	deprecateOld   bool
-	oldImageTTLSec int
-	labels         *mapVar
-	licenses       *listVar
-	inheritLabels  bool
-	oemSize        string
-	oemFSSize4K    uint64
-	diskSize       int
-	timeout        time.Duration
+	imageProject           string
+	zone                   string
+	project                string
+	imageName              string
+	imageSuffix            string
+	imageFamily            string
+	deprecateOld           bool
+	oldImageTTLSec         int
+	labels                 *mapVar
+	licenses               *listVar
+	inheritLabels          bool
+	oemSize                string
+	oemFSSize4K            uint64
+	diskSize               int
+	timeout                time.Duration
+	localOutputDir         string
+	exportURI              string
+	exportFormat           string
+	shareWith              *listVar
+	copyTo                 *listVar
+	copyDeprecate          bool
+	buildID                string
+	ifExists               string
+	vars                   *mapVar
+	machineType            string
+	network                string
+	subnet                 string
+	noExternalIP           bool
+	serviceAccount         string
+	scopes                 *listVar
+	networkTags            *listVar
+	bootDiskType           string
+	shieldedVM             bool
+	confidentialVM         bool
+	guestOSFeatures        *listVar
+	inheritGuestOSFeatures bool
+	timelineFile           string
+	skipMarkerFile         string
+	artifactCacheTTL       time.Duration
+	compositeThreshold     string
+	debugOnFailure         time.Duration
 }
 
 // Name implements subcommands.Command.Name.
@@ -73,16 +141,20 @@ func (f *FinishImageBuild) Usage() string {
 // SetFlags implements subcommands.Command.SetFlags.
 func (f *FinishImageBuild) SetFlags(flags *flag.FlagSet) {
 	flags.StringVar(&f.imageProject, "image-project", "", "Output image project.")
-	flags.StringVar(&f.imageName, "image-name", "", "Output image name. Mutually exclusive with 'image-suffix'.")
+	flags.StringVar(&f.imageName, "image-name", "", "Output image name. Mutually exclusive with 'image-suffix'. "+
+		"Can be a Go template that refers to the source image's {{.Milestone}} and {{.BuildNumber}}, the current "+
+		"{{.Date}}, the source image's {{.Labels.<key>}} and the {{.Vars.<key>}} set with 'var'. Example: "+
+		"-image-name=my-cos-{{.Milestone}}-{{.BuildNumber}}-{{.Date}}")
 	flags.StringVar(&f.imageSuffix, "image-suffix", "", "Construct the output image name from the input image "+
-		"name and this suffix. Mutually exclusive with 'image-name'.")
+		"name and this suffix. Mutually exclusive with 'image-name'. Can be a Go template, like 'image-name'.")
 	flags.StringVar(&f.imageFamily, "image-family", "", "Output image family.")
 	flags.BoolVar(&f.deprecateOld, "deprecate-old-images", false, "Deprecate old images in the output image "+
 		"family. Can only be used if 'image-family' is set.")
 	flags.IntVar(&f.oldImageTTLSec, "old-image-ttl", 0, "Time-to-live in seconds for old images that are "+
 		"deprecated. After this period of time, old images will enter the deleted state. Can only be used if "+
-		"'deprecate-old-images' is set. '0' indicates no time-to-live (images won't be configured to enter "+
-		"the deleted state).")
+		"'deprecate-old-images' or 'copy-deprecate-old-images' is set. '0' indicates no time-to-live (images "+
+		"won't be configured to enter the deleted state). Also applies to images deprecated by "+
+		"'copy-deprecate-old-images'.")
 	flags.StringVar(&f.zone, "zone", "", "Zone to make GCE resources in.")
 	flags.StringVar(&f.project, "project", "", "Project to make GCE resources in.")
 	if f.labels == nil {
@@ -105,6 +177,93 @@ func (f *FinishImageBuild) SetFlags(flags *flag.FlagSet) {
 		"indicates the default size.")
 	flags.DurationVar(&f.timeout, "timeout", time.Hour, "Timeout value of the image build process. Must be formatted "+
 		"according to Golang's time.Duration string format.")
+	flags.StringVar(&f.localOutputDir, "local-output-dir", "", "Directory to write the output disk image to. "+
+		"Only used if the build was started with 'local-source-image'.")
+	flags.StringVar(&f.exportURI, "export-uri", "", "GCS object to export the output image to, in the form "+
+		"gs://<bucket>/<object>. A SHA-256 checksum file is written next to it, at '<export-uri>.sha256'.")
+	flags.StringVar(&f.exportFormat, "export-format", config.ExportRawTarGz, "Format to export the output image "+
+		"in. One of "+strings.Join(config.ExportFormats, ", ")+". Only used if 'export-uri' is set.")
+	if f.shareWith == nil {
+		f.shareWith = &listVar{}
+	}
+	flags.Var(f.shareWith, "share-with", "Principals to grant 'roles/compute.imageUser' on the result image to. "+
+		"Format is 'type:id,type:id,...', where type is one of project, user, group, serviceAccount or domain. "+
+		"Example: -share-with=project:my-project,group:my-group@example.com")
+	if f.copyTo == nil {
+		f.copyTo = &listVar{}
+	}
+	flags.Var(f.copyTo, "copy-to", "Destinations to copy the result image to after it is created. Format is "+
+		"'project[/storage-location],...'. Copies have the same name, family, labels and licenses as the result "+
+		"image. Example: -copy-to=project-a,project-b/us-west1")
+	flags.BoolVar(&f.copyDeprecate, "copy-deprecate-old-images", false, "Deprecate old images in the image family "+
+		"of each copy of the result image. Can only be used if 'image-family' and 'copy-to' are set.")
+	flags.StringVar(&f.buildID, "build-id", "", "ID of the Cloud Build build that runs the image build, to record "+
+		"in the provenance of the result image. Example: -build-id=$BUILD_ID")
+	if f.vars == nil {
+		f.vars = newMapVar()
+	}
+	flags.Var(f.vars, "var", "Values to use in the 'image-name' or 'image-suffix' templates. Format is "+
+		"'key1=value1,key2=value2,...'. Example: -var=team=infra -image-name=cos-{{.Vars.team}}-{{.Date}}")
+	flags.StringVar(&f.ifExists, "if-exists", ifExistsSkip, "What to do if the result image already exists. One of "+
+		"'skip' (exit with status 3 without building), 'fail' (exit with an error), 'replace' (build the image "+
+		"again and replace the existing image once the build succeeds) or 'suffix' (build an image named after "+
+		"the result image with the first free suffix '-1', '-2', ...).")
+	flags.StringVar(&f.machineType, "machine-type", "", "Machine type of the builder VM. Defaults to n1-standard-1. "+
+		"Must be an N1 machine type if a GPU is installed.")
+	flags.StringVar(&f.network, "network", "", "Network of the builder VM, as a name or partial URL. Defaults to "+
+		"the 'default' network, unless 'subnet' is set.")
+	flags.StringVar(&f.subnet, "subnet", "", "Subnetwork of the builder VM, as a name or partial URL. Example: "+
+		"-subnet=projects/host-project/regions/us-west1/subnetworks/my-subnet")
+	flags.BoolVar(&f.noExternalIP, "no-external-ip", false, "Don't give the builder VM an external IP address. The "+
+		"subnetwork of the builder VM must have Private Google Access enabled.")
+	flags.StringVar(&f.serviceAccount, "service-account", "", "Email of the service account of the builder VM. "+
+		"Defaults to the Compute Engine default service account.")
+	if f.scopes == nil {
+		f.scopes = &listVar{}
+	}
+	flags.Var(f.scopes, "scopes", "OAuth scopes of the builder VM. Format is 'scope1,scope2,...'. Scopes can be "+
+		"given as URLs or as short names like 'cloud-platform', and must allow reading from GCS. Defaults to "+
+		"devstorage.read_write,cloud-platform.")
+	if f.networkTags == nil {
+		f.networkTags = &listVar{}
+	}
+	flags.Var(f.networkTags, "network-tags", "Network tags of the builder VM. Format is 'tag1,tag2,...'.")
+	flags.StringVar(&f.bootDiskType, "boot-disk-type", "", "Disk type of the boot disk of the builder VM. One of "+
+		strings.Join(bootDiskTypes, ", ")+". Defaults to pd-standard.")
+	flags.BoolVar(&f.shieldedVM, "shielded-vm", false, "Run the builder VM as a Shielded VM with secure boot, vTPM "+
+		"and integrity monitoring, to check that the customized image still boots with secure boot. The source "+
+		"image must have the UEFI_COMPATIBLE guest OS feature.")
+	flags.BoolVar(&f.confidentialVM, "confidential-vm", false, "Run the builder VM as a Confidential VM. The source "+
+		"image must have the SEV_CAPABLE guest OS feature, and 'machine-type' must be from one of the machine "+
+		"families "+strings.Join(confidentialMachineFamilies, ", ")+".")
+	if f.guestOSFeatures == nil {
+		f.guestOSFeatures = &listVar{}
+	}
+	flags.Var(f.guestOSFeatures, "guest-os-features", "Guest OS features to set on the result image. Format is "+
+		"'feature1,feature2,...'. Supported features are "+strings.Join(guestOSFeatureTypes, ", ")+".")
+	flags.BoolVar(&f.inheritGuestOSFeatures, "inherit-guest-os-features", false, "Indicates if the result image "+
+		"should have the guest OS features of the source image, in addition to the ones set with "+
+		"'guest-os-features'.")
+	flags.StringVar(&f.skipMarkerFile, "skip-marker-file", "", "Local file that is written if the image build "+
+		"is skipped because the result image already exists and 'if-exists' is 'skip'. It contains the URL of the "+
+		"existing image.")
+	flags.StringVar(&f.timelineFile, "timeline-file", "", "Local file to write the provisioning timeline of the "+
+		"builder VM to, as JSON. The timeline has the start time, duration and status of each build step, and the "+
+		"last log lines of the step that failed. It is written even if the image build fails.")
+	flags.DurationVar(&f.artifactCacheTTL, "artifact-cache-ttl", 0, "How long the build context and the files of "+
+		"'-deps-dir' are kept in the artifact cache in GCS after an image build last used them, like 168h. Cached "+
+		"files are stored under '<gcs-workdir>/artifact-cache', and aren't uploaded again while their contents don't "+
+		"change. Defaults to 0, which disables the cache: the files are uploaded for each image build and deleted "+
+		"afterwards.")
+	flags.StringVar(&f.compositeThreshold, "parallel-composite-upload-threshold", "", "Size from which files are "+
+		"uploaded to GCS as parallel composite uploads, like 150M. Files of at least this size are split into parts "+
+		"that are uploaded in parallel and then composed into one object. Composite objects have no MD5 hash. "+
+		"Parallel composite uploads are disabled if unset.")
+	flags.DurationVar(&f.debugOnFailure, "debug-on-failure", 0, "If provisioning fails, keep the builder VM running "+
+		"for this long for debugging, along with its disks and the build inputs in GCS. Connection instructions are "+
+		"printed, and everything is cleaned up once the duration is over, the command is interrupted or "+
+		"'cleanup-debug' is run. Must be formatted according to Golang's time.Duration string format. Example: "+
+		"-debug-on-failure=2h. Disabled if 0.")
 }
 
 func (f *FinishImageBuild) validate() error {
@@ -119,33 +278,196 @@ func (f *FinishImageBuild) validate() error {
 			return fmt.Errorf("oem-size must be at least %dM", defaultOEMSizeMB)
 		}
 	}
+	if f.compositeThreshold != "" {
+		if _, err := partutil.ConvertSizeToBytes(f.compositeThreshold); err != nil {
+			return fmt.Errorf("invalid format of parallel-composite-upload-threshold: %q, error msg:(%v)",
+				f.compositeThreshold, err)
+		}
+	}
 	switch {
 	case f.imageName == "" && f.imageSuffix == "":
 		return fmt.Errorf("one of 'image-name' or 'image-suffix' must be set")
 	case f.imageName != "" && f.imageSuffix != "":
 		return fmt.Errorf("'image-name' and 'image-suffix' are mutually exclusive")
+	case !validTemplate(f.imageName):
+		return fmt.Errorf("invalid 'image-name' template %q", f.imageName)
+	case !validTemplate(f.imageSuffix):
+		return fmt.Errorf("invalid 'image-suffix' template %q", f.imageSuffix)
+	case f.imageName != "" && !strings.Contains(f.imageName, "{{") && validateImageName(f.imageName) != nil:
+		// Templated names are validated once they are rendered.
+		return validateImageName(f.imageName)
 	case f.deprecateOld && f.imageFamily == "":
 		return fmt.Errorf("'deprecate-old-images' can only be used if 'image-family' is set")
-	case f.oldImageTTLSec != 0 && !f.deprecateOld:
-		return fmt.Errorf("'old-image-ttl' can only be used if 'deprecate-old-images' is set")
+	case f.oldImageTTLSec != 0 && !f.deprecateOld && !f.copyDeprecate:
+		return fmt.Errorf("'old-image-ttl' can only be used if 'deprecate-old-images' or " +
+			"'copy-deprecate-old-images' is set")
+	case f.exportURI != "" && !strings.HasPrefix(f.exportURI, "gs://"):
+		return fmt.Errorf("'export-uri' must be a GCS URL of the form gs://<bucket>/<object>, got %q", f.exportURI)
+	case !validPrincipals(f.shareWith.l):
+		return fmt.Errorf("invalid 'share-with' value %q", strings.Join(f.shareWith.l, ","))
+	case !validCopyTargets(f.copyTo.l):
+		return fmt.Errorf("invalid 'copy-to' value %q", strings.Join(f.copyTo.l, ","))
+	case f.copyDeprecate && (f.imageFamily == "" || len(f.copyTo.l) == 0):
+		return fmt.Errorf("'copy-deprecate-old-images' can only be used if 'image-family' and 'copy-to' are set")
+	case !isExportFormat(f.exportFormat):
+		return fmt.Errorf("'export-format' must be one of %s, got %q", strings.Join(config.ExportFormats, ", "),
+			f.exportFormat)
+	case !isIfExistsMode(f.ifExists):
+		return fmt.Errorf("'if-exists' must be one of %s, got %q", strings.Join(ifExistsModes, ", "), f.ifExists)
+	case f.debugOnFailure < 0:
+		return fmt.Errorf("'debug-on-failure' must not be negative, got %v", f.debugOnFailure)
+	case f.artifactCacheTTL < 0:
+		return fmt.Errorf("'artifact-cache-ttl' must not be negative, got %v", f.artifactCacheTTL)
+	case !validGuestOSFeatures(f.guestOSFeatures.l):
+		return fmt.Errorf("'guest-os-features' must be a list of %s, got %q", strings.Join(guestOSFeatureTypes, ", "),
+			strings.Join(f.guestOSFeatures.l, ","))
+	default:
+		return f.validateBuilderVM()
+	}
+}
+
+// validTemplate checks if text parses as an output image name template.
+func validTemplate(text string) bool {
+	_, err := parseImageNameTemplate("", text)
+	return err == nil
+}
+
+// validPrincipals checks if the given principals can be shared with.
+func validPrincipals(principals []string) bool {
+	for _, p := range principals {
+		if _, err := gce.ShareMember(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validCopyTargets checks if the given image copy destinations are valid.
+func validCopyTargets(targets []string) bool {
+	_, err := copyTargets(targets)
+	return err == nil
+}
+
+// copyTargets parses the given image copy destinations.
+func copyTargets(targets []string) ([]*gce.CopyTarget, error) {
+	var parsed []*gce.CopyTarget
+	for _, t := range targets {
+		target, err := gce.ParseCopyTarget(t)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, target)
+	}
+	return parsed, nil
+}
+
+// isExportFormat checks if format is a supported export format. An empty format
+// means the default format.
+func isExportFormat(format string) bool {
+	if format == "" {
+		return true
+	}
+	for _, f := range config.ExportFormats {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// isIfExistsMode checks if mode is a valid value of 'if-exists'. An empty mode
+// means the default mode.
+func isIfExistsMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	for _, m := range ifExistsModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+// validGuestOSFeatures checks if the given guest OS features can be set on the
+// output image.
+func validGuestOSFeatures(features []string) bool {
+	for _, feature := range features {
+		if !contains(guestOSFeatureTypes, feature) {
+			return false
+		}
+	}
+	return true
+}
+
+// addGuestOSFeatures adds the given guest OS features to the given image,
+// skipping the ones that it already has.
+func addGuestOSFeatures(image *config.Image, features []string) {
+	for _, feature := range features {
+		if !hasGuestOSFeature(image.Image, feature) {
+			image.GuestOsFeatures = append(image.GuestOsFeatures, &compute.GuestOsFeature{Type: feature})
+		}
+	}
+}
+
+// sourceGuestOSFeatures gets the types of the guest OS features of the given
+// image.
+func sourceGuestOSFeatures(image *compute.Image) []string {
+	var features []string
+	for _, f := range image.GuestOsFeatures {
+		features = append(features, f.Type)
+	}
+	return features
+}
+
+// validateBackend validates the flags that depend on the builder backend
+// selected by "start-image-build".
+func (f *FinishImageBuild) validateBackend(buildConfig *config.Build) error {
+	if buildConfig.Backend == config.BackendLocal {
+		switch {
+		case f.localOutputDir == "":
+			return fmt.Errorf("'local-output-dir' must be set for local image builds")
+		case f.deprecateOld:
+			return fmt.Errorf("'deprecate-old-images' is not supported for local image builds")
+		case f.inheritLabels:
+			return fmt.Errorf("'inherit-labels' is not supported for local image builds")
+		case f.exportURI != "":
+			return fmt.Errorf("'export-uri' is not supported for local image builds")
+		case len(f.shareWith.l) != 0:
+			return fmt.Errorf("'share-with' is not supported for local image builds")
+		case len(f.copyTo.l) != 0:
+			return fmt.Errorf("'copy-to' is not supported for local image builds")
+		case f.ifExists != "" && f.ifExists != ifExistsSkip:
+			return fmt.Errorf("'if-exists' is not supported for local image builds")
+		case f.usesBuilderVMFlags():
+			return fmt.Errorf("builder VM flags like 'machine-type' and 'network' are not supported for local " +
+				"image builds")
+		case len(f.guestOSFeatures.l) != 0 || f.inheritGuestOSFeatures:
+			return fmt.Errorf("guest OS features are not supported for local image builds")
+		case f.debugOnFailure != 0:
+			return fmt.Errorf("'debug-on-failure' is not supported for local image builds")
+		default:
+			return nil
+		}
+	}
+	switch {
+	case f.localOutputDir != "":
+		return fmt.Errorf("'local-output-dir' can only be used for local image builds")
 	case f.zone == "":
 		return fmt.Errorf("'zone' must be set")
 	case f.project == "":
 		return fmt.Errorf("'project' must be set")
 	default:
-		return nil
+		return f.validateGPU(buildConfig)
 	}
 }
 
-func (f *FinishImageBuild) loadConfigs(files *fs.Files) (*config.Image, *config.Build, *config.Image, *provisioner.Config, error) {
+func (f *FinishImageBuild) loadConfigs(files *fs.Files) (*config.Image, *config.Build, *config.Image,
+	*provisioner.Config, error) {
 	sourceImageConfig := &config.Image{}
 	if err := config.LoadFromFile(files.SourceImageConfig, sourceImageConfig); err != nil {
 		return nil, nil, nil, nil, err
 	}
-	imageName := f.imageName
-	if f.imageSuffix != "" {
-		imageName = sourceImageConfig.Name + f.imageSuffix
-	}
 	buildConfig := &config.Build{}
 	if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
 		return nil, nil, nil, nil, err
@@ -154,15 +476,49 @@ func (f *FinishImageBuild) loadConfigs(files *fs.Files) (*config.Image, *config.
 	buildConfig.Zone = f.zone
 	buildConfig.DiskSize = f.diskSize
 	buildConfig.Timeout = f.timeout.String()
+	buildConfig.LocalOutputDir = f.localOutputDir
+	buildConfig.ExportURI = f.exportURI
+	if f.exportURI != "" {
+		buildConfig.ExportFormat = f.exportFormat
+	}
+	buildConfig.MachineType = f.machineType
+	buildConfig.Network = f.network
+	buildConfig.Subnet = f.subnet
+	buildConfig.NoExternalIP = f.noExternalIP
+	buildConfig.ServiceAccount = f.serviceAccount
+	buildConfig.Scopes = expandScopes(f.scopes.l)
+	buildConfig.NetworkTags = f.networkTags.l
+	buildConfig.BootDiskType = f.bootDiskType
+	buildConfig.ShieldedVM = f.shieldedVM
+	buildConfig.ConfidentialVM = f.confidentialVM
+	if f.artifactCacheTTL > 0 {
+		buildConfig.ArtifactCacheTTL = f.artifactCacheTTL.String()
+	}
+	if f.compositeThreshold != "" {
+		threshold, err := partutil.ConvertSizeToBytes(f.compositeThreshold)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		buildConfig.CompositeUploadThreshold = int64(threshold)
+	}
+	if f.debugOnFailure > 0 {
+		name, err := debugInstanceName()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		buildConfig.DebugInstance = name
+	}
 	provConfig := &provisioner.Config{}
 	if err := config.LoadFromFile(files.ProvConfig, provConfig); err != nil {
 		return nil, nil, nil, nil, err
 	}
 	provConfig.BootDisk.OEMSize = f.oemSize
-	outputImageConfig := config.NewImage(imageName, f.imageProject)
+	// The output image name is set by setOutputName.
+	outputImageConfig := config.NewImage("", f.imageProject)
 	outputImageConfig.Labels = f.labels.m
 	outputImageConfig.Licenses = f.licenses.l
 	outputImageConfig.Family = f.imageFamily
+	addGuestOSFeatures(outputImageConfig, f.guestOSFeatures.l)
 	return sourceImageConfig, buildConfig, outputImageConfig, provConfig, nil
 }
 
@@ -278,31 +634,206 @@ func update(dst, src map[string]string) {
 	}
 }
 
+// addProvenance attaches the provenance of the image build to the output image
+// as labels and as the image description. Labels specified through the
+// '-labels' flag take precedence over provenance labels. It must be called
+// before the image build updates provConfig.
+func (f *FinishImageBuild) addProvenance(files *fs.Files, sourceImage, outputImage *config.Image,
+	provConfig *provisioner.Config) error {
+	provenance, err := preloader.NewProvenance(files, sourceImage, provConfig, version, f.buildID)
+	if err != nil {
+		return err
+	}
+	update(outputImage.Labels, provenance.Labels())
+	outputImage.Description, err = provenance.Description()
+	return err
+}
+
+// inheritLabels adds the labels of the source image to the output image.
+// Provenance labels of the source image describe how the source image was
+// built, so they aren't inherited.
+func inheritLabels(outputImage *config.Image, sourceLabels map[string]string) {
+	inherited := make(map[string]string)
+	for k, v := range sourceLabels {
+		if !strings.HasPrefix(k, preloader.ProvenanceLabelPrefix) {
+			inherited[k] = v
+		}
+	}
+	update(outputImage.Labels, inherited)
+}
+
+// resolveLabels sets the labels of the output image: the labels specified
+// through the '-labels' flag, provenance labels and, if 'inherit-labels' is
+// set, the labels of the source image, in order of precedence. It fails if the
+// output image would have more labels than GCE allows.
+func (f *FinishImageBuild) resolveLabels(files *fs.Files, sourceImage, outputImage *config.Image,
+	provConfig *provisioner.Config, sourceLabels map[string]string) error {
+	if err := f.addProvenance(files, sourceImage, outputImage, provConfig); err != nil {
+		return err
+	}
+	if f.inheritLabels {
+		inheritLabels(outputImage, sourceLabels)
+	}
+	if len(outputImage.Labels) > maxImageLabels {
+		return fmt.Errorf("the result image would have %d labels, but GCE images can have at most %d labels",
+			len(outputImage.Labels), maxImageLabels)
+	}
+	return nil
+}
+
+// setOutputName sets the name of the output image from the 'image-name' or
+// 'image-suffix' template.
+func (f *FinishImageBuild) setOutputName(sourceImage, outputImage *config.Image, sourceLabels map[string]string) error {
+	name, err := f.outputImageName(sourceImage.Name, sourceLabels, time.Now())
+	if err != nil {
+		return err
+	}
+	outputImage.Name = name
+	return nil
+}
+
+// handleExistingImage applies the 'if-exists' behavior to an output image that
+// already exists. It reports whether the image build should continue, possibly
+// with a new output image name. If the image build continues under a temporary
+// name, the name of the existing image that it replaces once it succeeds is
+// returned as well. An error means the step must fail.
+func (f *FinishImageBuild) handleExistingImage(svc *compute.Service, outputImage *config.Image) (bool, string, error) {
+	switch f.ifExists {
+	case ifExistsFail:
+		return false, "", fmt.Errorf("result image %s already exists in project %s", outputImage.Name,
+			outputImage.Project)
+	case ifExistsReplace:
+		name, err := temporaryImageName(outputImage.Name)
+		if err != nil {
+			return false, "", err
+		}
+		log.Printf("Result image %s already exists in project %s. Building image %s and replacing the existing "+
+			"image with it once the build succeeds.\n", outputImage.Name, outputImage.Project, name)
+		replace := outputImage.Name
+		outputImage.Name = name
+		return true, replace, nil
+	case ifExistsSuffix:
+		name, err := gce.AvailableImageName(svc, outputImage.Project, outputImage.Name)
+		if err != nil {
+			return false, "", err
+		}
+		log.Printf("Result image %s already exists in project %s. Building image %s instead.\n",
+			outputImage.Name, outputImage.Project, name)
+		outputImage.Name = name
+		return true, "", nil
+	default:
+		log.Printf("Result image %s already exists in project %s. Skipping the image build.\n",
+			outputImage.Name, outputImage.Project)
+		if f.skipMarkerFile != "" {
+			if err := ioutil.WriteFile(f.skipMarkerFile, []byte(outputImage.URL()+"\n"), 0644); err != nil {
+				return false, "", fmt.Errorf("error writing skip marker file: %v", err)
+			}
+		}
+		return false, "", nil
+	}
+}
+
+// reportTimeline prints the provisioning timeline of the builder VM and writes
+// it to 'timeline-file', if it is set.
+func (f *FinishImageBuild) reportTimeline(timeline *preloader.Timeline) error {
+	if timeline == nil {
+		return nil
+	}
+	if len(timeline.Steps) != 0 || len(timeline.Events) != 0 {
+		log.Print(timeline.Summary())
+	}
+	if f.timelineFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(timeline, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.timelineFile, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing provisioning timeline: %v", err)
+	}
+	return nil
+}
+
 // Execute implements subcommands.Command.Execute. It gathers image configuration parameters
 // and creates a GCE image.
-func (f *FinishImageBuild) Execute(ctx context.Context, flags *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+func (f *FinishImageBuild) Execute(ctx context.Context, flags *flag.FlagSet,
+	args ...interface{}) subcommands.ExitStatus {
 	if flags.NArg() != 0 {
 		flags.Usage()
 		return subcommands.ExitUsageError
 	}
 	files := args[0].(*fs.Files)
 	defer files.CleanupAllPersistent()
-	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
+	if err := f.validate(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if f.skipMarkerFile != "" {
+		// A skip marker left by an earlier run must not be mistaken for this one.
+		if err := os.Remove(f.skipMarkerFile); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	sourceImage, buildConfig, outputImage, provConfig, err := f.loadConfigs(files)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	defer gcsClient.Close()
-	if err := f.validate(); err != nil {
+	if err := f.validateBackend(buildConfig); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	sourceImage, buildConfig, outputImage, provConfig, err := f.loadConfigs(files)
+	if err := validateOEM(buildConfig, provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if buildConfig.Backend == config.BackendLocal {
+		// Local builds don't use GCE or GCS, so source image labels aren't
+		// available.
+		if err := f.setOutputName(sourceImage, outputImage, nil); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		timeline, err := preloader.BuildImage(ctx, nil, files, sourceImage, outputImage, buildConfig, provConfig)
+		if err := f.reportTimeline(timeline); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	if err := validateOEM(buildConfig, provConfig); err != nil {
+	defer gcsClient.Close()
+	if err := validateAcceleratorType(svc, buildConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	var sourceLabels map[string]string
+	if f.inheritLabels || f.usesSourceLabels() || f.inheritGuestOSFeatures || f.shieldedVM || f.confidentialVM {
+		image, err := svc.Images.Get(sourceImage.Project, sourceImage.Name).Do()
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		if err := f.validateSourceImage(image); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		sourceLabels = image.Labels
+		if f.inheritGuestOSFeatures {
+			addGuestOSFeatures(outputImage, sourceGuestOSFeatures(image))
+		}
+	}
+	if err := f.setOutputName(sourceImage, outputImage, sourceLabels); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
@@ -311,19 +842,43 @@ func (f *FinishImageBuild) Execute(ctx context.Context, flags *flag.FlagSet, arg
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
+	var replace string
 	if exists {
-		log.Printf("Result image %s already exists in project %s. Exiting.\n", outputImage.Name, outputImage.Project)
-		return subcommands.ExitSuccess
-	}
-	if f.inheritLabels {
-		image, err := svc.Images.Get(sourceImage.Project, sourceImage.Name).Do()
+		var build bool
+		build, replace, err = f.handleExistingImage(svc, outputImage)
 		if err != nil {
 			log.Println(err)
 			return subcommands.ExitFailure
 		}
-		update(outputImage.Labels, image.Labels)
+		if !build {
+			return exitSkipped
+		}
+	}
+	if err := f.resolveLabels(files, sourceImage, outputImage, provConfig, sourceLabels); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	timeline, err := preloader.BuildImage(ctx, gcsClient, files, sourceImage, outputImage, buildConfig, provConfig)
+	timelineErr := f.reportTimeline(timeline)
+	if session := preloader.NewDebugSession(buildConfig); session != nil {
+		// Provisioning is only debugged if it failed, rather than being canceled.
+		runDebugSession(ctx, svc, gcsClient, session, err != nil && ctx.Err() == nil, f.debugOnFailure)
+	}
+	if err != nil && replace != "" {
+		// The existing image is kept if the image build fails. The image build can
+		// fail after creating the image, for example while exporting it.
+		exists, existsErr := gce.ImageExists(svc, outputImage.Project, outputImage.Name)
+		if existsErr == nil && exists {
+			if err := gce.DeleteImage(context.Background(), svc, outputImage.Project, outputImage.Name); err != nil {
+				log.Printf("Failed to delete image %s: %v", outputImage.Name, err)
+			}
+		}
+	}
+	if timelineErr != nil {
+		log.Println(timelineErr)
+		return subcommands.ExitFailure
 	}
-	if err := preloader.BuildImage(ctx, gcsClient, files, sourceImage, outputImage, buildConfig, provConfig); err != nil {
+	if err != nil {
 		if _, ok := err.(*exec.ExitError); ok {
 			log.Printf("command failed: %s. See stdout logs for details", err)
 			return subcommands.ExitFailure
@@ -331,6 +886,28 @@ func (f *FinishImageBuild) Execute(ctx context.Context, flags *flag.FlagSet, arg
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
+	if replace != "" {
+		if err := gce.ReplaceImage(ctx, svc, outputImage, replace); err != nil {
+			log.Printf("replacing image %s failed: %s", replace, err)
+			return subcommands.ExitFailure
+		}
+		log.Printf("Replaced image %s with image %s", replace, outputImage.Name)
+		outputImage.Name = replace
+	}
+	if len(f.shareWith.l) != 0 {
+		if err := gce.ShareImage(ctx, svc, outputImage, f.shareWith.l); err != nil {
+			log.Printf("sharing image failed: %s", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if len(f.copyTo.l) != 0 {
+		// Copy targets were validated in f.validate.
+		targets, _ := copyTargets(f.copyTo.l)
+		if err := gce.CopyImage(ctx, svc, outputImage, targets, f.copyDeprecate, f.oldImageTTLSec); err != nil {
+			log.Printf("copying image failed: %s", err)
+			return subcommands.ExitFailure
+		}
+	}
 	if f.deprecateOld {
 		if err := gce.DeprecateInFamily(ctx, svc, outputImage, f.oldImageTTLSec); err != nil {
 			log.Printf("deprecating images failed: %s", err)
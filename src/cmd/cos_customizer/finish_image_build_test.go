@@ -16,17 +16,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/preloader"
 
 	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/subcommands"
 	compute "google.golang.org/api/compute/v1"
 )
@@ -117,9 +123,11 @@ func TestOutputImageExists(t *testing.T) {
 	gce, svc := fakes.GCEForTest(t, "p")
 	gce.Images = &compute.ImageList{Items: []*compute.Image{{Name: "out"}}}
 	files.DaisyBin = "/bin/false"
-	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out", "-image-project=p"); err != nil {
+	got, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out", "-image-project=p")
+	if got != exitSkipped {
 		t.Logf("images: %v", gce.Images)
-		t.Errorf("FinishImageBuild.Execute(-image-name=out -image-project=p); daisy shouldn't execute if image exists; err: %q", err)
+		t.Errorf("FinishImageBuild.Execute(-image-name=out -image-project=p) = %v, want %v; daisy shouldn't execute if "+
+			"image exists; err: %q", got, exitSkipped, err)
 	}
 }
 
@@ -133,9 +141,377 @@ func TestOutputImageSuffixExists(t *testing.T) {
 	gce, svc := fakes.GCEForTest(t, "p")
 	gce.Images = &compute.ImageList{Items: []*compute.Image{{Name: "in-out"}}}
 	files.DaisyBin = "/bin/false"
-	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-suffix=-out", "-image-project=p"); err != nil {
+	got, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-suffix=-out", "-image-project=p")
+	if got != exitSkipped {
 		t.Logf("images: %v", gce.Images)
-		t.Errorf("FinishImageBuild.Execute(-image-suffix=-out -image-project=p); daisy shouldn't execute if image exists; err: %q", err)
+		t.Errorf("FinishImageBuild.Execute(-image-suffix=-out -image-project=p) = %v, want %v; daisy shouldn't execute if "+
+			"image exists; err: %q", got, exitSkipped, err)
+	}
+}
+
+// recordDaisyArgs replaces the Daisy binary with a script that records its
+// arguments, one per line, and returns the path of the file they are written
+// to.
+func recordDaisyArgs(t *testing.T, tmpDir string, files *fs.Files) string {
+	t.Helper()
+	argsFile := filepath.Join(tmpDir, "daisy_args")
+	files.DaisyBin = filepath.Join(tmpDir, "daisy")
+	script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$@\" > %s\n", argsFile)
+	if err := ioutil.WriteFile(files.DaisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return argsFile
+}
+
+// recordDaisyWorkflow replaces the Daisy binary with a script that copies the
+// templated workflow, which is the last argument, and returns the path of the
+// copy.
+func recordDaisyWorkflow(t *testing.T, tmpDir string, files *fs.Files) string {
+	t.Helper()
+	workflowCopy := filepath.Join(tmpDir, "daisy_workflow")
+	files.DaisyBin = filepath.Join(tmpDir, "daisy")
+	script := fmt.Sprintf("#!/bin/sh\nfor last; do :; done\ncp \"$last\" %s\n", workflowCopy)
+	if err := ioutil.WriteFile(files.DaisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return workflowCopy
+}
+
+func TestTemplatedImageName(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	argsFile := recordDaisyArgs(t, tmpDir, files)
+	gcs := fakes.GCSForTest(t)
+	gce, svc := fakes.GCEForTest(t, "p")
+	gce.Images = &compute.ImageList{Items: []*compute.Image{{Name: "in", Labels: map[string]string{"team": "infra"}}}}
+	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-project=p",
+		"-image-name=out-{{.Labels.team}}-{{.Vars.env}}", "-var=env=prod"); err != nil {
+		t.Fatal(err)
+	}
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "-var:output_image_name\nout-infra-prod\n") {
+		t.Errorf("FinishImageBuild.Execute: got daisy args %q, want output image name %q", string(args), "out-infra-prod")
+	}
+}
+
+func TestBuilderVM(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	argsFile := recordDaisyArgs(t, tmpDir, files)
+	gcs := fakes.GCSForTest(t)
+	_, svc := fakes.GCEForTest(t, "p")
+	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-project=p",
+		"-image-name=out", "-machine-type=e2-standard-4", "-boot-disk-type=pd-ssd", "-no-external-ip",
+		"-scopes=devstorage.read_only"); err != nil {
+		t.Fatal(err)
+	}
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"-var:machine_type\ne2-standard-4\n", "-var:boot_disk_type\npd-ssd\n"} {
+		if !strings.Contains(string(args), want) {
+			t.Errorf("FinishImageBuild.Execute: got daisy args %q, want them to contain %q", string(args), want)
+		}
+	}
+}
+
+func TestGuestOSFeatures(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     []string
+		wantDaisy bool
+		want      []string
+	}{
+		{
+			name:      "Set",
+			flags:     []string{"-guest-os-features=GVNIC,SEV_CAPABLE"},
+			wantDaisy: true,
+			want:      []string{"GVNIC", "SEV_CAPABLE"},
+		},
+		{
+			name:      "Inherit",
+			flags:     []string{"-guest-os-features=GVNIC", "-inherit-guest-os-features"},
+			wantDaisy: true,
+			want:      []string{"GVNIC", "UEFI_COMPATIBLE"},
+		},
+		{
+			name:      "ShieldedVM",
+			flags:     []string{"-shielded-vm"},
+			wantDaisy: true,
+		},
+		{
+			name:  "ConfidentialVMSourceNotSEVCapable",
+			flags: []string{"-confidential-vm", "-machine-type=n2d-standard-2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpDir, files, err := setupFinishBuildFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			workflowCopy := recordDaisyWorkflow(t, tmpDir, files)
+			if err := ioutil.WriteFile(files.DaisyWorkflow, []byte("{{.GuestOSFeatures}}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			gcs := fakes.GCSForTest(t)
+			gce, svc := fakes.GCEForTest(t, "p")
+			gce.Images = &compute.ImageList{Items: []*compute.Image{{Name: "in",
+				GuestOsFeatures: []*compute.GuestOsFeature{{Type: "UEFI_COMPATIBLE"}, {Type: "GVNIC"}}}}}
+			flags := append([]string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p"}, test.flags...)
+			executeFinishBuild(files, svc, gcs.Client, flags...)
+			workflow, err := ioutil.ReadFile(workflowCopy)
+			if gotDaisy := err == nil; gotDaisy != test.wantDaisy {
+				t.Fatalf("FinishImageBuild.Execute(%v): daisy executed: %v, want %v", test.flags, gotDaisy, test.wantDaisy)
+			}
+			if !test.wantDaisy {
+				return
+			}
+			var got []*compute.GuestOsFeature
+			if err := json.Unmarshal(workflow, &got); err != nil {
+				t.Fatal(err)
+			}
+			var gotTypes []string
+			for _, f := range got {
+				gotTypes = append(gotTypes, f.Type)
+			}
+			if diff := cmp.Diff(gotTypes, test.want); diff != "" {
+				t.Errorf("FinishImageBuild.Execute(%v): guest OS features mismatch: diff (-got, +want): %s", test.flags, diff)
+			}
+		})
+	}
+}
+
+func TestGPUZone(t *testing.T) {
+	var testData = []struct {
+		testName         string
+		acceleratorTypes []*compute.AcceleratorType
+		wantDaisy        bool
+	}{
+		{
+			testName:         "Offered",
+			acceleratorTypes: []*compute.AcceleratorType{{Name: "nvidia-tesla-t4", Zone: "zones/z", MaximumCardsPerInstance: 4}},
+			wantDaisy:        true,
+		},
+		{
+			testName:         "OtherZone",
+			acceleratorTypes: []*compute.AcceleratorType{{Name: "nvidia-tesla-t4", Zone: "zones/z2", MaximumCardsPerInstance: 4}},
+		},
+		{
+			testName:         "TooManyGPUs",
+			acceleratorTypes: []*compute.AcceleratorType{{Name: "nvidia-tesla-t4", Zone: "zones/z", MaximumCardsPerInstance: 1}},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupFinishBuildFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := config.SaveConfigToPath(files.BuildConfig, &config.Build{GCSBucket: "b", GCSDir: "d",
+				GPUType: "nvidia-tesla-t4", GPUCount: 2}); err != nil {
+				t.Fatal(err)
+			}
+			workflowCopy := recordDaisyWorkflow(t, tmpDir, files)
+			if err := ioutil.WriteFile(files.DaisyWorkflow, []byte("{{.Accelerators}}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			gcs := fakes.GCSForTest(t)
+			gce, svc := fakes.GCEForTest(t, "p")
+			gce.AcceleratorTypes = input.acceleratorTypes
+			executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out", "-image-project=p")
+			workflow, err := ioutil.ReadFile(workflowCopy)
+			if gotDaisy := err == nil; gotDaisy != input.wantDaisy {
+				t.Fatalf("FinishImageBuild.Execute: daisy executed: %v, want %v", gotDaisy, input.wantDaisy)
+			}
+			if want := `"acceleratorCount":2`; input.wantDaisy && !strings.Contains(string(workflow), want) {
+				t.Errorf("FinishImageBuild.Execute: got accelerators %s, want them to contain %s", string(workflow), want)
+			}
+		})
+	}
+}
+
+func TestTimelineFile(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files.DaisyBin = filepath.Join(tmpDir, "daisy")
+	script := `#!/bin/bash
+echo '[build-image]: Instance "preload-vm": StatusMatch found: "BuildStatus: BuildEvent: {\"time\":\"2021-03-04T10:00:00Z\",\"type\":\"step-start\",\"step\":1,\"stepType\":\"RunScript\"}"'
+echo '[build-image]: Instance "preload-vm": StatusMatch found: "BuildStatus: BuildEvent: {\"time\":\"2021-03-04T10:00:10Z\",\"type\":\"step-end\",\"step\":1,\"stepType\":\"RunScript\",\"error\":\"exit status 1\"}"'
+exit 1
+`
+	if err := ioutil.WriteFile(files.DaisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	timelineFile := filepath.Join(tmpDir, "timeline.json")
+	gcs := fakes.GCSForTest(t)
+	_, svc := fakes.GCEForTest(t, "p")
+	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-project=p",
+		"-image-name=out", "-timeline-file="+timelineFile); err == nil {
+		t.Fatal("FinishImageBuild.Execute: got nil, want error")
+	}
+	data, err := ioutil.ReadFile(timelineFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &preloader.Timeline{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Steps) != 1 || got.Steps[0].Status != preloader.StepFailed || got.Steps[0].DurationSeconds != 10 {
+		t.Errorf("FinishImageBuild.Execute: got timeline %s, want one failed step that ran for 10s", string(data))
+	}
+}
+
+func TestDebugOnFailure(t *testing.T) {
+	var testData = []struct {
+		testName   string
+		daisyExit  int
+		wantStatus subcommands.ExitStatus
+	}{
+		{"Failure", 1, subcommands.ExitFailure},
+		{"Success", 0, subcommands.ExitSuccess},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupFinishBuildFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			workflow := `{"Steps": {"run": {"CreateInstances": [{ {{.DebugInstance}} "Name": "preload-vm"}]}}}`
+			if err := ioutil.WriteFile(files.DaisyWorkflow, []byte(workflow), 0644); err != nil {
+				t.Fatal(err)
+			}
+			workflowCopy := filepath.Join(tmpDir, "daisy_workflow")
+			files.DaisyBin = filepath.Join(tmpDir, "daisy")
+			script := fmt.Sprintf("#!/bin/sh\nfor last; do :; done\ncp \"$last\" %s\nexit %d\n", workflowCopy,
+				input.daisyExit)
+			if err := ioutil.WriteFile(files.DaisyBin, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			gcs := fakes.GCSForTest(t)
+			_, svc := fakes.GCEForTest(t, "p")
+			// The fake GCE server doesn't run Daisy workflows, so the builder VM
+			// doesn't exist, and the debug session is cleaned up right away.
+			got, _ := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-project=p",
+				"-image-name=out", "-debug-on-failure=1h")
+			if got != input.wantStatus {
+				t.Fatalf("FinishImageBuild.Execute: got %v, want %v", got, input.wantStatus)
+			}
+			data, err := ioutil.ReadFile(workflowCopy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v interface{}
+			if err := json.Unmarshal(data, &v); err != nil {
+				t.Fatalf("FinishImageBuild.Execute: got invalid workflow: %v\n%s", err, string(data))
+			}
+			if !strings.Contains(string(data), `"NoCleanup":true,"RealName":"cos-customizer-debug-`) {
+				t.Errorf("FinishImageBuild.Execute: got workflow %s, want the builder VM to be kept", string(data))
+			}
+			for key := range gcs.Objects {
+				if strings.HasPrefix(key, "/b/d/cos-customizer/") {
+					t.Errorf("FinishImageBuild.Execute: got object %s, want build inputs to be cleaned up", key)
+				}
+			}
+		})
+	}
+}
+
+func TestIfExists(t *testing.T) {
+	tests := []struct {
+		name           string
+		ifExists       string
+		daisyFails     bool
+		wantStatus     subcommands.ExitStatus
+		wantDaisy      bool
+		wantImages     []string
+		wantName       string
+		wantSkipMarker bool
+	}{
+		{name: "Skip", ifExists: "skip", wantStatus: exitSkipped, wantImages: []string{"out", "out-1"},
+			wantSkipMarker: true},
+		{name: "Fail", ifExists: "fail", wantStatus: subcommands.ExitFailure, wantImages: []string{"out", "out-1"}},
+		{name: "Replace", ifExists: "replace", wantStatus: subcommands.ExitSuccess, wantDaisy: true,
+			wantImages: []string{"out-1", "out"}, wantName: "out-tmp"},
+		{name: "ReplaceFailedBuild", ifExists: "replace", daisyFails: true, wantStatus: subcommands.ExitFailure,
+			wantDaisy: true, wantImages: []string{"out", "out-1"}, wantName: "out-tmp"},
+		{name: "Suffix", ifExists: "suffix", wantStatus: subcommands.ExitSuccess, wantDaisy: true,
+			wantImages: []string{"out", "out-1"}, wantName: "out-2"},
+	}
+	defer func(f func(string) (string, error)) { temporaryImageName = f }(temporaryImageName)
+	temporaryImageName = func(name string) (string, error) { return name + "-tmp", nil }
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpDir, files, err := setupFinishBuildFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			argsFile := recordDaisyArgs(t, tmpDir, files)
+			if test.daisyFails {
+				script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$@\" > %s\nexit 1\n", argsFile)
+				if err := ioutil.WriteFile(files.DaisyBin, []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gcs := fakes.GCSForTest(t)
+			gce, svc := fakes.GCEForTest(t, "p")
+			gce.Images = &compute.ImageList{Items: []*compute.Image{{Name: "out"}, {Name: "out-1"}}}
+			if test.wantName == "out-tmp" {
+				// Daisy creates the output image, but the fake Daisy doesn't.
+				gce.Images.Items = append(gce.Images.Items, &compute.Image{Name: "out-tmp", Description: "new"})
+			}
+			skipMarker := filepath.Join(tmpDir, "skipped")
+			got, _ := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out",
+				"-image-project=p", "-if-exists="+test.ifExists, "-skip-marker-file="+skipMarker)
+			if got != test.wantStatus {
+				t.Errorf("FinishImageBuild.Execute(-if-exists=%s): got status %v, want %v", test.ifExists, got, test.wantStatus)
+			}
+			var gotImages []string
+			for _, image := range gce.Images.Items {
+				gotImages = append(gotImages, image.Name)
+			}
+			if diff := cmp.Diff(gotImages, test.wantImages); diff != "" {
+				t.Errorf("FinishImageBuild.Execute(-if-exists=%s): images mismatch: diff (-got, +want): %s", test.ifExists, diff)
+			}
+			if test.ifExists == "replace" && !test.daisyFails && gce.Images.Items[1].Description != "new" {
+				t.Errorf("FinishImageBuild.Execute(-if-exists=replace): got image %+v, want the new image", gce.Images.Items[1])
+			}
+			marker, err := ioutil.ReadFile(skipMarker)
+			if gotMarker := err == nil; gotMarker != test.wantSkipMarker {
+				t.Errorf("FinishImageBuild.Execute(-if-exists=%s): skip marker written: %v, want %v", test.ifExists,
+					gotMarker, test.wantSkipMarker)
+			}
+			if test.wantSkipMarker && string(marker) != "projects/p/global/images/out\n" {
+				t.Errorf("FinishImageBuild.Execute(-if-exists=%s): got skip marker %q, want the existing image URL",
+					test.ifExists, string(marker))
+			}
+			args, err := ioutil.ReadFile(argsFile)
+			if gotDaisy := err == nil; gotDaisy != test.wantDaisy {
+				t.Fatalf("FinishImageBuild.Execute(-if-exists=%s): daisy executed: %v, want %v", test.ifExists, gotDaisy, test.wantDaisy)
+			}
+			if test.wantDaisy && !strings.Contains(string(args), "-var:output_image_name\n"+test.wantName+"\n") {
+				t.Errorf("FinishImageBuild.Execute(-if-exists=%s): got daisy args %q, want output image name %q",
+					test.ifExists, string(args), test.wantName)
+			}
+		})
 	}
 }
 
@@ -157,6 +533,31 @@ func TestDeprecateImages(t *testing.T) {
 	}
 }
 
+func TestInheritLabels(t *testing.T) {
+	outputImage := config.NewImage("out", "p")
+	outputImage.Labels = map[string]string{"a": "flag", "cos-customizer-version": "v2"}
+	inheritLabels(outputImage, map[string]string{"a": "source", "b": "source", "cos-customizer-steps": "0123"})
+	want := map[string]string{"a": "flag", "b": "source", "cos-customizer-version": "v2"}
+	if diff := cmp.Diff(outputImage.Labels, want); diff != "" {
+		t.Errorf("inheritLabels: diff (-got, +want): %s", diff)
+	}
+}
+
+func TestTooManyLabels(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	gcs := fakes.GCSForTest(t)
+	_, svc := fakes.GCEForTest(t, "p")
+	flag := "-labels=" + strings.Join(manyLabels(62), ",")
+	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out",
+		"-image-project=p", flag); err == nil {
+		t.Errorf("FinishImageBuild.Execute: succeeded with 62 labels and provenance labels, want error")
+	}
+}
+
 func TestValidateFailure(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -174,6 +575,96 @@ func TestValidateFailure(t *testing.T) {
 			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-image-family=f", "-disk-size-gb=11", "-oem-size=3072M"},
 			expectErr: true,
 			msg:       "disk size should be invalid",
+		}, {
+			name:      "ExportURI",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-export-uri=/tmp/out.tar.gz"},
+			expectErr: true,
+			msg:       "'export-uri' should be invalid",
+		}, {
+			name:      "SharePrincipal",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-share-with=alice@example.com"},
+			expectErr: true,
+			msg:       "'share-with' should be invalid",
+		}, {
+			name:      "CopyTarget",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-copy-to=p2/"},
+			expectErr: true,
+			msg:       "'copy-to' should be invalid",
+		}, {
+			name:      "CopyDeprecateNoFamily",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-copy-to=p2", "-copy-deprecate-old-images"},
+			expectErr: true,
+			msg:       "'copy-deprecate-old-images' should require 'image-family'",
+		}, {
+			name:      "ExportFormat",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-export-uri=gs://b/out", "-export-format=vhd"},
+			expectErr: true,
+			msg:       "'export-format' should be invalid",
+		}, {
+			name:      "IfExists",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-if-exists=overwrite"},
+			expectErr: true,
+			msg:       "'if-exists' should be invalid",
+		}, {
+			name:      "ImageNameTemplate",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out-{{.Date", "-image-project=p"},
+			expectErr: true,
+			msg:       "'image-name' template should be invalid",
+		}, {
+			name:      "ImageName",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=Out_{{.Date}}", "-image-project=p"},
+			expectErr: true,
+			msg:       "'image-name' should be invalid",
+		}, {
+			name:      "MachineType",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-machine-type=E2 standard"},
+			expectErr: true,
+			msg:       "'machine-type' should be invalid",
+		}, {
+			name:      "ScopesWithoutStorage",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-scopes=compute"},
+			expectErr: true,
+			msg:       "'scopes' should require a GCS scope",
+		}, {
+			name:      "NetworkTag",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-network-tags=Allow_SSH"},
+			expectErr: true,
+			msg:       "'network-tags' should be invalid",
+		}, {
+			name:      "BootDiskType",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-boot-disk-type=local-ssd"},
+			expectErr: true,
+			msg:       "'boot-disk-type' should be invalid",
+		}, {
+			name:      "ServiceAccount",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-service-account=builder"},
+			expectErr: true,
+			msg:       "'service-account' should be invalid",
+		}, {
+			name:      "GuestOSFeatures",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-guest-os-features=UEFI"},
+			expectErr: true,
+			msg:       "'guest-os-features' should be invalid",
+		}, {
+			name:      "ConfidentialVMMachineType",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-confidential-vm"},
+			expectErr: true,
+			msg:       "'confidential-vm' should require an SEV machine type",
+		}, {
+			name:      "ArtifactCacheTTL",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-artifact-cache-ttl=-1h"},
+			expectErr: true,
+			msg:       "'artifact-cache-ttl' should be invalid",
+		}, {
+			name:      "CompositeUploadThreshold",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-parallel-composite-upload-threshold=big"},
+			expectErr: true,
+			msg:       "'parallel-composite-upload-threshold' should be invalid",
+		}, {
+			name:      "DebugOnFailure",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-debug-on-failure=-1h"},
+			expectErr: true,
+			msg:       "'debug-on-failure' should be invalid",
 		},
 	}
 	for _, test := range tests {
@@ -191,3 +682,131 @@ func TestValidateFailure(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateBackend(t *testing.T) {
+	tests := []struct {
+		name        string
+		backend     string
+		gpuType     string
+		gpuCount    int
+		finishBuild *FinishImageBuild
+		expectErr   bool
+	}{
+		{
+			name:        "Daisy",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z"},
+		}, {
+			name:        "DaisyNoZone",
+			finishBuild: &FinishImageBuild{project: "p"},
+			expectErr:   true,
+		}, {
+			name:        "DaisyOutputDir",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z", localOutputDir: "out"},
+			expectErr:   true,
+		}, {
+			name:        "Local",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out"},
+		}, {
+			name:        "LocalNoOutputDir",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{},
+			expectErr:   true,
+		}, {
+			name:        "LocalExport",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", exportURI: "gs://b/out"},
+			expectErr:   true,
+		}, {
+			name:        "LocalShare",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", shareWith: &listVar{l: []string{"project:p"}}},
+			expectErr:   true,
+		}, {
+			name:        "LocalCopy",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", copyTo: &listVar{l: []string{"p2"}}},
+			expectErr:   true,
+		}, {
+			name:        "LocalDeprecate",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", imageFamily: "f", deprecateOld: true},
+			expectErr:   true,
+		}, {
+			name:        "LocalMachineType",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", machineType: "e2-standard-4"},
+			expectErr:   true,
+		}, {
+			name:        "LocalShieldedVM",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", shieldedVM: true},
+			expectErr:   true,
+		}, {
+			name:        "LocalGuestOSFeatures",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", guestOSFeatures: &listVar{l: []string{"GVNIC"}}},
+			expectErr:   true,
+		}, {
+			name:        "LocalDebugOnFailure",
+			backend:     config.BackendLocal,
+			finishBuild: &FinishImageBuild{localOutputDir: "out", debugOnFailure: time.Hour},
+			expectErr:   true,
+		}, {
+			name:        "DaisyGPUConfidentialVM",
+			gpuType:     "nvidia-tesla-t4",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z", machineType: "n1-standard-8", confidentialVM: true},
+			expectErr:   true,
+		}, {
+			name:        "DaisyGPU",
+			gpuType:     "nvidia-tesla-t4",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z", machineType: "n1-standard-8"},
+		}, {
+			name:        "DaisyGPUMachineType",
+			gpuType:     "nvidia-tesla-t4",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z", machineType: "e2-standard-4"},
+			expectErr:   true,
+		}, {
+			name:        "DaisyUnknownGPU",
+			gpuType:     "nvidia-tesla-x1",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z"},
+			expectErr:   true,
+		}, {
+			name:        "DaisyBuiltInGPU",
+			gpuType:     "nvidia-l4",
+			gpuCount:    2,
+			finishBuild: &FinishImageBuild{project: "p", zone: "z", machineType: "g2-standard-24"},
+		}, {
+			name:        "DaisyBuiltInGPUDefaultMachineType",
+			gpuType:     "nvidia-l4",
+			finishBuild: &FinishImageBuild{project: "p", zone: "z"},
+			expectErr:   true,
+		}, {
+			name:        "DaisyBuiltInGPUCount",
+			gpuType:     "nvidia-h100-80gb",
+			gpuCount:    4,
+			finishBuild: &FinishImageBuild{project: "p", zone: "z", machineType: "a3-highgpu-8g"},
+			expectErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.finishBuild.shareWith == nil {
+				test.finishBuild.shareWith = &listVar{}
+			}
+			if test.finishBuild.copyTo == nil {
+				test.finishBuild.copyTo = &listVar{}
+			}
+			test.finishBuild.scopes = &listVar{}
+			test.finishBuild.networkTags = &listVar{}
+			if test.finishBuild.guestOSFeatures == nil {
+				test.finishBuild.guestOSFeatures = &listVar{}
+			}
+			err := test.finishBuild.validateBackend(&config.Build{Backend: test.backend, GPUType: test.gpuType,
+				GPUCount: test.gpuCount})
+			if gotErr := err != nil; gotErr != test.expectErr {
+				t.Errorf("validateBackend: got %v, want error: %v", err, test.expectErr)
+			}
+		})
+	}
+}
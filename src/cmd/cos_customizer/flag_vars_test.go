@@ -88,3 +88,15 @@ func TestListVar(t *testing.T) {
 		})
 	}
 }
+
+func TestRepeatedVar(t *testing.T) {
+	rv := &repeatedVar{}
+	for _, flag := range []string{"a", "b,c"} {
+		if err := rv.Set(flag); err != nil {
+			t.Fatalf("repeatedVar.Set(%s) = %s; want nil", flag, err)
+		}
+	}
+	if want := []string{"a", "b,c"}; !cmp.Equal(rv.l, want) {
+		t.Errorf("repeatedVar: got %v, want %v", rv.l, want)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/gce"
+
+	"github.com/google/subcommands"
+)
+
+// GCImages implements subcommands.Command for the "gc-images" command.
+// This command deletes old images in an image family according to a retention
+// policy. It doesn't use the state of an image build process, and can be run
+// at any time.
+type GCImages struct {
+	project       string
+	family        string
+	keep          int
+	maxAge        time.Duration
+	protectLabels *listVar
+	dryRun        bool
+	out           io.Writer
+}
+
+// Name implements subcommands.Command.Name.
+func (*GCImages) Name() string {
+	return "gc-images"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*GCImages) Synopsis() string {
+	return "Delete old images in an image family according to a retention policy."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*GCImages) Usage() string {
+	return `gc-images -project=<project> -family=<family> [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (g *GCImages) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&g.project, "project", "", "Project containing the image family.")
+	f.StringVar(&g.family, "family", "", "Image family to garbage collect.")
+	f.IntVar(&g.keep, "keep", 0, "Number of newest images in the family to always keep.")
+	f.DurationVar(&g.maxAge, "max-age", 0, "Delete images older than this age, unless they are among the 'keep' "+
+		"newest images. Must be formatted according to Golang's time.Duration string format. Example: "+
+		"-max-age=720h. If '0' and 'keep' is set, all images that aren't among the 'keep' newest images are deleted.")
+	if g.protectLabels == nil {
+		g.protectLabels = &listVar{}
+	}
+	f.Var(g.protectLabels, "protect-labels", "Labels that protect images from deletion. Format is "+
+		"'key1,key2=value2,...'. An image is protected if it has one of the label keys, or one of the label key-value "+
+		"pairs.")
+	f.BoolVar(&g.dryRun, "dry-run", false, "Print the images that would be deleted without deleting them.")
+}
+
+func (g *GCImages) policy() (*gce.RetentionPolicy, error) {
+	switch {
+	case g.project == "":
+		return nil, fmt.Errorf("'project' must be set")
+	case g.family == "":
+		return nil, fmt.Errorf("'family' must be set")
+	case g.keep < 0:
+		return nil, fmt.Errorf("'keep' must not be negative")
+	case g.maxAge < 0:
+		return nil, fmt.Errorf("'max-age' must not be negative")
+	}
+	policy := &gce.RetentionPolicy{KeepLast: g.keep, MaxAge: g.maxAge, ProtectedLabels: make(map[string]string)}
+	for _, label := range g.protectLabels.l {
+		split := strings.SplitN(label, "=", 2)
+		if split[0] == "" {
+			return nil, fmt.Errorf("invalid 'protect-labels' item %q", label)
+		}
+		if len(split) == 2 {
+			policy.ProtectedLabels[split[0]] = split[1]
+		} else {
+			policy.ProtectedLabels[split[0]] = ""
+		}
+	}
+	return policy, nil
+}
+
+// printSummary prints the decision made for each image, followed by the
+// number of deleted and kept images.
+func (g *GCImages) printSummary(decisions []*gce.GCDecision) error {
+	deleteAction := "DELETE"
+	deleted := "deleted"
+	if g.dryRun {
+		deleteAction = "WOULD DELETE"
+		deleted = "would be deleted"
+	}
+	var numDeleted int
+	for _, d := range decisions {
+		action := "KEEP"
+		if d.Delete {
+			action = deleteAction
+			numDeleted++
+		}
+		if _, err := fmt.Fprintf(g.out, "%s\t%s\t%s\n", action, d.Image, d.Reason); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(g.out, "%d images in family %s: %d %s, %d kept\n", len(decisions), g.family, numDeleted,
+		deleted, len(decisions)-numDeleted)
+	return err
+}
+
+// Execute implements subcommands.Command.Execute. It applies the retention
+// policy to the image family and prints a summary.
+func (g *GCImages) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if g.out == nil {
+		g.out = os.Stdout
+	}
+	policy, err := g.policy()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if gcsClient != nil {
+		defer gcsClient.Close()
+	}
+	decisions, err := gce.GCImages(ctx, svc, g.project, g.family, policy, g.dryRun)
+	if decisions != nil {
+		if err := g.printSummary(decisions); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
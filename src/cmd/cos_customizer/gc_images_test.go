@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestGCImagesCommand(t *testing.T) {
+	created := func(age time.Duration) string { return time.Now().Add(-age).Format(time.RFC3339) }
+	day := 24 * time.Hour
+	var testData = []struct {
+		testName    string
+		flags       []string
+		want        subcommands.ExitStatus
+		wantImages  []string
+		wantSummary string
+	}{
+		{
+			testName:    "Delete",
+			flags:       []string{"-project=p", "-family=f", "-keep=1", "-max-age=48h", "-protect-labels=release"},
+			want:        subcommands.ExitSuccess,
+			wantImages:  []string{"new", "mid", "protected"},
+			wantSummary: "4 images in family f: 1 deleted, 3 kept",
+		},
+		{
+			testName:    "DryRun",
+			flags:       []string{"-project=p", "-family=f", "-keep=1", "-dry-run"},
+			want:        subcommands.ExitSuccess,
+			wantImages:  []string{"new", "mid", "old", "protected"},
+			wantSummary: "4 images in family f: 3 would be deleted, 1 kept",
+		},
+		{
+			testName:    "ProtectLabelValue",
+			flags:       []string{"-project=p", "-family=f", "-keep=1", "-protect-labels=release=no"},
+			want:        subcommands.ExitSuccess,
+			wantImages:  []string{"new"},
+			wantSummary: "4 images in family f: 3 deleted, 1 kept",
+		},
+		{
+			testName:   "NoFamily",
+			flags:      []string{"-project=p", "-keep=1"},
+			want:       subcommands.ExitFailure,
+			wantImages: []string{"new", "mid", "old", "protected"},
+		},
+		{
+			testName:   "NegativeKeep",
+			flags:      []string{"-project=p", "-family=f", "-keep=-1"},
+			want:       subcommands.ExitFailure,
+			wantImages: []string{"new", "mid", "old", "protected"},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			gce, svc := fakes.GCEForTest(t, "p")
+			gce.Images = &compute.ImageList{Items: []*compute.Image{
+				{Name: "new", Family: "f", CreationTimestamp: created(time.Hour)},
+				{Name: "mid", Family: "f", CreationTimestamp: created(day)},
+				{Name: "old", Family: "f", CreationTimestamp: created(3 * day)},
+				{Name: "protected", Family: "f", CreationTimestamp: created(5 * day),
+					Labels: map[string]string{"release": "yes"}},
+			}}
+			clients := ServiceClients(func(context.Context, bool) (*compute.Service, *storage.Client, error) {
+				return svc, nil, nil
+			})
+			var out bytes.Buffer
+			gcImages := &GCImages{out: &out}
+			flagSet := &flag.FlagSet{}
+			gcImages.SetFlags(flagSet)
+			if err := flagSet.Parse(input.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := gcImages.Execute(context.Background(), flagSet, nil, clients); got != input.want {
+				t.Fatalf("GCImages.Execute(%v): got %v, want %v", input.flags, got, input.want)
+			}
+			var gotImages []string
+			for _, image := range gce.Images.Items {
+				gotImages = append(gotImages, image.Name)
+			}
+			if strings.Join(gotImages, ",") != strings.Join(input.wantImages, ",") {
+				t.Errorf("GCImages.Execute(%v): got images %v, want %v", input.flags, gotImages, input.wantImages)
+			}
+			if !strings.Contains(out.String(), input.wantSummary) {
+				t.Errorf("GCImages.Execute(%v): output does not contain %q; output:\n%s", input.flags,
+					input.wantSummary, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/gce"
+)
+
+// imageNameRegex matches valid GCE image names.
+var imageNameRegex = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// imageNameData holds the fields that output image name templates can refer
+// to.
+type imageNameData struct {
+	sourceName string
+	// Date is the current UTC date, formatted as YYYYMMDD.
+	Date string
+	// Labels holds the labels of the source image.
+	Labels map[string]string
+	// Vars holds the values given with the '-var' flag.
+	Vars map[string]string
+}
+
+// Milestone gets the milestone of the source image. It fails if the source
+// image name isn't a COS image name.
+func (d *imageNameData) Milestone() (int, error) {
+	milestone, _, err := gce.ImageVersion(d.sourceName)
+	return milestone, err
+}
+
+// BuildNumber gets the build number of the source image, e.g.
+// "16108-403-22". It fails if the source image name isn't a COS image name.
+func (d *imageNameData) BuildNumber() (string, error) {
+	_, buildNumber, err := gce.ImageVersion(d.sourceName)
+	return buildNumber, err
+}
+
+// parseImageNameTemplate parses an output image name template. References to
+// missing labels or vars are errors.
+func parseImageNameTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// renderImageName executes an output image name template.
+func renderImageName(name, text string, data *imageNameData) (string, error) {
+	tmpl, err := parseImageNameTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// validateImageName checks the given name against the GCE naming rules for
+// images.
+func validateImageName(name string) error {
+	if !imageNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid image name %q: image names must be 1-63 characters long, start with a "+
+			"lowercase letter, and contain only lowercase letters, digits and dashes, and must not end with a dash", name)
+	}
+	return nil
+}
+
+// usesSourceLabels checks if the output image name templates refer to the
+// labels of the source image.
+func (f *FinishImageBuild) usesSourceLabels() bool {
+	return strings.Contains(f.imageName+f.imageSuffix, ".Labels")
+}
+
+// outputImageName renders the output image name from the 'image-name' or
+// 'image-suffix' template and validates it.
+func (f *FinishImageBuild) outputImageName(sourceName string, sourceLabels map[string]string, now time.Time) (string, error) {
+	if sourceLabels == nil {
+		sourceLabels = make(map[string]string)
+	}
+	data := &imageNameData{
+		sourceName: sourceName,
+		Date:       now.UTC().Format("20060102"),
+		Labels:     sourceLabels,
+		Vars:       f.vars.m,
+	}
+	var name string
+	if f.imageSuffix != "" {
+		suffix, err := renderImageName("image-suffix", f.imageSuffix, data)
+		if err != nil {
+			return "", err
+		}
+		name = sourceName + suffix
+	} else {
+		var err error
+		name, err = renderImageName("image-name", f.imageName, data)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := validateImageName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
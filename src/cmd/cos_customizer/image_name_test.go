@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputImageName(t *testing.T) {
+	now := time.Date(2021, time.March, 4, 23, 0, 0, 0, time.FixedZone("UTC-5", -5*60*60))
+	tests := []struct {
+		name        string
+		finishBuild *FinishImageBuild
+		sourceName  string
+		labels      map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "Plain",
+			finishBuild: &FinishImageBuild{imageName: "my-image"},
+			sourceName:  "cos-stable-89-16108-403-22",
+			want:        "my-image",
+		},
+		{
+			name:        "Version",
+			finishBuild: &FinishImageBuild{imageName: "my-cos-{{.Milestone}}-{{.BuildNumber}}-{{.Date}}"},
+			sourceName:  "cos-stable-89-16108-403-22",
+			want:        "my-cos-89-16108-403-22-20210305",
+		},
+		{
+			name:        "LabelsAndVars",
+			finishBuild: &FinishImageBuild{imageName: "{{.Vars.team}}-{{.Labels.env}}", vars: &mapVar{map[string]string{"team": "infra"}}},
+			sourceName:  "my-image",
+			labels:      map[string]string{"env": "prod"},
+			want:        "infra-prod",
+		},
+		{
+			name:        "Suffix",
+			finishBuild: &FinishImageBuild{imageSuffix: "-{{.Date}}"},
+			sourceName:  "my-image",
+			want:        "my-image-20210305",
+		},
+		{
+			name:        "NotCOSImage",
+			finishBuild: &FinishImageBuild{imageName: "my-cos-{{.Milestone}}"},
+			sourceName:  "my-image",
+			wantErr:     true,
+		},
+		{
+			name:        "MissingLabel",
+			finishBuild: &FinishImageBuild{imageName: "my-image-{{.Labels.env}}"},
+			sourceName:  "my-image",
+			wantErr:     true,
+		},
+		{
+			name:        "MissingVar",
+			finishBuild: &FinishImageBuild{imageName: "my-image-{{.Vars.env}}", vars: newMapVar()},
+			sourceName:  "my-image",
+			wantErr:     true,
+		},
+		{
+			name:        "InvalidName",
+			finishBuild: &FinishImageBuild{imageName: "{{.Milestone}}-image"},
+			sourceName:  "cos-stable-89-16108-403-22",
+			wantErr:     true,
+		},
+		{
+			name:        "TooLong",
+			finishBuild: &FinishImageBuild{imageSuffix: "-" + strings.Repeat("a", 60)},
+			sourceName:  "my-image",
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.finishBuild.vars == nil {
+				test.finishBuild.vars = newMapVar()
+			}
+			got, err := test.finishBuild.outputImageName(test.sourceName, test.labels, now)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("outputImageName(%s): got err %v, want err: %v", test.sourceName, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("outputImageName(%s): got %q, want %q", test.sourceName, got, test.want)
+			}
+		})
+	}
+}
@@ -42,11 +42,6 @@ const (
 	installerContainer = "gcr.io/cos-cloud/cos-gpu-installer:v20210715"
 )
 
-// TODO(b/121332360): Move most GPU functionality to cos-gpu-installer
-var (
-	validGPUs = []string{"nvidia-tesla-k80", "nvidia-tesla-p100", "nvidia-tesla-v100"}
-)
-
 // InstallGPU implements subcommands.Command for the "install-gpu" command.
 // This command configures the current image build process to customize the result image
 // with GPU drivers.
@@ -55,6 +50,7 @@ type InstallGPU struct {
 	NvidiaDriverMd5sum   string
 	NvidiaInstallDirHost string
 	gpuType              string
+	gpuCount             int
 	getValidDrivers      bool
 	gpuDataDir           string
 }
@@ -84,7 +80,9 @@ func (i *InstallGPU) SetFlags(f *flag.FlagSet) {
 		"Location to install drivers on the image.")
 	f.StringVar(
 		&i.gpuType, "gpu-type", "nvidia-tesla-p100",
-		fmt.Sprintf("The type of GPU to verify drivers for. Must be one of: %v", validGPUs))
+		fmt.Sprintf("The type of GPU to verify drivers for. Must be one of: %v", config.AcceleratorTypes()))
+	f.IntVar(&i.gpuCount, "gpu-count", 1, "The number of GPUs to attach to the builder VM. GPUs of accelerator-optimized "+
+		"machine types, like A100, L4 and H100 GPUs, come with the machine type, which must match the number of GPUs.")
 	f.BoolVar(
 		&i.getValidDrivers, "get-valid-drivers", false,
 		"Print the list of supported GPU driver versions. If this flag is given, no other actions will be taken.")
@@ -117,28 +115,18 @@ func validDriverVersions(ctx context.Context, gcsClient *storage.Client) (map[st
 }
 
 func (i *InstallGPU) validate(ctx context.Context, gcsClient *storage.Client, files *fs.Files, provConfig *provisioner.Config) error {
-	isValidGPU := false
-	for _, g := range validGPUs {
-		if i.gpuType == g {
-			isValidGPU = true
-			break
-		}
+	accelerator := config.FindAccelerator(i.gpuType)
+	if accelerator == nil {
+		return fmt.Errorf("%q is an invalid GPU type. Must be one of: %v", i.gpuType, config.AcceleratorTypes())
 	}
-	if !isValidGPU {
-		return fmt.Errorf("%q is an invalid GPU type. Must be one of: %v", i.gpuType, validGPUs)
+	if !accelerator.ValidCount(i.gpuCount) {
+		return fmt.Errorf("%d is an invalid GPU count for GPU type %s", i.gpuCount, i.gpuType)
 	}
 	if i.NvidiaDriverVersion == "" {
 		return fmt.Errorf("version must be set")
 	}
-	var gpuAlreadyConf bool
-	for _, s := range provConfig.Steps {
-		if s.Type == "InstallGPU" {
-			gpuAlreadyConf = true
-			break
-		}
-	}
-	if gpuAlreadyConf {
-		return fmt.Errorf("install-gpu can only be invoked once in an image build process. Only one driver version can be installed on the image")
+	if countSteps(provConfig.Steps, "InstallGPU") > 0 {
+		return errMultipleGPUSteps
 	}
 	if strings.HasSuffix(i.NvidiaDriverVersion, ".run") {
 		log.Printf("driver version is set to %q, which looks like an nvidia installer file", i.NvidiaDriverVersion)
@@ -208,6 +196,7 @@ func (i *InstallGPU) updateBuildConfig(configPath string) error {
 		return err
 	}
 	buildConfig.GPUType = i.gpuType
+	buildConfig.GPUCount = i.gpuCount
 	if i.gpuDataDir != "" {
 		files, err := ioutil.ReadDir(i.gpuDataDir)
 		if err != nil {
@@ -210,6 +210,47 @@ func TestInstallGPUInvalidGPUType(t *testing.T) {
 	}
 }
 
+func TestInstallGPUCount(t *testing.T) {
+	var testData = []struct {
+		testName string
+		flags    []string
+		wantErr  bool
+		want     int
+	}{
+		{"Default", []string{"-gpu-type=nvidia-tesla-t4"}, false, 1},
+		{"N1", []string{"-gpu-type=nvidia-tesla-t4", "-gpu-count=4"}, false, 4},
+		{"BuiltIn", []string{"-gpu-type=nvidia-tesla-a100", "-gpu-count=16"}, false, 16},
+		{"InvalidCount", []string{"-gpu-type=nvidia-tesla-t4", "-gpu-count=3"}, true, 0},
+		{"InvalidBuiltInCount", []string{"-gpu-type=nvidia-l4", "-gpu-count=16"}, true, 0},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupInstallGPUFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			gcs := fakes.GCSForTest(t)
+			defer gcs.Close()
+			flags := append([]string{"-version=390.46"}, input.flags...)
+			_, err = executeInstallGPU(context.Background(), files, gcs.Client, flags...)
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Fatalf("install-gpu(%v): got %v, want error: %v", flags, err, input.wantErr)
+			}
+			if input.wantErr {
+				return
+			}
+			buildConfig := &config.Build{}
+			if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+				t.Fatal(err)
+			}
+			if buildConfig.GPUCount != input.want {
+				t.Errorf("install-gpu(%v): got GPU count %d, want %d", flags, buildConfig.GPUCount, input.want)
+			}
+		})
+	}
+}
+
 func TestInstallGPURunTwice(t *testing.T) {
 	tmpDir, files, err := setupInstallGPUFiles()
 	if err != nil {
@@ -238,6 +279,7 @@ func TestInstallGPUProvisionerConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 	want := provisioner.Config{
+		SchemaVersion: provisioner.ConfigSchemaVersion,
 		Steps: []provisioner.StepConfig{
 			{
 				Type: "InstallGPU",
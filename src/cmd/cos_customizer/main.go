@@ -21,6 +21,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
 
@@ -32,6 +34,10 @@ import (
 	"google.golang.org/api/option"
 )
 
+// version is the version of cos-customizer. It is recorded in the provenance of
+// output images, and can be set at link time with -X main.version=<version>.
+var version = "dev"
+
 var persistentDir = flag.String("local-state-workdir", ".cos-customizer-workdir",
 	"Name of the directory in $HOME to use for storing local state.")
 
@@ -68,9 +74,21 @@ func main() {
 	subcommands.Register(new(DisableAutoUpdate), "")
 	subcommands.Register(new(FinishImageBuild), "")
 	subcommands.Register(new(InstallPackage), "")
+	subcommands.Register(new(Build), "")
+	subcommands.Register(new(Plan), "")
+	subcommands.Register(new(ListSteps), "")
+	subcommands.Register(new(RemoveStep), "")
+	subcommands.Register(new(MoveStep), "")
+	subcommands.Register(new(InsertStep), "")
+	subcommands.Register(new(GCImages), "")
+	subcommands.Register(new(RollbackFamily), "")
+	subcommands.Register(new(CleanupDebug), "")
 	flag.Parse()
-	ctx := context.Background()
+	// Cloud Build sends SIGTERM when a build times out or is canceled. Canceling
+	// the context gives the running command a chance to clean up.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	files := fs.DefaultFiles(*persistentDir)
 	ret := int(subcommands.Execute(ctx, files, ServiceClients(clients)))
+	stop()
 	os.Exit(ret)
 }
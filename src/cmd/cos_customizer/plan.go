@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/preloader"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+
+	"github.com/google/subcommands"
+)
+
+// Plan implements subcommands.Command for the "plan" command.
+// This command previews the image build that "finish-image-build" would run,
+// without uploading files to GCS or creating any GCE resources. It accepts the
+// same flags as "finish-image-build".
+type Plan struct {
+	FinishImageBuild
+	out io.Writer
+}
+
+// Name implements subcommands.Command.Name.
+func (p *Plan) Name() string {
+	return "plan"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (p *Plan) Synopsis() string {
+	return "Preview the COS image build without creating any cloud resources."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (p *Plan) Usage() string {
+	return `plan [flags]
+`
+}
+
+// partitionLayout describes the boot disk partition layout that the
+// provisioner will produce.
+func partitionLayout(buildConfig *config.Build, provConfig *provisioner.Config, diskResize bool) []string {
+	// The default size of a COS image is assumed to be 10GB.
+	const imgSize = 10
+	diskSize := imgSize
+	if buildConfig.DiskSize > imgSize {
+		diskSize = buildConfig.DiskSize
+	}
+	var layout []string
+	if diskResize {
+		layout = append(layout, fmt.Sprintf("boot disk: created at %dGB, resized to %dGB during provisioning",
+			imgSize, diskSize))
+	} else {
+		layout = append(layout, fmt.Sprintf("boot disk: %dGB", diskSize))
+	}
+	if provConfig.BootDisk.ReclaimSDA3 {
+		layout = append(layout, "/dev/sda3: shrunk to 2MB, reclaiming 2046MB")
+	} else {
+		layout = append(layout, "/dev/sda3: unchanged")
+	}
+	switch {
+	case provConfig.BootDisk.OEMSize == "":
+		layout = append(layout, "/dev/sda8 (OEM): unchanged")
+	case hasSealOEM(provConfig):
+		layout = append(layout, fmt.Sprintf("/dev/sda8 (OEM): resized to %s and sealed; file system size %dK, "+
+			"remainder holds the dm-verity hash tree", provConfig.BootDisk.OEMSize, provConfig.BootDisk.OEMFSSize4K*4))
+	default:
+		layout = append(layout, fmt.Sprintf("/dev/sda8 (OEM): resized to %s", provConfig.BootDisk.OEMSize))
+	}
+	layout = append(layout, "/dev/sda1 (stateful): all remaining space")
+	return layout
+}
+
+func (p *Plan) print(plan *preloader.Plan, layout []string) error {
+	provConfig, err := json.MarshalIndent(plan.ProvConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	var uploads []string
+	for file, url := range plan.Uploads {
+		uploads = append(uploads, fmt.Sprintf("%s -> %s", file, url))
+	}
+	sort.Strings(uploads)
+	sections := []struct {
+		title string
+		body  string
+	}{
+		{"Daisy workflow", plan.Workflow},
+		{"Provisioner config", string(provConfig)},
+		{"Daisy args", strings.Join(plan.DaisyArgs, " ")},
+		{"GCS uploads", strings.Join(uploads, "\n")},
+		{"Partition layout", strings.Join(layout, "\n")},
+	}
+	for _, s := range sections {
+		if _, err := fmt.Fprintf(p.out, "==> %s\n%s\n\n", s.title, strings.TrimSpace(s.body)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute implements subcommands.Command.Execute. It computes the image build
+// from the saved image configurations and prints it.
+func (p *Plan) Execute(ctx context.Context, flags *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return subcommands.ExitUsageError
+	}
+	if p.out == nil {
+		p.out = os.Stdout
+	}
+	files := args[0].(*fs.Files)
+	if err := p.validate(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	sourceImage, buildConfig, outputImage, provConfig, err := p.loadConfigs(files)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := p.validateBackend(buildConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := validateOEM(buildConfig, provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	var sourceLabels map[string]string
+	if buildConfig.Backend != config.BackendLocal && (p.inheritLabels || p.usesSourceLabels() ||
+		p.inheritGuestOSFeatures) {
+		// Reading the source image doesn't create any resources.
+		svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer gcsClient.Close()
+		image, err := svc.Images.Get(sourceImage.Project, sourceImage.Name).Do()
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		sourceLabels = image.Labels
+		if p.inheritGuestOSFeatures {
+			addGuestOSFeatures(outputImage, sourceGuestOSFeatures(image))
+		}
+	}
+	if err := p.setOutputName(sourceImage, outputImage, sourceLabels); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if buildConfig.Backend != config.BackendLocal {
+		if err := p.resolveLabels(files, sourceImage, outputImage, provConfig, sourceLabels); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	plan, err := preloader.PlanImage(files, sourceImage, outputImage, buildConfig, provConfig)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := p.print(plan, partitionLayout(buildConfig, provConfig, plan.DiskResize)); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
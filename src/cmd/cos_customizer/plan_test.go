@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestPlan(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := config.SaveConfigToPath(files.ProvConfig, &provisioner.Config{
+		Steps:    []provisioner.StepConfig{{Type: "SealOEM"}},
+		BootDisk: provisioner.BootDiskConfig{ReclaimSDA3: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files.DaisyWorkflow, []byte(`{"labels": {{.Labels}}, "description": {{.Description}}}`),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	plan := &Plan{out: &out}
+	flagSet := &flag.FlagSet{}
+	plan.SetFlags(flagSet)
+	if err := flagSet.Parse([]string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p",
+		"-disk-size-gb=12", "-oem-size=1G"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := plan.Execute(context.Background(), flagSet, files, nil); got != subcommands.ExitSuccess {
+		t.Fatalf("Plan.Execute: got %v, want %v", got, subcommands.ExitSuccess)
+	}
+	for _, want := range []string{
+		"==> Daisy workflow",
+		"-var:cidata_img <cidata.tar.gz>",
+		`"cos-customizer-version":"dev"`,
+		"Derivative of projects/p/global/images/in. Built by cos-customizer: ",
+		`"WaitForDiskResize": true`,
+		"boot disk: created at 10GB, resized to 12GB during provisioning",
+		"/dev/sda3: shrunk to 2MB, reclaiming 2046MB",
+		"/dev/sda8 (OEM): resized to 2047M and sealed; file system size 1048576K",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Plan.Execute: output does not contain %q; output:\n%s", want, out.String())
+		}
+	}
+	// Planning must not clean up the build state, so that the real build can
+	// follow.
+	if _, err := os.Stat(files.ProvConfig); err != nil {
+		t.Errorf("Plan.Execute: provisioner config is gone: %v", err)
+	}
+}
+
+func TestPartitionLayout(t *testing.T) {
+	got := partitionLayout(&config.Build{}, &provisioner.Config{}, false)
+	want := []string{
+		"boot disk: 10GB",
+		"/dev/sda3: unchanged",
+		"/dev/sda8 (OEM): unchanged",
+		"/dev/sda1 (stateful): all remaining space",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("partitionLayout: diff (-got, +want): %s", diff)
+	}
+}
+
+func TestPlanLabels(t *testing.T) {
+	var testData = []struct {
+		testName string
+		flags    []string
+		want     subcommands.ExitStatus
+		wantOut  string
+	}{
+		{
+			testName: "InheritLabels",
+			flags:    []string{"-inherit-labels", "-labels=a=flag"},
+			want:     subcommands.ExitSuccess,
+			wantOut:  `"a":"flag","b":"source"`,
+		},
+		{
+			testName: "TooManyLabels",
+			flags:    []string{"-inherit-labels", "-labels=" + strings.Join(manyLabels(60), ",")},
+			want:     subcommands.ExitFailure,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupFinishBuildFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := ioutil.WriteFile(files.DaisyWorkflow, []byte(`{"labels": {{.Labels}}}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			gce, svc := fakes.GCEForTest(t, "p")
+			gce.Images = &compute.ImageList{Items: []*compute.Image{{Name: "in",
+				Labels: map[string]string{"a": "source", "b": "source"}}}}
+			clients := ServiceClients(func(context.Context, bool) (*compute.Service, *storage.Client, error) {
+				return svc, fakes.GCSForTest(t).Client, nil
+			})
+			var out bytes.Buffer
+			plan := &Plan{out: &out}
+			flagSet := &flag.FlagSet{}
+			plan.SetFlags(flagSet)
+			flags := append([]string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p"}, input.flags...)
+			if err := flagSet.Parse(flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := plan.Execute(context.Background(), flagSet, files, clients); got != input.want {
+				t.Fatalf("Plan.Execute(%v): got %v, want %v", flags, got, input.want)
+			}
+			if !strings.Contains(out.String(), input.wantOut) {
+				t.Errorf("Plan.Execute(%v): output does not contain %q; output:\n%s", flags, input.wantOut, out.String())
+			}
+		})
+	}
+}
+
+// manyLabels returns n distinct 'key=value' label flag items.
+func manyLabels(n int) []string {
+	var labels []string
+	for i := 0; i < n; i++ {
+		labels = append(labels, fmt.Sprintf("k%d=v", i))
+	}
+	return labels
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/gce"
+
+	"github.com/google/subcommands"
+)
+
+// RollbackFamily implements subcommands.Command for the "rollback-family"
+// command. This command restores a previous image as the head of an image
+// family. It doesn't use the state of an image build process, and can be run
+// at any time.
+type RollbackFamily struct {
+	project string
+	family  string
+	to      string
+	steps   int
+	state   string
+}
+
+// Name implements subcommands.Command.Name.
+func (*RollbackFamily) Name() string {
+	return "rollback-family"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*RollbackFamily) Synopsis() string {
+	return "Restore a previous image as the head of an image family."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*RollbackFamily) Usage() string {
+	return `rollback-family -project=<project> -family=<family> (-to=<image> | -steps=<steps>) [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (r *RollbackFamily) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.project, "project", "", "Project containing the image family.")
+	f.StringVar(&r.family, "family", "", "Image family to roll back.")
+	f.StringVar(&r.to, "to", "", "Name of the image in the family to restore as the head of the family. "+
+		"Exactly one of 'to' and 'steps' must be set.")
+	f.IntVar(&r.steps, "steps", 0, "Number of images to roll back from the current head of the family. "+
+		"Exactly one of 'to' and 'steps' must be set.")
+	f.StringVar(&r.state, "state", "DEPRECATED", "Deprecation state to mark the images that are newer than the "+
+		"restored image with. Must be DEPRECATED or OBSOLETE.")
+}
+
+func (r *RollbackFamily) validate() error {
+	switch {
+	case r.project == "":
+		return fmt.Errorf("'project' must be set")
+	case r.family == "":
+		return fmt.Errorf("'family' must be set")
+	case r.to != "" && r.steps != 0:
+		return fmt.Errorf("'to' and 'steps' cannot both be set")
+	case r.to == "" && r.steps <= 0:
+		return fmt.Errorf("one of 'to' or a positive 'steps' must be set")
+	case r.state != "DEPRECATED" && r.state != "OBSOLETE":
+		return fmt.Errorf("'state' must be DEPRECATED or OBSOLETE, not %q", r.state)
+	default:
+		return nil
+	}
+}
+
+// Execute implements subcommands.Command.Execute. It clears the deprecation
+// status of the target image, and deprecates the images that are newer than it.
+func (r *RollbackFamily) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if err := r.validate(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if gcsClient != nil {
+		defer gcsClient.Close()
+	}
+	target, err := gce.RollbackFamily(ctx, svc, r.project, r.family, r.to, r.steps, r.state)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	log.Printf("Image %s is now the head of image family %s", target, r.family)
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestRollbackFamilyCommand(t *testing.T) {
+	var testData = []struct {
+		testName       string
+		flags          []string
+		want           subcommands.ExitStatus
+		wantDeprecated map[string]string
+	}{
+		{
+			testName:       "Steps",
+			flags:          []string{"-project=p", "-family=f", "-steps=1"},
+			want:           subcommands.ExitSuccess,
+			wantDeprecated: map[string]string{"new": "DEPRECATED"},
+		},
+		{
+			testName:       "ToObsolete",
+			flags:          []string{"-project=p", "-family=f", "-to=old", "-state=OBSOLETE"},
+			want:           subcommands.ExitSuccess,
+			wantDeprecated: map[string]string{"new": "OBSOLETE"},
+		},
+		{
+			testName: "ToAndSteps",
+			flags:    []string{"-project=p", "-family=f", "-to=old", "-steps=1"},
+			want:     subcommands.ExitFailure,
+		},
+		{
+			testName: "NoTarget",
+			flags:    []string{"-project=p", "-family=f"},
+			want:     subcommands.ExitFailure,
+		},
+		{
+			testName: "InvalidState",
+			flags:    []string{"-project=p", "-family=f", "-steps=1", "-state=DELETED"},
+			want:     subcommands.ExitFailure,
+		},
+		{
+			testName: "NoFamily",
+			flags:    []string{"-project=p", "-steps=1"},
+			want:     subcommands.ExitFailure,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			gce, svc := fakes.GCEForTest(t, "p")
+			now := time.Now()
+			gce.Images = &compute.ImageList{Items: []*compute.Image{
+				{Name: "new", Family: "f", CreationTimestamp: now.Format(time.RFC3339)},
+				{Name: "old", Family: "f", CreationTimestamp: now.Add(-time.Hour).Format(time.RFC3339)},
+			}}
+			clients := ServiceClients(func(context.Context, bool) (*compute.Service, *storage.Client, error) {
+				return svc, nil, nil
+			})
+			rollback := &RollbackFamily{}
+			flagSet := &flag.FlagSet{}
+			rollback.SetFlags(flagSet)
+			if err := flagSet.Parse(input.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := rollback.Execute(context.Background(), flagSet, nil, clients); got != input.want {
+				t.Fatalf("RollbackFamily.Execute(%v): got %v, want %v", input.flags, got, input.want)
+			}
+			if len(gce.Deprecated) != len(input.wantDeprecated) {
+				t.Errorf("RollbackFamily.Execute(%v): got deprecated images %v, want %v", input.flags, gce.Deprecated,
+					input.wantDeprecated)
+			}
+			for name, state := range input.wantDeprecated {
+				status, ok := gce.Deprecated[name]
+				if !ok || status.State != state {
+					t.Errorf("RollbackFamily.Execute(%v): image %s: got status %v, want state %s", input.flags, name,
+						status, state)
+					continue
+				}
+				if want := "projects/p/global/images/old"; status.Replacement != want {
+					t.Errorf("RollbackFamily.Execute(%v): image %s: got replacement %q, want %q", input.flags, name,
+						status.Replacement, want)
+				}
+			}
+		})
+	}
+}
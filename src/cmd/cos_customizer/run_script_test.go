@@ -117,6 +117,7 @@ func TestRunScript(t *testing.T) {
 			testName: "NoEnv",
 			flags:    nil,
 			wantProvConfig: provisioner.Config{
+				SchemaVersion: provisioner.ConfigSchemaVersion,
 				Steps: []provisioner.StepConfig{
 					{
 						Type: "RunScript",
@@ -132,6 +133,7 @@ func TestRunScript(t *testing.T) {
 			testName: "Env",
 			flags:    []string{"-env=HELLO1=world1,HELLO2=world2"},
 			wantProvConfig: provisioner.Config{
+				SchemaVersion: provisioner.ConfigSchemaVersion,
 				Steps: []provisioner.StepConfig{
 					{
 						Type: "RunScript",
@@ -22,6 +22,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
@@ -40,13 +41,18 @@ type ServiceClients func(ctx context.Context, anonymousCreds bool) (*compute.Ser
 // StartImageBuild implements subcommands.Command for the 'start-image-build' command.
 // This command initializes a new image customization process.
 type StartImageBuild struct {
-	buildContext string
+	buildContext *repeatedVar
 	gcsBucket    string
 	gcsWorkdir   string
 	imageProject string
 	imageName    string
 	milestone    int
 	imageFamily  string
+	constraint   string
+	localImage   string
+
+	// imageConstraint is the parsed 'image-constraint', set by validate.
+	imageConstraint *gce.ImageConstraint
 }
 
 // Name implements subcommands.Command.Name.
@@ -67,28 +73,46 @@ func (*StartImageBuild) Usage() string {
 
 // SetFlags implements subcommands.Command.SetFlags.
 func (s *StartImageBuild) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&s.buildContext, "build-context", ".", "Path to the build context")
+	if s.buildContext == nil {
+		s.buildContext = &repeatedVar{}
+	}
+	f.Var(s.buildContext, "build-context", "Path to the build context. Defaults to '.'. Can be repeated to merge "+
+		"several build contexts, in which case files in later build contexts take precedence over files at the same "+
+		"path in earlier ones.")
 	f.StringVar(&s.gcsBucket, "gcs-bucket", "", "GCS bucket to use for scratch space")
 	f.StringVar(&s.gcsWorkdir, "gcs-workdir", "", "GCS directory to use for scratch space")
 	f.StringVar(&s.imageProject, "image-project", "", "Source image project")
-	f.StringVar(&s.imageName, "image-name", "", "Source image name. Mutually exclusive with 'image-milestone' and "+
-		"'image-family'.")
-	f.IntVar(&s.milestone, "image-milestone", 0, "Source image milestone. Mutually exclusive with 'image-name' "+
-		"and 'image-family'. Can only be used if 'image-project' is cos-cloud.")
-	f.StringVar(&s.imageFamily, "image-family", "", "Source image family. Mutually exclusive with 'image-name' "+
-		"and 'image-milestone'.")
+	f.StringVar(&s.imageName, "image-name", "", "Source image name. Mutually exclusive with 'image-milestone', "+
+		"'image-family' and 'image-constraint'.")
+	f.IntVar(&s.milestone, "image-milestone", 0, "Source image milestone. Mutually exclusive with 'image-name', "+
+		"'image-family' and 'image-constraint'. Can only be used if 'image-project' is cos-cloud.")
+	f.StringVar(&s.imageFamily, "image-family", "", "Source image family. Mutually exclusive with 'image-name', "+
+		"'image-milestone' and 'image-constraint'.")
+	f.StringVar(&s.constraint, "image-constraint", "", "Use the latest image in 'image-project' that satisfies "+
+		"this constraint as the source image. A comma-separated list of clauses on the channel, milestone and "+
+		"build number of the image. Example: 'channel=stable,milestone>=101,<105' or 'build~=17800.66'. "+
+		"Mutually exclusive with 'image-name', 'image-milestone' and 'image-family'.")
+	f.StringVar(&s.localImage, "local-source-image", "", "Path to a raw COS disk image, or to a .tar.gz archive "+
+		"containing a raw disk image named disk.raw, to use as the source image. Builds the image on the local "+
+		"machine using QEMU instead of on GCE. Mutually exclusive with 'image-name', 'image-milestone', "+
+		"'image-family' and 'image-constraint'.")
 }
 
 func (s *StartImageBuild) validate() error {
 	numSet := 0
-	for _, val := range []bool{s.imageName != "", s.milestone != 0, s.imageFamily != ""} {
+	for _, val := range []bool{s.imageName != "", s.milestone != 0, s.imageFamily != "", s.constraint != "",
+		s.localImage != ""} {
 		if val {
 			numSet++
 		}
 	}
 	switch {
 	case numSet != 1:
-		return fmt.Errorf("exactly one of image-name, image-milestone, image-family must be set")
+		return fmt.Errorf("exactly one of image-name, image-milestone, image-family, image-constraint, " +
+			"local-source-image must be set")
+	case s.localImage != "":
+		// The local backend doesn't use GCE or GCS.
+		return nil
 	case s.milestone != 0 && s.imageProject != "cos-cloud":
 		return fmt.Errorf("image-milestone can only be used if image-project is set to cos-cloud. "+
 			"image-milestone: %d image-project: %s", s.milestone, s.imageProject)
@@ -98,6 +122,10 @@ func (s *StartImageBuild) validate() error {
 		return fmt.Errorf("gcs-workdir must be set")
 	case s.imageProject == "":
 		return fmt.Errorf("image-project must be set")
+	case s.constraint != "":
+		var err error
+		s.imageConstraint, err = gce.ParseImageConstraint(s.constraint)
+		return err
 	default:
 		return nil
 	}
@@ -115,6 +143,16 @@ func (s *StartImageBuild) resolveImageName(ctx context.Context, svc *compute.Ser
 			return err
 		}
 		log.Printf("Using image %s from milestone %d\n", s.imageName, s.milestone)
+	case s.constraint != "":
+		var err error
+		s.imageName, err = gce.ResolveImageConstraint(ctx, svc, s.imageProject, s.imageConstraint)
+		if err != nil {
+			if err == gce.ErrImageNotFound {
+				return fmt.Errorf("no image in project %s satisfies constraint %q", s.imageProject, s.constraint)
+			}
+			return err
+		}
+		log.Printf("Using image %s for constraint %q\n", s.imageName, s.constraint)
 	case s.imageFamily != "":
 		image, err := svc.Images.GetFromFamily(s.imageProject, s.imageFamily).Do()
 		if err != nil {
@@ -147,8 +185,17 @@ func saveImage(imageName, imageProject, dst string) error {
 	return config.Save(outFile, image)
 }
 
-func saveBuildConfig(gcsBucket, gcsWorkdir, dst string) error {
-	buildConfig := &config.Build{GCSBucket: gcsBucket, GCSDir: gcsWorkdir}
+// localImageName gets a source image name from the file name of a local source
+// image.
+func localImageName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".tar.gz", ".tgz", ".raw", ".img"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+func saveBuildConfig(buildConfig *config.Build, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0774); err != nil {
 		return err
 	}
@@ -181,20 +228,40 @@ func (s *StartImageBuild) Execute(ctx context.Context, f *flag.FlagSet, args ...
 		return subcommands.ExitUsageError
 	}
 	files := args[0].(*fs.Files)
-	svc, _, err := args[1].(ServiceClients)(ctx, false)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
-	}
 	if err := s.validate(); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	if err := s.resolveImageName(ctx, svc); err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+	buildConfig := &config.Build{GCSBucket: s.gcsBucket, GCSDir: s.gcsWorkdir}
+	if s.localImage != "" {
+		localImage, err := filepath.Abs(s.localImage)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		if _, err := os.Stat(localImage); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		s.imageName = localImageName(localImage)
+		buildConfig.Backend = config.BackendLocal
+		buildConfig.LocalSourceImage = localImage
+	} else {
+		svc, _, err := args[1].(ServiceClients)(ctx, false)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		if err := s.resolveImageName(ctx, svc); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	buildContexts := s.buildContext.l
+	if len(buildContexts) == 0 {
+		buildContexts = []string{"."}
 	}
-	if err := fs.CreateBuildContextArchive(s.buildContext, files.UserBuildContextArchive); err != nil {
+	if err := fs.CreateMergedBuildContextArchive(buildContexts, files.UserBuildContextArchive); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
@@ -202,7 +269,7 @@ func (s *StartImageBuild) Execute(ctx context.Context, f *flag.FlagSet, args ...
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	if err := saveBuildConfig(s.gcsBucket, s.gcsWorkdir, files.BuildConfig); err != nil {
+	if err := saveBuildConfig(buildConfig, files.BuildConfig); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
@@ -105,6 +105,28 @@ func TestResolveMilestoneNoCosCloud(t *testing.T) {
 	}
 }
 
+func TestInvalidImageConstraint(t *testing.T) {
+	files, tmpDir, err := setupStartBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	gce, client := fakes.GCEForTest(t, "p")
+	defer gce.Close()
+	gce.Images.Items = []*compute.Image{{Name: "cos-stable-101-17162-40-13", Status: "READY"}}
+	for _, constraint := range []string{"milestone~=101", "milestone>=102"} {
+		if _, err := executeStartBuild(files, client, "-image-constraint="+constraint, "-image-project=p",
+			"-gcs-bucket=b", "-gcs-workdir=w"); err == nil {
+			t.Errorf("start-image-build should fail with image constraint %q", constraint)
+		}
+	}
+	// Syntax errors are caught before GCE is used.
+	s := &StartImageBuild{constraint: "milestone~=101", imageProject: "p", gcsBucket: "b", gcsWorkdir: "w"}
+	if err := s.validate(); err == nil {
+		t.Error("StartImageBuild.validate: got nil, want error for image constraint \"milestone~=101\"")
+	}
+}
+
 func TestSourceImage(t *testing.T) {
 	testData := []struct {
 		testName string
@@ -128,6 +150,16 @@ func TestSourceImage(t *testing.T) {
 			"-image-milestone=65",
 			"cos-stable-65-10032-10-0",
 		},
+		{
+			"Constraint",
+			[]*compute.Image{
+				{Name: "cos-stable-101-17162-40-13", Status: "READY"},
+				{Name: "cos-stable-105-17800-66-3", Status: "READY"},
+				{Name: "cos-beta-104-17500-0-0", Status: "READY"},
+				{Name: "cos-stable-104-17400-0-0", Status: "PENDING"}},
+			"-image-constraint=channel=stable,milestone>=101,<105",
+			"cos-stable-101-17162-40-13",
+		},
 		{
 			"ProvideImageName",
 			[]*compute.Image{
@@ -189,3 +221,36 @@ func TestProvisionerConfigCreated(t *testing.T) {
 		t.Errorf("cannot unmarshal provisioner config %q: got %v", string(data), err)
 	}
 }
+
+func TestLocalSourceImage(t *testing.T) {
+	files, tmpDir, err := setupStartBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	source := filepath.Join(tmpDir, "cos-dev-93-16623-0-0.tar.gz")
+	if err := ioutil.WriteFile(source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Local builds don't need service clients.
+	if _, err := executeStartBuild(files, nil, "-local-source-image="+source); err != nil {
+		t.Fatal(err)
+	}
+	sourceImage := &config.Image{}
+	if err := config.LoadFromFile(files.SourceImageConfig, sourceImage); err != nil {
+		t.Fatal(err)
+	}
+	if want := "cos-dev-93-16623-0-0"; sourceImage.Name != want {
+		t.Errorf("start-image-build: got source image name %q, want %q", sourceImage.Name, want)
+	}
+	buildConfig := &config.Build{}
+	if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+		t.Fatal(err)
+	}
+	if buildConfig.Backend != config.BackendLocal || buildConfig.LocalSourceImage != source {
+		t.Errorf("start-image-build: got build config %+v, want local backend with source image %q", buildConfig, source)
+	}
+	if _, err := executeStartBuild(files, nil, "-local-source-image="+source, "-image-name=n"); err == nil {
+		t.Errorf("start-image-build: got nil, want error for both 'local-source-image' and 'image-name'")
+	}
+}
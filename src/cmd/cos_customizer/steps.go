@@ -0,0 +1,345 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+
+	"github.com/google/subcommands"
+)
+
+var errMultipleGPUSteps = errors.New("install-gpu can only be invoked once in an image build process. " +
+	"Only one driver version can be installed on the image")
+
+// stepCommands returns the build steps that add a step to the provisioner
+// config.
+func stepCommands() []subcommands.Command {
+	return []subcommands.Command{&RunScript{}, &InstallGPU{}, &SealOEM{}, &DisableAutoUpdate{}, &InstallPackage{}}
+}
+
+// countSteps counts the number of steps of the given type.
+func countSteps(steps []provisioner.StepConfig, stepType string) int {
+	var n int
+	for _, s := range steps {
+		if s.Type == stepType {
+			n++
+		}
+	}
+	return n
+}
+
+// validateSteps runs the build step validations that depend on the full list
+// of configured steps.
+func validateSteps(steps []provisioner.StepConfig) error {
+	if countSteps(steps, "InstallGPU") > 1 {
+		return errMultipleGPUSteps
+	}
+	return nil
+}
+
+// loadSteps loads the saved provisioner config and checks that index is a
+// valid step index in it.
+func loadSteps(files *fs.Files, index int) (*provisioner.Config, error) {
+	provConfig := &provisioner.Config{}
+	if err := config.LoadFromFile(files.ProvConfig, provConfig); err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(provConfig.Steps) {
+		return nil, fmt.Errorf("step index %d is out of range; %d steps are configured", index, len(provConfig.Steps))
+	}
+	return provConfig, nil
+}
+
+// saveSteps validates the steps in the given provisioner config, updates the
+// config state derived from the steps, and saves the config.
+func saveSteps(files *fs.Files, provConfig *provisioner.Config) error {
+	if err := validateSteps(provConfig.Steps); err != nil {
+		return err
+	}
+	// Both seal-oem and disable-auto-update reclaim /dev/sda3, so it can only be
+	// kept if one of them is still configured.
+	provConfig.BootDisk.ReclaimSDA3 = countSteps(provConfig.Steps, "SealOEM") > 0 ||
+		countSteps(provConfig.Steps, "DisableAutoUpdate") > 0
+	if countSteps(provConfig.Steps, "InstallGPU") == 0 {
+		// The GPU type and GCS files in the build config are only set by
+		// install-gpu.
+		buildConfig := &config.Build{}
+		if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+			return err
+		}
+		buildConfig.GPUType = ""
+		buildConfig.GPUCount = 0
+		buildConfig.GCSFiles = nil
+		if err := config.SaveConfigToPath(files.BuildConfig, buildConfig); err != nil {
+			return err
+		}
+	}
+	return config.SaveConfigToPath(files.ProvConfig, provConfig)
+}
+
+// moveStep moves the step at index from so that it ends up at index to.
+func moveStep(steps []provisioner.StepConfig, from, to int) []provisioner.StepConfig {
+	step := steps[from]
+	steps = append(steps[:from], steps[from+1:]...)
+	steps = append(steps[:to], append([]provisioner.StepConfig{step}, steps[to:]...)...)
+	return steps
+}
+
+// ListSteps implements subcommands.Command for the "list-steps" command.
+// This command prints the steps configured in the current image build process.
+type ListSteps struct {
+	out io.Writer
+}
+
+// Name implements subcommands.Command.Name.
+func (*ListSteps) Name() string {
+	return "list-steps"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*ListSteps) Synopsis() string {
+	return "List the configured build steps."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*ListSteps) Usage() string {
+	return `list-steps
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (*ListSteps) SetFlags(f *flag.FlagSet) {}
+
+// Execute implements subcommands.Command.Execute. It prints each configured
+// step along with its index.
+func (l *ListSteps) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if l.out == nil {
+		l.out = os.Stdout
+	}
+	files := args[0].(*fs.Files)
+	var provConfig provisioner.Config
+	if err := config.LoadFromFile(files.ProvConfig, &provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	for i, s := range provConfig.Steps {
+		line := fmt.Sprintf("%d\t%s", i, s.Type)
+		if len(s.Args) != 0 && string(s.Args) != "null" {
+			line += "\t" + string(s.Args)
+		}
+		if _, err := fmt.Fprintln(l.out, line); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// RemoveStep implements subcommands.Command for the "remove-step" command.
+// This command removes a step from the current image build process.
+type RemoveStep struct {
+	index int
+}
+
+// Name implements subcommands.Command.Name.
+func (*RemoveStep) Name() string {
+	return "remove-step"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*RemoveStep) Synopsis() string {
+	return "Remove a configured build step."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*RemoveStep) Usage() string {
+	return `remove-step -index=<index>
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (r *RemoveStep) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&r.index, "index", -1, "Index of the step to remove, as printed by 'list-steps'.")
+}
+
+// Execute implements subcommands.Command.Execute. It removes the step at the
+// given index.
+func (r *RemoveStep) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	provConfig, err := loadSteps(files, r.index)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	provConfig.Steps = append(provConfig.Steps[:r.index], provConfig.Steps[r.index+1:]...)
+	if err := saveSteps(files, provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// MoveStep implements subcommands.Command for the "move-step" command.
+// This command changes the position of a step in the current image build
+// process.
+type MoveStep struct {
+	from int
+	to   int
+}
+
+// Name implements subcommands.Command.Name.
+func (*MoveStep) Name() string {
+	return "move-step"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*MoveStep) Synopsis() string {
+	return "Move a configured build step to a different position."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*MoveStep) Usage() string {
+	return `move-step -from=<index> -to=<index>
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (m *MoveStep) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&m.from, "from", -1, "Index of the step to move, as printed by 'list-steps'.")
+	f.IntVar(&m.to, "to", -1, "Index that the step should have after it is moved.")
+}
+
+// Execute implements subcommands.Command.Execute. It moves the step at index
+// 'from' to index 'to'.
+func (m *MoveStep) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	provConfig, err := loadSteps(files, m.from)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if _, err := loadSteps(files, m.to); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	provConfig.Steps = moveStep(provConfig.Steps, m.from, m.to)
+	if err := saveSteps(files, provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// InsertStep implements subcommands.Command for the "insert-step" command.
+// This command runs a build step, and inserts the step it configures before
+// an existing step instead of appending it.
+type InsertStep struct {
+	before int
+}
+
+// Name implements subcommands.Command.Name.
+func (*InsertStep) Name() string {
+	return "insert-step"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*InsertStep) Synopsis() string {
+	return "Insert a build step before a configured build step."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*InsertStep) Usage() string {
+	return `insert-step -before=<index> <step> [step flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (i *InsertStep) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&i.before, "before", -1, "Index of the step to insert the new step before, as printed by "+
+		"'list-steps'.")
+}
+
+// Execute implements subcommands.Command.Execute. It runs the given build step
+// with the given flags, and then moves the step it configured to the requested
+// position.
+func (i *InsertStep) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	var cmd subcommands.Command
+	for _, c := range stepCommands() {
+		if c.Name() == f.Arg(0) {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		log.Printf("%q is not a build step that can be inserted", f.Arg(0))
+		return subcommands.ExitUsageError
+	}
+	provConfig, err := loadSteps(files, i.before)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	numSteps := len(provConfig.Steps)
+	stepFlags := flag.NewFlagSet(cmd.Name(), flag.ContinueOnError)
+	cmd.SetFlags(stepFlags)
+	if err := stepFlags.Parse(f.Args()[1:]); err != nil {
+		log.Println(err)
+		return subcommands.ExitUsageError
+	}
+	if ret := cmd.Execute(ctx, stepFlags, args...); ret != subcommands.ExitSuccess {
+		return ret
+	}
+	provConfig = &provisioner.Config{}
+	if err := config.LoadFromFile(files.ProvConfig, provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if len(provConfig.Steps) != numSteps+1 {
+		log.Printf("%s did not configure a step", cmd.Name())
+		return subcommands.ExitFailure
+	}
+	provConfig.Steps = moveStep(provConfig.Steps, numSteps, i.before)
+	if err := saveSteps(files, provConfig); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func setupStepsFiles(t *testing.T, provConfig *provisioner.Config, buildConfig *config.Build) *fs.Files {
+	t.Helper()
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	if err := config.SaveConfigToPath(files.ProvConfig, provConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SaveConfigToPath(files.BuildConfig, buildConfig); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func executeStepsCommand(t *testing.T, files *fs.Files, cmd subcommands.Command, flags ...string) (subcommands.ExitStatus, error) {
+	t.Helper()
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	clients := ServiceClients(func(context.Context, bool) (*compute.Service, *storage.Client, error) {
+		return nil, gcs.Client, nil
+	})
+	flagSet := &flag.FlagSet{}
+	cmd.SetFlags(flagSet)
+	if err := flagSet.Parse(flags); err != nil {
+		return 0, err
+	}
+	return cmd.Execute(context.Background(), flagSet, files, clients), nil
+}
+
+func stepTypes(t *testing.T, files *fs.Files) []string {
+	t.Helper()
+	provConfig := &provisioner.Config{}
+	if err := config.LoadFromFile(files.ProvConfig, provConfig); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, s := range provConfig.Steps {
+		types = append(types, s.Type)
+	}
+	return types
+}
+
+func newStepsConfig(reclaimSDA3 bool, types ...string) *provisioner.Config {
+	provConfig := &provisioner.Config{BootDisk: provisioner.BootDiskConfig{ReclaimSDA3: reclaimSDA3}}
+	for _, t := range types {
+		provConfig.Steps = append(provConfig.Steps, provisioner.StepConfig{Type: t})
+	}
+	return provConfig
+}
+
+func TestListSteps(t *testing.T) {
+	provConfig := newStepsConfig(false, "SealOEM")
+	provConfig.Steps = append([]provisioner.StepConfig{{Type: "RunScript", Args: json.RawMessage(`{"Path":"s"}`)}},
+		provConfig.Steps...)
+	files := setupStepsFiles(t, provConfig, &config.Build{})
+	var out bytes.Buffer
+	if ret, err := executeStepsCommand(t, files, &ListSteps{out: &out}); err != nil || ret != subcommands.ExitSuccess {
+		t.Fatalf("ListSteps.Execute: got (%v, %v), want (%v, nil)", ret, err, subcommands.ExitSuccess)
+	}
+	if want := "0\tRunScript\t{\"Path\":\"s\"}\n1\tSealOEM\n"; out.String() != want {
+		t.Errorf("ListSteps.Execute: got output %q, want %q", out.String(), want)
+	}
+}
+
+func TestRemoveStep(t *testing.T) {
+	files := setupStepsFiles(t, newStepsConfig(true, "DisableAutoUpdate", "InstallGPU", "RunScript"),
+		&config.Build{GPUType: "nvidia-tesla-k80", GCSFiles: []string{"f"}})
+	if ret, err := executeStepsCommand(t, files, &RemoveStep{}, "-index=1"); err != nil || ret != subcommands.ExitSuccess {
+		t.Fatalf("RemoveStep.Execute(-index=1): got (%v, %v), want (%v, nil)", ret, err, subcommands.ExitSuccess)
+	}
+	if diff := cmp.Diff(stepTypes(t, files), []string{"DisableAutoUpdate", "RunScript"}); diff != "" {
+		t.Errorf("RemoveStep.Execute(-index=1): steps mismatch: diff (-got, +want): %s", diff)
+	}
+	buildConfig := &config.Build{}
+	if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+		t.Fatal(err)
+	}
+	if buildConfig.GPUType != "" || buildConfig.GCSFiles != nil {
+		t.Errorf("RemoveStep.Execute(-index=1): GPU build config not cleared: %+v", buildConfig)
+	}
+	if ret, err := executeStepsCommand(t, files, &RemoveStep{}, "-index=0"); err != nil || ret != subcommands.ExitSuccess {
+		t.Fatalf("RemoveStep.Execute(-index=0): got (%v, %v), want (%v, nil)", ret, err, subcommands.ExitSuccess)
+	}
+	provConfig := &provisioner.Config{}
+	if err := config.LoadFromFile(files.ProvConfig, provConfig); err != nil {
+		t.Fatal(err)
+	}
+	if provConfig.BootDisk.ReclaimSDA3 {
+		t.Errorf("RemoveStep.Execute(-index=0): ReclaimSDA3 is still set after removing disable-auto-update")
+	}
+	if ret, _ := executeStepsCommand(t, files, &RemoveStep{}, "-index=1"); ret != subcommands.ExitFailure {
+		t.Errorf("RemoveStep.Execute(-index=1): got %v, want %v", ret, subcommands.ExitFailure)
+	}
+}
+
+func TestMoveStep(t *testing.T) {
+	var testData = []struct {
+		testName string
+		flags    []string
+		want     []string
+		wantRet  subcommands.ExitStatus
+	}{
+		{
+			testName: "Forward",
+			flags:    []string{"-from=0", "-to=2"},
+			want:     []string{"B", "C", "A"},
+			wantRet:  subcommands.ExitSuccess,
+		},
+		{
+			testName: "Backward",
+			flags:    []string{"-from=2", "-to=0"},
+			want:     []string{"C", "A", "B"},
+			wantRet:  subcommands.ExitSuccess,
+		},
+		{
+			testName: "OutOfRange",
+			flags:    []string{"-from=0", "-to=3"},
+			want:     []string{"A", "B", "C"},
+			wantRet:  subcommands.ExitFailure,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			files := setupStepsFiles(t, newStepsConfig(false, "A", "B", "C"), &config.Build{})
+			if ret, err := executeStepsCommand(t, files, &MoveStep{}, input.flags...); err != nil || ret != input.wantRet {
+				t.Fatalf("MoveStep.Execute(%v): got (%v, %v), want (%v, nil)", input.flags, ret, err, input.wantRet)
+			}
+			if diff := cmp.Diff(stepTypes(t, files), input.want); diff != "" {
+				t.Errorf("MoveStep.Execute(%v): steps mismatch: diff (-got, +want): %s", input.flags, diff)
+			}
+		})
+	}
+}
+
+func TestInsertStep(t *testing.T) {
+	files := setupStepsFiles(t, newStepsConfig(false, "RunScript", "InstallGPU"), &config.Build{GPUType: "nvidia-tesla-k80"})
+	if ret, err := executeStepsCommand(t, files, &InsertStep{}, "-before=1", "seal-oem"); err != nil || ret != subcommands.ExitSuccess {
+		t.Fatalf("InsertStep.Execute(-before=1 seal-oem): got (%v, %v), want (%v, nil)", ret, err, subcommands.ExitSuccess)
+	}
+	if diff := cmp.Diff(stepTypes(t, files), []string{"RunScript", "SealOEM", "InstallGPU"}); diff != "" {
+		t.Errorf("InsertStep.Execute(-before=1 seal-oem): steps mismatch: diff (-got, +want): %s", diff)
+	}
+	provConfig := &provisioner.Config{}
+	if err := config.LoadFromFile(files.ProvConfig, provConfig); err != nil {
+		t.Fatal(err)
+	}
+	if !provConfig.BootDisk.ReclaimSDA3 {
+		t.Errorf("InsertStep.Execute(-before=1 seal-oem): ReclaimSDA3 is not set")
+	}
+	for _, flags := range [][]string{
+		{"-before=3", "seal-oem"},
+		{"-before=0", "finish-image-build"},
+		{"-before=0", "install-gpu", "-version=390.46", "-gpu-type=nvidia-tesla-k80"},
+	} {
+		if ret, _ := executeStepsCommand(t, files, &InsertStep{}, flags...); ret == subcommands.ExitSuccess {
+			t.Errorf("InsertStep.Execute(%v): got %v, want failure", flags, ret)
+		}
+	}
+	if diff := cmp.Diff(stepTypes(t, files), []string{"RunScript", "SealOEM", "InstallGPU"}); diff != "" {
+		t.Errorf("InsertStep.Execute: steps changed after failures: diff (-got, +want): %s", diff)
+	}
+}
@@ -13,7 +13,8 @@
 // limitations under the License.
 
 // metadata_watcher is a program that waits for 5 minutes for a specific GCE
-// instance metadata key to be present.
+// instance metadata key to be present. It exits immediately when it isn't
+// running on GCE.
 package main
 
 import (
@@ -29,6 +30,12 @@ func main() {
 		os.Exit(1)
 	}
 	key := os.Args[1]
+	if !metadata.OnGCE() {
+		// Builder VMs run by the local image builder don't have a metadata
+		// server, and nothing will ever set the key.
+		fmt.Println("Not running on GCE, not waiting for metadata")
+		os.Exit(0)
+	}
 	fmt.Printf("Waiting for metadata key %q...\n", key)
 	end := time.Now().Add(5 * time.Minute)
 	for time.Now().Before(end) {
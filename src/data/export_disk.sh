@@ -0,0 +1,80 @@
+#!/bin/bash
+#
+# Copyright 2021 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Exports the disk attached with device name "source" to GCS. This script is
+# the startup script of the export VM created by build_image.wf.json. The
+# export URI and format are read from the instance metadata, and the result is
+# reported on the serial console for Daisy to pick up.
+
+set -o errexit
+set -o pipefail
+set -o nounset
+
+readonly SOURCE_DISK=/dev/disk/by-id/google-source
+readonly BUFFER_DISK=/dev/disk/by-id/google-buffer
+readonly BUFFER_DIR=/mnt/buffer
+
+fail() {
+  echo "ExportFailed: $*"
+  exit 1
+}
+
+trap 'fail "unexpected error on line ${LINENO}"' ERR
+
+get_metadata() {
+  curl -sf -H "Metadata-Flavor: Google" \
+    "http://metadata.google.internal/computeMetadata/v1/instance/attributes/$1"
+}
+
+main() {
+  local -r uri="$(get_metadata export-uri)"
+  local -r format="$(get_metadata export-format)"
+  local -r name="$(basename "${uri}")"
+
+  echo "ExportStatus: preparing buffer disk"
+  mkfs.ext4 -q -F "${BUFFER_DISK}"
+  mkdir -p "${BUFFER_DIR}"
+  mount "${BUFFER_DISK}" "${BUFFER_DIR}"
+  cd "${BUFFER_DIR}"
+
+  echo "ExportStatus: converting disk to ${format}"
+  case "${format}" in
+    raw-tar-gz)
+      cp --sparse=always "${SOURCE_DISK}" disk.raw
+      tar --format=oldgnu -Sczf "${name}" disk.raw
+      rm disk.raw
+      ;;
+    vmdk)
+      qemu-img convert -O vmdk -o subformat=streamOptimized "${SOURCE_DISK}" "${name}"
+      ;;
+    qcow2)
+      qemu-img convert -c -O qcow2 "${SOURCE_DISK}" "${name}"
+      ;;
+    *)
+      fail "unknown export format ${format}"
+      ;;
+  esac
+
+  echo "ExportStatus: computing checksum"
+  sha256sum "${name}" > "${name}.sha256"
+
+  echo "ExportStatus: uploading to ${uri}"
+  gsutil -q cp "${name}" "${uri}"
+  gsutil -q cp "${name}.sha256" "${uri}.sha256"
+  echo "ExportSucceeded: exported disk to ${uri}"
+}
+
+main
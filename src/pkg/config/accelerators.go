@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// Accelerator describes a GPU type that can be attached to the builder VM.
+type Accelerator struct {
+	// Type is the name of the GCE accelerator type, like nvidia-tesla-t4.
+	Type string
+	// Counts lists the numbers of GPUs of this type that can be attached to an
+	// N1 VM. It is empty for GPUs that only come with accelerator-optimized
+	// machine types.
+	Counts []int
+	// MachineTypes maps the accelerator-optimized machine types that have GPUs
+	// of this type built in to the number of GPUs that they have.
+	MachineTypes map[string]int
+}
+
+// Accelerators is the catalog of the GPU types that the builder VM can use.
+var Accelerators = []*Accelerator{
+	{Type: "nvidia-tesla-k80", Counts: []int{1, 2, 4, 8}},
+	{Type: "nvidia-tesla-p4", Counts: []int{1, 2, 4}},
+	{Type: "nvidia-tesla-p100", Counts: []int{1, 2, 4}},
+	{Type: "nvidia-tesla-v100", Counts: []int{1, 2, 4, 8}},
+	{Type: "nvidia-tesla-t4", Counts: []int{1, 2, 4}},
+	{Type: "nvidia-tesla-a100", MachineTypes: map[string]int{
+		"a2-highgpu-1g":  1,
+		"a2-highgpu-2g":  2,
+		"a2-highgpu-4g":  4,
+		"a2-highgpu-8g":  8,
+		"a2-megagpu-16g": 16,
+	}},
+	{Type: "nvidia-a100-80gb", MachineTypes: map[string]int{
+		"a2-ultragpu-1g": 1,
+		"a2-ultragpu-2g": 2,
+		"a2-ultragpu-4g": 4,
+		"a2-ultragpu-8g": 8,
+	}},
+	{Type: "nvidia-l4", MachineTypes: map[string]int{
+		"g2-standard-4":  1,
+		"g2-standard-8":  1,
+		"g2-standard-12": 1,
+		"g2-standard-16": 1,
+		"g2-standard-32": 1,
+		"g2-standard-24": 2,
+		"g2-standard-48": 4,
+		"g2-standard-96": 8,
+	}},
+	{Type: "nvidia-h100-80gb", MachineTypes: map[string]int{
+		"a3-highgpu-1g": 1,
+		"a3-highgpu-2g": 2,
+		"a3-highgpu-4g": 4,
+		"a3-highgpu-8g": 8,
+	}},
+	{Type: "nvidia-h100-mega-80gb", MachineTypes: map[string]int{
+		"a3-megagpu-8g": 8,
+	}},
+}
+
+// AcceleratorTypes gets the names of the GPU types in the catalog.
+func AcceleratorTypes() []string {
+	var types []string
+	for _, a := range Accelerators {
+		types = append(types, a.Type)
+	}
+	return types
+}
+
+// FindAccelerator gets the catalog entry of the given GPU type, or nil if the
+// GPU type isn't in the catalog.
+func FindAccelerator(gpuType string) *Accelerator {
+	for _, a := range Accelerators {
+		if a.Type == gpuType {
+			return a
+		}
+	}
+	return nil
+}
+
+// BuiltIn checks if GPUs of this type only come with accelerator-optimized
+// machine types, rather than being attached to N1 VMs.
+func (a *Accelerator) BuiltIn() bool {
+	return len(a.MachineTypes) != 0
+}
+
+// ValidCount checks if a VM can have the given number of GPUs of this type.
+func (a *Accelerator) ValidCount(count int) bool {
+	for _, c := range a.Counts {
+		if c == count {
+			return true
+		}
+	}
+	for _, c := range a.MachineTypes {
+		if c == count {
+			return true
+		}
+	}
+	return false
+}
+
+// BuiltInGPUs checks if the given machine type has GPUs built in. GPUs can't be
+// attached to VMs of these machine types as guest accelerators.
+func BuiltInGPUs(machineType string) bool {
+	for _, a := range Accelerators {
+		if _, ok := a.MachineTypes[machineType]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -60,16 +60,147 @@ func (i *Image) MarshalJSON() ([]byte, error) {
 	return json.Marshal(computeIm)
 }
 
+// buildMigrations upgrades saved build configs to the latest schema version.
+// buildMigrations[i] upgrades a build config from version i to version i+1.
+//
+// A new version is only needed when a migration changes the data of older
+// build configs. Fields that are only added, and whose zero value keeps the
+// old behavior, don't need one, since older versions of cos-customizer ignore
+// unknown fields but reject newer schema versions.
+var buildMigrations = []utils.Migration{
+	// Version 1 introduced the SchemaVersion field.
+	nil,
+}
+
+const (
+	// BackendDaisy builds images on GCE using Daisy. It is the default backend.
+	BackendDaisy = "daisy"
+	// BackendLocal builds images on the local machine using QEMU.
+	BackendLocal = "local"
+)
+
+// Formats that the output image can be exported in.
+const (
+	// ExportRawTarGz is a gzipped tarball containing a raw disk image named
+	// disk.raw, in the format used for importing GCE images.
+	ExportRawTarGz = "raw-tar-gz"
+	// ExportVMDK is a stream optimized VMDK disk image.
+	ExportVMDK = "vmdk"
+	// ExportQCOW2 is a compressed qcow2 disk image.
+	ExportQCOW2 = "qcow2"
+)
+
+// ExportFormats lists the supported export formats.
+var ExportFormats = []string{ExportRawTarGz, ExportVMDK, ExportQCOW2}
+
+// BuildSchemaVersion is the schema version of build configs written by this
+// package.
+var BuildSchemaVersion = len(buildMigrations)
+
 // Build stores configuration data associated with the image build session.
+// Fields that are only set from the flags of finish-image-build are never
+// saved, so they don't affect the build configs that other versions of
+// cos-customizer read.
 type Build struct {
-	GCSBucket string
-	GCSDir    string
-	Project   string
-	Zone      string
-	DiskSize  int
-	GPUType   string
-	Timeout   string
-	GCSFiles  []string
+	// SchemaVersion is the schema version of the build config. It is set when
+	// the build config is saved, and build configs are upgraded to the latest
+	// version when they are loaded.
+	SchemaVersion int
+	GCSBucket     string
+	GCSDir        string
+	Project       string
+	Zone          string
+	DiskSize      int
+	GPUType       string
+	Timeout       string
+	GCSFiles      []string
+	// GPUCount is the number of GPUs of type GPUType attached to the builder
+	// VM. Zero means one GPU, as in build configs from before GPUCount was
+	// introduced.
+	GPUCount int
+	// Backend is the image builder backend to use. An empty value means
+	// BackendDaisy.
+	Backend string
+	// LocalSourceImage is the path to the source disk image used by the local
+	// backend. It is either a raw disk image, or a .tar.gz archive containing a
+	// raw disk image named disk.raw.
+	LocalSourceImage string
+	// LocalOutputDir is the directory that the local backend writes the output
+	// image to.
+	LocalOutputDir string `json:"-"`
+	// ExportURI is the GCS object that the output image is exported to. The
+	// output image isn't exported if it is empty.
+	ExportURI string `json:"-"`
+	// ExportFormat is the format that the output image is exported in. It is one
+	// of ExportFormats.
+	ExportFormat string `json:"-"`
+	// MachineType is the machine type of the builder VM. An empty value means
+	// the Daisy default.
+	MachineType string `json:"-"`
+	// Network and Subnet are the network and subnetwork of the builder VM, as
+	// names or partial URLs. The default network is used if both are empty.
+	Network string `json:"-"`
+	Subnet  string `json:"-"`
+	// NoExternalIP indicates that the builder VM must not have an external IP
+	// address.
+	NoExternalIP bool `json:"-"`
+	// ServiceAccount is the email of the service account of the builder VM. An
+	// empty value means the default compute service account.
+	ServiceAccount string `json:"-"`
+	// Scopes are the OAuth scopes of the builder VM. An empty value means the
+	// default scopes.
+	Scopes []string `json:"-"`
+	// NetworkTags are the network tags of the builder VM.
+	NetworkTags []string `json:"-"`
+	// BootDiskType is the disk type of the boot disk of the builder VM. An
+	// empty value means pd-standard.
+	BootDiskType string `json:"-"`
+	// ShieldedVM indicates that the builder VM runs as a Shielded VM with
+	// secure boot, vTPM and integrity monitoring enabled.
+	ShieldedVM bool `json:"-"`
+	// ConfidentialVM indicates that the builder VM runs as a Confidential VM.
+	ConfidentialVM bool `json:"-"`
+	// ArtifactCacheTTL is how long artifacts uploaded to GCS for the build are
+	// kept in the artifact cache after they were last used, as a duration
+	// string like "168h". An empty value means that the artifact cache isn't
+	// used, and artifacts are deleted after the build.
+	ArtifactCacheTTL string `json:"-"`
+	// CompositeUploadThreshold is the size in bytes from which artifacts are
+	// uploaded to GCS as parallel composite uploads. Zero disables parallel
+	// composite uploads.
+	CompositeUploadThreshold int64 `json:"-"`
+	// DebugInstance is the name of the builder VM when failed builds are
+	// debugged. If set, the builder VM and its disks are named after it, and
+	// they are kept along with the build inputs in GCS if provisioning fails.
+	// An empty value means that the workflow resources are always cleaned up.
+	DebugInstance string `json:"-"`
+}
+
+// GPUs gets the number of GPUs attached to the builder VM.
+func (b *Build) GPUs() int {
+	switch {
+	case b.GPUType == "":
+		return 0
+	case b.GPUCount == 0:
+		return 1
+	default:
+		return b.GPUCount
+	}
+}
+
+// MarshalJSON marshals the build config into JSON, stamped with the latest
+// schema version.
+func (b Build) MarshalJSON() ([]byte, error) {
+	type build Build
+	b.SchemaVersion = BuildSchemaVersion
+	return json.Marshal(build(b))
+}
+
+// UnmarshalJSON unmarshals a build config from JSON, upgrading it to the
+// latest schema version if necessary.
+func (b *Build) UnmarshalJSON(data []byte) error {
+	type build Build
+	return utils.UnmarshalVersioned(data, "build config", buildMigrations, (*build)(b))
 }
 
 // SaveConfigToFile clears the target config file and then saves the new config
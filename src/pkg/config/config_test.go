@@ -16,6 +16,7 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -74,3 +75,81 @@ func TestImageMarshalJSON(t *testing.T) {
 		t.Errorf("actual: %v expected: %v", got, image)
 	}
 }
+
+func TestBuildSchemaVersion(t *testing.T) {
+	data, err := json.Marshal(&Build{GCSBucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf(`"SchemaVersion":%d`, BuildSchemaVersion); !strings.Contains(string(data), want) {
+		t.Errorf("json.Marshal(Build) = %s; want it to contain %s", string(data), want)
+	}
+	got := &Build{}
+	if err := Load(strings.NewReader(`{"GCSBucket":"b"}`), got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Build{SchemaVersion: BuildSchemaVersion, GCSBucket: "b"}); !cmp.Equal(got, want) {
+		t.Errorf("Load(unversioned build config) = %+v; want %+v", got, want)
+	}
+	future := fmt.Sprintf(`{"SchemaVersion":%d}`, BuildSchemaVersion+1)
+	if err := Load(strings.NewReader(future), &Build{}); err == nil {
+		t.Errorf("Load(%s) = nil; want error", future)
+	}
+}
+
+func TestBuildFinishFlagsNotSaved(t *testing.T) {
+	data, err := json.Marshal(&Build{GCSBucket: "b", ExportURI: "gs://b/out", MachineType: "e2-standard-4",
+		ArtifactCacheTTL: "1h", DebugInstance: "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"ExportURI", "MachineType", "ArtifactCacheTTL", "DebugInstance"} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("json.Marshal(Build) = %s; want it to not contain %s", string(data), field)
+		}
+	}
+	// Build configs with fields that a version doesn't know about are still
+	// loaded, so that mixed versions of cos-customizer can be used in a build.
+	got := &Build{}
+	if err := Load(strings.NewReader(`{"SchemaVersion":1,"GCSBucket":"b","NewField":true}`), got); err != nil {
+		t.Errorf("Load(build config with an unknown field) = %v; want nil", err)
+	}
+}
+
+func TestAccelerators(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, a := range Accelerators {
+		if seen[a.Type] {
+			t.Errorf("Accelerators: GPU type %s is listed twice", a.Type)
+		}
+		seen[a.Type] = true
+		if (len(a.Counts) == 0) == (len(a.MachineTypes) == 0) {
+			t.Errorf("Accelerators: GPU type %s must have exactly one of Counts and MachineTypes", a.Type)
+		}
+	}
+	var testData = []struct {
+		gpuType string
+		count   int
+		want    bool
+	}{
+		{"nvidia-tesla-t4", 4, true},
+		{"nvidia-tesla-t4", 8, false},
+		{"nvidia-tesla-a100", 16, true},
+		{"nvidia-l4", 2, true},
+		{"nvidia-l4", 3, false},
+	}
+	for _, input := range testData {
+		if got := FindAccelerator(input.gpuType).ValidCount(input.count); got != input.want {
+			t.Errorf("ValidCount(%s, %d) = %v; want %v", input.gpuType, input.count, got, input.want)
+		}
+	}
+	if FindAccelerator("nvidia-tesla-x1") != nil {
+		t.Error("FindAccelerator(nvidia-tesla-x1) = non-nil; want nil")
+	}
+	if !FindAccelerator("nvidia-h100-80gb").BuiltIn() || FindAccelerator("nvidia-tesla-v100").BuiltIn() {
+		t.Error("BuiltIn: want true only for GPUs of accelerator-optimized machine types")
+	}
+	if !BuiltInGPUs("g2-standard-8") || BuiltInGPUs("n1-standard-8") {
+		t.Error("BuiltInGPUs: want true only for accelerator-optimized machine types")
+	}
+}
@@ -22,7 +22,9 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
 	compute "google.golang.org/api/compute/v1"
@@ -46,35 +48,182 @@ func writeError(w http.ResponseWriter, r *http.Request, code int) {
 // The GCE struct represents the state of the fake GCE instance. Fields on this struct can be modified to influence the
 // return values of GCE API calls.
 //
-// GCE should not be considered concurrency-safe. Do not use this struct in a concurrent way.
+// Requests to the fake GCE server are served one at a time, so the server can be used by concurrent clients. The
+// struct fields should not be modified while requests are in flight.
+//
+// A fake GCE server can serve more than one project; see AddProject.
 type GCE struct {
 	// Images represents the images present in the project.
 	Images *compute.ImageList
-	// Deprecated represents the set of deprecated images in the project.
+	// Deprecated represents the set of deprecated images in the project. It holds the last deprecation status set
+	// for each image; the deprecation status of the image in Images is updated as well.
 	Deprecated map[string]*compute.DeprecationStatus
-	// Operations is the sequence of operations that the fake GCE server should return.
+	// Operations is the sequence of operations that the fake GCE server should return. Once it is exhausted, DONE
+	// operations are returned.
 	Operations []*compute.Operation
+	// OperationRequests records the operations that were polled, as paths relative to the project; for example,
+	// "global/operations/op-1" or "zones/us-west1-b/operations/op-1". Global, regional and zonal operation requests
+	// all take their response from Operations.
+	OperationRequests []string
+	// IAMPolicies holds the IAM policies of the images in the project, keyed by image name. Images without an entry
+	// have an empty policy. Each successful setIamPolicy call assigns a new etag to the stored policy.
+	IAMPolicies map[string]*compute.Policy
+	// IAMConflicts is the number of upcoming setIamPolicy calls that should fail with an etag conflict, as if the
+	// policy had been concurrently modified by someone else.
+	IAMConflicts int
+	// Disks represents the disks present in the project, in all zones. The zone of a disk is the last path element
+	// of its Zone field.
+	Disks []*compute.Disk
+	// Instances represents the instances present in the project, in all zones. The zone of an instance is the last
+	// path element of its Zone field.
+	Instances []*compute.Instance
+	// AcceleratorTypes represents the accelerator types offered to the project, in all zones. The zone of an
+	// accelerator type is the last path element of its Zone field.
+	AcceleratorTypes []*compute.AcceleratorType
+	// SerialPortOutput holds the serial port output of each instance, keyed by instance name. Tests can set it to
+	// simulate output; getSerialPortOutput requests return it from the requested offset.
+	SerialPortOutput map[string]string
+	// Failures is the sequence of failures that the fake GCE server should inject. Each request is checked against
+	// the failures in order, and fails with the first matching failure.
+	Failures []*Failure
 	// server is an HTTP server that serves fake GCE requests. Requests are served using the state stored in
 	// the other struct fields.
 	server  *httptest.Server
 	project string
+	// projects holds the state of each project served by the fake GCE server, keyed by project name. It is shared
+	// by all of the projects of a server.
+	projects map[string]*GCE
+	// mu serializes requests to the fake GCE server. It is shared by all of the projects of a server.
+	mu *sync.Mutex
+	// iamVersion is used to generate IAM policy etags.
+	iamVersion int
+	// metadataVersion is used to generate instance metadata fingerprints.
+	metadataVersion int
+}
+
+func newGCEProject(project string) *GCE {
+	return &GCE{
+		Images:           &compute.ImageList{},
+		Deprecated:       make(map[string]*compute.DeprecationStatus),
+		IAMPolicies:      make(map[string]*compute.Policy),
+		SerialPortOutput: make(map[string]string),
+		project:          project,
+	}
+}
+
+// Failure describes requests that a fake server should fail.
+type Failure struct {
+	// Method is the HTTP method of the requests to fail. An empty method matches requests with any method.
+	Method string
+	// Path is a regular expression that must match the whole request path. For the fake GCE server, the path is
+	// relative to the project; for example, "zones/[^/]+/instances" or "global/images/im-1". For the fake GCS server,
+	// it's the full URL path; for example, "/upload/storage/v1/b/bucket/o" or "/bucket/object".
+	Path string
+	// Code is the HTTP status code to fail the requests with.
+	Code int
+	// Count is the number of matching requests to fail. Once it reaches zero, the failure is removed. A negative
+	// count fails every matching request.
+	Count int
+}
+
+// matches checks if the failure applies to a request with the given method and project-relative path.
+func (f *Failure) matches(method, path string) bool {
+	if f.Method != "" && f.Method != method {
+		return false
+	}
+	matched, err := regexp.MatchString("^(?:"+f.Path+")$", path)
+	if err != nil {
+		log.Printf("invalid failure path %q: %v", f.Path, err)
+		return false
+	}
+	return matched
+}
+
+// injectFailure finds the first of the given failures that applies to a request, and consumes it. It returns the
+// remaining failures, and the HTTP status code to fail the request with, or 0 if the request shouldn't fail.
+func injectFailure(failures []*Failure, method, path string) ([]*Failure, int) {
+	for i, f := range failures {
+		if !f.matches(method, path) {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				failures = append(failures[:i], failures[i+1:]...)
+			}
+		}
+		return failures, f.Code
+	}
+	return failures, 0
 }
 
 // NewGCEServer constructs a fake GCE implementation for a given GCE project.
 func NewGCEServer(project string) *GCE {
-	gce := &GCE{
-		Images:     &compute.ImageList{},
-		Deprecated: make(map[string]*compute.DeprecationStatus),
-		project:    project,
-	}
-	mux := http.NewServeMux()
-	mux.HandleFunc(fmt.Sprintf("/projects/%s/global/images", project), gce.imagesListHandler)
-	mux.HandleFunc(fmt.Sprintf("/projects/%s/global/images/", project), gce.imageHandler)
-	mux.HandleFunc(fmt.Sprintf("/projects/%s/global/operations/", project), gce.operationsHandler)
-	gce.server = httptest.NewServer(mux)
+	gce := newGCEProject(project)
+	gce.projects = map[string]*GCE{project: gce}
+	gce.mu = &sync.Mutex{}
+	gce.server = httptest.NewServer(http.HandlerFunc(gce.projectHandler))
+	return gce
+}
+
+// AddProject adds another project to the fake GCE server, and returns the fake GCE state of the new project. The
+// returned GCE shares its server with g, so clients of either of them can access both projects.
+func (g *GCE) AddProject(project string) *GCE {
+	gce := newGCEProject(project)
+	gce.projects = g.projects
+	gce.mu = g.mu
+	gce.server = g.server
+	g.projects[project] = gce
 	return gce
 }
 
+// projectHandler routes requests to the state of the project they refer to.
+func (g *GCE) projectHandler(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Path starts with /projects/<project>/global/, /projects/<project>/regions/<region>/ or
+	// /projects/<project>/zones/<zone>/
+	splitPath := strings.Split(r.URL.Path, "/")
+	if len(splitPath) < 5 || splitPath[1] != "projects" {
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	project, ok := g.projects[splitPath[2]]
+	if !ok {
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	var code int
+	project.Failures, code = injectFailure(project.Failures, r.Method, strings.Join(splitPath[3:], "/"))
+	if code != 0 {
+		writeError(w, r, code)
+		return
+	}
+	switch {
+	case len(splitPath) == 7 && (splitPath[3] == "regions" || splitPath[3] == "zones") && splitPath[5] == "operations":
+		project.operationsHandler(w, r)
+	case len(splitPath) >= 6 && splitPath[3] == "zones" && splitPath[5] == "disks":
+		project.disksHandler(w, r, splitPath[4], splitPath[6:])
+	case len(splitPath) >= 6 && splitPath[3] == "zones" && splitPath[5] == "instances":
+		project.instancesHandler(w, r, splitPath[4], splitPath[6:])
+	case len(splitPath) >= 6 && splitPath[3] == "zones" && splitPath[5] == "acceleratorTypes":
+		project.acceleratorTypesHandler(w, r, splitPath[4], splitPath[6:])
+	case splitPath[3] != "global":
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+	case len(splitPath) == 5 && splitPath[4] == "images":
+		project.imagesListHandler(w, r)
+	case len(splitPath) > 5 && splitPath[4] == "images":
+		project.imageHandler(w, r)
+	case len(splitPath) > 5 && splitPath[4] == "operations":
+		project.operationsHandler(w, r)
+	default:
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+	}
+}
+
 // Client gets a GCE client to use for accessing the fake GCE server.
 func (g *GCE) Client() (*compute.Service, error) {
 	client, err := compute.New(g.server.Client())
@@ -86,13 +235,25 @@ func (g *GCE) Client() (*compute.Service, error) {
 }
 
 func (g *GCE) operation() *compute.Operation {
+	if len(g.Operations) == 0 {
+		return &compute.Operation{Status: "DONE"}
+	}
 	op := g.Operations[0]
 	g.Operations = g.Operations[1:]
 	return op
 }
 
+// deprecate records the deprecation status of an image, and updates the status returned for the image. An empty or
+// ACTIVE state clears the deprecation status of the image.
 func (g *GCE) deprecate(name string, status *compute.DeprecationStatus) *compute.Operation {
 	g.Deprecated[name] = status
+	if image := g.image(name); image != nil {
+		if status.State == "" || status.State == "ACTIVE" {
+			image.Deprecated = nil
+		} else {
+			image.Deprecated = status
+		}
+	}
 	return g.operation()
 }
 
@@ -105,7 +266,61 @@ func (g *GCE) image(name string) *compute.Image {
 	return nil
 }
 
+// deleteImage deletes the image with the given name, along with its deprecation status and IAM policy. It reports
+// whether the image existed.
+func (g *GCE) deleteImage(name string) bool {
+	for i, image := range g.Images.Items {
+		if image.Name == name {
+			g.Images.Items = append(g.Images.Items[:i], g.Images.Items[i+1:]...)
+			delete(g.Deprecated, name)
+			delete(g.IAMPolicies, name)
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GCE) iamPolicy(name string) *compute.Policy {
+	if policy, ok := g.IAMPolicies[name]; ok {
+		return policy
+	}
+	return &compute.Policy{Etag: "initial"}
+}
+
+// setIAMPolicy stores the given policy if its etag matches the etag of the current policy.
+func (g *GCE) setIAMPolicy(name string, policy *compute.Policy) (*compute.Policy, int) {
+	current := g.iamPolicy(name)
+	if g.IAMConflicts > 0 {
+		g.IAMConflicts--
+		g.iamVersion++
+		current.Etag = fmt.Sprintf("etag-%d", g.iamVersion)
+		g.IAMPolicies[name] = current
+		return nil, http.StatusConflict
+	}
+	if policy.Etag != "" && policy.Etag != current.Etag {
+		return nil, http.StatusConflict
+	}
+	g.iamVersion++
+	policy.Etag = fmt.Sprintf("etag-%d", g.iamVersion)
+	g.IAMPolicies[name] = policy
+	return policy, http.StatusOK
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to marshal response: %v", v)
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	w.Write(bytes)
+}
+
 func (g *GCE) imagesListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		g.imageInsertHandler(w, r)
+		return
+	}
 	bytes, err := json.Marshal(g.Images)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError)
@@ -114,11 +329,46 @@ func (g *GCE) imagesListHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// imageInsertHandler creates the image in the request body. If the image is created from a source disk, the disk
+// must exist; source images aren't checked. The new image is READY immediately.
+func (g *GCE) imageInsertHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("failed to read body")
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	image := &compute.Image{}
+	if err := json.Unmarshal(body, image); err != nil || image.Name == "" {
+		log.Printf("failed to parse body: %s", string(body))
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+	if g.image(image.Name) != nil {
+		writeError(w, r, http.StatusConflict)
+		return
+	}
+	if image.SourceDisk != "" && g.diskByURL(image.SourceDisk) == nil {
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+	image.Status = "READY"
+	image.SelfLink = fmt.Sprintf("%s/projects/%s/global/images/%s", g.server.URL, g.project, image.Name)
+	g.Images.Items = append(g.Images.Items, image)
+	writeJSON(w, r, g.operation())
+}
+
 func (g *GCE) imageHandler(w http.ResponseWriter, r *http.Request) {
 	// Path starts with /project/<project>/global/images/<name>
 	splitPath := strings.Split(r.URL.Path, "/")
 	splitPath = splitPath[1:]
 	switch {
+	case len(splitPath) == 5 && r.Method == http.MethodDelete:
+		if !g.deleteImage(splitPath[4]) {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, g.operation())
 	case len(splitPath) == 5:
 		image := g.image(splitPath[4])
 		if image == nil {
@@ -157,6 +407,35 @@ func (g *GCE) imageHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.Write(bytes)
+	case len(splitPath) == 6 && splitPath[5] == "getIamPolicy":
+		if g.image(splitPath[4]) == nil {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, g.iamPolicy(splitPath[4]))
+	case len(splitPath) == 6 && splitPath[5] == "setIamPolicy":
+		if g.image(splitPath[4]) == nil {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("failed to read body")
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		req := &compute.GlobalSetPolicyRequest{}
+		if err := json.Unmarshal(body, req); err != nil || req.Policy == nil {
+			log.Printf("failed to parse body: %s", string(body))
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		policy, code := g.setIAMPolicy(splitPath[4], req.Policy)
+		if code != http.StatusOK {
+			writeError(w, r, code)
+			return
+		}
+		writeJSON(w, r, policy)
 	default:
 		log.Printf("unrecognized path: %s", r.URL.Path)
 		writeError(w, r, http.StatusNotFound)
@@ -164,6 +443,9 @@ func (g *GCE) imageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g *GCE) operationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Path starts with /projects/<project>/
+	splitPath := strings.SplitN(r.URL.Path, "/", 4)
+	g.OperationRequests = append(g.OperationRequests, splitPath[3])
 	bytes, err := json.Marshal(g.operation())
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError)
@@ -160,6 +160,13 @@ func TestDeprecate(t *testing.T) {
 			} else if !cmp.Equal(actualStatus, input.status) {
 				t.Errorf("actual: %v expected: %v", actualStatus, input.status)
 			}
+			wantImageStatus := input.status
+			if wantImageStatus.State == "" {
+				wantImageStatus = nil
+			}
+			if got := input.images[0].Deprecated; !cmp.Equal(got, wantImageStatus) {
+				t.Errorf("image deprecation status: actual: %v expected: %v", got, wantImageStatus)
+			}
 		})
 	}
 }
@@ -197,3 +204,107 @@ func TestGetOperation(t *testing.T) {
 		})
 	}
 }
+
+func TestScopedOperations(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Operations = []*compute.Operation{{Name: "op-1"}, {Name: "op-2"}, {Name: "op-3"}}
+	if _, err := client.GlobalOperations.Get("test-project", "op-1").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RegionOperations.Get("test-project", "us-west1", "op-2").Do(); err != nil {
+		t.Fatal(err)
+	}
+	op, err := client.ZoneOperations.Get("test-project", "us-west1-b", "op-3").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Name != "op-3" {
+		t.Errorf("ZoneOperations.Get: got operation %q, want op-3", op.Name)
+	}
+	want := []string{"global/operations/op-1", "regions/us-west1/operations/op-2", "zones/us-west1-b/operations/op-3"}
+	if diff := cmp.Diff(fakeGCE.OperationRequests, want); diff != "" {
+		t.Errorf("operation requests mismatch: diff (-got, +want): %s", diff)
+	}
+	if _, err := client.ZoneOperations.Get("other-project", "us-west1-b", "op-4").Do(); err == nil {
+		t.Error("ZoneOperations.Get(other-project): got nil, want error")
+	}
+}
+
+func TestIAMPolicy(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{Name: "im-1"}}
+	if _, err := client.Images.GetIamPolicy("test-project", "im-2").Do(); err == nil {
+		t.Errorf("GetIamPolicy(im-2): got nil, want error for missing image")
+	}
+	policy, err := client.Images.GetIamPolicy("test-project", "im-1").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.Bindings = []*compute.Binding{{Role: "roles/compute.imageUser", Members: []string{"group:g@example.com"}}}
+	got, err := client.Images.SetIamPolicy("test-project", "im-1", &compute.GlobalSetPolicyRequest{Policy: policy}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Etag == policy.Etag {
+		t.Errorf("SetIamPolicy: etag %q was not updated", got.Etag)
+	}
+	if len(fakeGCE.IAMPolicies["im-1"].Bindings) != 1 {
+		t.Errorf("SetIamPolicy: got stored policy %+v, want one binding", fakeGCE.IAMPolicies["im-1"])
+	}
+	// The old etag is stale now.
+	_, err = client.Images.SetIamPolicy("test-project", "im-1", &compute.GlobalSetPolicyRequest{Policy: policy}).Do()
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusConflict {
+		t.Errorf("SetIamPolicy(stale etag): got %v, want HTTP %d", err, http.StatusConflict)
+	}
+	fakeGCE.IAMConflicts = 1
+	_, err = client.Images.SetIamPolicy("test-project", "im-1", &compute.GlobalSetPolicyRequest{Policy: got}).Do()
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusConflict {
+		t.Errorf("SetIamPolicy(injected conflict): got %v, want HTTP %d", err, http.StatusConflict)
+	}
+}
+
+func TestImageInsert(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	other := fakeGCE.AddProject("other-project")
+	if _, err := client.Images.Insert("other-project", &compute.Image{Name: "im-1", Family: "f"}).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeGCE.Images.Items) != 0 {
+		t.Errorf("Insert(other-project): image was inserted into test-project: %v", fakeGCE.Images.Items)
+	}
+	if len(other.Images.Items) != 1 || other.Images.Items[0].Family != "f" {
+		t.Errorf("Insert(other-project): got images %v, want image im-1 in family f", other.Images.Items)
+	}
+	_, err := client.Images.Insert("other-project", &compute.Image{Name: "im-1"}).Do()
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusConflict {
+		t.Errorf("Insert(duplicate): got %v, want HTTP %d", err, http.StatusConflict)
+	}
+	_, err = client.Images.Insert("missing-project", &compute.Image{Name: "im-1"}).Do()
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusNotFound {
+		t.Errorf("Insert(missing-project): got %v, want HTTP %d", err, http.StatusNotFound)
+	}
+}
+
+func TestImageDelete(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{Name: "im-1"}, {Name: "im-2"}}
+	fakeGCE.Operations = []*compute.Operation{{Name: "op-1"}}
+	op, err := client.Images.Delete("test-project", "im-1").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Name != "op-1" {
+		t.Errorf("Delete(im-1): got operation %q, want op-1", op.Name)
+	}
+	if len(fakeGCE.Images.Items) != 1 || fakeGCE.Images.Items[0].Name != "im-2" {
+		t.Errorf("Delete(im-1): got images %v, want [im-2]", fakeGCE.Images.Items)
+	}
+	_, err = client.Images.Delete("test-project", "im-1").Do()
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusNotFound {
+		t.Errorf("Delete(im-1) twice: got %v, want HTTP %d", err, http.StatusNotFound)
+	}
+}
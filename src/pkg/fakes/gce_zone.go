@@ -0,0 +1,346 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func (g *GCE) zoneURL(zone string) string {
+	return fmt.Sprintf("%s/projects/%s/zones/%s", g.server.URL, g.project, zone)
+}
+
+// zonalOperation gets the next operation, scoped to the given zone.
+func (g *GCE) zonalOperation(zone string) *compute.Operation {
+	op := g.operation()
+	if op.Zone == "" {
+		op.Zone = g.zoneURL(zone)
+	}
+	return op
+}
+
+// readJSON parses the body of a request into v. It writes an error response and returns false if the body can't be
+// parsed.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("failed to read body")
+		writeError(w, r, http.StatusInternalServerError)
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		log.Printf("failed to parse body: %s", string(body))
+		writeError(w, r, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (g *GCE) disk(zone, name string) *compute.Disk {
+	for _, disk := range g.Disks {
+		if disk.Name == name && path.Base(disk.Zone) == zone {
+			return disk
+		}
+	}
+	return nil
+}
+
+// diskByURL finds a disk by a full or partial URL that ends with zones/<zone>/disks/<name>.
+func (g *GCE) diskByURL(url string) *compute.Disk {
+	return g.disk(path.Base(path.Dir(path.Dir(url))), path.Base(url))
+}
+
+func (g *GCE) deleteDisk(disk *compute.Disk) {
+	for i, d := range g.Disks {
+		if d == disk {
+			g.Disks = append(g.Disks[:i], g.Disks[i+1:]...)
+			return
+		}
+	}
+}
+
+// insertDisk creates the given disk in the given zone. It reports whether the disk was created; a disk can't be
+// created if a disk with the same name already exists in the zone.
+func (g *GCE) insertDisk(zone string, disk *compute.Disk) bool {
+	if g.disk(zone, disk.Name) != nil {
+		return false
+	}
+	disk.Zone = g.zoneURL(zone)
+	disk.SelfLink = fmt.Sprintf("%s/disks/%s", disk.Zone, disk.Name)
+	disk.Status = "READY"
+	if disk.SizeGb == 0 {
+		disk.SizeGb = 10
+	}
+	g.Disks = append(g.Disks, disk)
+	return true
+}
+
+// disksHandler serves requests for the disks in a zone. rest holds the path elements after
+// /projects/<project>/zones/<zone>/disks.
+func (g *GCE) disksHandler(w http.ResponseWriter, r *http.Request, zone string, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		disk := &compute.Disk{}
+		if !readJSON(w, r, disk) {
+			return
+		}
+		if disk.Name == "" {
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		if !g.insertDisk(zone, disk) {
+			writeError(w, r, http.StatusConflict)
+			return
+		}
+		writeJSON(w, r, g.zonalOperation(zone))
+	case len(rest) == 0:
+		list := &compute.DiskList{}
+		for _, disk := range g.Disks {
+			if path.Base(disk.Zone) == zone {
+				list.Items = append(list.Items, disk)
+			}
+		}
+		writeJSON(w, r, list)
+	case g.disk(zone, rest[0]) == nil:
+		writeError(w, r, http.StatusNotFound)
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		disk := g.disk(zone, rest[0])
+		if len(disk.Users) != 0 {
+			// The disk is in use by an instance.
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		g.deleteDisk(disk)
+		writeJSON(w, r, g.zonalOperation(zone))
+	case len(rest) == 1:
+		writeJSON(w, r, g.disk(zone, rest[0]))
+	case len(rest) == 2 && rest[1] == "resize" && r.Method == http.MethodPost:
+		req := &compute.DisksResizeRequest{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		disk := g.disk(zone, rest[0])
+		if req.SizeGb <= disk.SizeGb {
+			// Disks can only grow.
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		disk.SizeGb = req.SizeGb
+		writeJSON(w, r, g.zonalOperation(zone))
+	default:
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+	}
+}
+
+func (g *GCE) instance(zone, name string) *compute.Instance {
+	for _, instance := range g.Instances {
+		if instance.Name == name && path.Base(instance.Zone) == zone {
+			return instance
+		}
+	}
+	return nil
+}
+
+// insertInstance creates the given instance in the given zone, along with the disks that it initializes. It returns
+// the HTTP status code of the request.
+func (g *GCE) insertInstance(zone string, instance *compute.Instance) int {
+	if instance.Name == "" {
+		return http.StatusBadRequest
+	}
+	if g.instance(zone, instance.Name) != nil {
+		return http.StatusConflict
+	}
+	instance.Zone = g.zoneURL(zone)
+	instance.SelfLink = fmt.Sprintf("%s/instances/%s", instance.Zone, instance.Name)
+	// Check all of the disks before creating any of them, so that a failed insert has no effect.
+	for _, attached := range instance.Disks {
+		switch {
+		case attached.Source != "" && g.diskByURL(attached.Source) == nil:
+			return http.StatusBadRequest
+		case attached.Source == "" && attached.InitializeParams == nil:
+			return http.StatusBadRequest
+		}
+	}
+	for _, attached := range instance.Disks {
+		if attached.Source == "" {
+			params := attached.InitializeParams
+			name := params.DiskName
+			if name == "" {
+				name = instance.Name
+			}
+			disk := &compute.Disk{Name: name, SizeGb: params.DiskSizeGb, SourceImage: params.SourceImage}
+			if !g.insertDisk(zone, disk) {
+				return http.StatusConflict
+			}
+			attached.Source = disk.SelfLink
+		}
+		disk := g.diskByURL(attached.Source)
+		disk.Users = append(disk.Users, instance.SelfLink)
+	}
+	if instance.Metadata == nil {
+		instance.Metadata = &compute.Metadata{}
+	}
+	g.metadataVersion++
+	instance.Metadata.Fingerprint = fmt.Sprintf("fingerprint-%d", g.metadataVersion)
+	instance.Status = "RUNNING"
+	g.Instances = append(g.Instances, instance)
+	return http.StatusOK
+}
+
+// deleteInstance deletes the given instance. Attached disks are deleted if they are set to auto-delete, and
+// detached otherwise.
+func (g *GCE) deleteInstance(instance *compute.Instance) {
+	for i, inst := range g.Instances {
+		if inst == instance {
+			g.Instances = append(g.Instances[:i], g.Instances[i+1:]...)
+			break
+		}
+	}
+	for _, attached := range instance.Disks {
+		disk := g.diskByURL(attached.Source)
+		if disk == nil {
+			continue
+		}
+		if attached.AutoDelete {
+			g.deleteDisk(disk)
+			continue
+		}
+		for i, user := range disk.Users {
+			if user == instance.SelfLink {
+				disk.Users = append(disk.Users[:i], disk.Users[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(g.SerialPortOutput, instance.Name)
+}
+
+// serialPortOutput gets the serial port output of an instance from the given byte offset, like the
+// getSerialPortOutput API.
+func (g *GCE) serialPortOutput(instance *compute.Instance, start int64) *compute.SerialPortOutput {
+	contents := g.SerialPortOutput[instance.Name]
+	if start < 0 || start > int64(len(contents)) {
+		start = int64(len(contents))
+	}
+	return &compute.SerialPortOutput{
+		Contents: contents[start:],
+		Start:    start,
+		Next:     int64(len(contents)),
+		SelfLink: instance.SelfLink + "/serialPort",
+	}
+}
+
+// instancesHandler serves requests for the instances in a zone. rest holds the path elements after
+// /projects/<project>/zones/<zone>/instances.
+func (g *GCE) instancesHandler(w http.ResponseWriter, r *http.Request, zone string, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		instance := &compute.Instance{}
+		if !readJSON(w, r, instance) {
+			return
+		}
+		if code := g.insertInstance(zone, instance); code != http.StatusOK {
+			writeError(w, r, code)
+			return
+		}
+		writeJSON(w, r, g.zonalOperation(zone))
+	case len(rest) == 0:
+		list := &compute.InstanceList{}
+		for _, instance := range g.Instances {
+			if path.Base(instance.Zone) == zone {
+				list.Items = append(list.Items, instance)
+			}
+		}
+		writeJSON(w, r, list)
+	case g.instance(zone, rest[0]) == nil:
+		writeError(w, r, http.StatusNotFound)
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		g.deleteInstance(g.instance(zone, rest[0]))
+		writeJSON(w, r, g.zonalOperation(zone))
+	case len(rest) == 1:
+		writeJSON(w, r, g.instance(zone, rest[0]))
+	case len(rest) == 2 && rest[1] == "serialPort":
+		var start int64
+		if s := r.URL.Query().Get("start"); s != "" {
+			var err error
+			if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+				writeError(w, r, http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, r, g.serialPortOutput(g.instance(zone, rest[0]), start))
+	case len(rest) == 2 && rest[1] == "setMetadata" && r.Method == http.MethodPost:
+		metadata := &compute.Metadata{}
+		if !readJSON(w, r, metadata) {
+			return
+		}
+		instance := g.instance(zone, rest[0])
+		if metadata.Fingerprint != instance.Metadata.Fingerprint {
+			// The metadata was modified since the client read it.
+			writeError(w, r, http.StatusPreconditionFailed)
+			return
+		}
+		g.metadataVersion++
+		metadata.Fingerprint = fmt.Sprintf("fingerprint-%d", g.metadataVersion)
+		instance.Metadata = metadata
+		writeJSON(w, r, g.zonalOperation(zone))
+	case len(rest) == 2 && rest[1] == "stop" && r.Method == http.MethodPost:
+		g.instance(zone, rest[0]).Status = "TERMINATED"
+		writeJSON(w, r, g.zonalOperation(zone))
+	case len(rest) == 2 && rest[1] == "start" && r.Method == http.MethodPost:
+		g.instance(zone, rest[0]).Status = "RUNNING"
+		writeJSON(w, r, g.zonalOperation(zone))
+	default:
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+	}
+}
+
+func (g *GCE) acceleratorType(zone, name string) *compute.AcceleratorType {
+	for _, acceleratorType := range g.AcceleratorTypes {
+		if acceleratorType.Name == name && path.Base(acceleratorType.Zone) == zone {
+			return acceleratorType
+		}
+	}
+	return nil
+}
+
+func (g *GCE) acceleratorTypesHandler(w http.ResponseWriter, r *http.Request, zone string, rest []string) {
+	switch {
+	case r.Method != http.MethodGet:
+		writeError(w, r, http.StatusMethodNotAllowed)
+	case len(rest) == 0:
+		list := &compute.AcceleratorTypeList{}
+		for _, acceleratorType := range g.AcceleratorTypes {
+			if path.Base(acceleratorType.Zone) == zone {
+				list.Items = append(list.Items, acceleratorType)
+			}
+		}
+		writeJSON(w, r, list)
+	case len(rest) == 1 && g.acceleratorType(zone, rest[0]) != nil:
+		writeJSON(w, r, g.acceleratorType(zone, rest[0]))
+	default:
+		writeError(w, r, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakes
+
+import (
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func httpCode(err error) int {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code
+	}
+	return 0
+}
+
+func TestDisks(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	op, err := client.Disks.Insert("test-project", "z", &compute.Disk{Name: "d-1", SizeGb: 20}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(op.Zone) != "z" {
+		t.Errorf("Disks.Insert: got operation zone %q, want z", op.Zone)
+	}
+	if _, err := client.Disks.Insert("test-project", "z", &compute.Disk{Name: "d-1"}).Do(); httpCode(err) != http.StatusConflict {
+		t.Errorf("Disks.Insert(duplicate): got %v, want HTTP %d", err, http.StatusConflict)
+	}
+	if _, err := client.Disks.Insert("test-project", "z2", &compute.Disk{Name: "d-1"}).Do(); err != nil {
+		t.Errorf("Disks.Insert(other zone): %v", err)
+	}
+	list, err := client.Disks.List("test-project", "z").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].SizeGb != 20 || list.Items[0].Status != "READY" {
+		t.Errorf("Disks.List: got %v, want a single READY 20GB disk", list.Items)
+	}
+	if _, err := client.Disks.Resize("test-project", "z", "d-1", &compute.DisksResizeRequest{SizeGb: 10}).Do(); httpCode(err) != http.StatusBadRequest {
+		t.Errorf("Disks.Resize(shrink): got %v, want HTTP %d", err, http.StatusBadRequest)
+	}
+	if _, err := client.Disks.Resize("test-project", "z", "d-1", &compute.DisksResizeRequest{SizeGb: 30}).Do(); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := client.Disks.Get("test-project", "z", "d-1").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.SizeGb != 30 {
+		t.Errorf("Disks.Resize: got size %d, want 30", disk.SizeGb)
+	}
+	if _, err := client.Disks.Delete("test-project", "z", "d-1").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Disks.Get("test-project", "z", "d-1").Do(); httpCode(err) != http.StatusNotFound {
+		t.Errorf("Disks.Get(deleted): got %v, want HTTP %d", err, http.StatusNotFound)
+	}
+	if len(fakeGCE.Disks) != 1 || path.Base(fakeGCE.Disks[0].Zone) != "z2" {
+		t.Errorf("Disks.Delete: got disks %v, want only the disk in z2", fakeGCE.Disks)
+	}
+}
+
+func TestAcceleratorTypes(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.AcceleratorTypes = []*compute.AcceleratorType{
+		{Name: "nvidia-tesla-t4", Zone: "zones/z", MaximumCardsPerInstance: 4},
+		{Name: "nvidia-l4", Zone: "zones/z2", MaximumCardsPerInstance: 8},
+	}
+	got, err := client.AcceleratorTypes.Get("test-project", "z", "nvidia-tesla-t4").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MaximumCardsPerInstance != 4 {
+		t.Errorf("AcceleratorTypes.Get: got %d maximum cards, want 4", got.MaximumCardsPerInstance)
+	}
+	if _, err := client.AcceleratorTypes.Get("test-project", "z", "nvidia-l4").Do(); httpCode(err) != http.StatusNotFound {
+		t.Errorf("AcceleratorTypes.Get(other zone): got %v, want HTTP %d", err, http.StatusNotFound)
+	}
+	list, err := client.AcceleratorTypes.List("test-project", "z2").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "nvidia-l4" {
+		t.Errorf("AcceleratorTypes.List: got %v, want only nvidia-l4", list.Items)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	if _, err := client.Disks.Insert("test-project", "z", &compute.Disk{Name: "data"}).Do(); err != nil {
+		t.Fatal(err)
+	}
+	instance := &compute.Instance{
+		Name: "vm",
+		Disks: []*compute.AttachedDisk{
+			{Boot: true, AutoDelete: true, InitializeParams: &compute.AttachedDiskInitializeParams{SourceImage: "global/images/im"}},
+			{Source: "zones/z/disks/data"},
+		},
+	}
+	if _, err := client.Instances.Insert("test-project", "z", instance).Do(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Instances.Get("test-project", "z", "vm").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "RUNNING" {
+		t.Errorf("Instances.Get: got status %q, want RUNNING", got.Status)
+	}
+	boot, err := client.Disks.Get("test-project", "z", "vm").Do()
+	if err != nil {
+		t.Fatalf("Instances.Insert: boot disk wasn't created: %v", err)
+	}
+	if boot.SourceImage != "global/images/im" || len(boot.Users) != 1 {
+		t.Errorf("Instances.Insert: got boot disk %+v, want disk from global/images/im used by vm", boot)
+	}
+	if _, err := client.Disks.Delete("test-project", "z", "data").Do(); httpCode(err) != http.StatusBadRequest {
+		t.Errorf("Disks.Delete(in use): got %v, want HTTP %d", err, http.StatusBadRequest)
+	}
+	if _, err := client.Instances.Stop("test-project", "z", "vm").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if fakeGCE.Instances[0].Status != "TERMINATED" {
+		t.Errorf("Instances.Stop: got status %q, want TERMINATED", fakeGCE.Instances[0].Status)
+	}
+	if _, err := client.Instances.Delete("test-project", "z", "vm").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeGCE.Instances) != 0 {
+		t.Errorf("Instances.Delete: got instances %v, want none", fakeGCE.Instances)
+	}
+	// The boot disk is auto-deleted, and the data disk is detached.
+	if len(fakeGCE.Disks) != 1 || fakeGCE.Disks[0].Name != "data" || len(fakeGCE.Disks[0].Users) != 0 {
+		t.Errorf("Instances.Delete: got disks %v, want the detached data disk", fakeGCE.Disks)
+	}
+	missing := &compute.Instance{Name: "vm-2", Disks: []*compute.AttachedDisk{{Source: "zones/z/disks/missing"}}}
+	if _, err := client.Instances.Insert("test-project", "z", missing).Do(); httpCode(err) != http.StatusBadRequest {
+		t.Errorf("Instances.Insert(missing disk): got %v, want HTTP %d", err, http.StatusBadRequest)
+	}
+}
+
+func TestSerialPortOutput(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Instances = []*compute.Instance{{Name: "vm", Zone: "z"}}
+	fakeGCE.SerialPortOutput["vm"] = "hello world"
+	got, err := client.Instances.GetSerialPortOutput("test-project", "z", "vm").Start(6).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Contents != "world" || got.Start != 6 || got.Next != 11 {
+		t.Errorf("GetSerialPortOutput(start=6): got (%q, %d, %d), want (%q, 6, 11)", got.Contents, got.Start, got.Next, "world")
+	}
+	if _, err := client.Instances.GetSerialPortOutput("test-project", "z", "vm-2").Do(); httpCode(err) != http.StatusNotFound {
+		t.Errorf("GetSerialPortOutput(vm-2): got %v, want HTTP %d", err, http.StatusNotFound)
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	boot := &compute.AttachedDisk{InitializeParams: &compute.AttachedDiskInitializeParams{}}
+	if _, err := client.Instances.Insert("test-project", "z", &compute.Instance{Name: "vm", Disks: []*compute.AttachedDisk{boot}}).Do(); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := client.Instances.Get("test-project", "z", "vm").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "v"
+	metadata := &compute.Metadata{Fingerprint: instance.Metadata.Fingerprint, Items: []*compute.MetadataItems{{Key: "k", Value: &value}}}
+	if _, err := client.Instances.SetMetadata("test-project", "z", "vm", metadata).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(fakeGCE.Instances[0].Metadata.Items, metadata.Items); diff != "" {
+		t.Errorf("SetMetadata: diff (-got, +want): %s", diff)
+	}
+	// The fingerprint changed, so the stale fingerprint is rejected.
+	if _, err := client.Instances.SetMetadata("test-project", "z", "vm", metadata).Do(); httpCode(err) != http.StatusPreconditionFailed {
+		t.Errorf("SetMetadata(stale fingerprint): got %v, want HTTP %d", err, http.StatusPreconditionFailed)
+	}
+}
+
+func TestImageInsertFromDisk(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Disks = []*compute.Disk{{Name: "d", Zone: "z"}}
+	if _, err := client.Images.Insert("test-project", &compute.Image{Name: "im-1", SourceDisk: "zones/z/disks/d"}).Do(); err != nil {
+		t.Errorf("Images.Insert(existing disk): %v", err)
+	}
+	_, err := client.Images.Insert("test-project", &compute.Image{Name: "im-2", SourceDisk: "zones/z/disks/missing"}).Do()
+	if httpCode(err) != http.StatusBadRequest {
+		t.Errorf("Images.Insert(missing disk): got %v, want HTTP %d", err, http.StatusBadRequest)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	fakeGCE, client := GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{Name: "im-1"}}
+	fakeGCE.Failures = []*Failure{
+		{Method: http.MethodPost, Path: "zones/[^/]+/disks", Code: http.StatusForbidden, Count: 1},
+		{Path: "global/images/im-1", Code: http.StatusServiceUnavailable, Count: -1},
+	}
+	if _, err := client.Disks.Insert("test-project", "z", &compute.Disk{Name: "d"}).Do(); httpCode(err) != http.StatusForbidden {
+		t.Errorf("Disks.Insert: got %v, want HTTP %d", err, http.StatusForbidden)
+	}
+	if _, err := client.Disks.Insert("test-project", "z", &compute.Disk{Name: "d"}).Do(); err != nil {
+		t.Errorf("Disks.Insert: got %v after the failure was consumed, want nil", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Images.Get("test-project", "im-1").Do(); httpCode(err) != http.StatusServiceUnavailable {
+			t.Errorf("Images.Get(im-1): got %v, want HTTP %d", err, http.StatusServiceUnavailable)
+		}
+	}
+	if _, err := client.Images.List("test-project").Do(); err != nil {
+		t.Errorf("Images.List: got %v, want nil for a request that doesn't match", err)
+	}
+	if len(fakeGCE.Failures) != 1 {
+		t.Errorf("Failures: got %d failures left, want 1", len(fakeGCE.Failures))
+	}
+}
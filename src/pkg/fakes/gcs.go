@@ -16,9 +16,13 @@ package fakes
 
 import (
 	"context"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
@@ -27,15 +31,47 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/option"
 )
 
-type gcsObject struct{ Name, Bucket string }
-type gcsObjects struct{ Items []gcsObject }
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// gcsObject is the JSON representation of an object in the GCS JSON API.
+type gcsObject struct {
+	Name           string            `json:"name"`
+	Bucket         string            `json:"bucket"`
+	Generation     int64             `json:"generation,string,omitempty"`
+	Metageneration int64             `json:"metageneration,string,omitempty"`
+	Size           int64             `json:"size,string"`
+	ContentType    string            `json:"contentType,omitempty"`
+	MD5Hash        string            `json:"md5Hash,omitempty"`
+	CRC32C         string            `json:"crc32c,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+type gcsObjects struct{ Items []*gcsObject }
+
+// GCSObjectAttrs holds the attributes of an object in the fake GCS server. Hashes aren't stored; they are computed
+// from the object data.
+type GCSObjectAttrs struct {
+	Generation     int64
+	Metageneration int64
+	ContentType    string
+	Metadata       map[string]string
+}
+
+// resumableUpload is an upload session started with uploadType=resumable.
+type resumableUpload struct {
+	object *gcsObject
+	query  url.Values
+	data   []byte
+}
 
 func setTransportAddr(transport *http.Transport, addr string) {
 	transport.DialTLS = func(_, _ string) (net.Conn, error) {
@@ -53,27 +89,61 @@ func setTransportAddr(transport *http.Transport, addr string) {
 // are implemented here. Documentation for the GCS JSON API is here:
 // https://cloud.google.com/storage/docs/json_api/v1/
 //
-// This struct should not be considered concurrency safe.
+// Requests to the fake GCS server are served one at a time, so the server can be used by concurrent clients. The
+// struct fields should not be modified while requests are in flight.
 type GCS struct {
 	// Objects represents the collection of objects that exist in the fake GCS server.
 	// Keys are strings of the form "/<bucket>/<object path>". Values are data that belong
 	// in each object.
 	Objects map[string][]byte
+	// Attrs holds the attributes of the objects in Objects, with the same keys. Objects without attributes are
+	// treated as generation 1, metageneration 1 objects without a content type or metadata. Writes through the API
+	// assign a new generation to the object.
+	Attrs map[string]*GCSObjectAttrs
+	// Failures is the sequence of failures that the fake GCS server should inject. Each request is checked against
+	// the failures in order, and fails with the first matching failure.
+	Failures []*Failure
+	// PartialReads is the number of upcoming object reads that should send only the first half of the requested
+	// data, and then close the connection.
+	PartialReads int
 	// Client is the client to use when accessing the fake GCS server.
 	Client *storage.Client
 	// Server is the fake GCS server. It uses state from this struct for serving requests.
 	Server *httptest.Server
+	// mu serializes requests to the fake GCS server.
+	mu sync.Mutex
+	// generation is the last generation assigned to an object.
+	generation int64
+	// uploads holds the resumable uploads in progress, keyed by upload ID.
+	uploads map[string]*resumableUpload
+	// uploadID is used to generate upload IDs.
+	uploadID int
 }
 
 // NewGCSServer constructs a fake GCS implementation.
 func NewGCSServer(ctx context.Context) (*GCS, error) {
 	var err error
-	gcs := &GCS{make(map[string][]byte), nil, nil}
+	gcs := &GCS{
+		Objects:    make(map[string][]byte),
+		Attrs:      make(map[string]*GCSObjectAttrs),
+		generation: 1,
+		uploads:    make(map[string]*resumableUpload),
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", gcs.objectHandler)
 	mux.HandleFunc("/storage/v1/b/", gcs.bucketHandler)
 	mux.HandleFunc("/upload/storage/v1/b/", gcs.uploadHandler)
-	gcs.Server = httptest.NewTLSServer(mux)
+	gcs.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gcs.mu.Lock()
+		defer gcs.mu.Unlock()
+		var code int
+		gcs.Failures, code = injectFailure(gcs.Failures, r.Method, r.URL.Path)
+		if code != 0 {
+			writeError(w, r, code)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
 	httpClient := gcs.Server.Client()
 	setTransportAddr(httpClient.Transport.(*http.Transport), gcs.Server.Listener.Addr().String())
 	gcs.Client, err = storage.NewClient(ctx, option.WithHTTPClient(httpClient), option.WithoutAuthentication())
@@ -84,13 +154,176 @@ func NewGCSServer(ctx context.Context) (*GCS, error) {
 	return gcs, nil
 }
 
+// attrs gets the attributes of the object with the given key, creating the default attributes if the object has
+// none.
+func (g *GCS) attrs(key string) *GCSObjectAttrs {
+	attrs, ok := g.Attrs[key]
+	if !ok {
+		attrs = &GCSObjectAttrs{Generation: 1, Metageneration: 1}
+		if g.Attrs == nil {
+			g.Attrs = make(map[string]*GCSObjectAttrs)
+		}
+		g.Attrs[key] = attrs
+	}
+	return attrs
+}
+
+func crc32cHash(data []byte) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(data, crc32cTable))
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func md5Hash(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// object gets the JSON API representation of an existing object.
+func (g *GCS) object(bucket, name string) *gcsObject {
+	key := fmt.Sprintf("/%s/%s", bucket, name)
+	data := g.Objects[key]
+	attrs := g.attrs(key)
+	return &gcsObject{
+		Name:           name,
+		Bucket:         bucket,
+		Generation:     attrs.Generation,
+		Metageneration: attrs.Metageneration,
+		Size:           int64(len(data)),
+		ContentType:    attrs.ContentType,
+		MD5Hash:        md5Hash(data),
+		CRC32C:         crc32cHash(data),
+		Metadata:       attrs.Metadata,
+	}
+}
+
+// checkPreconditions checks the generation and precondition query parameters of a request against the object with
+// the given key. It returns the HTTP status code to fail the request with, or 0 if the request can go ahead. A
+// generation match of 0 requires the object to not exist.
+func (g *GCS) checkPreconditions(query url.Values, key string) int {
+	_, exists := g.Objects[key]
+	var generation, metageneration int64
+	if exists {
+		attrs := g.attrs(key)
+		generation, metageneration = attrs.Generation, attrs.Metageneration
+	}
+	params := []struct {
+		name  string
+		value int64
+		match bool
+	}{
+		{"ifGenerationMatch", generation, true},
+		{"ifGenerationNotMatch", generation, false},
+		{"ifMetagenerationMatch", metageneration, true},
+		{"ifMetagenerationNotMatch", metageneration, false},
+	}
+	if s := query.Get("generation"); s != "" {
+		if want, err := strconv.ParseInt(s, 10, 64); err != nil || !exists || want != generation {
+			return http.StatusNotFound
+		}
+	}
+	for _, p := range params {
+		s := query.Get(p.name)
+		if s == "" {
+			continue
+		}
+		want, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return http.StatusBadRequest
+		}
+		if (want == p.value) != p.match {
+			return http.StatusPreconditionFailed
+		}
+	}
+	return 0
+}
+
+// parseRange parses the Range header of a read request for an object of the given size. It returns the first and
+// last byte offsets to read, and whether the request was for a range.
+func parseRange(header string, size int64) (int64, int64, bool, error) {
+	if header == "" {
+		return 0, size - 1, false, nil
+	}
+	spec := strings.TrimPrefix(header, "bytes=")
+	split := strings.SplitN(spec, "-", 2)
+	if len(split) != 2 {
+		return 0, 0, false, fmt.Errorf("invalid range %q", header)
+	}
+	if split[0] == "" {
+		// A suffix range, like "bytes=-5".
+		n, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+	first, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	last := size - 1
+	if split[1] != "" {
+		if last, err = strconv.ParseInt(split[1], 10, 64); err != nil {
+			return 0, 0, false, err
+		}
+		if last > size-1 {
+			last = size - 1
+		}
+	}
+	return first, last, true, nil
+}
+
+// objectHandler handles object reads, which go through the XML API. Ranges, generations and preconditions are
+// supported.
 func (g *GCS) objectHandler(w http.ResponseWriter, r *http.Request) {
 	data, ok := g.Objects[r.URL.Path]
 	if !ok {
 		writeError(w, r, http.StatusNotFound)
 		return
 	}
-	if _, err := w.Write(data); err != nil {
+	if code := g.checkPreconditions(r.URL.Query(), r.URL.Path); code != 0 {
+		writeError(w, r, code)
+		return
+	}
+	first, last, isRange, err := parseRange(r.Header.Get("Range"), int64(len(data)))
+	if err != nil {
+		log.Printf("failed to parse range: %v", err)
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+	if isRange && first >= int64(len(data)) && len(data) > 0 {
+		writeError(w, r, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	attrs := g.attrs(r.URL.Path)
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	w.Header().Set("X-Goog-Metageneration", strconv.FormatInt(attrs.Metageneration, 10))
+	w.Header().Add("X-Goog-Hash", "crc32c="+crc32cHash(data))
+	w.Header().Add("X-Goog-Hash", "md5="+md5Hash(data))
+	if attrs.ContentType != "" {
+		w.Header().Set("Content-Type", attrs.ContentType)
+	}
+	body := data
+	if len(data) > 0 {
+		body = data[first : last+1]
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if isRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if g.PartialReads > 0 {
+		g.PartialReads--
+		// Send half of the data; the connection is closed because less data than the Content-Length is sent.
+		body = body[:len(body)/2]
+	}
+	if _, err := w.Write(body); err != nil {
 		log.Printf("write %q failed: %v", r.URL.Path, err)
 	}
 }
@@ -108,7 +341,7 @@ func (g *GCS) list(w http.ResponseWriter, r *http.Request, bucket string) {
 	var all gcsObjects
 	for k := range g.Objects {
 		if strings.HasPrefix(k, prefix) {
-			all.Items = append(all.Items, gcsObject{strings.TrimPrefix(k, bucketPrefix), bucket})
+			all.Items = append(all.Items, g.object(bucket, strings.TrimPrefix(k, bucketPrefix)))
 		}
 	}
 	bytes, err := json.Marshal(all)
@@ -123,7 +356,7 @@ func (g *GCS) list(w http.ResponseWriter, r *http.Request, bucket string) {
 
 // del handles a `delete` request.
 // See: https://cloud.google.com/storage/docs/json_api/v1/#Objects, `delete` method.
-// Doesn't handle any optional parameters.
+// Handles the generation and precondition optional parameters.
 func (g *GCS) del(w http.ResponseWriter, r *http.Request, bucket, objectPath string) {
 	key := fmt.Sprintf("/%s/%s", bucket, objectPath)
 	if _, ok := g.Objects[key]; !ok {
@@ -131,13 +364,84 @@ func (g *GCS) del(w http.ResponseWriter, r *http.Request, bucket, objectPath str
 		writeError(w, r, http.StatusNotFound)
 		return
 	}
+	if code := g.checkPreconditions(r.URL.Query(), key); code != 0 {
+		writeError(w, r, code)
+		return
+	}
 	delete(g.Objects, key)
+	delete(g.Attrs, key)
+}
+
+// get handles a `get` request, which gets the attributes of an object.
+// See: https://cloud.google.com/storage/docs/json_api/v1/#Objects, `get` method.
+// Handles the generation and precondition optional parameters.
+func (g *GCS) get(w http.ResponseWriter, r *http.Request, bucket, objectPath string) {
+	key := fmt.Sprintf("/%s/%s", bucket, objectPath)
+	if _, ok := g.Objects[key]; !ok {
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	if code := g.checkPreconditions(r.URL.Query(), key); code != 0 {
+		writeError(w, r, code)
+		return
+	}
+	writeJSON(w, r, g.object(bucket, objectPath))
+}
+
+// patch handles a `patch` request, which updates the content type and custom metadata of an object. Metadata keys
+// are merged into the existing metadata; keys set to null are removed, and null metadata removes all keys. Each
+// patch increments the metageneration of the object.
+// See: https://cloud.google.com/storage/docs/json_api/v1/#Objects, `patch` method.
+func (g *GCS) patch(w http.ResponseWriter, r *http.Request, bucket, objectPath string) {
+	key := fmt.Sprintf("/%s/%s", bucket, objectPath)
+	if _, ok := g.Objects[key]; !ok {
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	if code := g.checkPreconditions(r.URL.Query(), key); code != 0 {
+		writeError(w, r, code)
+		return
+	}
+	update := struct {
+		ContentType *string         `json:"contentType"`
+		Metadata    json.RawMessage `json:"metadata"`
+	}{}
+	if !readJSON(w, r, &update) {
+		return
+	}
+	var metadata map[string]*string
+	if len(update.Metadata) != 0 {
+		if err := json.Unmarshal(update.Metadata, &metadata); err != nil {
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	attrs := g.attrs(key)
+	if update.ContentType != nil {
+		attrs.ContentType = *update.ContentType
+	}
+	if string(update.Metadata) == "null" {
+		attrs.Metadata = nil
+	}
+	for k, v := range metadata {
+		if v == nil {
+			delete(attrs.Metadata, k)
+			continue
+		}
+		if attrs.Metadata == nil {
+			attrs.Metadata = make(map[string]string)
+		}
+		attrs.Metadata[k] = *v
+	}
+	attrs.Metageneration++
+	writeJSON(w, r, g.object(bucket, objectPath))
 }
 
 func (g *GCS) bucketHandler(w http.ResponseWriter, r *http.Request) {
 	// Path looks like:
 	// - /storage/v1/b/<bucket>/o
 	// - /storage/v1/b/<bucket>/o/<object>
+	// - /storage/v1/b/<bucket>/o/<object>/compose
 	splitPath := strings.SplitN(r.URL.Path, "/", 7)
 	if len(splitPath) < 6 || splitPath[5] != "o" {
 		log.Printf("unrecognized path: %s", r.URL.Path)
@@ -150,8 +454,14 @@ func (g *GCS) bucketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	bucket := splitPath[4]
 	switch {
-	case objectPath != "" && r.Method == "DELETE":
+	case strings.HasSuffix(objectPath, "/compose") && r.Method == http.MethodPost:
+		g.compose(w, r, bucket, strings.TrimSuffix(objectPath, "/compose"))
+	case objectPath != "" && r.Method == http.MethodDelete:
 		g.del(w, r, bucket, objectPath)
+	case objectPath != "" && r.Method == http.MethodPatch:
+		g.patch(w, r, bucket, objectPath)
+	case objectPath != "" && r.Method == http.MethodGet:
+		g.get(w, r, bucket, objectPath)
 	case objectPath == "":
 		g.list(w, r, bucket)
 	default:
@@ -161,20 +471,66 @@ func (g *GCS) bucketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (g *GCS) uploadHandler(w http.ResponseWriter, r *http.Request) {
-	splitPath := strings.Split(r.URL.Path, "/")
-	// Path looks like /upload/storage/v1/b/<bucket>/o
-	// (see: https://cloud.google.com/storage/docs/json_api/v1/#Objects, `insert` method)
-	// This implementation only accepts the path parameter 'bucket'. It does not accept any optional parameters.
-	//
-	// GCS uses multipart HTTP messages to upload data. The first part contains object metadata (name, bucket, etc)
-	// in JSON format, and the second part contains the object data. Here, we extract the object metadata and data
-	// from the multipart message and store it
-	if len(splitPath) != 7 || splitPath[6] != "o" {
-		log.Printf("unrecognized path: %s", r.URL.Path)
-		writeError(w, r, http.StatusNotFound)
+// insert creates an object from the given object metadata and data. The hashes in the object metadata, if any, must
+// match the data.
+func (g *GCS) insert(w http.ResponseWriter, r *http.Request, query url.Values, object *gcsObject, data []byte) {
+	key := fmt.Sprintf("/%s/%s", object.Bucket, object.Name)
+	if code := g.checkPreconditions(query, key); code != 0 {
+		writeError(w, r, code)
+		return
+	}
+	if (object.CRC32C != "" && object.CRC32C != crc32cHash(data)) || (object.MD5Hash != "" && object.MD5Hash != md5Hash(data)) {
+		log.Printf("upload of %s failed: hash mismatch", key)
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+	g.generation++
+	g.Objects[key] = data
+	g.Attrs[key] = &GCSObjectAttrs{
+		Generation:     g.generation,
+		Metageneration: 1,
+		ContentType:    object.ContentType,
+		Metadata:       object.Metadata,
+	}
+	writeJSON(w, r, g.object(object.Bucket, object.Name))
+}
+
+// compose handles a request that concatenates source objects into a destination object. The destination object
+// metadata is taken from the request, and its hashes, if any, must match the concatenated data.
+func (g *GCS) compose(w http.ResponseWriter, r *http.Request, bucket, objectPath string) {
+	req := &struct {
+		Destination   *gcsObject `json:"destination"`
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}{}
+	if !readJSON(w, r, req) {
 		return
 	}
+	var data []byte
+	for _, src := range req.SourceObjects {
+		srcData, ok := g.Objects[fmt.Sprintf("/%s/%s", bucket, src.Name)]
+		if !ok {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		data = append(data, srcData...)
+	}
+	object := req.Destination
+	if object == nil {
+		object = &gcsObject{}
+	}
+	object.Bucket = bucket
+	object.Name = objectPath
+	g.insert(w, r, r.URL.Query(), object, data)
+}
+
+// multipartUpload handles an upload with uploadType=multipart.
+//
+// GCS uses multipart HTTP messages to upload data. The first part contains object metadata (name, bucket, etc)
+// in JSON format, and the second part contains the object data. Here, we extract the object metadata and data
+// from the multipart message and store it.
+func (g *GCS) multipartUpload(w http.ResponseWriter, r *http.Request, bucket string) {
 	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
 		log.Printf("failed to parse Content-Type: %s", r.Header.Get("Content-Type"))
@@ -201,6 +557,11 @@ func (g *GCS) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		parts = append(parts, partData)
 	}
+	if len(parts) != 2 {
+		log.Printf("got %d parts in multipart upload, want 2", len(parts))
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
 	objectMetadata := parts[0]
 	objectData := parts[1]
 	object := &gcsObject{}
@@ -209,9 +570,90 @@ func (g *GCS) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, r, http.StatusInternalServerError)
 		return
 	}
-	g.Objects[fmt.Sprintf("/%s/%s", object.Bucket, object.Name)] = objectData
-	if _, err := w.Write(objectMetadata); err != nil {
-		log.Printf("write %q failed: %v", r.URL.Path, err)
+	if object.Bucket == "" {
+		object.Bucket = bucket
+	}
+	g.insert(w, r, r.URL.Query(), object, objectData)
+}
+
+// startResumableUpload handles the request that starts an upload with uploadType=resumable. The request body holds
+// the object metadata, and the response has the session URL in its Location header.
+func (g *GCS) startResumableUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	object := &gcsObject{}
+	if !readJSON(w, r, object) {
+		return
+	}
+	if object.Bucket == "" {
+		object.Bucket = bucket
+	}
+	g.uploadID++
+	id := strconv.Itoa(g.uploadID)
+	g.uploads[id] = &resumableUpload{object: object, query: r.URL.Query()}
+	w.Header().Set("Location", fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&upload_id=%s",
+		g.Server.URL, bucket, id))
+}
+
+// uploadChunk handles a request that uploads a chunk of data to a resumable upload session. The Content-Range header
+// of the request has the form "bytes <first>-<last>/<total>", where the total is "*" until the last chunk, or
+// "bytes */<total>" for an empty last chunk.
+func (g *GCS) uploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+	upload, ok := g.uploads[id]
+	if !ok {
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("failed to read body")
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	split := strings.SplitN(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/", 2)
+	if len(split) != 2 {
+		log.Printf("invalid Content-Range: %s", r.Header.Get("Content-Range"))
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+	if split[0] != "*" {
+		first, err := strconv.Atoi(strings.SplitN(split[0], "-", 2)[0])
+		if err != nil || first != len(upload.data) {
+			log.Printf("chunk at offset %s doesn't continue upload %s at offset %d", split[0], id, len(upload.data))
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		upload.data = append(upload.data, data...)
+	}
+	if split[1] == "*" {
+		// More chunks follow. The client asked for 200 responses instead of 308 responses.
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		if len(upload.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		}
+		return
+	}
+	delete(g.uploads, id)
+	g.insert(w, r, upload.query, upload.object, upload.data)
+}
+
+func (g *GCS) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	splitPath := strings.Split(r.URL.Path, "/")
+	// Path looks like /upload/storage/v1/b/<bucket>/o
+	// (see: https://cloud.google.com/storage/docs/json_api/v1/#Objects, `insert` method)
+	// Multipart and resumable uploads are supported, with the generation precondition optional parameters.
+	if len(splitPath) != 7 || splitPath[6] != "o" {
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	bucket := splitPath[5]
+	query := r.URL.Query()
+	switch {
+	case query.Get("upload_id") != "":
+		g.uploadChunk(w, r, query.Get("upload_id"))
+	case query.Get("uploadType") == "resumable":
+		g.startResumableUpload(w, r, bucket)
+	default:
+		g.multipartUpload(w, r, bucket)
 	}
 }
 
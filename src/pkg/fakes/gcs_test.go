@@ -15,9 +15,13 @@
 package fakes
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"net/http"
 	"testing"
 
 	"cloud.google.com/go/storage"
@@ -233,3 +237,175 @@ func TestDeleteObjectDoesNotExist(t *testing.T) {
 	}
 
 }
+
+func TestGenerations(t *testing.T) {
+	gcs := GCSForTest(t)
+	defer gcs.Close()
+	ctx := context.Background()
+	obj := gcs.Client.Bucket("bucket").Object("object")
+	write := func(o *storage.ObjectHandle, data string) error {
+		w := o.NewWriter(ctx)
+		if _, err := w.Write([]byte(data)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	if err := write(obj.If(storage.Conditions{DoesNotExist: true}), "v1"); err != nil {
+		t.Fatalf("write(DoesNotExist): %v", err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write(obj.If(storage.Conditions{DoesNotExist: true}), "v2"); err == nil {
+		t.Error("write(DoesNotExist): got nil, want error for an existing object")
+	}
+	if err := write(obj.If(storage.Conditions{GenerationMatch: attrs.Generation}), "v2"); err != nil {
+		t.Fatalf("write(GenerationMatch): %v", err)
+	}
+	newAttrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newAttrs.Generation <= attrs.Generation || newAttrs.Metageneration != 1 {
+		t.Errorf("write: got generation %d and metageneration %d, want generation > %d and metageneration 1",
+			newAttrs.Generation, newAttrs.Metageneration, attrs.Generation)
+	}
+	if _, err := obj.Generation(attrs.Generation).NewReader(ctx); err != storage.ErrObjectNotExist {
+		t.Errorf("NewReader(old generation): got %v, want %v", err, storage.ErrObjectNotExist)
+	}
+	if err := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); err == nil {
+		t.Error("Delete(GenerationMatch old generation): got nil, want error")
+	}
+	if err := obj.If(storage.Conditions{GenerationMatch: newAttrs.Generation}).Delete(ctx); err != nil {
+		t.Errorf("Delete(GenerationMatch): %v", err)
+	}
+}
+
+func TestObjectAttrs(t *testing.T) {
+	gcs := GCSForTest(t)
+	defer gcs.Close()
+	ctx := context.Background()
+	obj := gcs.Client.Bucket("bucket").Object("object")
+	w := obj.NewWriter(ctx)
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{"k1": "v1", "k2": "v2"}
+	w.CRC32C = crc32.Checksum([]byte("data"), crc32.MakeTable(crc32.Castagnoli))
+	w.SendCRC32C = true
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMD5 := md5.Sum([]byte("data"))
+	if attrs.CRC32C != w.CRC32C || !cmp.Equal(attrs.MD5, wantMD5[:]) || attrs.Size != 4 || attrs.ContentType != "text/plain" {
+		t.Errorf("Attrs: got %+v, want the hashes, size and content type of %q", attrs, "data")
+	}
+	updated, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{"k1": "new", "k3": "v3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(updated.Metadata, map[string]string{"k1": "new", "k2": "v2", "k3": "v3"}); diff != "" {
+		t.Errorf("Update: metadata diff (-got, +want): %s", diff)
+	}
+	if updated.Metageneration != 2 {
+		t.Errorf("Update: got metageneration %d, want 2", updated.Metageneration)
+	}
+	w = gcs.Client.Bucket("bucket").Object("bad-crc").NewWriter(ctx)
+	w.CRC32C = 1
+	w.SendCRC32C = true
+	w.Write([]byte("data"))
+	if err := w.Close(); err == nil {
+		t.Error("Writer.Close: got nil, want error for a mismatched CRC32C")
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	gcs := GCSForTest(t)
+	defer gcs.Close()
+	// The data is larger than a chunk, so it's uploaded in several requests.
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+	w := gcs.Client.Bucket("bucket").Object("object").NewWriter(context.Background())
+	w.ChunkSize = 256 * 1024
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gcs.Objects["/bucket/object"], data) {
+		t.Errorf("resumable upload: got %d bytes, want %d bytes", len(gcs.Objects["/bucket/object"]), len(data))
+	}
+}
+
+func TestCompose(t *testing.T) {
+	gcs := GCSForTest(t)
+	defer gcs.Close()
+	ctx := context.Background()
+	gcs.Objects["/bucket/dir/part-0"] = []byte("hello, ")
+	gcs.Objects["/bucket/dir/part-1"] = []byte("world")
+	bucket := gcs.Client.Bucket("bucket")
+	c := bucket.Object("dir/object").ComposerFrom(bucket.Object("dir/part-0"), bucket.Object("dir/part-1"))
+	c.CRC32C = crc32.Checksum([]byte("hello, world"), crc32.MakeTable(crc32.Castagnoli))
+	c.SendCRC32C = true
+	c.Metadata = map[string]string{"k": "v"}
+	if _, err := c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(gcs.Objects["/bucket/dir/object"]); got != "hello, world" {
+		t.Errorf("Compose: got %q, want %q", got, "hello, world")
+	}
+	if got := gcs.Attrs["/bucket/dir/object"].Metadata["k"]; got != "v" {
+		t.Errorf("Compose: got metadata %q, want %q", got, "v")
+	}
+	c = bucket.Object("dir/bad-crc").ComposerFrom(bucket.Object("dir/part-0"))
+	c.CRC32C = 1
+	c.SendCRC32C = true
+	if _, err := c.Run(ctx); err == nil {
+		t.Error("Compose: got nil, want error for a mismatched CRC32C")
+	}
+	c = bucket.Object("dir/missing").ComposerFrom(bucket.Object("dir/part-2"))
+	if _, err := c.Run(ctx); err == nil {
+		t.Error("Compose: got nil, want error for a missing source object")
+	}
+}
+
+func TestRangeRead(t *testing.T) {
+	gcs := GCSForTest(t)
+	defer gcs.Close()
+	gcs.Objects["/bucket/object"] = []byte("0123456789")
+	r, err := gcs.Client.Bucket("bucket").Object("object").NewRangeReader(context.Background(), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "234" || r.Attrs.Size != 10 {
+		t.Errorf("NewRangeReader(2, 3): got %q of size %d, want %q of size 10", string(got), r.Attrs.Size, "234")
+	}
+}
+
+func TestReadFaults(t *testing.T) {
+	gcs := GCSForTest(t)
+	defer gcs.Close()
+	gcs.Objects["/bucket/object"] = []byte("data")
+	gcs.Failures = []*Failure{{Path: "/bucket/object", Code: http.StatusForbidden, Count: 1}}
+	if _, err := gcs.Client.Bucket("bucket").Object("object").NewReader(context.Background()); err == nil {
+		t.Error("NewReader: got nil, want injected error")
+	}
+	gcs.PartialReads = 1
+	r, err := gcs.Client.Bucket("bucket").Object("object").NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("ReadAll: got %q, want error for a partial read", string(got))
+	}
+}
@@ -14,24 +14,42 @@
 
 package fakes
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
-// Time is a fake implementation of the time package.
+// Time is a fake implementation of the time package. It is safe for concurrent
+// use.
 type Time struct {
+	mu      sync.Mutex
 	current time.Time
 }
 
 // NewTime gets a Time instance initialized with the given time.
 func NewTime(t time.Time) *Time {
-	return &Time{t}
+	return &Time{current: t}
 }
 
 // Now gets the current time.
 func (t *Time) Now() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.current
 }
 
 // Sleep increments the current time by the given duration.
 func (t *Time) Sleep(s time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	t.current = t.current.Add(s)
 }
+
+// After increments the current time by the given duration, and returns a
+// channel that already holds the new current time.
+func (t *Time) After(s time.Duration) <-chan time.Time {
+	t.Sleep(s)
+	ch := make(chan time.Time, 1)
+	ch <- t.Now()
+	return ch
+}
@@ -23,17 +23,21 @@ import (
 	"path/filepath"
 )
 
-func tarFile(src, dst string) error {
+// tarFile archives the given file. mode is "cf" to create the archive, or
+// "rf" to append to it.
+func tarFile(mode, src, dst string) error {
 	dirPath := filepath.Dir(src)
 	baseName := filepath.Base(src)
-	cmd := exec.Command("tar", "cf", dst, "-C", dirPath, baseName)
+	cmd := exec.Command("tar", mode, dst, "-C", dirPath, baseName)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-func tarDir(root, dst string) error {
-	args := []string{"cf", dst, "-C", root}
+// tarDir archives the contents of the given directory. mode is "cf" to create
+// the archive, or "rf" to append to it.
+func tarDir(mode, root, dst string) error {
+	args := []string{mode, dst, "-C", root}
 	inputFiles, err := filepath.Glob(filepath.Join(root, "*"))
 	if err != nil {
 		return err
@@ -58,24 +62,42 @@ func tarDir(root, dst string) error {
 
 // CreateBuildContextArchive creates a tar archive of the given build context.
 func CreateBuildContextArchive(src, dst string) error {
+	return CreateMergedBuildContextArchive([]string{src}, dst)
+}
+
+// CreateMergedBuildContextArchive creates a tar archive that merges the given
+// build contexts. They are added to the archive in order, so files in later
+// build contexts take precedence over files at the same path in earlier ones.
+func CreateMergedBuildContextArchive(srcs []string, dst string) error {
+	if len(srcs) == 0 {
+		return fmt.Errorf("no build context given")
+	}
 	if _, err := os.Stat(dst); !os.IsNotExist(err) {
 		return fmt.Errorf("dst path already exists: %s", dst)
 	}
 	if err := os.MkdirAll(filepath.Dir(dst), 0774); err != nil {
 		return err
 	}
-	info, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-	switch {
-	case info.IsDir():
-		return tarDir(src, dst)
-	case info.Mode().IsRegular():
-		return tarFile(src, dst)
-	default:
-		return fmt.Errorf("input path %s is neither a directory nor a regular file", src)
+	mode := "cf"
+	for _, src := range srcs {
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			err = tarDir(mode, src, dst)
+		case info.Mode().IsRegular():
+			err = tarFile(mode, src, dst)
+		default:
+			err = fmt.Errorf("input path %s is neither a directory nor a regular file", src)
+		}
+		if err != nil {
+			return err
+		}
+		mode = "rf"
 	}
+	return nil
 }
 
 // ArchiveHasObject determines if the given tar archive contains the given object.
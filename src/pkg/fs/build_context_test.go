@@ -154,6 +154,44 @@ func TestCreateBuildContextArchive(t *testing.T) {
 	}
 }
 
+func TestCreateMergedBuildContextArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for file, contents := range map[string]string{"a/x": "x", "a/lib/y": "a", "b/lib/y": "b", "c": "c"} {
+		path := filepath.Join(tmpDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcs := []string{filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b"), filepath.Join(tmpDir, "c")}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateMergedBuildContextArchive(srcs, archive); err != nil {
+		t.Fatalf("CreateMergedBuildContextArchive(%v, _): %v", srcs, err)
+	}
+	got := filepath.Join(tmpDir, "got")
+	if err := os.Mkdir(got, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("tar", "xf", archive, "-C", got).Run(); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{"x": "x", "lib/y": "b", "c": "c"} {
+		contents, err := ioutil.ReadFile(filepath.Join(got, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != want {
+			t.Errorf("CreateMergedBuildContextArchive(%v, _): got %s = %q, want %q", srcs, file, contents, want)
+		}
+	}
+}
+
 func TestArchiveHasObjectEmptyDir(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
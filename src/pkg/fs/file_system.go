@@ -28,6 +28,10 @@ const (
 	// DaisyBin is the location of the Daisy binary.
 	daisyBin = "/daisy"
 
+	// qemuBin is the QEMU binary used by the local image builder. It is looked
+	// up in $PATH.
+	qemuBin = "qemu-system-x86_64"
+
 	// Directory whose contents do not persist across build steps.
 	// This directory is used for building files into the container image.
 	volatileDir = "/data"
@@ -61,6 +65,8 @@ type Files struct {
 	DaisyWorkflow string
 	// DaisyBin points to the Daisy binary.
 	DaisyBin string
+	// QEMUBin points to the QEMU binary used by the local image builder.
+	QEMUBin string
 }
 
 // DefaultFiles builds a Files struct with a default file layout.
@@ -74,6 +80,7 @@ func DefaultFiles(persistentDir string) *Files {
 		ProvConfig:              filepath.Join(persistentDir, provConfig),
 		DaisyWorkflow:           filepath.Join(volatileDir, daisyWorkflow),
 		DaisyBin:                daisyBin,
+		QEMUBin:                 qemuBin,
 	}
 }
 
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+var (
+	// constraintClauseRegex matches a single clause of an image constraint. The
+	// key can be omitted, in which case the key of the previous clause is used.
+	constraintClauseRegex = regexp.MustCompile(`^(channel|milestone|build)?\s*(~=|==|!=|>=|<=|=|>|<)\s*(\S+)$`)
+	channelRegex          = regexp.MustCompile(`^[a-z]+$`)
+	// buildRegex matches a full or partial build number. Components can be
+	// separated by dots, as in 17800.66.3, or by dashes, as in image names.
+	buildRegex = regexp.MustCompile(`^[0-9]+([.-][0-9]+){0,2}$`)
+)
+
+type constraintClause struct {
+	key   string
+	op    string
+	value string
+	// milestone is the parsed value of milestone clauses.
+	milestone int
+	// build is the parsed value of build clauses.
+	build []int
+}
+
+// ImageConstraint selects COS images by the channel, milestone and build
+// number encoded in their names.
+type ImageConstraint struct {
+	expr    string
+	clauses []*constraintClause
+}
+
+// parseBuild parses a full or partial build number into its components.
+func parseBuild(s string) []int {
+	var build []int
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == '.' || r == '-' }) {
+		// Callers validate s using buildRegex, so this is guaranteed to work.
+		n, _ := strconv.Atoi(part)
+		build = append(build, n)
+	}
+	return build
+}
+
+func parseConstraintClause(s, prevKey string) (*constraintClause, error) {
+	match := constraintClauseRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return nil, fmt.Errorf("invalid clause %q", s)
+	}
+	c := &constraintClause{key: match[1], op: match[2], value: match[3]}
+	if c.op == "==" {
+		c.op = "="
+	}
+	if c.key == "" {
+		if prevKey == "" {
+			return nil, fmt.Errorf("clause %q must start with channel, milestone or build", s)
+		}
+		c.key = prevKey
+	}
+	switch c.key {
+	case "channel":
+		if c.op != "=" && c.op != "!=" {
+			return nil, fmt.Errorf("clause %q: channels can only be compared with = and !=", s)
+		}
+		if !channelRegex.MatchString(c.value) {
+			return nil, fmt.Errorf("clause %q: invalid channel %q", s, c.value)
+		}
+	case "milestone":
+		if c.op == "~=" {
+			return nil, fmt.Errorf("clause %q: ~= can only be used with build numbers", s)
+		}
+		var err error
+		c.milestone, err = strconv.Atoi(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("clause %q: invalid milestone %q", s, c.value)
+		}
+	case "build":
+		if !buildRegex.MatchString(c.value) {
+			return nil, fmt.Errorf("clause %q: invalid build number %q", s, c.value)
+		}
+		c.build = parseBuild(c.value)
+		if c.op == "~=" && len(c.build) < 2 {
+			return nil, fmt.Errorf("clause %q: ~= requires a build number with at least two components", s)
+		}
+	}
+	return c, nil
+}
+
+// ParseImageConstraint parses an image constraint expression. An expression is
+// a comma-separated list of clauses, all of which must match. Each clause is of
+// the form <key><op><value>, where key is one of channel, milestone or build.
+// The key can be omitted to reuse the key of the previous clause, so that
+// ranges can be written as "milestone>=101,<105". Channels can be compared with
+// = and !=. Milestones and build numbers can also be compared with <, <=, >
+// and >=. Build numbers are compared only up to the number of components given
+// in the clause, so "build=17800.66" matches 17800.66.3. "build~=17800.66"
+// matches builds that are at least 17800.66 and start with 17800.
+func ParseImageConstraint(expr string) (*ImageConstraint, error) {
+	c := &ImageConstraint{expr: expr}
+	var prevKey string
+	for _, s := range strings.Split(expr, ",") {
+		clause, err := parseConstraintClause(s, prevKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image constraint %q: %v", expr, err)
+		}
+		c.clauses = append(c.clauses, clause)
+		prevKey = clause.key
+	}
+	return c, nil
+}
+
+// String returns the expression that the constraint was parsed from.
+func (c *ImageConstraint) String() string {
+	return c.expr
+}
+
+// compareInts compares two integer sequences of the same length, returning
+// -1, 0 or 1.
+func compareInts(a, b []int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// compareOp checks if the result of a comparison satisfies an operator.
+func compareOp(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+func (c *constraintClause) matches(image *decodedImageName) bool {
+	switch c.key {
+	case "channel":
+		return compareOp(strings.Compare(image.channel, c.value), c.op)
+	case "milestone":
+		return compareOp(compareInts([]int{image.milestone}, []int{c.milestone}), c.op)
+	case "build":
+		build := parseBuild(image.buildNumber)[:len(c.build)]
+		if c.op == "~=" {
+			n := len(c.build) - 1
+			return compareInts(build[:n], c.build[:n]) == 0 && compareInts(build, c.build) >= 0
+		}
+		return compareOp(compareInts(build, c.build), c.op)
+	default:
+		return false
+	}
+}
+
+func (c *ImageConstraint) matches(image *decodedImageName) bool {
+	for _, clause := range c.clauses {
+		if !clause.matches(image) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveImageConstraint gets the name of the latest image in the given
+// project that satisfies the given constraint. Image names must follow the
+// naming pattern of the images in cos-cloud; other images are ignored, along
+// with images that are deprecated or not READY.
+func ResolveImageConstraint(ctx context.Context, svc *compute.Service, project string,
+	constraint *ImageConstraint) (string, error) {
+	var latest *decodedImageName
+	err := svc.Images.List(project).Pages(ctx, func(imageList *compute.ImageList) error {
+		for _, image := range imageList.Items {
+			if image.Status != "READY" || !active(image) {
+				continue
+			}
+			decoded, err := newDecodedImageName(image.Name)
+			if err != nil {
+				continue
+			}
+			if constraint.matches(decoded) && (latest == nil || imageCompare(latest, decoded)) {
+				latest = decoded
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if latest == nil {
+		return "", ErrImageNotFound
+	}
+	return latest.name, nil
+}
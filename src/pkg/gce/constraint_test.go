@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestParseImageConstraintInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"stable",
+		">=101",
+		"channel>stable",
+		"channel=Stable",
+		"milestone~=101",
+		"milestone>=abc",
+		"build~=17800",
+		"build=17800.66.3.1",
+		"build=17800..66",
+		"version=1",
+		"milestone>=101,",
+	} {
+		if _, err := ParseImageConstraint(expr); err == nil {
+			t.Errorf("ParseImageConstraint(%q): got nil, want error", expr)
+		}
+	}
+}
+
+func TestResolveImageConstraint(t *testing.T) {
+	images := []*compute.Image{
+		{Name: "cos-stable-100-17000-0-0", Status: "READY"},
+		{Name: "cos-stable-101-17162-40-13", Status: "READY"},
+		{Name: "cos-stable-101-17162-40-20", Status: "READY"},
+		{Name: "cos-beta-105-17800-66-3", Status: "READY"},
+		{Name: "cos-beta-105-17800-66-10", Status: "READY"},
+		{Name: "cos-beta-105-17800-70-0", Status: "READY"},
+		{Name: "cos-dev-105-17801-0-0", Status: "READY"},
+		{Name: "cos-stable-104-17500-0-0", Status: "READY",
+			Deprecated: &compute.DeprecationStatus{State: "DEPRECATED"}},
+		{Name: "cos-stable-103-17400-0-0", Status: "PENDING"},
+		{Name: "cos-stable-102-17300-0-0", Status: "READY", Deprecated: &compute.DeprecationStatus{State: "ACTIVE"}},
+		{Name: "not-a-cos-image", Status: "READY"},
+	}
+	var testData = []struct {
+		testName string
+		expr     string
+		want     string
+		wantErr  error
+	}{
+		{
+			testName: "ChannelAndMilestoneRange",
+			expr:     "channel=stable,milestone>=101,<105",
+			want:     "cos-stable-102-17300-0-0",
+		},
+		{
+			testName: "MilestoneUpperBound",
+			expr:     "milestone<102",
+			want:     "cos-stable-101-17162-40-20",
+		},
+		{
+			testName: "CompatibleBuild",
+			expr:     "build~=17800.66",
+			want:     "cos-beta-105-17800-70-0",
+		},
+		{
+			testName: "CompatibleBuildPatch",
+			expr:     "build~=17800.66.4",
+			want:     "cos-beta-105-17800-66-10",
+		},
+		{
+			testName: "BuildPin",
+			expr:     "build=17162.40.13",
+			want:     "cos-stable-101-17162-40-13",
+		},
+		{
+			testName: "BuildPrefix",
+			expr:     "build==17162-40",
+			want:     "cos-stable-101-17162-40-20",
+		},
+		{
+			testName: "ChannelExcluded",
+			expr:     "channel!=dev,milestone=105",
+			want:     "cos-beta-105-17800-70-0",
+		},
+		{
+			testName: "SkipsNotReady",
+			expr:     "milestone=103",
+			wantErr:  ErrImageNotFound,
+		},
+		{
+			testName: "SkipsDeprecated",
+			expr:     "milestone=104",
+			wantErr:  ErrImageNotFound,
+		},
+	}
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = images
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			constraint, err := ParseImageConstraint(input.expr)
+			if err != nil {
+				t.Fatalf("ParseImageConstraint(%q): %v", input.expr, err)
+			}
+			got, err := ResolveImageConstraint(context.Background(), client, "test-project", constraint)
+			if err != input.wantErr {
+				t.Errorf("ResolveImageConstraint(_, _, _, %q) = %v, want: %v", input.expr, err, input.wantErr)
+			}
+			if got != input.want {
+				t.Errorf("ResolveImageConstraint(_, _, _, %q) = %s, want: %s", input.expr, got, input.want)
+			}
+		})
+	}
+}
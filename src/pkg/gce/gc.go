@@ -0,0 +1,195 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// RetentionPolicy describes which images in an image family are garbage
+// collected by GCImages.
+type RetentionPolicy struct {
+	// KeepLast is the number of newest images in the family that are never
+	// deleted.
+	KeepLast int
+	// MaxAge is the age after which images that aren't among the KeepLast
+	// newest images are deleted. If MaxAge is zero and KeepLast is set, all
+	// images that aren't among the KeepLast newest images are deleted. If both
+	// are zero, images are only deleted once their deprecation deletion time
+	// has passed.
+	MaxAge time.Duration
+	// ProtectedLabels protects images from deletion. An image is protected if
+	// it has a label with a key in ProtectedLabels, and either the value in
+	// ProtectedLabels is empty or the label has that value.
+	ProtectedLabels map[string]string
+}
+
+// GCDecision is the outcome of garbage collection for a single image.
+type GCDecision struct {
+	Image  string
+	Delete bool
+	// Reason explains why the image is deleted or kept.
+	Reason string
+}
+
+// protected checks if an image is protected by the given labels.
+func protected(image *compute.Image, labels map[string]string) (string, bool) {
+	for k, v := range labels {
+		got, ok := image.Labels[k]
+		if ok && (v == "" || got == v) {
+			return fmt.Sprintf("protected by label %s=%s", k, got), true
+		}
+	}
+	return "", false
+}
+
+// active checks if an image is not deprecated, obsolete or deleted, which
+// makes it a candidate when the image family is resolved.
+func active(image *compute.Image) bool {
+	return image.Deprecated == nil || image.Deprecated.State == "" || image.Deprecated.State == "ACTIVE"
+}
+
+// familyImages lists the images in an image family, in no particular order.
+func familyImages(ctx context.Context, svc *compute.Service, project, family string) ([]*compute.Image, error) {
+	var images []*compute.Image
+	filter := fmt.Sprintf("family = %s", family)
+	err := svc.Images.List(project).Filter(filter).Pages(ctx, func(imageList *compute.ImageList) error {
+		for _, image := range imageList.Items {
+			if image.Family == family {
+				images = append(images, image)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// gcDecisions applies the given retention policy to the images of a family.
+// Decisions are returned from newest to oldest image.
+func gcDecisions(images []*compute.Image, policy *RetentionPolicy, now time.Time) []*GCDecision {
+	type dated struct {
+		image   *compute.Image
+		created time.Time
+	}
+	var sorted []dated
+	// Images without a valid creation time are never deleted, since their age
+	// is unknown.
+	var unknown []*GCDecision
+	for _, image := range images {
+		created, err := time.Parse(time.RFC3339, image.CreationTimestamp)
+		if err != nil {
+			unknown = append(unknown, &GCDecision{image.Name, false,
+				fmt.Sprintf("unknown creation time %q", image.CreationTimestamp)})
+			continue
+		}
+		sorted = append(sorted, dated{image, created})
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].created.After(sorted[j].created) })
+	// The newest active image is the one that the family resolves to, so it is
+	// kept regardless of the retention policy.
+	head := -1
+	for i, d := range sorted {
+		if active(d.image) {
+			head = i
+			break
+		}
+	}
+	var result []*GCDecision
+	for i, d := range sorted {
+		decision := &GCDecision{Image: d.image.Name}
+		result = append(result, decision)
+		age := now.Sub(d.created)
+		if reason, ok := protected(d.image, policy.ProtectedLabels); ok {
+			decision.Reason = reason
+			continue
+		}
+		if i < policy.KeepLast {
+			decision.Reason = fmt.Sprintf("one of the %d newest images", policy.KeepLast)
+			continue
+		}
+		if i == head {
+			decision.Reason = "newest active image in the family"
+			continue
+		}
+		if d.image.Deprecated != nil && d.image.Deprecated.Deleted != "" {
+			deleted, err := time.Parse(time.RFC3339, d.image.Deprecated.Deleted)
+			if err == nil && !deleted.After(now) {
+				decision.Delete = true
+				decision.Reason = fmt.Sprintf("deletion time %s has passed", d.image.Deprecated.Deleted)
+				continue
+			}
+		}
+		switch {
+		case policy.MaxAge > 0 && age > policy.MaxAge:
+			decision.Delete = true
+			decision.Reason = fmt.Sprintf("older than %s", policy.MaxAge)
+		case policy.MaxAge > 0:
+			decision.Reason = fmt.Sprintf("newer than %s", policy.MaxAge)
+		case policy.KeepLast > 0:
+			decision.Delete = true
+			decision.Reason = fmt.Sprintf("not one of the %d newest images", policy.KeepLast)
+		default:
+			decision.Reason = "no retention limit applies"
+		}
+	}
+	return append(result, unknown...)
+}
+
+func gcImages(ctx context.Context, svc *compute.Service, project, family string, policy *RetentionPolicy, dryRun bool,
+	t *timePkg) ([]*GCDecision, error) {
+	if family == "" {
+		return nil, fmt.Errorf("an image family is required for garbage collection")
+	}
+	images, err := familyImages(ctx, svc, project, family)
+	if err != nil {
+		return nil, err
+	}
+	decisions := gcDecisions(images, policy, t.Now())
+	if dryRun {
+		return decisions, nil
+	}
+	var ops []*compute.Operation
+	for _, d := range decisions {
+		if !d.Delete {
+			continue
+		}
+		op, err := svc.Images.Delete(project, d.Image).Do()
+		if err != nil {
+			return decisions, fmt.Errorf("error deleting image %s: %v", d.Image, err)
+		}
+		ops = append(ops, op)
+	}
+	return decisions, waitForOps(ctx, svc, project, ops, t)
+}
+
+// GCImages garbage collects the images in an image family according to the
+// given retention policy. Protected images, the newest images and the newest
+// active image, which the family resolves to, are always kept. The remaining
+// images are deleted if they are older than the maximum age, or if the
+// deletion time in their deprecation status has passed. If dryRun is set,
+// nothing is deleted. The decision made for each image is returned, from
+// newest to oldest image.
+func GCImages(ctx context.Context, svc *compute.Service, project, family string, policy *RetentionPolicy,
+	dryRun bool) ([]*GCDecision, error) {
+	return gcImages(ctx, svc, project, family, policy, dryRun, realTime)
+}
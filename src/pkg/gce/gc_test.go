@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	"github.com/google/go-cmp/cmp"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func familyImage(name string, created time.Time) *compute.Image {
+	return &compute.Image{Name: name, Family: "f", CreationTimestamp: created.Format(time.RFC3339)}
+}
+
+func TestGCImages(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	expired := familyImage("expired", now.Add(-2*day))
+	expired.Deprecated = &compute.DeprecationStatus{State: "DEPRECATED", Deleted: now.Add(-time.Hour).Format(time.RFC3339)}
+	protectedImage := familyImage("protected", now.Add(-30*day))
+	protectedImage.Labels = map[string]string{"release": "yes"}
+	images := []*compute.Image{
+		familyImage("day-10", now.Add(-10*day)),
+		familyImage("day-1", now.Add(-1*day)),
+		expired,
+		familyImage("day-5", now.Add(-5*day)),
+		protectedImage,
+		{Name: "no-time", Family: "f"},
+		{Name: "other-family", Family: "g", CreationTimestamp: now.Add(-100 * day).Format(time.RFC3339)},
+	}
+	var testData = []struct {
+		testName    string
+		policy      *RetentionPolicy
+		dryRun      bool
+		wantDeleted []string
+	}{
+		{
+			testName:    "ExpiredOnly",
+			policy:      &RetentionPolicy{},
+			wantDeleted: []string{"expired"},
+		},
+		{
+			testName:    "KeepLast",
+			policy:      &RetentionPolicy{KeepLast: 2},
+			wantDeleted: []string{"day-5", "day-10", "protected"},
+		},
+		{
+			testName:    "MaxAge",
+			policy:      &RetentionPolicy{MaxAge: 7 * day},
+			wantDeleted: []string{"expired", "day-10", "protected"},
+		},
+		{
+			testName:    "MaxAgeKeepsFamilyHead",
+			policy:      &RetentionPolicy{MaxAge: 12 * time.Hour},
+			wantDeleted: []string{"expired", "day-5", "day-10", "protected"},
+		},
+		{
+			testName:    "ProtectedLabelKey",
+			policy:      &RetentionPolicy{MaxAge: 7 * day, ProtectedLabels: map[string]string{"release": ""}},
+			wantDeleted: []string{"expired", "day-10"},
+		},
+		{
+			testName:    "KeepLastAndMaxAge",
+			policy:      &RetentionPolicy{KeepLast: 1, MaxAge: 3 * day},
+			wantDeleted: []string{"expired", "day-5", "day-10", "protected"},
+		},
+		{
+			testName:    "ProtectedLabelValue",
+			policy:      &RetentionPolicy{MaxAge: 7 * day, ProtectedLabels: map[string]string{"release": "no"}},
+			wantDeleted: []string{"expired", "day-10", "protected"},
+		},
+		{
+			testName:    "DryRun",
+			policy:      &RetentionPolicy{KeepLast: 1},
+			dryRun:      true,
+			wantDeleted: []string{"expired", "day-5", "day-10", "protected"},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			fakeGCE, client := fakes.GCEForTest(t, "test-project")
+			defer fakeGCE.Close()
+			fakeGCE.Images.Items = append([]*compute.Image{}, images...)
+			decisions, err := gcImages(context.Background(), client, "test-project", "f", input.policy, input.dryRun,
+				fakeTime(now))
+			if err != nil {
+				t.Fatalf("gcImages: %v", err)
+			}
+			var gotDeleted []string
+			for _, d := range decisions {
+				if d.Delete {
+					gotDeleted = append(gotDeleted, d.Image)
+				}
+			}
+			if diff := cmp.Diff(gotDeleted, input.wantDeleted); diff != "" {
+				t.Errorf("gcImages: deleted images mismatch: diff (-got, +want): %s", diff)
+			}
+			wantRemaining := len(images)
+			if !input.dryRun {
+				wantRemaining -= len(input.wantDeleted)
+			}
+			if len(fakeGCE.Images.Items) != wantRemaining {
+				t.Errorf("gcImages: got %d remaining images, want %d: %v", len(fakeGCE.Images.Items), wantRemaining,
+					fakeGCE.Images.Items)
+			}
+		})
+	}
+}
+
+func TestGCImagesNoFamily(t *testing.T) {
+	if _, err := GCImages(context.Background(), nil, "test-project", "", &RetentionPolicy{}, true); err == nil {
+		t.Error("GCImages: did not fail without a family")
+	}
+}
+
+func TestGCDecisionsDeprecatedHead(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	deprecated := familyImage("deprecated", now.Add(-2*day))
+	deprecated.Deprecated = &compute.DeprecationStatus{State: "DEPRECATED"}
+	images := []*compute.Image{
+		familyImage("day-10", now.Add(-10*day)),
+		deprecated,
+		familyImage("day-5", now.Add(-5*day)),
+	}
+	got := gcDecisions(images, &RetentionPolicy{MaxAge: day}, now)
+	want := []*GCDecision{
+		{Image: "deprecated", Delete: true, Reason: "older than 24h0m0s"},
+		{Image: "day-5", Reason: "newest active image in the family"},
+		{Image: "day-10", Delete: true, Reason: "older than 24h0m0s"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("gcDecisions: got unexpected decisions; diff (-got, +want): %s", diff)
+	}
+}
@@ -17,13 +17,17 @@ package gce
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
@@ -35,11 +39,20 @@ import (
 const (
 	defaultOperationTimeout = time.Duration(600) * time.Second
 	defaultRetryInterval    = time.Duration(5) * time.Second
+	// initialPollInterval and maxPollInterval bound the exponential backoff
+	// used when polling operations.
+	initialPollInterval = time.Second
+	maxPollInterval     = time.Duration(30) * time.Second
+	// maxIAMPolicyAttempts is the number of times an IAM policy read-modify-write
+	// is attempted before giving up on etag conflicts.
+	maxIAMPolicyAttempts = 5
+	// imageUserRole is the IAM role that allows principals to use an image.
+	imageUserRole = "roles/compute.imageUser"
 )
 
 type timePkg struct {
 	Now   func() time.Time
-	Sleep func(time.Duration)
+	After func(time.Duration) <-chan time.Time
 }
 
 var (
@@ -49,12 +62,12 @@ var (
 	// ErrImageNotFound indicates that a GCE image could not be found
 	ErrImageNotFound = errors.New("image not found")
 
-	realTime = &timePkg{time.Now, time.Sleep}
+	realTime = &timePkg{time.Now, time.After}
 
 	// This should match <prefix>-<channel>-<milestone>-<buildnumber>.
 	// This is the format of images in cos-cloud.
 	// Example: cos-dev-72-11172-0-0
-	imageNameRegex = regexp.MustCompile("[a-z0-9-]+-[a-z]+-([0-9]+)-([0-9]+-[0-9]+-[0-9]+)")
+	imageNameRegex = regexp.MustCompile("[a-z0-9-]+-([a-z]+)-([0-9]+)-([0-9]+-[0-9]+-[0-9]+)")
 )
 
 // buildDeprecationStatus constructs a *compute.DeprecationStatus struct used in a Deprecate GCE API
@@ -68,41 +81,6 @@ func buildDeprecationStatus(replacement string, deleteTime time.Time) *compute.D
 	return status
 }
 
-func waitForOp(svc *compute.Service, project string, op *compute.Operation, deadline time.Time, t *timePkg) error {
-	if op.Error != nil {
-		return fmt.Errorf("error with operation. name: %s error: %v", op.Name, op.Error)
-	}
-	if op.Status == "DONE" {
-		return nil
-	}
-	for {
-		t.Sleep(defaultRetryInterval)
-		op, err := svc.GlobalOperations.Get(project, op.Name).Do()
-		if err != nil {
-			return err
-		}
-		if op.Error != nil {
-			return fmt.Errorf("error with operation. name: %s error: %v", op.Name, op.Error)
-		}
-		if op.Status == "DONE" {
-			return nil
-		}
-		if t.Now().After(deadline) {
-			return ErrTimeout
-		}
-	}
-}
-
-func waitForOps(svc *compute.Service, project string, ops []*compute.Operation, t *timePkg) error {
-	deadline := t.Now().Add(defaultOperationTimeout)
-	for _, op := range ops {
-		if err := waitForOp(svc, project, op, deadline, t); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func deprecateInFamily(ctx context.Context, svc *compute.Service, newImage *config.Image, ttl int, t *timePkg) error {
 	if newImage.Family == "" {
 		return fmt.Errorf("input image does not have a family for deprecateInFamily. image: %v", newImage)
@@ -132,7 +110,7 @@ func deprecateInFamily(ctx context.Context, svc *compute.Service, newImage *conf
 		}
 		ops = append(ops, op)
 	}
-	return waitForOps(svc, newImage.Project, ops, t)
+	return waitForOps(ctx, svc, newImage.Project, ops, t)
 }
 
 // DeprecateInFamily deprecates all of the old images in an image family.
@@ -152,8 +130,383 @@ func ImageExists(svc *compute.Service, project, name string) (bool, error) {
 	return true, nil
 }
 
+// AcceleratorType gets the given accelerator type in the given zone, or nil if
+// the accelerator type isn't offered in that zone.
+func AcceleratorType(svc *compute.Service, project, zone, name string) (*compute.AcceleratorType, error) {
+	acceleratorType, err := svc.AcceleratorTypes.Get(project, zone, name).Do()
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return acceleratorType, nil
+}
+
+// maxImageNameLength is the maximum length of a GCE image name.
+const maxImageNameLength = 63
+
+// AvailableImageName finds a name for a new image in the given project by
+// appending an incrementing suffix ("-1", "-2", ...) to the given name. The
+// first name that isn't taken by an existing image is returned.
+func AvailableImageName(svc *compute.Service, project, name string) (string, error) {
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if len(candidate) > maxImageNameLength {
+			return "", fmt.Errorf("cannot find an available name for image %s: %s is longer than %d characters",
+				name, candidate, maxImageNameLength)
+		}
+		exists, err := ImageExists(svc, project, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+// TemporaryImageName generates a unique name to build an image under before it
+// replaces the existing image with the given name. The given name is shortened
+// if needed to fit the random suffix.
+func TemporaryImageName(name string) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	suffix := "-tmp-" + hex.EncodeToString(b)
+	if len(name)+len(suffix) > maxImageNameLength {
+		name = name[:maxImageNameLength-len(suffix)]
+	}
+	return name + suffix, nil
+}
+
+func deleteImage(ctx context.Context, svc *compute.Service, project, name string, t *timePkg) error {
+	op, err := svc.Images.Delete(project, name).Do()
+	if err != nil {
+		return fmt.Errorf("error deleting image %s: %v", name, err)
+	}
+	return waitForOps(ctx, svc, project, []*compute.Operation{op}, t)
+}
+
+// DeleteImage deletes the given image and waits for the deletion to finish.
+func DeleteImage(ctx context.Context, svc *compute.Service, project, name string) error {
+	return deleteImage(ctx, svc, project, name, realTime)
+}
+
+func replaceImage(ctx context.Context, svc *compute.Service, image *config.Image, name string, t *timePkg) error {
+	src, err := svc.Images.Get(image.Project, image.Name).Do()
+	if err != nil {
+		return err
+	}
+	exists, err := ImageExists(svc, image.Project, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := deleteImage(ctx, svc, image.Project, name, t); err != nil {
+			return err
+		}
+	}
+	replacement := &compute.Image{
+		Name:            name,
+		Family:          src.Family,
+		Labels:          src.Labels,
+		Licenses:        src.Licenses,
+		Description:     src.Description,
+		GuestOsFeatures: src.GuestOsFeatures,
+		SourceImage:     image.URL(),
+	}
+	// Image names are unique, so the existing image must be deleted before its
+	// copy is created. If creating the copy fails, the given image is the only
+	// one left with the new contents, so the error names it.
+	op, err := svc.Images.Insert(image.Project, replacement).Do()
+	if err == nil {
+		err = waitForOps(ctx, svc, image.Project, []*compute.Operation{op}, t)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating image %s from %s, the new image is kept as %s: %v", name, image.Name,
+			image.Name, err)
+	}
+	return deleteImage(ctx, svc, image.Project, image.Name, t)
+}
+
+// ReplaceImage replaces the image with the given name in the project of the
+// given image by a copy of the given image, and then deletes the given image.
+// The copy has the same family, labels, licenses and guest OS features as the
+// given image. If no image with the given name exists, the copy is created
+// without deleting anything first. If creating the copy fails, the given image
+// is kept and the error names it.
+func ReplaceImage(ctx context.Context, svc *compute.Service, image *config.Image, name string) error {
+	return replaceImage(ctx, svc, image, name, realTime)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func deleteInstance(ctx context.Context, svc *compute.Service, project, zone, name string, disks []string,
+	t *timePkg) error {
+	op, err := svc.Instances.Delete(project, zone, name).Do()
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return fmt.Errorf("error deleting instance %s: %v", name, err)
+	default:
+		// Disks can only be deleted once the instance doesn't use them anymore.
+		if err := waitForOps(ctx, svc, project, []*compute.Operation{op}, t); err != nil {
+			return err
+		}
+	}
+	var ops []*compute.Operation
+	for _, disk := range disks {
+		op, err := svc.Disks.Delete(project, zone, disk).Do()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting disk %s: %v", disk, err)
+		}
+		ops = append(ops, op)
+	}
+	return waitForOps(ctx, svc, project, ops, t)
+}
+
+// DeleteInstance deletes the given instance, and then the given disks in the
+// same zone, and waits for the deletions to finish. An instance or disk that
+// doesn't exist is treated as already deleted.
+func DeleteInstance(ctx context.Context, svc *compute.Service, project, zone, name string, disks []string) error {
+	return deleteInstance(ctx, svc, project, zone, name, disks, realTime)
+}
+
+// ShareMember converts a principal given to ShareImage into an IAM policy
+// member. "project:<id>" is shorthand for the principals that have the viewer
+// role on the project, and is converted to "projectViewer:<id>". Other
+// principals must be valid IAM members of the form user:<email>,
+// group:<email>, serviceAccount:<email> or domain:<domain>.
+func ShareMember(principal string) (string, error) {
+	split := strings.SplitN(principal, ":", 2)
+	if len(split) != 2 || split[1] == "" {
+		return "", fmt.Errorf("invalid principal %q: must be of the form <type>:<id>", principal)
+	}
+	switch split[0] {
+	case "project":
+		return "projectViewer:" + split[1], nil
+	case "user", "group", "serviceAccount", "domain":
+		return principal, nil
+	default:
+		return "", fmt.Errorf("invalid principal %q: type must be one of project, user, group, serviceAccount, domain",
+			principal)
+	}
+}
+
+// isIAMConflict checks if the given error indicates that an IAM policy was
+// concurrently modified since it was read.
+func isIAMConflict(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && (e.Code == http.StatusConflict || e.Code == http.StatusPreconditionFailed)
+}
+
+// addImageUsers adds the given members to the image user binding of the given
+// policy. It reports whether the policy was changed.
+func addImageUsers(policy *compute.Policy, members []string) bool {
+	var binding *compute.Binding
+	for _, b := range policy.Bindings {
+		// Conditional bindings are left alone; the members are granted the role
+		// unconditionally.
+		if b.Role == imageUserRole && b.Condition == nil {
+			binding = b
+			break
+		}
+	}
+	if binding == nil {
+		binding = &compute.Binding{Role: imageUserRole}
+		policy.Bindings = append(policy.Bindings, binding)
+	}
+	existing := make(map[string]bool)
+	for _, m := range binding.Members {
+		existing[m] = true
+	}
+	changed := false
+	for _, m := range members {
+		if !existing[m] {
+			binding.Members = append(binding.Members, m)
+			existing[m] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+func shareImage(ctx context.Context, svc *compute.Service, image *config.Image, principals []string, t *timePkg) error {
+	var members []string
+	for _, p := range principals {
+		m, err := ShareMember(p)
+		if err != nil {
+			return err
+		}
+		members = append(members, m)
+	}
+	for attempt := 1; ; attempt++ {
+		policy, err := svc.Images.GetIamPolicy(image.Project, image.Name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		if !addImageUsers(policy, members) {
+			return nil
+		}
+		_, err = svc.Images.SetIamPolicy(image.Project, image.Name, &compute.GlobalSetPolicyRequest{Policy: policy}).
+			Context(ctx).Do()
+		if err == nil {
+			return nil
+		}
+		if !isIAMConflict(err) || attempt == maxIAMPolicyAttempts {
+			return fmt.Errorf("error setting IAM policy of image %s: %v", image.Name, err)
+		}
+		if err := sleep(ctx, t, defaultRetryInterval); err != nil {
+			return fmt.Errorf("error setting IAM policy of image %s: %v", image.Name, err)
+		}
+	}
+}
+
+// ShareImage grants the image user role on the given image to the given
+// principals (see ShareMember). The image IAM policy is read, modified and
+// written back; if it was concurrently modified in between, the update is
+// retried, for at most maxIAMPolicyAttempts attempts in total. Waiting between
+// attempts stops when the context is done.
+func ShareImage(ctx context.Context, svc *compute.Service, image *config.Image, principals []string) error {
+	return shareImage(ctx, svc, image, principals, realTime)
+}
+
+// CopyTarget is a destination that an image can be copied to.
+type CopyTarget struct {
+	Project string
+	// StorageLocation is the Cloud Storage location to store the image copy in.
+	// The default location is used if it is empty.
+	StorageLocation string
+}
+
+// ParseCopyTarget parses a copy target of the form project[/storage-location].
+func ParseCopyTarget(s string) (*CopyTarget, error) {
+	split := strings.SplitN(s, "/", 2)
+	target := &CopyTarget{Project: split[0]}
+	if len(split) == 2 {
+		target.StorageLocation = split[1]
+		if target.StorageLocation == "" {
+			return nil, fmt.Errorf("invalid copy target %q: storage location is empty", s)
+		}
+	}
+	if target.Project == "" {
+		return nil, fmt.Errorf("invalid copy target %q: project is empty", s)
+	}
+	return target, nil
+}
+
+// String formats the copy target in the form accepted by ParseCopyTarget.
+func (c *CopyTarget) String() string {
+	if c.StorageLocation == "" {
+		return c.Project
+	}
+	return c.Project + "/" + c.StorageLocation
+}
+
+// CopyError reports the destinations that an image couldn't be copied to.
+type CopyError struct {
+	// Errs holds the error for each failed destination, keyed by destination.
+	Errs map[string]error
+	// Total is the number of destinations that the image copy was attempted to.
+	Total int
+}
+
+// Error implements error.Error.
+func (e *CopyError) Error() string {
+	var dests []string
+	for dest := range e.Errs {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	var msgs []string
+	for _, dest := range dests {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", dest, e.Errs[dest]))
+	}
+	return fmt.Sprintf("failed to copy image to %d of %d destinations: %s", len(e.Errs), e.Total,
+		strings.Join(msgs, "; "))
+}
+
+func copyImage(ctx context.Context, svc *compute.Service, src *compute.Image, srcImage *config.Image, target *CopyTarget,
+	deprecateOld bool, ttl int, t *timePkg) error {
+	image := &compute.Image{
+		Name:            src.Name,
+		Family:          src.Family,
+		Labels:          src.Labels,
+		Licenses:        src.Licenses,
+		Description:     src.Description,
+		GuestOsFeatures: src.GuestOsFeatures,
+		SourceImage:     srcImage.URL(),
+	}
+	if target.StorageLocation != "" {
+		image.StorageLocations = []string{target.StorageLocation}
+	}
+	op, err := svc.Images.Insert(target.Project, image).Do()
+	if err != nil {
+		return err
+	}
+	if err := waitForOps(ctx, svc, target.Project, []*compute.Operation{op}, t); err != nil {
+		return err
+	}
+	if deprecateOld {
+		copied := &config.Image{Image: image, Project: target.Project}
+		if err := deprecateInFamily(ctx, svc, copied, ttl, t); err != nil {
+			return fmt.Errorf("image was copied, but deprecating old images failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func copyImages(ctx context.Context, svc *compute.Service, srcImage *config.Image, targets []*CopyTarget,
+	deprecateOld bool, ttl int, t *timePkg) error {
+	src, err := svc.Images.Get(srcImage.Project, srcImage.Name).Do()
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *CopyTarget) {
+			defer wg.Done()
+			err := copyImage(ctx, svc, src, srcImage, target, deprecateOld, ttl, t)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[target.String()] = err
+				return
+			}
+			log.Printf("Copied image %s to %s", src.Name, target)
+		}(target)
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		return &CopyError{Errs: errs, Total: len(targets)}
+	}
+	return nil
+}
+
+// CopyImage copies the given image to each of the given targets in parallel.
+// The copies have the same name, family, labels, licenses and guest OS
+// features as the source image. If deprecateOld is set, the old images in the
+// image family of each copy are deprecated, in the same way as
+// DeprecateInFamily. If any of the copies fail, a *CopyError is returned.
+func CopyImage(ctx context.Context, svc *compute.Service, srcImage *config.Image, targets []*CopyTarget,
+	deprecateOld bool, ttl int) error {
+	return copyImages(ctx, svc, srcImage, targets, deprecateOld, ttl, realTime)
+}
+
 type decodedImageName struct {
 	name        string
+	channel     string
 	milestone   int
 	buildNumber string
 }
@@ -165,11 +518,22 @@ func newDecodedImageName(name string) (*decodedImageName, error) {
 	if match == nil {
 		return nil, fmt.Errorf("could not parse name %s", name)
 	}
-	milestone, err := strconv.Atoi(match[1])
+	milestone, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, fmt.Errorf("could not convert %s to a milestone: %s", match[2], err)
+	}
+	return &decodedImageName{name, match[1], milestone, match[3]}, nil
+}
+
+// ImageVersion gets the milestone and the build number encoded in the name of
+// a COS image. For example, the version of "cos-stable-89-16108-403-22" is
+// milestone 89 and build number "16108-403-22".
+func ImageVersion(name string) (int, string, error) {
+	decoded, err := newDecodedImageName(name)
 	if err != nil {
-		return nil, fmt.Errorf("could not convert %s to a milestone: %s", match[1], err)
+		return 0, "", err
 	}
-	return &decodedImageName{name, milestone, match[2]}, nil
+	return decoded.milestone, decoded.buildNumber, nil
 }
 
 func imageCompare(first, second *decodedImageName) bool {
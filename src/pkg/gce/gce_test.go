@@ -16,18 +16,21 @@ package gce
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
 
+	"github.com/google/go-cmp/cmp"
 	compute "google.golang.org/api/compute/v1"
 )
 
 func fakeTime(current time.Time) *timePkg {
 	fake := fakes.NewTime(current)
-	return &timePkg{fake.Now, fake.Sleep}
+	return &timePkg{fake.Now, fake.After}
 }
 
 func TestDeprecateInFamilyNoFamily(t *testing.T) {
@@ -247,6 +250,136 @@ func TestImageExists(t *testing.T) {
 	}
 }
 
+func TestAcceleratorType(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.AcceleratorTypes = []*compute.AcceleratorType{{Name: "nvidia-tesla-t4", Zone: "zones/z"}}
+	got, err := AcceleratorType(client, "test-project", "z", "nvidia-tesla-t4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Name != "nvidia-tesla-t4" {
+		t.Errorf("AcceleratorType(nvidia-tesla-t4): got %v, want nvidia-tesla-t4", got)
+	}
+	got, err = AcceleratorType(client, "test-project", "z", "nvidia-l4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("AcceleratorType(nvidia-l4): got %v, want nil", got)
+	}
+}
+
+func TestAvailableImageName(t *testing.T) {
+	tests := []struct {
+		testName string
+		images   []string
+		name     string
+		want     string
+		wantErr  bool
+	}{
+		{testName: "FirstSuffix", images: []string{"im"}, name: "im", want: "im-1"},
+		{testName: "NextSuffix", images: []string{"im", "im-1", "im-2", "im-4"}, name: "im", want: "im-3"},
+		{testName: "TooLong", images: []string{strings.Repeat("a", 62)}, name: strings.Repeat("a", 62), wantErr: true},
+	}
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			fakeGCE.Images.Items = buildImageList(test.images)
+			got, err := AvailableImageName(client, "test-project", test.name)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("AvailableImageName(_, _, %s): got err %v, want err: %v", test.name, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("AvailableImageName(_, _, %s): got %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = buildImageList([]string{"im-1", "im-2"})
+	if err := deleteImage(context.Background(), client, "test-project", "im-1", fakeTime(time.Now())); err != nil {
+		t.Fatalf("deleteImage: %v", err)
+	}
+	if exists, err := ImageExists(client, "test-project", "im-1"); err != nil || exists {
+		t.Errorf("deleteImage: image im-1 still exists; err: %v", err)
+	}
+	if err := deleteImage(context.Background(), client, "test-project", "im-3", fakeTime(time.Now())); err == nil {
+		t.Error("deleteImage(im-3): got nil, want error for a missing image")
+	}
+}
+
+func TestReplaceImage(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{
+		{Name: "im-1", Description: "old"},
+		{Name: "im-1-tmp", Family: "f", Labels: map[string]string{"k": "v"}, Description: "new"},
+	}
+	tmp := config.NewImage("im-1-tmp", "test-project")
+	if err := replaceImage(context.Background(), client, tmp, "im-1", fakeTime(time.Now())); err != nil {
+		t.Fatalf("replaceImage: %v", err)
+	}
+	if len(fakeGCE.Images.Items) != 1 {
+		t.Fatalf("replaceImage: got images %v, want only im-1", fakeGCE.Images.Items)
+	}
+	got := fakeGCE.Images.Items[0]
+	if got.Name != "im-1" || got.Description != "new" || got.Family != "f" || got.Labels["k"] != "v" ||
+		got.SourceImage != "projects/test-project/global/images/im-1-tmp" {
+		t.Errorf("replaceImage: got image %+v, want a copy of im-1-tmp named im-1", got)
+	}
+}
+
+func TestReplaceImageInsertFails(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{Name: "im-1"}, {Name: "im-1-tmp"}}
+	fakeGCE.Failures = []*fakes.Failure{{Method: "POST", Path: "global/images", Code: 500, Count: -1}}
+	tmp := config.NewImage("im-1-tmp", "test-project")
+	err := replaceImage(context.Background(), client, tmp, "im-1", fakeTime(time.Now()))
+	if err == nil || !strings.Contains(err.Error(), "kept as im-1-tmp") {
+		t.Errorf("replaceImage: got %v, want an error that names the kept image im-1-tmp", err)
+	}
+	if len(fakeGCE.Images.Items) != 1 || fakeGCE.Images.Items[0].Name != "im-1-tmp" {
+		t.Errorf("replaceImage: got images %v, want only im-1-tmp", fakeGCE.Images.Items)
+	}
+}
+
+func TestDeleteInstance(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Disks = []*compute.Disk{
+		{Name: "vm-boot", Zone: "zones/z", SelfLink: "projects/test-project/zones/z/disks/vm-boot",
+			Users: []string{"projects/test-project/zones/z/instances/vm"}},
+		{Name: "other", Zone: "zones/z"},
+	}
+	fakeGCE.Instances = []*compute.Instance{{
+		Name:     "vm",
+		Zone:     "zones/z",
+		SelfLink: "projects/test-project/zones/z/instances/vm",
+		Disks:    []*compute.AttachedDisk{{Source: "projects/test-project/zones/z/disks/vm-boot"}},
+	}}
+	if err := deleteInstance(context.Background(), client, "test-project", "z", "vm", []string{"vm-boot", "vm-cidata"},
+		fakeTime(time.Now())); err != nil {
+		t.Fatalf("deleteInstance: %v", err)
+	}
+	if len(fakeGCE.Instances) != 0 {
+		t.Errorf("deleteInstance: got instances %v, want none", fakeGCE.Instances)
+	}
+	if len(fakeGCE.Disks) != 1 || fakeGCE.Disks[0].Name != "other" {
+		t.Errorf("deleteInstance: got disks %v, want only disk other", fakeGCE.Disks)
+	}
+	// Deleting an instance that was already deleted succeeds.
+	if err := deleteInstance(context.Background(), client, "test-project", "z", "vm", []string{"vm-boot"},
+		fakeTime(time.Now())); err != nil {
+		t.Errorf("deleteInstance: got %v, want nil for a deleted instance", err)
+	}
+}
+
 func buildImageList(names []string) []*compute.Image {
 	var images []*compute.Image
 	for _, name := range names {
@@ -255,6 +388,19 @@ func buildImageList(names []string) []*compute.Image {
 	return images
 }
 
+func TestImageVersion(t *testing.T) {
+	milestone, buildNumber, err := ImageVersion("cos-stable-89-16108-403-22")
+	if err != nil {
+		t.Fatalf("ImageVersion: %v", err)
+	}
+	if milestone != 89 || buildNumber != "16108-403-22" {
+		t.Errorf("ImageVersion: got (%d, %q), want (89, %q)", milestone, buildNumber, "16108-403-22")
+	}
+	if _, _, err := ImageVersion("my-image"); err == nil {
+		t.Error("ImageVersion(my-image): got nil, want error")
+	}
+}
+
 func TestResolveMilestone(t *testing.T) {
 	testResolveMilestoneData := []struct {
 		testName      string
@@ -308,3 +454,187 @@ func TestResolveMilestone(t *testing.T) {
 		})
 	}
 }
+
+func TestShareImage(t *testing.T) {
+	testShareImageData := []struct {
+		testName    string
+		policy      *compute.Policy
+		principals  []string
+		conflicts   int
+		wantMembers []string
+		wantErr     bool
+	}{
+		{
+			testName:    "EmptyPolicy",
+			principals:  []string{"project:p", "group:g@example.com"},
+			wantMembers: []string{"projectViewer:p", "group:g@example.com"},
+		},
+		{
+			testName: "ExistingBinding",
+			policy: &compute.Policy{Etag: "e", Bindings: []*compute.Binding{
+				{Role: "roles/compute.imageUser", Members: []string{"user:u@example.com"}},
+			}},
+			principals:  []string{"user:u@example.com", "domain:example.com"},
+			wantMembers: []string{"user:u@example.com", "domain:example.com"},
+		},
+		{
+			testName:    "RetryConflict",
+			principals:  []string{"project:p"},
+			conflicts:   maxIAMPolicyAttempts - 1,
+			wantMembers: []string{"projectViewer:p"},
+		},
+		{
+			testName:   "TooManyConflicts",
+			principals: []string{"project:p"},
+			conflicts:  maxIAMPolicyAttempts,
+			wantErr:    true,
+		},
+		{
+			testName:   "InvalidPrincipal",
+			principals: []string{"alice@example.com"},
+			wantErr:    true,
+		},
+	}
+	for _, input := range testShareImageData {
+		t.Run(input.testName, func(t *testing.T) {
+			fakeGCE, client := fakes.GCEForTest(t, "test-project")
+			defer fakeGCE.Close()
+			fakeGCE.Images.Items = []*compute.Image{{Name: "im-1"}}
+			if input.policy != nil {
+				fakeGCE.IAMPolicies["im-1"] = input.policy
+			}
+			fakeGCE.IAMConflicts = input.conflicts
+			image := config.NewImage("im-1", "test-project")
+			err := shareImage(context.Background(), client, image, input.principals, fakeTime(time.Now()))
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Fatalf("shareImage(_, %v, %v, _): got %v, want error: %v", image, input.principals, err, input.wantErr)
+			}
+			if input.wantErr {
+				return
+			}
+			policy := fakeGCE.IAMPolicies["im-1"]
+			var got []string
+			for _, b := range policy.Bindings {
+				if b.Role == "roles/compute.imageUser" {
+					got = append(got, b.Members...)
+				}
+			}
+			if !cmp.Equal(got, input.wantMembers) {
+				t.Errorf("shareImage(_, %v, %v, _): got image users %v, want %v", image, input.principals, got,
+					input.wantMembers)
+			}
+		})
+	}
+}
+
+func TestShareImageCanceled(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{Name: "im-1"}}
+	fakeGCE.IAMConflicts = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The context is canceled while waiting to retry, and the retry never
+	// fires.
+	tm := fakeTime(time.Now())
+	tm.After = func(time.Duration) <-chan time.Time {
+		cancel()
+		return nil
+	}
+	image := config.NewImage("im-1", "test-project")
+	if err := shareImage(ctx, client, image, []string{"project:p"}, tm); err == nil {
+		t.Error("shareImage: got nil, want error when the context is canceled")
+	}
+}
+
+func TestParseCopyTarget(t *testing.T) {
+	testParseCopyTargetData := []struct {
+		input   string
+		want    *CopyTarget
+		wantErr bool
+	}{
+		{input: "p", want: &CopyTarget{Project: "p"}},
+		{input: "p/us-west1", want: &CopyTarget{Project: "p", StorageLocation: "us-west1"}},
+		{input: "p/", wantErr: true},
+		{input: "/us", wantErr: true},
+	}
+	for _, input := range testParseCopyTargetData {
+		got, err := ParseCopyTarget(input.input)
+		if gotErr := err != nil; gotErr != input.wantErr {
+			t.Errorf("ParseCopyTarget(%q): got error %v, want error: %v", input.input, err, input.wantErr)
+			continue
+		}
+		if !cmp.Equal(got, input.want) {
+			t.Errorf("ParseCopyTarget(%q) = %+v; want %+v", input.input, got, input.want)
+		}
+		if got != nil && got.String() != input.input {
+			t.Errorf("ParseCopyTarget(%q).String() = %q; want %q", input.input, got.String(), input.input)
+		}
+	}
+}
+
+func TestCopyImage(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "src-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{
+		Name:            "im-1",
+		Family:          "f",
+		Labels:          map[string]string{"k": "v"},
+		Licenses:        []string{"projects/cos-cloud/global/licenses/cos"},
+		GuestOsFeatures: []*compute.GuestOsFeature{{Type: "UEFI_COMPATIBLE"}},
+	}}
+	dst1 := fakeGCE.AddProject("dst-1")
+	dst1.Images.Items = []*compute.Image{{Name: "old", Family: "f"}}
+	dst2 := fakeGCE.AddProject("dst-2")
+	// dst-3 already has an image with the same name, so the copy fails.
+	dst3 := fakeGCE.AddProject("dst-3")
+	dst3.Images.Items = []*compute.Image{{Name: "im-1"}}
+	var targets []*CopyTarget
+	for _, s := range []string{"dst-1", "dst-2/us", "dst-3", "dst-4"} {
+		target, err := ParseCopyTarget(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, target)
+	}
+	err := copyImages(context.Background(), client, config.NewImage("im-1", "src-project"), targets, true, 0,
+		fakeTime(time.Now()))
+	copyErr, ok := err.(*CopyError)
+	if !ok {
+		t.Fatalf("copyImages: got %v, want *CopyError", err)
+	}
+	var failed []string
+	for dest := range copyErr.Errs {
+		failed = append(failed, dest)
+	}
+	sort.Strings(failed)
+	if want := []string{"dst-3", "dst-4"}; !cmp.Equal(failed, want) || copyErr.Total != 4 {
+		t.Errorf("copyImages: got failed destinations %v of %d, want %v of 4", failed, copyErr.Total, want)
+	}
+	for _, dst := range []*fakes.GCE{dst1, dst2} {
+		var copied *compute.Image
+		for _, im := range dst.Images.Items {
+			if im.Name == "im-1" {
+				copied = im
+			}
+		}
+		if copied == nil {
+			t.Errorf("copyImages: image was not copied; images: %v", dst.Images.Items)
+			continue
+		}
+		if copied.Family != "f" || !cmp.Equal(copied.Labels, map[string]string{"k": "v"}) || len(copied.Licenses) != 1 ||
+			len(copied.GuestOsFeatures) != 1 || copied.GuestOsFeatures[0].Type != "UEFI_COMPATIBLE" {
+			t.Errorf("copyImages: got copy %+v, want family, labels, licenses and guest OS features of the source image",
+				copied)
+		}
+		if copied.SourceImage != "projects/src-project/global/images/im-1" {
+			t.Errorf("copyImages: got source image %q, want projects/src-project/global/images/im-1", copied.SourceImage)
+		}
+	}
+	if got := dst2.Images.Items[0].StorageLocations; !cmp.Equal(got, []string{"us"}) {
+		t.Errorf("copyImages: got storage locations %v, want [us]", got)
+	}
+	if _, ok := dst1.Deprecated["old"]; !ok {
+		t.Errorf("copyImages: image 'old' in dst-1 is not deprecated; deprecated images: %v", dst1.Deprecated)
+	}
+}
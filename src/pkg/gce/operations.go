@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// OperationsError is returned when more than one of a set of GCE operations
+// fails.
+type OperationsError struct {
+	// Errs holds the errors of the failed operations.
+	Errs []error
+	// Total is the number of operations that were waited for.
+	Total int
+}
+
+func (e *OperationsError) Error() string {
+	var msgs []string
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d of %d operations failed: %s", len(e.Errs), e.Total, strings.Join(msgs, "; "))
+}
+
+// jitter picks a random duration in [d/2, d], so that clients polling many
+// operations don't poll in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// operationWaiter waits for global, regional and zonal GCE operations to
+// finish. Operations are polled with exponential backoff and jitter.
+type operationWaiter struct {
+	svc     *compute.Service
+	project string
+	timeout time.Duration
+	t       *timePkg
+}
+
+func newOperationWaiter(svc *compute.Service, project string, t *timePkg) *operationWaiter {
+	return &operationWaiter{svc: svc, project: project, timeout: defaultOperationTimeout, t: t}
+}
+
+// get fetches the current state of an operation from the endpoint that
+// matches its scope.
+func (w *operationWaiter) get(ctx context.Context, op *compute.Operation) (*compute.Operation, error) {
+	switch {
+	case op.Zone != "":
+		return w.svc.ZoneOperations.Get(w.project, path.Base(op.Zone), op.Name).Context(ctx).Do()
+	case op.Region != "":
+		return w.svc.RegionOperations.Get(w.project, path.Base(op.Region), op.Name).Context(ctx).Do()
+	default:
+		return w.svc.GlobalOperations.Get(w.project, op.Name).Context(ctx).Do()
+	}
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, t *timePkg, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-t.After(d):
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait waits for a single operation to finish. The deadline is checked before
+// sleeping, and the last sleep is shortened so that the operation is polled
+// one last time at the deadline.
+func (w *operationWaiter) wait(ctx context.Context, op *compute.Operation, deadline time.Time) error {
+	interval := initialPollInterval
+	for {
+		if op.Error != nil {
+			var msgs []string
+			for _, e := range op.Error.Errors {
+				msgs = append(msgs, e.Message)
+			}
+			return fmt.Errorf("error with operation. name: %s error: %s", op.Name, strings.Join(msgs, "; "))
+		}
+		if op.Status == "DONE" {
+			return nil
+		}
+		remaining := deadline.Sub(w.t.Now())
+		if remaining <= 0 {
+			return ErrTimeout
+		}
+		d := jitter(interval)
+		if d > remaining {
+			d = remaining
+		}
+		if err := sleep(ctx, w.t, d); err != nil {
+			return err
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+		name := op.Name
+		var err error
+		op, err = w.get(ctx, op)
+		if err != nil {
+			return fmt.Errorf("error getting operation %s: %v", name, err)
+		}
+	}
+}
+
+// waitAll waits for all of the given operations to finish, sharing a single
+// deadline. Every operation is waited for, even if some of them fail. If
+// exactly one operation fails, its error is returned unchanged; if more than
+// one fails, an *OperationsError is returned.
+func (w *operationWaiter) waitAll(ctx context.Context, ops []*compute.Operation) error {
+	deadline := w.t.Now().Add(w.timeout)
+	var errs []error
+	for _, op := range ops {
+		if err := w.wait(ctx, op, deadline); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return &OperationsError{Errs: errs, Total: len(ops)}
+	}
+}
+
+func waitForOps(ctx context.Context, svc *compute.Service, project string, ops []*compute.Operation, t *timePkg) error {
+	return newOperationWaiter(svc, project, t).waitAll(ctx, ops)
+}
+
+// WaitForOperations waits for the given GCE operations in the given project to
+// finish. Global, regional and zonal operations are supported. Waiting stops
+// when the context is done, or after a timeout of 10 minutes.
+func WaitForOperations(ctx context.Context, svc *compute.Service, project string, ops []*compute.Operation) error {
+	return waitForOps(ctx, svc, project, ops, realTime)
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	"github.com/google/go-cmp/cmp"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// recordingTime is a fake time package that records the durations slept.
+func recordingTime(current time.Time, slept *[]time.Duration) *timePkg {
+	fake := fakes.NewTime(current)
+	return &timePkg{fake.Now, func(d time.Duration) <-chan time.Time {
+		*slept = append(*slept, d)
+		return fake.After(d)
+	}}
+}
+
+func TestWaitForOpsScopes(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	ops := []*compute.Operation{
+		{Name: "op-1", Status: "RUNNING"},
+		{Name: "op-2", Status: "RUNNING", Region: "https://www.googleapis.com/compute/v1/projects/test-project/regions/r"},
+		{Name: "op-3", Status: "PENDING", Zone: "https://www.googleapis.com/compute/v1/projects/test-project/zones/z"},
+		{Name: "op-4", Status: "DONE", Zone: "https://www.googleapis.com/compute/v1/projects/test-project/zones/z"},
+	}
+	if err := waitForOps(context.Background(), client, "test-project", ops, fakeTime(time.Now())); err != nil {
+		t.Fatalf("waitForOps: %v", err)
+	}
+	want := []string{"global/operations/op-1", "regions/r/operations/op-2", "zones/z/operations/op-3"}
+	if diff := cmp.Diff(fakeGCE.OperationRequests, want); diff != "" {
+		t.Errorf("waitForOps: operation requests mismatch: diff (-got, +want): %s", diff)
+	}
+}
+
+func TestWaitForOpsBackoff(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	for i := 0; i < 7; i++ {
+		fakeGCE.Operations = append(fakeGCE.Operations, &compute.Operation{Name: "op-1", Status: "RUNNING"})
+	}
+	var slept []time.Duration
+	ops := []*compute.Operation{{Name: "op-1", Status: "RUNNING"}}
+	if err := waitForOps(context.Background(), client, "test-project", ops, recordingTime(time.Now(), &slept)); err != nil {
+		t.Fatalf("waitForOps: %v", err)
+	}
+	wantMax := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		30 * time.Second, 30 * time.Second, 30 * time.Second}
+	if len(slept) != len(wantMax) {
+		t.Fatalf("waitForOps: got %d sleeps, want %d: %v", len(slept), len(wantMax), slept)
+	}
+	for i, d := range slept {
+		if d < wantMax[i]/2 || d > wantMax[i] {
+			t.Errorf("waitForOps: sleep %d: got %v, want between %v and %v", i, d, wantMax[i]/2, wantMax[i])
+		}
+	}
+}
+
+func TestWaitForOpsTimeout(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	for i := 0; i < 1000; i++ {
+		fakeGCE.Operations = append(fakeGCE.Operations, &compute.Operation{Name: "op-1", Status: "RUNNING"})
+	}
+	var slept []time.Duration
+	ops := []*compute.Operation{{Name: "op-1", Status: "RUNNING"}}
+	err := waitForOps(context.Background(), client, "test-project", ops, recordingTime(time.Now(), &slept))
+	if err != ErrTimeout {
+		t.Fatalf("waitForOps: got %v, want %v", err, ErrTimeout)
+	}
+	var total time.Duration
+	for _, d := range slept {
+		total += d
+	}
+	if total != defaultOperationTimeout {
+		t.Errorf("waitForOps: slept for %v in total, want exactly the timeout %v", total, defaultOperationTimeout)
+	}
+}
+
+func TestWaitForOpsCanceled(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ops := []*compute.Operation{{Name: "op-1", Status: "RUNNING"}, {Name: "op-2", Status: "RUNNING"}}
+	if err := waitForOps(ctx, client, "test-project", ops, fakeTime(time.Now())); err != context.Canceled {
+		t.Errorf("waitForOps: got %v, want %v", err, context.Canceled)
+	}
+	if len(fakeGCE.OperationRequests) != 0 {
+		t.Errorf("waitForOps: operations were polled after cancellation: %v", fakeGCE.OperationRequests)
+	}
+}
+
+func TestWaitForOpsErrors(t *testing.T) {
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	failed := &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Message: "quota exceeded"}}}
+	fakeGCE.Operations = []*compute.Operation{{Name: "op-2", Status: "DONE", Error: failed}}
+	ops := []*compute.Operation{
+		{Name: "op-1", Status: "DONE", Error: failed},
+		{Name: "op-2", Status: "RUNNING"},
+		{Name: "op-3", Status: "DONE"},
+	}
+	err := waitForOps(context.Background(), client, "test-project", ops, fakeTime(time.Now()))
+	opsErr, ok := err.(*OperationsError)
+	if !ok {
+		t.Fatalf("waitForOps: got %v, want *OperationsError", err)
+	}
+	if len(opsErr.Errs) != 2 || opsErr.Total != 3 {
+		t.Errorf("waitForOps: got %d of %d failed operations, want 2 of 3: %v", len(opsErr.Errs), opsErr.Total, err)
+	}
+	// A single failed operation is reported as is.
+	err = waitForOps(context.Background(), client, "test-project", ops[:1], fakeTime(time.Now()))
+	if _, ok := err.(*OperationsError); ok || err == nil {
+		t.Errorf("waitForOps: got %v, want the error of the failed operation", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// sortFamilyImages sorts the images of an image family from newest to oldest.
+// All images must have a valid creation time, so that the order is known.
+func sortFamilyImages(images []*compute.Image) error {
+	for _, image := range images {
+		if _, err := time.Parse(time.RFC3339, image.CreationTimestamp); err != nil {
+			return fmt.Errorf("image %s has an invalid creation time %q: %v", image.Name, image.CreationTimestamp, err)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		first, _ := time.Parse(time.RFC3339, images[i].CreationTimestamp)
+		second, _ := time.Parse(time.RFC3339, images[j].CreationTimestamp)
+		return first.After(second)
+	})
+	return nil
+}
+
+// rollbackTarget finds the index of the image that a rollback restores in a
+// list of family images sorted from newest to oldest.
+func rollbackTarget(images []*compute.Image, to string, steps int) (int, error) {
+	if to != "" {
+		for i, image := range images {
+			if image.Name == to {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("image %s is not in the image family", to)
+	}
+	head := -1
+	for i, image := range images {
+		if active(image) {
+			head = i
+			break
+		}
+	}
+	if head == -1 {
+		return 0, fmt.Errorf("the image family has no active image to roll back from")
+	}
+	if head+steps >= len(images) {
+		return 0, fmt.Errorf("cannot roll back %d images from %s; the image family only has %d older images",
+			steps, images[head].Name, len(images)-head-1)
+	}
+	return head + steps, nil
+}
+
+func rollbackFamily(ctx context.Context, svc *compute.Service, project, family, to string, steps int, state string,
+	t *timePkg) (string, error) {
+	switch {
+	case family == "":
+		return "", fmt.Errorf("an image family is required for a rollback")
+	case (to == "") == (steps <= 0):
+		return "", fmt.Errorf("exactly one of a target image or a positive number of steps is required for a rollback")
+	case state != "DEPRECATED" && state != "OBSOLETE":
+		return "", fmt.Errorf("invalid deprecation state %q for newer images; must be DEPRECATED or OBSOLETE", state)
+	}
+	images, err := familyImages(ctx, svc, project, family)
+	if err != nil {
+		return "", err
+	}
+	if err := sortFamilyImages(images); err != nil {
+		return "", err
+	}
+	target, err := rollbackTarget(images, to, steps)
+	if err != nil {
+		return "", err
+	}
+	if d := images[target].Deprecated; d != nil && d.State == "DELETED" {
+		return "", fmt.Errorf("cannot roll back to image %s, since it is marked DELETED", images[target].Name)
+	}
+	targetImage := config.NewImage(images[target].Name, project)
+	var ops []*compute.Operation
+	if !active(images[target]) {
+		op, err := svc.Images.Deprecate(project, targetImage.Name, &compute.DeprecationStatus{State: "ACTIVE"}).Do()
+		if err != nil {
+			return "", fmt.Errorf("error clearing the deprecation status of image %s: %v", targetImage.Name, err)
+		}
+		ops = append(ops, op)
+	}
+	for _, image := range images[:target] {
+		// Images that are already deprecated keep their deprecation status, so
+		// that their deletion time isn't reset.
+		if !active(image) {
+			continue
+		}
+		status := &compute.DeprecationStatus{State: state, Replacement: targetImage.URL()}
+		op, err := svc.Images.Deprecate(project, image.Name, status).Do()
+		if err != nil {
+			return "", fmt.Errorf("error deprecating image %s: %v", image.Name, err)
+		}
+		ops = append(ops, op)
+	}
+	return targetImage.Name, waitForOps(ctx, svc, project, ops, t)
+}
+
+// RollbackFamily restores a previous image as the head of an image family.
+// The target image is either the image named by to, or the image that is steps
+// images older than the current head of the family. The deprecation status of
+// the target image is cleared, and all active images in the family that are
+// newer than the target image are marked with the given deprecation state
+// (either DEPRECATED or OBSOLETE), with the target image as their replacement.
+// Newer images that are already deprecated are left alone. Images marked
+// DELETED can't be rolled back to. The name of the target image is returned.
+func RollbackFamily(ctx context.Context, svc *compute.Service, project, family, to string, steps int,
+	state string) (string, error) {
+	return rollbackFamily(ctx, svc, project, family, to, steps, state, realTime)
+}
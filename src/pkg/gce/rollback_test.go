@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	"github.com/google/go-cmp/cmp"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestRollbackFamily(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	images := func() []*compute.Image {
+		obsolete := familyImage("day-3", now.Add(-3*24*time.Hour))
+		obsolete.Deprecated = &compute.DeprecationStatus{State: "OBSOLETE"}
+		newest := familyImage("day-0", now)
+		newest.Deprecated = &compute.DeprecationStatus{State: "DEPRECATED"}
+		return []*compute.Image{
+			familyImage("day-2", now.Add(-2*24*time.Hour)),
+			newest,
+			obsolete,
+			familyImage("day-1", now.Add(-24*time.Hour)),
+			{Name: "other-family", Family: "g", CreationTimestamp: now.Format(time.RFC3339)},
+		}
+	}
+	var testData = []struct {
+		testName       string
+		to             string
+		steps          int
+		state          string
+		ops            []*compute.Operation
+		wantTarget     string
+		wantDeprecated map[string]*compute.DeprecationStatus
+	}{
+		{
+			testName:   "OneStep",
+			steps:      1,
+			state:      "DEPRECATED",
+			wantTarget: "day-2",
+			wantDeprecated: map[string]*compute.DeprecationStatus{
+				"day-1": {State: "DEPRECATED", Replacement: "projects/test-project/global/images/day-2"},
+			},
+		},
+		{
+			testName:   "ToObsoleteImage",
+			to:         "day-3",
+			state:      "OBSOLETE",
+			ops:        []*compute.Operation{{Name: "op-1", Status: "RUNNING"}, {Name: "op-1", Status: "DONE"}},
+			wantTarget: "day-3",
+			wantDeprecated: map[string]*compute.DeprecationStatus{
+				"day-3": {State: "ACTIVE"},
+				"day-1": {State: "OBSOLETE", Replacement: "projects/test-project/global/images/day-3"},
+				"day-2": {State: "OBSOLETE", Replacement: "projects/test-project/global/images/day-3"},
+			},
+		},
+		{
+			testName:   "ToDeprecatedHead",
+			to:         "day-0",
+			state:      "DEPRECATED",
+			wantTarget: "day-0",
+			wantDeprecated: map[string]*compute.DeprecationStatus{
+				"day-0": {State: "ACTIVE"},
+			},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			fakeGCE, client := fakes.GCEForTest(t, "test-project")
+			defer fakeGCE.Close()
+			fakeGCE.Images.Items = images()
+			fakeGCE.Operations = input.ops
+			got, err := rollbackFamily(context.Background(), client, "test-project", "f", input.to, input.steps,
+				input.state, fakeTime(now))
+			if err != nil {
+				t.Fatalf("rollbackFamily: %v", err)
+			}
+			if got != input.wantTarget {
+				t.Errorf("rollbackFamily: got target %q, want %q", got, input.wantTarget)
+			}
+			if diff := cmp.Diff(fakeGCE.Deprecated, input.wantDeprecated); diff != "" {
+				t.Errorf("rollbackFamily: deprecation status mismatch: diff (-got, +want): %s", diff)
+			}
+			if len(fakeGCE.Operations) != 0 {
+				t.Errorf("rollbackFamily: did not wait for all operations; remaining: %v", fakeGCE.Operations)
+			}
+		})
+	}
+}
+
+func TestRollbackFamilyInvalid(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	var testData = []struct {
+		testName string
+		family   string
+		to       string
+		steps    int
+		state    string
+	}{
+		{testName: "NoFamily", steps: 1, state: "DEPRECATED"},
+		{testName: "NoTarget", family: "f", state: "DEPRECATED"},
+		{testName: "ToAndSteps", family: "f", to: "day-1", steps: 1, state: "DEPRECATED"},
+		{testName: "InvalidState", family: "f", steps: 1, state: "DELETED"},
+		{testName: "TooManySteps", family: "f", steps: 3, state: "DEPRECATED"},
+		{testName: "TargetNotInFamily", family: "f", to: "other", state: "DEPRECATED"},
+		{testName: "DeletedTarget", family: "f", to: "deleted", state: "DEPRECATED"},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			fakeGCE, client := fakes.GCEForTest(t, "test-project")
+			defer fakeGCE.Close()
+			fakeGCE.Images.Items = []*compute.Image{
+				familyImage("day-0", now),
+				familyImage("day-1", now.Add(-24*time.Hour)),
+				{Name: "other", Family: "g", CreationTimestamp: now.Format(time.RFC3339)},
+				{Name: "deleted", Family: "f", CreationTimestamp: now.Add(-48 * time.Hour).Format(time.RFC3339),
+					Deprecated: &compute.DeprecationStatus{State: "DELETED"}},
+			}
+			if _, err := rollbackFamily(context.Background(), client, "test-project", input.family, input.to,
+				input.steps, input.state, fakeTime(now)); err == nil {
+				t.Error("rollbackFamily: got nil, want error")
+			}
+			if len(fakeGCE.Deprecated) != 0 {
+				t.Errorf("rollbackFamily: images were deprecated: %v", fakeGCE.Deprecated)
+			}
+		})
+	}
+}
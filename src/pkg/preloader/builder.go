@@ -0,0 +1,216 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+
+	"cloud.google.com/go/storage"
+)
+
+// Builder is an image builder backend. An image build runs each method in
+// order, and Cleanup is always run once the build is over, even if the build
+// failed.
+type Builder interface {
+	// Stage prepares the build inputs (the templated configs, the CIDATA disk
+	// and the build contexts) so that they can be used by the builder VM.
+	Stage(ctx context.Context) error
+	// Boot starts the builder VM with the boot disk and the CIDATA disk
+	// attached.
+	Boot(ctx context.Context) error
+	// Wait waits for the provisioner on the builder VM to signal success or
+	// failure on the serial port, and for the builder VM to shut down. If the
+	// provisioner waits for a boot disk resize, the boot disk is resized.
+	Wait(ctx context.Context) error
+	// Capture captures the boot disk of the builder VM as the output image.
+	Capture(ctx context.Context) error
+	// Cleanup releases the resources used by the build.
+	Cleanup(ctx context.Context) error
+	// Timeline gets the provisioning timeline of the builder VM so far.
+	Timeline() *Timeline
+}
+
+// newBuilder creates the Builder selected by the build config.
+func newBuilder(gcsClient *storage.Client, files *fs.Files, input, output *config.Image, buildSpec *config.Build,
+	provConfig *provisioner.Config) (Builder, error) {
+	switch buildSpec.Backend {
+	case "", config.BackendDaisy:
+		return &daisyBuilder{
+			gcs:        &gcsManager{gcsClient, buildSpec.GCSBucket, buildSpec.GCSDir},
+			files:      files,
+			input:      input,
+			output:     output,
+			buildSpec:  buildSpec,
+			provConfig: provConfig,
+		}, nil
+	case config.BackendLocal:
+		return &localBuilder{
+			files:      files,
+			output:     output,
+			buildSpec:  buildSpec,
+			provConfig: provConfig,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown image builder backend %q", buildSpec.Backend)
+	}
+}
+
+// cleanupTimeout is how long the cleanup of an image build can take. It also
+// bounds how long Daisy is given to clean up the workflow resources after it
+// is interrupted.
+const cleanupTimeout = 10 * time.Minute
+
+// runBuilder runs an image build using the given Builder. Cleanup uses its own
+// context, so that resources are released even if the build was canceled.
+func runBuilder(ctx context.Context, b Builder) error {
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if err := b.Cleanup(cleanupCtx); err != nil {
+			log.Printf("error cleaning up image build: %v", err)
+		}
+	}()
+	if err := b.Stage(ctx); err != nil {
+		return err
+	}
+	if err := b.Boot(ctx); err != nil {
+		return err
+	}
+	if err := b.Wait(ctx); err != nil {
+		return err
+	}
+	return b.Capture(ctx)
+}
+
+// daisyBuilder builds images on GCE using the Daisy workflow at
+// //data/build_image.wf.json. Daisy runs the entire workflow in one process,
+// so the builder VM is booted, waited on and captured by the workflow itself.
+// Daisy is run as the binary that ships in the container image, since its Go
+// library isn't a dependency of this module; progress events are derived from
+// its output instead of its API.
+//
+// TODO: run the workflow in process with the Daisy Go library, so that
+// cancellation runs the workflow cleanup directly instead of relying on the
+// Daisy binary to handle an interrupt.
+type daisyBuilder struct {
+	gcs        *gcsManager
+	files      *fs.Files
+	input      *config.Image
+	output     *config.Image
+	buildSpec  *config.Build
+	provConfig *provisioner.Config
+	args       []string
+	cmd        *exec.Cmd
+	// monitored is closed once all of the output of Daisy has been read.
+	monitored chan struct{}
+	timeline  timelineRecorder
+	// failed indicates that the Daisy workflow failed without being canceled.
+	failed bool
+}
+
+// Stage uploads the build inputs to GCS and templates the Daisy workflow.
+func (d *daisyBuilder) Stage(ctx context.Context) error {
+	var err error
+	d.args, err = daisyArgs(ctx, d.gcs, d.files, d.input, d.output, d.buildSpec, d.provConfig)
+	return err
+}
+
+// Boot starts the Daisy workflow.
+func (d *daisyBuilder) Boot(context.Context) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	d.cmd = exec.Command(d.files.DaisyBin, d.args...)
+	d.cmd.Stdout = w
+	d.cmd.Stderr = w
+	err = d.cmd.Start()
+	// Only Daisy writes to the pipe from now on, so the reader gets EOF once
+	// Daisy exits.
+	w.Close()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	d.monitored = make(chan struct{})
+	go func() {
+		defer close(d.monitored)
+		defer r.Close()
+		if err := monitorDaisy(r, os.Stdout, &d.timeline); err != nil {
+			log.Printf("error reading Daisy output: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Wait waits for the Daisy workflow to finish. If the context is done first,
+// Daisy is interrupted, which makes it cancel the workflow and delete the
+// resources that the workflow created, like the builder VM and its disks.
+// Daisy is killed if it doesn't exit within cleanupTimeout.
+func (d *daisyBuilder) Wait(ctx context.Context) error {
+	exited := make(chan error, 1)
+	go func() { exited <- d.cmd.Wait() }()
+	select {
+	case err := <-exited:
+		<-d.monitored
+		d.failed = err != nil
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("Image build canceled: %v. Interrupting Daisy to clean up the workflow resources.", ctx.Err())
+	if err := d.cmd.Process.Signal(os.Interrupt); err != nil {
+		log.Printf("error interrupting Daisy: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(cleanupTimeout):
+		log.Printf("Daisy didn't exit within %v of being interrupted; killing it. Workflow resources may be leaked.",
+			cleanupTimeout)
+		d.cmd.Process.Kill()
+		<-exited
+	}
+	<-d.monitored
+	return fmt.Errorf("image build canceled: %v", ctx.Err())
+}
+
+// Capture does nothing, since the Daisy workflow creates the output image.
+func (d *daisyBuilder) Capture(context.Context) error {
+	return nil
+}
+
+// Cleanup deletes the build inputs from GCS, unless the workflow failed and the
+// builder VM is kept for debugging.
+func (d *daisyBuilder) Cleanup(ctx context.Context) error {
+	if d.failed && d.buildSpec.DebugInstance != "" {
+		log.Printf("Keeping the build inputs in %s for debugging", d.gcs.managedDirURL())
+		return nil
+	}
+	return d.gcs.cleanup(ctx)
+}
+
+// Timeline gets the provisioning timeline from the serial port lines that
+// Daisy logged.
+func (d *daisyBuilder) Timeline() *Timeline {
+	return d.timeline.get()
+}
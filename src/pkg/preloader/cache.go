@@ -0,0 +1,225 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// cacheDir is the directory, relative to the GCS directory of the build,
+	// that holds the artifact cache. Unlike the managed directory, it isn't
+	// cleaned up after the build.
+	cacheDir = "artifact-cache"
+	// lastUsedKey is the object metadata key that records when a cached
+	// artifact was last used by an image build, in RFC 3339 format.
+	lastUsedKey = "cos-customizer-last-used"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// artifactHash holds the hashes of a local file.
+type artifactHash struct {
+	sha256 string
+	crc32c uint32
+}
+
+// hashArtifact computes the SHA-256 and CRC32C hashes of the given file.
+func hashArtifact(file string) (*artifactHash, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q: %v", file, err)
+	}
+	defer f.Close()
+	sha := sha256.New()
+	crc := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(sha, crc), f); err != nil {
+		return nil, fmt.Errorf("error reading %q: %v", file, err)
+	}
+	return &artifactHash{sha256: fmt.Sprintf("%x", sha.Sum(nil)), crc32c: crc.Sum32()}, nil
+}
+
+// groupKey computes the cache key of a group of files that must be stored in
+// the same GCS directory. It is the SHA-256 hash of a sha256sum style listing
+// of the files, so it changes if any of the files is renamed or modified.
+func groupKey(hashes map[string]*artifactHash) string {
+	var names []string
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sha := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(sha, "%s  %s\n", hashes[name].sha256, name)
+	}
+	return fmt.Sprintf("%x", sha.Sum(nil))
+}
+
+// cachedUploads gets the paths of the given files in the artifact cache,
+// relative to the cache directory. Each group of files is stored in a
+// directory named after the group's cache key, under the base names of the
+// files. The hashes of the files are returned as well.
+func cachedUploads(groups [][]string) (map[string]string, map[string]*artifactHash, error) {
+	paths := make(map[string]string)
+	hashes := make(map[string]*artifactHash)
+	for _, group := range groups {
+		groupHashes := make(map[string]*artifactHash)
+		for _, file := range group {
+			if _, ok := groupHashes[filepath.Base(file)]; ok {
+				return nil, nil, fmt.Errorf("cachedUploads: collision in file name %q", filepath.Base(file))
+			}
+			h, err := hashArtifact(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			groupHashes[filepath.Base(file)] = h
+			hashes[file] = h
+		}
+		key := groupKey(groupHashes)
+		for _, file := range group {
+			paths[file] = path.Join(key, filepath.Base(file))
+		}
+	}
+	return paths, hashes, nil
+}
+
+func (m *gcsManager) cacheDir() string {
+	return filepath.Join(m.gcsDir, cacheDir)
+}
+
+// cacheURL gets the GCS URL of the given file in the artifact cache. The file
+// should be given as a path relative to the cache directory.
+func (m *gcsManager) cacheURL(name string) string {
+	return fmt.Sprintf("gs://%s/%s", m.gcsBucket, filepath.Join(m.cacheDir(), name))
+}
+
+// storeCached stores the given file in the artifact cache, unless it is
+// already cached with a matching CRC32C. Either way, the cached object is
+// marked as used at the given time. A cached object that is deleted by
+// another image build expiring it before it is marked as used is treated as
+// a cache miss. The name should be given as a path relative to the cache
+// directory.
+func (m *gcsManager) storeCached(ctx context.Context, slots uploadSlots, file, name string, h *artifactHash,
+	now time.Time, compositeThreshold int64) error {
+	object := m.gcsClient.Bucket(m.gcsBucket).Object(filepath.Join(m.cacheDir(), name))
+	lastUsed := map[string]string{lastUsedKey: now.UTC().Format(time.RFC3339)}
+	attrs, err := object.Attrs(ctx)
+	switch {
+	case err == nil && attrs.CRC32C == h.crc32c:
+		_, err := object.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: lastUsed})
+		if err == nil {
+			log.Printf("Using cached artifact %s for %s", m.cacheURL(name), file)
+			return nil
+		}
+		if !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+		log.Printf("Cached artifact %s expired while looking it up; uploading %s again", m.cacheURL(name), file)
+	case err != nil && !errors.Is(err, storage.ErrObjectNotExist):
+		return err
+	}
+	return m.uploadFile(ctx, slots, file, object.ObjectName(), h.crc32c, lastUsed, compositeThreshold)
+}
+
+// expireCache deletes the cached artifacts that haven't been used by an image
+// build for longer than ttl. Artifacts that are used concurrently by another
+// image build are kept, since marking them as used changes their
+// metageneration, and uploading them again changes their generation.
+func (m *gcsManager) expireCache(ctx context.Context, ttl time.Duration, now time.Time) error {
+	q := &storage.Query{Prefix: m.cacheDir() + "/"}
+	it := m.gcsClient.Bucket(m.gcsBucket).Objects(ctx, q)
+	var expired []*storage.ObjectAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		lastUsed, err := time.Parse(time.RFC3339, attrs.Metadata[lastUsedKey])
+		if err != nil {
+			// Objects that weren't stored by cos-customizer are left alone.
+			continue
+		}
+		if now.Sub(lastUsed) > ttl {
+			expired = append(expired, attrs)
+		}
+	}
+	for _, attrs := range expired {
+		object := m.gcsClient.Bucket(m.gcsBucket).Object(attrs.Name).Generation(attrs.Generation).
+			If(storage.Conditions{MetagenerationMatch: attrs.Metageneration})
+		if err := object.Delete(ctx); err != nil {
+			var e *googleapi.Error
+			if errors.As(err, &e) && e.Code == http.StatusPreconditionFailed || errors.Is(err, storage.ErrObjectNotExist) {
+				continue
+			}
+			return err
+		}
+		log.Printf("Deleted expired cached artifact gs://%s/%s", m.gcsBucket, attrs.Name)
+	}
+	return nil
+}
+
+// storeInCache stores the given files in the artifact cache in parallel, and
+// deletes the cached artifacts that have expired. Keys are local files and
+// values are paths relative to the cache directory.
+func storeInCache(ctx context.Context, gcs *gcsManager, files map[string]string, hashes map[string]*artifactHash,
+	ttl time.Duration, compositeThreshold int64) error {
+	now := time.Now()
+	err := uploadFiles(files, func(slots uploadSlots, file, cacheRelPath string) error {
+		return gcs.storeCached(ctx, slots, file, cacheRelPath, hashes[file], now, compositeThreshold)
+	})
+	if err != nil {
+		return err
+	}
+	return gcs.expireCache(ctx, ttl, now)
+}
+
+// cacheTTL parses the artifact cache TTL of the build config. A TTL of zero
+// means that the artifact cache isn't used.
+func cacheTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid artifact cache TTL %q: %v", ttl, err)
+	}
+	return d, nil
+}
+
+// gcsURLDir gets the GCS URL of the directory holding the object with the
+// given GCS URL.
+func gcsURLDir(url string) string {
+	return url[:strings.LastIndex(url, "/")]
+}
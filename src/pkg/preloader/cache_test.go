@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+)
+
+func writeArtifact(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCachedUploads(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	a := writeArtifact(t, tmpDir, "a/f.run", "driver")
+	b := writeArtifact(t, tmpDir, "b/f.run", "driver")
+	c := writeArtifact(t, tmpDir, "c/g.run", "driver")
+	d := writeArtifact(t, tmpDir, "d/f.run", "other driver")
+	paths, hashes, err := cachedUploads([][]string{{a}, {b}, {c}, {d}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths[a] != paths[b] {
+		t.Errorf("cachedUploads: got %q and %q for files with the same name and contents, want the same path", paths[a], paths[b])
+	}
+	if path.Dir(paths[a]) == path.Dir(paths[c]) || path.Dir(paths[a]) == path.Dir(paths[d]) {
+		t.Errorf("cachedUploads: got paths %v, want renamed or modified files to have different cache keys", paths)
+	}
+	if path.Base(paths[c]) != "g.run" {
+		t.Errorf("cachedUploads: got path %q, want the base name g.run", paths[c])
+	}
+	if hashes[a].crc32c == hashes[d].crc32c {
+		t.Errorf("cachedUploads: got the same CRC32C for files with different contents")
+	}
+	if _, _, err := cachedUploads([][]string{{a, b}}); err == nil {
+		t.Error("cachedUploads: got nil, want error for a group with colliding file names")
+	}
+}
+
+func TestStoreCached(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	file := writeArtifact(t, tmpDir, "f.run", "driver")
+	h, err := hashArtifact(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcs := fakes.GCSForTest(t)
+	gm := &gcsManager{gcs.Client, "bucket", "dir"}
+	const key = "/bucket/dir/artifact-cache/k/f.run"
+	first := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	if err := gm.storeCached(context.Background(), newUploadSlots(), file, "k/f.run", h, first, 0); err != nil {
+		t.Fatal(err)
+	}
+	generation := gcs.Attrs[key].Generation
+	if got := gcs.Attrs[key].Metadata[lastUsedKey]; got != "2021-03-04T10:00:00Z" {
+		t.Errorf("storeCached: got last used %q, want 2021-03-04T10:00:00Z", got)
+	}
+	if err := gm.storeCached(context.Background(), newUploadSlots(), file, "k/f.run", h, first.Add(time.Hour), 0); err != nil {
+		t.Fatal(err)
+	}
+	if gcs.Attrs[key].Generation != generation {
+		t.Errorf("storeCached: cached artifact was uploaded again")
+	}
+	if got := gcs.Attrs[key].Metadata[lastUsedKey]; got != "2021-03-04T11:00:00Z" {
+		t.Errorf("storeCached: got last used %q, want 2021-03-04T11:00:00Z", got)
+	}
+	// The cached artifact is deleted by another image build between looking it
+	// up and marking it as used.
+	gcs.Failures = []*fakes.Failure{{Method: "PATCH", Path: "/storage/v1/b/bucket/o/.*", Code: http.StatusNotFound,
+		Count: 1}}
+	if err := gm.storeCached(context.Background(), newUploadSlots(), file, "k/f.run", h, first.Add(2*time.Hour), 0); err != nil {
+		t.Fatalf("storeCached: got %v, want the deleted artifact to be uploaded again", err)
+	}
+	if gcs.Attrs[key].Generation == generation {
+		t.Errorf("storeCached: deleted cached artifact was not uploaded again")
+	}
+	if got := gcs.Attrs[key].Metadata[lastUsedKey]; got != "2021-03-04T12:00:00Z" {
+		t.Errorf("storeCached: got last used %q, want 2021-03-04T12:00:00Z", got)
+	}
+	gcs.Objects[key] = []byte("corrupt")
+	if err := gm.storeCached(context.Background(), newUploadSlots(), file, "k/f.run", h, first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(gcs.Objects[key]); got != "driver" {
+		t.Errorf("storeCached: got cached artifact %q after a CRC32C mismatch, want %q", got, "driver")
+	}
+}
+
+func TestExpireCache(t *testing.T) {
+	gcs := fakes.GCSForTest(t)
+	gm := &gcsManager{gcs.Client, "bucket", "dir"}
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	objects := map[string]string{
+		"/bucket/dir/artifact-cache/old/f":   now.Add(-48 * time.Hour).Format(time.RFC3339),
+		"/bucket/dir/artifact-cache/new/f":   now.Add(-time.Hour).Format(time.RFC3339),
+		"/bucket/dir/artifact-cache/other/f": "",
+		"/bucket/dir/cos-customizer/f":       now.Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	for key, lastUsed := range objects {
+		gcs.Objects[key] = []byte("data")
+		if lastUsed != "" {
+			gcs.Attrs[key] = &fakes.GCSObjectAttrs{Generation: 1, Metageneration: 1,
+				Metadata: map[string]string{lastUsedKey: lastUsed}}
+		}
+	}
+	if err := gm.expireCache(context.Background(), 24*time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+	for key := range objects {
+		_, ok := gcs.Objects[key]
+		if want := key != "/bucket/dir/artifact-cache/old/f"; ok != want {
+			t.Errorf("expireCache: object %s exists: %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestDaisyArgsArtifactCache(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	depsFile := writeArtifact(t, tmpDir, "deps/NVIDIA-Linux-x86_64-450.51.06.run", "driver")
+	gcs := fakes.GCSForTest(t)
+	gm := &gcsManager{gcs.Client, "bucket", "dir"}
+	buildSpec := &config.Build{GCSBucket: "bucket", GCSDir: "dir", GCSFiles: []string{depsFile}, ArtifactCacheTTL: "24h"}
+	provConfig := &provisioner.Config{Steps: []provisioner.StepConfig{{
+		Type: "InstallGPU",
+		Args: mustMarshalJSON(t, &provisioner.InstallGPUStep{GCSDepsPrefix: tmpDir}),
+	}}}
+	if _, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), config.NewImage("", ""), buildSpec,
+		provConfig); err != nil {
+		t.Fatal(err)
+	}
+	for key := range gcs.Objects {
+		if !strings.HasPrefix(key, "/bucket/dir/artifact-cache/") {
+			t.Errorf("daisyArgs: got object %s, want all artifacts in the artifact cache", key)
+		}
+	}
+	if got := provConfig.BuildContexts["user"]; !strings.HasPrefix(got, "gs://bucket/dir/artifact-cache/") {
+		t.Errorf("daisyArgs: got build context %q, want a cached artifact", got)
+	}
+	var step provisioner.InstallGPUStep
+	if err := json.Unmarshal(provConfig.Steps[0].Args, &step); err != nil {
+		t.Fatal(err)
+	}
+	object := strings.TrimPrefix(step.GCSDepsPrefix, "gs:/") + "/NVIDIA-Linux-x86_64-450.51.06.run"
+	if got, ok := gcs.Objects[object]; !ok || string(got) != "driver" {
+		t.Errorf("daisyArgs: got GCSDepsPrefix %q, want the cache directory of the GPU dependencies", step.GCSDepsPrefix)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+)
+
+var (
+	// stepStartedRegex matches the Daisy log line of a step that starts.
+	stepStartedRegex = regexp.MustCompile(`Running step "([^"]+)" \(([^)]+)\)`)
+	// stepFinishedRegex matches the Daisy log line of a step that finishes.
+	stepFinishedRegex = regexp.MustCompile(`Step "([^"]+)" \(([^)]+)\) successfully finished`)
+	// signalRegex matches the serial port lines that the provisioner and the
+	// export step print to report progress, as they are logged by Daisy's
+	// WaitForInstancesSignal step.
+	signalRegex = regexp.MustCompile(`(Build|Export)(Status|Succeeded|Failed):\s*(.*?)"?\s*$`)
+	// statusMatchRegex matches the serial port line, quoted by Daisy, that a
+	// WaitForInstancesSignal step logs when it finds a StatusMatch.
+	statusMatchRegex = regexp.MustCompile(`StatusMatch found: ("(?:[^"\\]|\\.)*")`)
+)
+
+// daisyEvent is a progress event of a Daisy workflow.
+type daisyEvent struct {
+	// Severity is the Cloud Logging severity of the event.
+	Severity string `json:"severity"`
+	// Event is the kind of the event: step-started, step-finished,
+	// build-status, build-succeeded, build-failed, export-status,
+	// export-succeeded or export-failed.
+	Event    string `json:"event"`
+	Step     string `json:"step,omitempty"`
+	StepType string `json:"stepType,omitempty"`
+	Message  string `json:"message"`
+}
+
+// parseDaisyLine gets the progress event in a line of Daisy output, or nil if
+// the line doesn't hold one.
+func parseDaisyLine(line string) *daisyEvent {
+	if match := stepStartedRegex.FindStringSubmatch(line); match != nil {
+		return &daisyEvent{Severity: "INFO", Event: "step-started", Step: match[1], StepType: match[2],
+			Message: fmt.Sprintf("Running step %s (%s)", match[1], match[2])}
+	}
+	if match := stepFinishedRegex.FindStringSubmatch(line); match != nil {
+		return &daisyEvent{Severity: "INFO", Event: "step-finished", Step: match[1], StepType: match[2],
+			Message: fmt.Sprintf("Finished step %s (%s)", match[1], match[2])}
+	}
+	if strings.Contains(line, provisioner.EventPrefix) {
+		// Provisioning events are reported by monitorDaisy.
+		return nil
+	}
+	if match := signalRegex.FindStringSubmatch(line); match != nil {
+		severity := "INFO"
+		if match[2] == "Failed" {
+			severity = "ERROR"
+		}
+		return &daisyEvent{Severity: severity, Event: strings.ToLower(match[1] + "-" + match[2]), Message: match[3]}
+	}
+	return nil
+}
+
+// serialLine gets the serial port line of the builder VM in a line of Daisy
+// output. It reports false if the line doesn't hold a serial port line.
+func serialLine(line string) (string, bool) {
+	match := statusMatchRegex.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+	s, err := strconv.Unquote(match[1])
+	if err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// provisionerEvent gets the progress event for a provisioning event.
+func provisionerEvent(e *provisioner.Event) *daisyEvent {
+	event := &daisyEvent{Severity: "INFO", Event: "provisioner-" + e.Type, Message: e.Message}
+	if e.Step != 0 {
+		event.Step = strconv.Itoa(e.Step)
+		event.StepType = e.StepType
+		event.Message = fmt.Sprintf("Build step %d (%s)", e.Step, e.StepType)
+	}
+	if e.Error != "" {
+		event.Severity = "ERROR"
+		event.Message = e.Error
+	}
+	return event
+}
+
+// monitorDaisy copies the output of a Daisy process to out. After each line
+// that holds a progress event, the event is written to out as a JSON
+// structured log record. The serial port lines of the builder VM that Daisy
+// logs are recorded in timeline.
+func monitorDaisy(r io.Reader, out io.Writer, timeline *timelineRecorder) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+		event := parseDaisyLine(line)
+		if serial, ok := serialLine(line); ok {
+			timeline.addLine(serial)
+			if e := provisioner.ParseEvent(serial); e != nil {
+				event = provisionerEvent(e)
+			}
+		}
+		if event == nil {
+			continue
+		}
+		record, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(out, string(record)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDaisyLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want *daisyEvent
+	}{
+		{
+			name: "StepStarted",
+			line: `[build-image]: 2021-03-04T10:00:00Z Running step "setup" (CreateDisks)`,
+			want: &daisyEvent{Severity: "INFO", Event: "step-started", Step: "setup", StepType: "CreateDisks",
+				Message: "Running step setup (CreateDisks)"},
+		},
+		{
+			name: "StepFinished",
+			line: `[build-image]: 2021-03-04T10:00:10Z Step "setup" (CreateDisks) successfully finished.`,
+			want: &daisyEvent{Severity: "INFO", Event: "step-finished", Step: "setup", StepType: "CreateDisks",
+				Message: "Finished step setup (CreateDisks)"},
+		},
+		{
+			name: "BuildStatus",
+			line: `[build-image.run]: 2021-03-04T10:01:00Z WaitForInstancesSignal: Instance "preload-vm": StatusMatch found: "BuildStatus: Installing packages"`,
+			want: &daisyEvent{Severity: "INFO", Event: "build-status", Message: "Installing packages"},
+		},
+		{
+			name: "BuildFailed",
+			line: `[build-image.run]: 2021-03-04T10:02:00Z WaitForInstancesSignal: FailureMatch found for "preload-vm": "BuildFailed: exiting due to errors"`,
+			want: &daisyEvent{Severity: "ERROR", Event: "build-failed", Message: "exiting due to errors"},
+		},
+		{
+			name: "NoEvent",
+			line: `[Daisy] Running workflow "build-image" (id=abcde)`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(parseDaisyLine(test.line), test.want); diff != "" {
+				t.Errorf("parseDaisyLine(%q): diff (-got, +want): %s", test.line, diff)
+			}
+		})
+	}
+}
+
+func TestMonitorDaisy(t *testing.T) {
+	input := "[Daisy] Running workflow \"w\"\n[w]: Running step \"s\" (CreateInstances)\n"
+	var out strings.Builder
+	if err := monitorDaisy(strings.NewReader(input), &out, &timelineRecorder{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "[Daisy] Running workflow \"w\"" || lines[1] != "[w]: Running step \"s\" (CreateInstances)" {
+		t.Fatalf("monitorDaisy: got output %q, want the input followed by an event", out.String())
+	}
+	got := &daisyEvent{}
+	if err := json.Unmarshal([]byte(lines[2]), got); err != nil {
+		t.Fatalf("monitorDaisy: event isn't JSON: %v", err)
+	}
+	if got.Event != "step-started" || got.Step != "s" {
+		t.Errorf("monitorDaisy: got event %+v, want step-started event for step s", got)
+	}
+}
+
+func TestMonitorDaisyTimeline(t *testing.T) {
+	input := `[build-image]: Instance "preload-vm": StatusMatch found: "BuildStatus: BuildEvent: ` +
+		`{\"time\":\"2021-03-04T10:00:00Z\",\"type\":\"step-start\",\"step\":1,\"stepType\":\"RunScript\"}"` + "\n"
+	var out strings.Builder
+	var timeline timelineRecorder
+	if err := monitorDaisy(strings.NewReader(input), &out, &timeline); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("monitorDaisy: got output %q, want the input followed by an event", out.String())
+	}
+	got := &daisyEvent{}
+	if err := json.Unmarshal([]byte(lines[1]), got); err != nil {
+		t.Fatalf("monitorDaisy: event isn't JSON: %v", err)
+	}
+	if want := (&daisyEvent{Severity: "INFO", Event: "provisioner-step-start", Step: "1", StepType: "RunScript",
+		Message: "Build step 1 (RunScript)"}); !cmp.Equal(got, want) {
+		t.Errorf("monitorDaisy: got event %+v, want %+v", got, want)
+	}
+	if steps := timeline.get().Steps; len(steps) != 1 || steps[0].Type != "RunScript" {
+		t.Errorf("monitorDaisy: got timeline steps %+v, want a RunScript step", steps)
+	}
+}
+
+func TestDaisyBuilderCancel(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cleanedUp := filepath.Join(tmpDir, "cleaned_up")
+	started := filepath.Join(tmpDir, "started")
+	// The fake Daisy binary cleans up when it is interrupted, like Daisy does.
+	script := "#!/bin/sh\ntrap 'touch " + cleanedUp + "; exit 1' INT\ntouch " + started + "\n" +
+		"while true; do sleep 0.1; done\n"
+	daisyBin := filepath.Join(tmpDir, "daisy")
+	if err := ioutil.WriteFile(daisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := &daisyBuilder{files: &fs.Files{DaisyBin: daisyBin}}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := d.Boot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the trap to be installed before canceling.
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := d.Wait(ctx); err == nil {
+		t.Error("daisyBuilder.Wait: got nil, want error for a canceled build")
+	}
+	if _, err := os.Stat(cleanedUp); err != nil {
+		t.Errorf("daisyBuilder.Wait: Daisy wasn't interrupted to clean up: %v", err)
+	}
+}
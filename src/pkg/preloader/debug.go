@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/gce"
+
+	"cloud.google.com/go/storage"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// DebugLabel is the label of builder VMs that are kept for debugging.
+	DebugLabel = "cos-customizer-debug"
+	// debugMetadataKey is the metadata key of builder VMs that are kept for
+	// debugging. The startup script keeps the VM running after a failure if it
+	// is set, and its value is the GCS directory that holds the build inputs.
+	debugMetadataKey = "cos-customizer-debug"
+)
+
+// DebugSession is a builder VM that is kept running after a failed image
+// build, along with its disks and the build inputs in GCS.
+type DebugSession struct {
+	Project  string
+	Zone     string
+	Instance string
+	Disks    []string
+	// GCSBucket and GCSDir locate the GCS directory of the image build. Only
+	// the build inputs that cos-customizer manages in it are deleted.
+	GCSBucket string
+	GCSDir    string
+}
+
+// debugDisks gets the names of the boot disk and the CIDATA disk of a builder
+// VM that is kept for debugging.
+func debugDisks(instance string) (string, string) {
+	return instance + "-boot", instance + "-cidata"
+}
+
+// NewDebugSession gets the debug session of an image build with the given
+// build config, or nil if the build config doesn't keep the builder VM.
+func NewDebugSession(buildSpec *config.Build) *DebugSession {
+	if buildSpec.DebugInstance == "" {
+		return nil
+	}
+	bootDisk, cidataDisk := debugDisks(buildSpec.DebugInstance)
+	return &DebugSession{
+		Project:   buildSpec.Project,
+		Zone:      buildSpec.Zone,
+		Instance:  buildSpec.DebugInstance,
+		Disks:     []string{bootDisk, cidataDisk},
+		GCSBucket: buildSpec.GCSBucket,
+		GCSDir:    buildSpec.GCSDir,
+	}
+}
+
+// debugWorkflowFields gets the fields of the Daisy workflow that keep the
+// builder VM and its disks for debugging: the boot disk, the CIDATA disk and
+// the builder VM fields, and the builder VM metadata. They are all empty if
+// the build config doesn't keep the builder VM.
+func debugWorkflowFields(buildSpec *config.Build) ([]string, error) {
+	if buildSpec.DebugInstance == "" {
+		return make([]string, 4), nil
+	}
+	bootDisk, cidataDisk := debugDisks(buildSpec.DebugInstance)
+	var fields []string
+	for _, v := range []interface{}{
+		map[string]interface{}{"RealName": bootDisk, "NoCleanup": true},
+		map[string]interface{}{"RealName": cidataDisk, "NoCleanup": true},
+		map[string]interface{}{"RealName": buildSpec.DebugInstance, "NoCleanup": true,
+			"labels": map[string]string{DebugLabel: "true"}},
+		map[string]string{debugMetadataKey: fmt.Sprintf("gs://%s/%s", buildSpec.GCSBucket, buildSpec.GCSDir)},
+	} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		// The fields are inserted before the other fields of a JSON object.
+		fields = append(fields, strings.TrimSuffix(strings.TrimPrefix(string(data), "{"), "}")+",")
+	}
+	return fields, nil
+}
+
+// DebugSessions finds the builder VMs that are kept for debugging in the
+// given zone.
+func DebugSessions(ctx context.Context, svc *compute.Service, project, zone string) ([]*DebugSession, error) {
+	var sessions []*DebugSession
+	err := svc.Instances.List(project, zone).Filter(fmt.Sprintf("labels.%s=true", DebugLabel)).Pages(ctx,
+		func(list *compute.InstanceList) error {
+			for _, instance := range list.Items {
+				if instance.Labels[DebugLabel] != "true" {
+					continue
+				}
+				s := &DebugSession{Project: project, Zone: zone, Instance: instance.Name}
+				for _, disk := range instance.Disks {
+					s.Disks = append(s.Disks, path.Base(disk.Source))
+				}
+				if instance.Metadata != nil {
+					for _, item := range instance.Metadata.Items {
+						if item.Key == debugMetadataKey && item.Value != nil {
+							split := strings.SplitN(strings.TrimPrefix(*item.Value, "gs://"), "/", 2)
+							if len(split) == 2 {
+								s.GCSBucket, s.GCSDir = split[0], split[1]
+							}
+						}
+					}
+				}
+				sessions = append(sessions, s)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Instructions describes how to connect to the builder VM of the debug
+// session.
+func (s *DebugSession) Instructions() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "The builder VM %s is kept running in project %s, zone %s for debugging.\n", s.Instance, s.Project,
+		s.Zone)
+	fmt.Fprintf(&b, "Its disks are %s.", strings.Join(s.Disks, ", "))
+	if s.GCSBucket != "" {
+		fmt.Fprintf(&b, " The build inputs are kept in gs://%s/%s.", s.GCSBucket, path.Join(s.GCSDir, managedDir))
+	}
+	fmt.Fprintf(&b, "\nThe provisioner state is in /var/lib/.cos-customizer, and the CIDATA disk is mounted at "+
+		"/mnt/disks/cidata.\n")
+	fmt.Fprintf(&b, "To connect to the builder VM, run:\n")
+	fmt.Fprintf(&b, "  gcloud compute ssh %s --project=%s --zone=%s\n", s.Instance, s.Project, s.Zone)
+	fmt.Fprintf(&b, "or, to use its serial console:\n")
+	fmt.Fprintf(&b, "  gcloud compute connect-to-serial-port %s --project=%s --zone=%s --port=3\n", s.Instance,
+		s.Project, s.Zone)
+	fmt.Fprintf(&b, "To clean up, run:\n")
+	fmt.Fprintf(&b, "  cos-customizer cleanup-debug -project=%s -zone=%s -instance=%s\n", s.Project, s.Zone,
+		s.Instance)
+	return b.String()
+}
+
+// Exists checks if the builder VM of the debug session still exists.
+func (s *DebugSession) Exists(svc *compute.Service) (bool, error) {
+	if _, err := svc.Instances.Get(s.Project, s.Zone, s.Instance).Do(); err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Cleanup deletes the builder VM of the debug session, its disks and the build
+// inputs in GCS. Resources that were already deleted are skipped.
+func (s *DebugSession) Cleanup(ctx context.Context, svc *compute.Service, gcsClient *storage.Client) error {
+	if err := gce.DeleteInstance(ctx, svc, s.Project, s.Zone, s.Instance, s.Disks); err != nil {
+		return err
+	}
+	if s.GCSBucket == "" {
+		return nil
+	}
+	gcs := &gcsManager{gcsClient, s.GCSBucket, s.GCSDir}
+	return gcs.cleanup(ctx)
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+
+	"github.com/google/go-cmp/cmp"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// insertBuilderVM creates a builder VM with a boot disk and a CIDATA disk, like
+// the Daisy workflow does.
+func insertBuilderVM(t *testing.T, svc *compute.Service, name string, labels map[string]string,
+	metadata map[string]string) {
+	t.Helper()
+	bootDisk, cidataDisk := debugDisks(name)
+	instance := &compute.Instance{
+		Name:   name,
+		Labels: labels,
+		Disks: []*compute.AttachedDisk{
+			{InitializeParams: &compute.AttachedDiskInitializeParams{DiskName: bootDisk}},
+			{InitializeParams: &compute.AttachedDiskInitializeParams{DiskName: cidataDisk}},
+		},
+		Metadata: &compute.Metadata{},
+	}
+	for k, v := range metadata {
+		v := v
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{Key: k, Value: &v})
+	}
+	if _, err := svc.Instances.Insert("p", "z", instance).Do(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugSessions(t *testing.T) {
+	_, svc := fakes.GCEForTest(t, "p")
+	insertBuilderVM(t, svc, "debug", map[string]string{DebugLabel: "true"},
+		map[string]string{debugMetadataKey: "gs://bucket/dir/sub"})
+	insertBuilderVM(t, svc, "other", nil, nil)
+	got, err := DebugSessions(context.Background(), svc, "p", "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*DebugSession{{Project: "p", Zone: "z", Instance: "debug", Disks: []string{"debug-boot", "debug-cidata"},
+		GCSBucket: "bucket", GCSDir: "dir/sub"}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("DebugSessions: got unexpected sessions; diff (-got +want):\n%s", diff)
+	}
+	if instructions := got[0].Instructions(); !strings.Contains(instructions, "cleanup-debug -project=p -zone=z -instance=debug") {
+		t.Errorf("Instructions: got %q, want the cleanup-debug command", instructions)
+	}
+}
+
+func TestNewDebugSession(t *testing.T) {
+	if got := NewDebugSession(&config.Build{Project: "p", Zone: "z"}); got != nil {
+		t.Errorf("NewDebugSession: got %v, want nil without a debug instance", got)
+	}
+	got := NewDebugSession(&config.Build{Project: "p", Zone: "z", GCSBucket: "bucket", GCSDir: "dir",
+		DebugInstance: "debug"})
+	want := &DebugSession{Project: "p", Zone: "z", Instance: "debug", Disks: []string{"debug-boot", "debug-cidata"},
+		GCSBucket: "bucket", GCSDir: "dir"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("NewDebugSession: got unexpected session; diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestDebugSessionCleanup(t *testing.T) {
+	gce, svc := fakes.GCEForTest(t, "p")
+	gcs := fakes.GCSForTest(t)
+	insertBuilderVM(t, svc, "debug", map[string]string{DebugLabel: "true"}, nil)
+	gcs.Objects["/bucket/dir/cos-customizer/user_build_context.tar"] = []byte("context")
+	gcs.Objects["/bucket/dir/artifact-cache/k/f.run"] = []byte("driver")
+	s := &DebugSession{Project: "p", Zone: "z", Instance: "debug", Disks: []string{"debug-boot", "debug-cidata"},
+		GCSBucket: "bucket", GCSDir: "dir"}
+	if exists, err := s.Exists(svc); err != nil || !exists {
+		t.Fatalf("Exists: got (%v, %v), want (true, nil)", exists, err)
+	}
+	if err := s.Cleanup(context.Background(), svc, gcs.Client); err != nil {
+		t.Fatal(err)
+	}
+	if len(gce.Instances) != 0 || len(gce.Disks) != 0 {
+		t.Errorf("Cleanup: got instances %v and disks %v, want none", gce.Instances, gce.Disks)
+	}
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/user_build_context.tar"]; ok {
+		t.Error("Cleanup: build inputs were not deleted")
+	}
+	if _, ok := gcs.Objects["/bucket/dir/artifact-cache/k/f.run"]; !ok {
+		t.Error("Cleanup: artifact cache was deleted, want only the build inputs deleted")
+	}
+	if exists, err := s.Exists(svc); err != nil || exists {
+		t.Errorf("Exists: got (%v, %v), want (false, nil)", exists, err)
+	}
+	// Cleaning up a session that was already cleaned up succeeds.
+	if err := s.Cleanup(context.Background(), svc, gcs.Client); err != nil {
+		t.Errorf("Cleanup: got %v, want nil for a session that was cleaned up", err)
+	}
+}
@@ -16,18 +16,69 @@ package preloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
 const (
 	managedDir = "cos-customizer"
+	// maxParallelUploads is the maximum number of uploads to GCS that run at
+	// the same time, counting each part of a parallel composite upload as one
+	// upload.
+	maxParallelUploads = 4
+	// maxUploadAttempts is how many times an upload that fails with a
+	// transient error is attempted.
+	maxUploadAttempts = 4
+	// uploadRetryInterval is how long to wait before retrying a failed upload
+	// for the first time. It doubles after each attempt.
+	uploadRetryInterval = time.Second
+	// compositeComponents is the number of parts that a file is split into for
+	// a parallel composite upload. GCS composes at most 32 objects at once.
+	compositeComponents = 8
 )
 
+// newRetryTimer creates the timer that uploads wait on between attempts. Tests
+// replace it to avoid waiting.
+var newRetryTimer = time.NewTimer
+
+// uploadSlots limits the number of uploads to GCS that run at the same time.
+// Each file that is uploaded in one piece, and each part of a file that is
+// uploaded as a parallel composite upload, holds a slot while it is uploaded.
+type uploadSlots chan struct{}
+
+func newUploadSlots() uploadSlots {
+	return make(uploadSlots, maxParallelUploads)
+}
+
+// acquire waits for a free slot, or until the context is done.
+func (s uploadSlots) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s uploadSlots) release() {
+	<-s
+}
+
 // gcsManager provides a simple key/value interface to a GCS directory, where keys are object paths
 // and values are object data.
 type gcsManager struct {
@@ -59,6 +110,201 @@ func (m *gcsManager) store(ctx context.Context, r io.Reader, name string) error
 	return w.Close()
 }
 
+// uploadFile uploads the given local file to the given object, with the given
+// metadata. GCS rejects the upload if the data it receives doesn't match the
+// given CRC32C of the file. Uploads that fail with transient errors are retried
+// with exponential backoff. Files of at least compositeThreshold bytes are
+// split into parts that are uploaded in parallel and then composed; a zero
+// compositeThreshold disables parallel composite uploads. Uploads take their
+// slots from the given uploadSlots.
+func (m *gcsManager) uploadFile(ctx context.Context, slots uploadSlots, file, object string, crc uint32,
+	metadata map[string]string, compositeThreshold int64) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if compositeThreshold > 0 && info.Size() >= compositeThreshold {
+		err = m.compositeUpload(ctx, slots, file, object, info.Size(), crc, metadata)
+	} else {
+		err = withRetries(ctx, func() error {
+			if err := slots.acquire(ctx); err != nil {
+				return err
+			}
+			defer slots.release()
+			return m.uploadPart(ctx, file, 0, info.Size(), object, crc, metadata)
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading %q to gs://%s/%s: %v", file, m.gcsBucket, object, err)
+	}
+	elapsed := time.Since(start)
+	log.Printf("Uploaded %s to gs://%s/%s (%d bytes in %v, %.1f MiB/s)", file, m.gcsBucket, object, info.Size(),
+		elapsed.Round(time.Millisecond), float64(info.Size())/(1<<20)/elapsed.Seconds())
+	return nil
+}
+
+// uploadPart uploads size bytes of the given file, starting at offset, to the
+// given object.
+func (m *gcsManager) uploadPart(ctx context.Context, file string, offset, size int64, object string, crc uint32,
+	metadata map[string]string) error {
+	r, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening %q: %v", file, err)
+	}
+	defer r.Close()
+	w := m.gcsClient.Bucket(m.gcsBucket).Object(object).NewWriter(ctx)
+	w.CRC32C = crc
+	w.SendCRC32C = true
+	w.Metadata = metadata
+	if _, err := io.Copy(w, io.NewSectionReader(r, offset, size)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// compositeUpload uploads the given file as a parallel composite upload. The
+// parts of the file are uploaded in parallel to temporary objects next to the
+// given object, which are composed into the object and then deleted. Each part
+// takes a slot from the given uploadSlots while it is uploaded.
+func (m *gcsManager) compositeUpload(ctx context.Context, slots uploadSlots, file, object string, size int64,
+	crc uint32, metadata map[string]string) error {
+	partSize := (size + compositeComponents - 1) / compositeComponents
+	bucket := m.gcsClient.Bucket(m.gcsBucket)
+	var parts []*storage.ObjectHandle
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []string
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		name := fmt.Sprintf("%s.part-%d", object, len(parts))
+		parts = append(parts, bucket.Object(name))
+		wg.Add(1)
+		go func(offset, n int64, name string) {
+			defer wg.Done()
+			err := withRetries(ctx, func() error {
+				partCRC, err := crc32cRange(file, offset, n)
+				if err != nil {
+					return err
+				}
+				if err := slots.acquire(ctx); err != nil {
+					return err
+				}
+				defer slots.release()
+				return m.uploadPart(ctx, file, offset, n, name, partCRC, nil)
+			})
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err.Error())
+			}
+		}(offset, n, name)
+	}
+	wg.Wait()
+	defer func() {
+		for _, part := range parts {
+			if err := part.Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				log.Printf("Failed to delete part gs://%s/%s of a composite upload: %v", m.gcsBucket, part.ObjectName(), err)
+			}
+		}
+	}()
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return withRetries(ctx, func() error {
+		c := bucket.Object(object).ComposerFrom(parts...)
+		c.CRC32C = crc
+		c.SendCRC32C = true
+		c.Metadata = metadata
+		_, err := c.Run(ctx)
+		return err
+	})
+}
+
+// crc32cRange computes the CRC32C of size bytes of the given file, starting at
+// offset.
+func crc32cRange(file string, offset, size int64) (uint32, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("error opening %q: %v", file, err)
+	}
+	defer f.Close()
+	crc := crc32.New(crc32cTable)
+	if _, err := io.Copy(crc, io.NewSectionReader(f, offset, size)); err != nil {
+		return 0, fmt.Errorf("error reading %q: %v", file, err)
+	}
+	return crc.Sum32(), nil
+}
+
+// withRetries calls f until it succeeds, fails with an error that isn't
+// transient, or has been attempted maxUploadAttempts times. The storage client
+// retries most failed requests on its own, but it doesn't retry request
+// timeouts and gives up on resumable upload chunks after a while. Waiting
+// between attempts stops when the context is done.
+func withRetries(ctx context.Context, f func() error) error {
+	interval := uploadRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isTransient(err) || attempt == maxUploadAttempts {
+			return err
+		}
+		log.Printf("Upload attempt %d failed, retrying in %v: %v", attempt, interval, err)
+		timer := newRetryTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%v; not retrying: %v", err, ctx.Err())
+		}
+		interval *= 2
+	}
+}
+
+// isTransient checks if a GCS request that failed with the given error can be
+// retried.
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusRequestTimeout || apiErr.Code == http.StatusTooManyRequests ||
+			apiErr.Code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// uploadFiles calls upload for each of the given files in parallel. Keys are
+// local files, and values are passed to upload along with them. The calls
+// share one uploadSlots, so at most maxParallelUploads files or parts of files
+// are uploaded at the same time.
+func uploadFiles(files map[string]string, upload func(slots uploadSlots, file, name string) error) error {
+	slots := newUploadSlots()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []string
+	for file, name := range files {
+		wg.Add(1)
+		go func(file, name string) {
+			defer wg.Done()
+			if err := upload(slots, file, name); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err.Error())
+			}
+		}(file, name)
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 // url gets the GCS URL of the given file. The file should be given as a path
 // relative to the managed directory.
 func (m *gcsManager) url(name string) string {
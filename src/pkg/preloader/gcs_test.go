@@ -18,12 +18,20 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/api/googleapi"
 )
 
 func TestStore(t *testing.T) {
@@ -87,3 +95,159 @@ func TestCleanup(t *testing.T) {
 		t.Errorf("storageManager.cleanup(_): object /bucket/obj3 was deleted")
 	}
 }
+
+// recordSleeps replaces newRetryTimer with a function that records how long
+// uploads would wait without waiting, and returns a function that restores it.
+func recordSleeps(slept *[]time.Duration) func() {
+	var mu sync.Mutex
+	newRetryTimer = func(d time.Duration) *time.Timer {
+		mu.Lock()
+		defer mu.Unlock()
+		*slept = append(*slept, d)
+		return time.NewTimer(0)
+	}
+	return func() { newRetryTimer = time.NewTimer }
+}
+
+func TestStoreInGCS(t *testing.T) {
+	var testData = []struct {
+		testName           string
+		failures           []*fakes.Failure
+		compositeThreshold int64
+		wantSlept          []time.Duration
+		wantErr            bool
+	}{
+		{testName: "Success"},
+		{
+			testName:  "TransientError",
+			failures:  []*fakes.Failure{{Method: "POST", Path: "/upload/storage/v1/b/bucket/o", Code: http.StatusRequestTimeout, Count: 1}},
+			wantSlept: []time.Duration{time.Second},
+		},
+		{
+			testName: "TooManyTransientErrors",
+			failures: []*fakes.Failure{{Method: "POST", Path: "/upload/storage/v1/b/bucket/o", Code: http.StatusRequestTimeout, Count: -1}},
+			// Each of the files is attempted maxUploadAttempts times.
+			wantSlept: []time.Duration{time.Second, time.Second, time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second,
+				4 * time.Second, 4 * time.Second, 4 * time.Second},
+			wantErr: true,
+		},
+		{
+			testName: "PermanentError",
+			failures: []*fakes.Failure{{Method: "POST", Path: "/upload/storage/v1/b/bucket/o", Code: http.StatusForbidden, Count: 1}},
+			wantErr:  true,
+		},
+		{testName: "CompositeUpload", compositeThreshold: 10},
+		{
+			testName:           "CompositeUploadTransientError",
+			failures:           []*fakes.Failure{{Method: "POST", Path: "/storage/v1/b/bucket/o/.*/compose", Code: http.StatusRequestTimeout, Count: 1}},
+			compositeThreshold: 10,
+			wantSlept:          []time.Duration{time.Second},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			want := map[string]string{
+				"/bucket/dir/cos-customizer/small": "data",
+				"/bucket/dir/cos-customizer/large": strings.Repeat("0123456789", 10),
+				"/bucket/dir/cos-customizer/empty": "",
+			}
+			files := make(map[string]string)
+			for key, data := range want {
+				file := filepath.Join(tmpDir, filepath.Base(key))
+				if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+				files[file] = filepath.Base(key)
+			}
+			var slept []time.Duration
+			defer recordSleeps(&slept)()
+			gcs := fakes.GCSForTest(t)
+			defer gcs.Close()
+			gcs.Failures = input.failures
+			err = storeInGCS(context.Background(), &gcsManager{gcs.Client, "bucket", "dir"}, files, input.compositeThreshold)
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Fatalf("storeInGCS: got error %v, want error: %v", err, input.wantErr)
+			}
+			if diff := cmp.Diff(slept, input.wantSlept, cmpopts.SortSlices(func(a, b time.Duration) bool { return a < b })); diff != "" {
+				t.Errorf("storeInGCS: retry intervals diff (-got, +want): %s", diff)
+			}
+			if input.wantErr {
+				return
+			}
+			got := make(map[string]string)
+			for key, data := range gcs.Objects {
+				got[key] = string(data)
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("storeInGCS: objects diff (-got, +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestWithRetriesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempts := 0
+	err := withRetries(ctx, func() error {
+		attempts++
+		// The context is canceled while the upload waits to be retried.
+		cancel()
+		return &googleapi.Error{Code: http.StatusRequestTimeout}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("withRetries: got error %v after %d attempts, want an error after 1 attempt", err, attempts)
+	}
+}
+
+func TestStoreInGCSSharedSlots(t *testing.T) {
+	// More files than slots, each uploaded as a parallel composite upload with
+	// more parts than slots, share the same slots without deadlocking.
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	files := make(map[string]string)
+	for i := 0; i < 2*maxParallelUploads; i++ {
+		file := filepath.Join(tmpDir, fmt.Sprintf("f%d", i))
+		if err := ioutil.WriteFile(file, []byte(strings.Repeat("0123456789", 10)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[file] = filepath.Base(file)
+	}
+	if err := storeInGCS(context.Background(), &gcsManager{gcs.Client, "bucket", "dir"}, files, 10); err != nil {
+		t.Fatalf("storeInGCS: %v", err)
+	}
+	if got := len(gcs.Objects); got != len(files) {
+		t.Errorf("storeInGCS: got %d objects, want %d", got, len(files))
+	}
+}
+
+func TestStoreInGCSCRC32CMismatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	gm := &gcsManager{gcs.Client, "bucket", "dir"}
+	if err := gm.uploadFile(context.Background(), newUploadSlots(), file, gm.objectPath("file"), 1, nil, 0); err == nil {
+		t.Error("uploadFile: got nil, want error for a mismatched CRC32C")
+	}
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/file"]; ok {
+		t.Error("uploadFile: object was stored despite a mismatched CRC32C")
+	}
+}
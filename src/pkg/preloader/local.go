@@ -0,0 +1,350 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/utils"
+)
+
+const (
+	// ciDataMount is where the startup script mounts the CIDATA disk on the
+	// builder VM.
+	ciDataMount = "/mnt/disks/cidata"
+	// localBuildContext is the name of the user build context archive on the
+	// CIDATA disk.
+	localBuildContext = "user_build_context.tar"
+	// localDiskName is the name of the output disk image in the output
+	// directory. GCE requires this name for imported disk images.
+	localDiskName = "disk.raw"
+	// resizeSignal is printed by the provisioner when it waits for the boot disk
+	// to be resized.
+	resizeSignal = "waiting for the boot disk size to change"
+)
+
+// localPollInterval is how often the local builder checks the serial port
+// output of the builder VM.
+var localPollInterval = time.Second
+
+// localBuilder builds images on the local machine. It runs the builder VM in
+// QEMU against a raw disk image file, and doesn't need a GCP project.
+type localBuilder struct {
+	files      *fs.Files
+	output     *config.Image
+	buildSpec  *config.Build
+	provConfig *provisioner.Config
+
+	workDir   string
+	disk      string
+	ciData    string
+	serialLog string
+	monitor   net.Listener
+	monitorCh chan net.Conn
+	conn      net.Conn
+	cmd       *exec.Cmd
+	exited    chan error
+	done      bool
+	resized   bool
+	offset    int64
+	timeline  timelineRecorder
+}
+
+// copySourceDisk copies the source disk image to the output directory.
+func (l *localBuilder) copySourceDisk() error {
+	src := l.buildSpec.LocalSourceImage
+	if strings.HasSuffix(src, ".tar.gz") || strings.HasSuffix(src, ".tgz") {
+		return utils.RunCommand([]string{"tar", "xzf", src, "-C", l.buildSpec.LocalOutputDir, localDiskName}, "", nil)
+	}
+	return utils.RunCommand([]string{"cp", "--sparse=always", src, l.disk}, "", nil)
+}
+
+// Stage copies the source disk image to the output directory and writes the
+// CIDATA disk image. The user build context is stored on the CIDATA disk,
+// since the builder VM can't read it from GCS.
+func (l *localBuilder) Stage(ctx context.Context) error {
+	switch {
+	case l.buildSpec.LocalSourceImage == "":
+		return errors.New("the local backend requires a local source image")
+	case l.buildSpec.LocalOutputDir == "":
+		return errors.New("the local backend requires an output directory")
+	case l.buildSpec.GPUType != "" || len(l.buildSpec.GCSFiles) != 0:
+		return errors.New("install-gpu is not supported by the local backend")
+	}
+	if err := os.MkdirAll(l.buildSpec.LocalOutputDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	l.workDir, err = ioutil.TempDir(fs.ScratchDir, "local-build-")
+	if err != nil {
+		return err
+	}
+	l.disk = filepath.Join(l.buildSpec.LocalOutputDir, localDiskName)
+	if err := l.copySourceDisk(); err != nil {
+		return fmt.Errorf("error copying source disk %q: %v", l.buildSpec.LocalSourceImage, err)
+	}
+	if !needDiskResize(l.provConfig, l.buildSpec) && l.buildSpec.DiskSize > 10 {
+		// Same as the disk_size_gb variable of the Daisy workflow; the boot disk
+		// starts out with the requested size.
+		if err := os.Truncate(l.disk, int64(l.buildSpec.DiskSize)<<30); err != nil {
+			return err
+		}
+	}
+	buildContexts := map[string]string{
+		"user": "file://" + path.Join(ciDataMount, localBuildContext),
+	}
+	if err := updateProvConfig(l.provConfig, l.buildSpec, buildContexts, "", l.files); err != nil {
+		return err
+	}
+	l.ciData, err = writeCIDataDisk(l.files, map[string]string{l.files.UserBuildContextArchive: localBuildContext})
+	if err != nil {
+		return err
+	}
+	l.serialLog = filepath.Join(l.workDir, "serial.log")
+	l.monitor, err = net.Listen("unix", filepath.Join(l.workDir, "monitor.sock"))
+	return err
+}
+
+// qemuPath escapes a path for use in a QEMU option string.
+func qemuPath(p string) string {
+	return strings.ReplaceAll(p, ",", ",,")
+}
+
+func (l *localBuilder) qemuArgs() []string {
+	return []string{
+		// KVM is used if it's available. Otherwise, QEMU falls back to software
+		// emulation.
+		"-machine", "accel=kvm:tcg",
+		"-m", "2048",
+		"-smp", "2",
+		"-display", "none",
+		// Attach the disks to a SCSI controller so that they show up as
+		// /dev/sda and /dev/sdb, like they do on GCE.
+		"-device", "virtio-scsi-pci,id=scsi",
+		"-drive", "if=none,id=boot-disk,format=raw,file=" + qemuPath(l.disk),
+		"-device", "scsi-hd,drive=boot-disk,bus=scsi.0,scsi-id=0",
+		"-drive", "if=none,id=cidata-disk,format=raw,file=" + qemuPath(l.ciData),
+		"-device", "scsi-hd,drive=cidata-disk,bus=scsi.0,scsi-id=1",
+		"-netdev", "user,id=net0",
+		"-device", "virtio-net-pci,netdev=net0",
+		// The provisioner writes its status to ttyS2.
+		"-serial", "null",
+		"-serial", "null",
+		"-serial", "file:" + qemuPath(l.serialLog),
+		"-monitor", "unix:" + qemuPath(l.monitor.Addr().String()),
+	}
+}
+
+// Boot starts the builder VM in QEMU.
+func (l *localBuilder) Boot(context.Context) error {
+	l.cmd = exec.Command(l.files.QEMUBin, l.qemuArgs()...)
+	l.cmd.Stdout = os.Stdout
+	l.cmd.Stderr = os.Stdout
+	if err := l.cmd.Start(); err != nil {
+		return err
+	}
+	l.exited = make(chan error, 1)
+	go func() { l.exited <- l.cmd.Wait() }()
+	l.monitorCh = make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.monitor.Accept()
+		if err != nil {
+			// The listener is closed during cleanup, which is expected if QEMU
+			// never connected.
+			return
+		}
+		l.monitorCh <- conn
+	}()
+	return nil
+}
+
+// readSerial reads the complete lines that have been written to the serial
+// port since the last call.
+func (l *localBuilder) readSerial() ([]string, error) {
+	f, err := os.Open(l.serialLog)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(l.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var lines []string
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		l.offset += int64(len(line))
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// resizeDisk resizes the boot disk of the running builder VM using the QEMU
+// monitor.
+func (l *localBuilder) resizeDisk(ctx context.Context) error {
+	if l.conn == nil {
+		select {
+		case l.conn = <-l.monitorCh:
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for QEMU monitor connection: %v", ctx.Err())
+		}
+	}
+	log.Printf("Resizing boot disk to %dGB", l.buildSpec.DiskSize)
+	if _, err := fmt.Fprintf(l.conn, "block_resize boot-disk %dG\n", l.buildSpec.DiskSize); err != nil {
+		return fmt.Errorf("error resizing boot disk: %v", err)
+	}
+	l.resized = true
+	return nil
+}
+
+// Wait watches the serial port output of the builder VM until the builder VM
+// shuts down.
+func (l *localBuilder) Wait(ctx context.Context) error {
+	timeout := time.Hour
+	if l.buildSpec.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(l.buildSpec.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(localPollInterval)
+	defer ticker.Stop()
+	var succeeded bool
+	for {
+		var exitErr error
+		select {
+		case exitErr = <-l.exited:
+			l.done = true
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("timed out after %v waiting for the builder VM: %w", timeout, ctx.Err())
+			}
+			return fmt.Errorf("canceled while waiting for the builder VM: %w", ctx.Err())
+		case <-ticker.C:
+		}
+		lines, err := l.readSerial()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+			l.timeline.addLine(line)
+			switch {
+			case strings.Contains(line, "BuildFailed:"):
+				return fmt.Errorf("image build failed: %s", line)
+			case strings.Contains(line, "BuildSucceeded:"):
+				succeeded = true
+			case strings.Contains(line, resizeSignal) && !l.resized && needDiskResize(l.provConfig, l.buildSpec):
+				if err := l.resizeDisk(ctx); err != nil {
+					return err
+				}
+			}
+		}
+		if l.done {
+			if exitErr != nil {
+				return fmt.Errorf("QEMU failed: %v", exitErr)
+			}
+			if !succeeded {
+				return errors.New("builder VM shut down before the build succeeded")
+			}
+			return nil
+		}
+	}
+}
+
+// Capture archives the boot disk in the format used for importing GCE images.
+// Both the raw disk image and the archive are left in the output directory.
+func (l *localBuilder) Capture(context.Context) error {
+	tarPath := filepath.Join(l.buildSpec.LocalOutputDir, l.output.Name+".tar")
+	if err := utils.RunCommand([]string{
+		"tar", "--format=oldgnu", "-Scf", tarPath, "-C", l.buildSpec.LocalOutputDir, localDiskName,
+	}, "", nil); err != nil {
+		return err
+	}
+	if err := fs.GzipFile(tarPath, tarPath+".gz"); err != nil {
+		return err
+	}
+	if err := os.Remove(tarPath); err != nil {
+		return err
+	}
+	log.Printf("Wrote output image to %s and %s", l.disk, tarPath+".gz")
+	return nil
+}
+
+// Cleanup stops the builder VM if it is still running, and deletes the
+// temporary files used by the build.
+func (l *localBuilder) Cleanup(context.Context) error {
+	if l.cmd != nil && l.cmd.Process != nil && !l.done {
+		if err := l.cmd.Process.Kill(); err != nil {
+			log.Printf("error stopping QEMU: %v", err)
+		}
+		<-l.exited
+		l.done = true
+	}
+	if l.conn == nil {
+		select {
+		case l.conn = <-l.monitorCh:
+		default:
+		}
+	}
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	if l.monitor != nil {
+		l.monitor.Close()
+	}
+	if l.ciData != "" {
+		if err := os.Remove(l.ciData); err != nil {
+			return err
+		}
+	}
+	if l.workDir != "" {
+		return os.RemoveAll(l.workDir)
+	}
+	return nil
+}
+
+// Timeline gets the provisioning timeline from the serial port output of the
+// builder VM.
+func (l *localBuilder) Timeline() *Timeline {
+	return l.timeline.get()
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+)
+
+// fakeQEMU writes a fake QEMU binary that writes the given serial output to the
+// serial port file and exits.
+func fakeQEMU(t *testing.T, dir, serialOutput string) string {
+	t.Helper()
+	script := `#!/bin/bash
+for arg in "$@"; do
+  case "${arg}" in
+    file:*) serial="${arg#file:}" ;;
+  esac
+done
+cat >> "${serial}" <<'EOF'
+` + serialOutput + `EOF
+`
+	path := filepath.Join(dir, "qemu")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocalBuildImage(t *testing.T) {
+	localPollInterval = 10 * time.Millisecond
+	var testData = []struct {
+		testName     string
+		serialOutput string
+		wantErr      bool
+	}{
+		{
+			testName:     "Success",
+			serialOutput: "BuildStatus: running\nBuildSucceeded: done\n",
+		},
+		{
+			testName:     "Failure",
+			serialOutput: "BuildStatus: running\nBuildFailed: exiting due to errors\n",
+			wantErr:      true,
+		},
+		{
+			testName:     "NoSignal",
+			serialOutput: "BuildStatus: running\n",
+			wantErr:      true,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			files.QEMUBin = fakeQEMU(t, tmpDir, input.serialOutput)
+			source := filepath.Join(tmpDir, "source.raw")
+			if err := ioutil.WriteFile(source, []byte("disk"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			outDir := filepath.Join(tmpDir, "out")
+			buildSpec := &config.Build{
+				Backend:          config.BackendLocal,
+				LocalSourceImage: source,
+				LocalOutputDir:   outDir,
+			}
+			provConfig := &provisioner.Config{}
+			_, err = BuildImage(context.Background(), nil, files, config.NewImage("in", "p"), config.NewImage("out", "p"),
+				buildSpec, provConfig)
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Fatalf("BuildImage: got %v, want error: %v", err, input.wantErr)
+			}
+			if want := "file:///mnt/disks/cidata/user_build_context.tar"; provConfig.BuildContexts["user"] != want {
+				t.Errorf("BuildImage: got build context %q, want %q", provConfig.BuildContexts["user"], want)
+			}
+			if input.wantErr {
+				return
+			}
+			got, err := ioutil.ReadFile(filepath.Join(outDir, "disk.raw"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "disk" {
+				t.Errorf("BuildImage: got disk contents %q, want %q", string(got), "disk")
+			}
+			if _, err := os.Stat(filepath.Join(outDir, "out.tar.gz")); err != nil {
+				t.Errorf("BuildImage: output archive not written: %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalBuildImageUnsupported(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files.QEMUBin = "/bin/false"
+	for _, buildSpec := range []*config.Build{
+		{Backend: config.BackendLocal, LocalOutputDir: tmpDir},
+		{Backend: config.BackendLocal, LocalSourceImage: "disk.raw"},
+		{Backend: config.BackendLocal, LocalSourceImage: "disk.raw", LocalOutputDir: tmpDir, GPUType: "nvidia-tesla-k80"},
+		{Backend: "unknown"},
+	} {
+		if _, err := BuildImage(context.Background(), nil, files, config.NewImage("in", "p"), config.NewImage("out", "p"),
+			buildSpec, &provisioner.Config{}); err == nil {
+			t.Errorf("BuildImage(%+v): got nil, want error", buildSpec)
+		}
+	}
+}
+
+func TestLocalResizeDisk(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	monitor, err := net.Listen("unix", filepath.Join(tmpDir, "monitor.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Close()
+	l := &localBuilder{buildSpec: &config.Build{DiskSize: 20}, monitorCh: make(chan net.Conn, 1)}
+	go func() {
+		conn, err := monitor.Accept()
+		if err == nil {
+			l.monitorCh <- conn
+		}
+	}()
+	qemu, err := net.Dial("unix", monitor.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qemu.Close()
+	if err := l.resizeDisk(context.Background()); err != nil {
+		t.Fatalf("resizeDisk: %v", err)
+	}
+	defer l.conn.Close()
+	got, err := bufio.NewReader(qemu).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "block_resize boot-disk 20G\n"; got != want {
+		t.Errorf("resizeDisk: got monitor command %q, want %q", got, want)
+	}
+}
+
+func TestLocalWaitCanceled(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var testData = []struct {
+		testName string
+		ctx      context.Context
+		timeout  string
+		want     error
+	}{
+		{testName: "Canceled", ctx: canceled, want: context.Canceled},
+		{testName: "Timeout", ctx: context.Background(), timeout: "1ms", want: context.DeadlineExceeded},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			l := &localBuilder{
+				buildSpec: &config.Build{Timeout: input.timeout},
+				serialLog: filepath.Join(tmpDir, "serial.log"),
+				exited:    make(chan error),
+			}
+			if err := l.Wait(input.ctx); !errors.Is(err, input.want) {
+				t.Errorf("localBuilder.Wait: got %v, want %v", err, input.want)
+			}
+		})
+	}
+}
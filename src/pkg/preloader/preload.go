@@ -20,11 +20,11 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -45,8 +45,10 @@ var ciDataImg []byte
 // storeInGCS stores the given files in GCS using the given gcsManager.
 // Files to store are provided in a map where each key is a file on the local
 // file system and each value is the relative path in GCS at which to store the
-// corresponding key. The provided relative paths in GCS must be unique.
-func storeInGCS(ctx context.Context, gcs *gcsManager, files map[string]string) error {
+// corresponding key. The provided relative paths in GCS must be unique. Files
+// are uploaded in parallel, and files of at least compositeThreshold bytes are
+// uploaded as parallel composite uploads unless compositeThreshold is zero.
+func storeInGCS(ctx context.Context, gcs *gcsManager, files map[string]string, compositeThreshold int64) error {
 	gcsRelPaths := make(map[string]bool)
 	for _, gcsRelPath := range files {
 		if gcsRelPaths[gcsRelPath] {
@@ -54,17 +56,13 @@ func storeInGCS(ctx context.Context, gcs *gcsManager, files map[string]string) e
 		}
 		gcsRelPaths[gcsRelPath] = true
 	}
-	for file, gcsRelPath := range files {
-		r, err := os.Open(file)
+	return uploadFiles(files, func(slots uploadSlots, file, gcsRelPath string) error {
+		h, err := hashArtifact(file)
 		if err != nil {
-			return fmt.Errorf("error opening %q: %v", file, err)
-		}
-		defer r.Close()
-		if err := gcs.store(ctx, r, gcsRelPath); err != nil {
 			return err
 		}
-	}
-	return nil
+		return gcs.uploadFile(ctx, slots, file, gcs.objectPath(gcsRelPath), h.crc32c, nil, compositeThreshold)
+	})
 }
 
 func needDiskResize(provConfig *provisioner.Config, buildSpec *config.Build) bool {
@@ -75,6 +73,68 @@ func needDiskResize(provConfig *provisioner.Config, buildSpec *config.Build) boo
 	return buildSpec.DiskSize > 10 && (provConfig.BootDisk.OEMSize != "" || provConfig.BootDisk.ReclaimSDA3)
 }
 
+// defaultScopes are the OAuth scopes of the builder VM if the build config
+// doesn't set any.
+var defaultScopes = []string{
+	"https://www.googleapis.com/auth/devstorage.read_write",
+	"https://www.googleapis.com/auth/cloud-platform",
+}
+
+// exportScopes are the OAuth scopes of the VM that exports the output image.
+var exportScopes = []string{"https://www.googleapis.com/auth/devstorage.read_write"}
+
+// networkInterfaces gets the network interfaces of the VMs in the Daisy
+// workflow. It returns nil if the build config uses the default network with
+// an external IP, which lets Daisy configure the network.
+func networkInterfaces(buildSpec *config.Build) []map[string]interface{} {
+	if buildSpec.Network == "" && buildSpec.Subnet == "" && !buildSpec.NoExternalIP {
+		return nil
+	}
+	iface := make(map[string]interface{})
+	if buildSpec.Network != "" {
+		iface["network"] = buildSpec.Network
+	}
+	if buildSpec.Subnet != "" {
+		iface["subnetwork"] = buildSpec.Subnet
+	}
+	// Daisy adds an external IP to network interfaces without access configs,
+	// so an empty list is needed to leave it out.
+	if buildSpec.NoExternalIP {
+		iface["accessConfigs"] = []interface{}{}
+	} else {
+		iface["accessConfigs"] = []map[string]string{{"type": "ONE_TO_ONE_NAT"}}
+	}
+	return []map[string]interface{}{iface}
+}
+
+// serviceAccounts gets the service accounts of a VM in the Daisy workflow
+// with the given scopes. It returns nil if the build config uses the default
+// service account, in which case Daisy uses the Scopes of the VM.
+func serviceAccounts(buildSpec *config.Build, scopes []string) []map[string]interface{} {
+	if buildSpec.ServiceAccount == "" {
+		return nil
+	}
+	return []map[string]interface{}{{"email": buildSpec.ServiceAccount, "scopes": scopes}}
+}
+
+// shieldedInstanceConfig gets the Shielded VM config of the builder VM, or nil
+// if the builder VM isn't a Shielded VM.
+func shieldedInstanceConfig(buildSpec *config.Build) map[string]bool {
+	if !buildSpec.ShieldedVM {
+		return nil
+	}
+	return map[string]bool{"enableSecureBoot": true, "enableVtpm": true, "enableIntegrityMonitoring": true}
+}
+
+// confidentialInstanceConfig gets the Confidential VM config of the builder VM,
+// or nil if the builder VM isn't a Confidential VM.
+func confidentialInstanceConfig(buildSpec *config.Build) map[string]bool {
+	if !buildSpec.ConfidentialVM {
+		return nil
+	}
+	return map[string]bool{"enableConfidentialCompute": true}
+}
+
 // writeDaisyWorkflow templates the given Daisy workflow and writes the result to a temporary file.
 // The given workflow should be the one at //data/build_image.wf.json.
 func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSpec *config.Build, provConfig *provisioner.Config) (string, error) {
@@ -90,11 +150,13 @@ func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSp
 	if err != nil {
 		return "", err
 	}
-	if buildSpec.GPUType != "" {
+	// Accelerator-optimized machine types come with their GPUs, so GPUs are only
+	// attached to other machine types.
+	if buildSpec.GPUType != "" && !config.BuiltInGPUs(buildSpec.MachineType) {
 		acceleratorType := fmt.Sprintf("projects/%s/zones/%s/acceleratorTypes/%s",
 			buildSpec.Project, buildSpec.Zone, buildSpec.GPUType)
 		acceleratorsJSON, err = json.Marshal([]map[string]interface{}{
-			{"acceleratorType": acceleratorType, "acceleratorCount": 1}})
+			{"acceleratorType": acceleratorType, "acceleratorCount": buildSpec.GPUs()}})
 		if err != nil {
 			return "", err
 		}
@@ -103,6 +165,50 @@ func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSp
 	if err != nil {
 		return "", err
 	}
+	scopes := buildSpec.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return "", err
+	}
+	networkInterfacesJSON, err := json.Marshal(networkInterfaces(buildSpec))
+	if err != nil {
+		return "", err
+	}
+	serviceAccountsJSON, err := json.Marshal(serviceAccounts(buildSpec, scopes))
+	if err != nil {
+		return "", err
+	}
+	exportServiceAccountsJSON, err := json.Marshal(serviceAccounts(buildSpec, exportScopes))
+	if err != nil {
+		return "", err
+	}
+	tagsJSON, err := json.Marshal(buildSpec.NetworkTags)
+	if err != nil {
+		return "", err
+	}
+	shieldedJSON, err := json.Marshal(shieldedInstanceConfig(buildSpec))
+	if err != nil {
+		return "", err
+	}
+	confidentialJSON, err := json.Marshal(confidentialInstanceConfig(buildSpec))
+	if err != nil {
+		return "", err
+	}
+	guestOSFeaturesJSON, err := json.Marshal(outputImage.GuestOsFeatures)
+	if err != nil {
+		return "", err
+	}
+	description := outputImage.Description
+	if description == "" {
+		description = "Derivative of ${source_image}."
+	}
+	descriptionJSON, err := json.Marshal(description)
+	if err != nil {
+		return "", err
+	}
 
 	// template content for the step resize-disk.
 	// If the oem-size is set, or need to reclaim sda3 (with disk-size-gb set),
@@ -132,6 +238,10 @@ func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSp
 		resizeDiskJSON = `"WaitForInstancesSignal": [{"Name": "preload-vm","Interval": "10s","SerialOutput": {"Port": 3,"SuccessMatch": "BuildStatus:"}}]`
 		waitResizeJSON = `"WaitForInstancesSignal": [{"Name": "preload-vm","Interval": "10s","SerialOutput": {"Port": 3,"SuccessMatch": "BuildStatus:"}}]`
 	}
+	debugFields, err := debugWorkflowFields(buildSpec)
+	if err != nil {
+		return "", err
+	}
 	tmpl, err := template.New("workflow").Parse(string(tmplContents))
 	if err != nil {
 		return "", err
@@ -141,17 +251,45 @@ func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSp
 		return "", err
 	}
 	if err := tmpl.Execute(w, struct {
-		Labels       string
-		Accelerators string
-		Licenses     string
-		ResizeDisks  string
-		WaitResize   string
+		Labels                     string
+		Accelerators               string
+		Licenses                   string
+		Description                string
+		ResizeDisks                string
+		WaitResize                 string
+		Export                     bool
+		Scopes                     string
+		NetworkInterfaces          string
+		ServiceAccounts            string
+		ExportServiceAccounts      string
+		Tags                       string
+		ShieldedInstanceConfig     string
+		ConfidentialInstanceConfig string
+		GuestOSFeatures            string
+		DebugBootDisk              string
+		DebugCIDataDisk            string
+		DebugInstance              string
+		DebugMetadata              string
 	}{
 		string(labelsJSON),
 		string(acceleratorsJSON),
 		string(licensesJSON),
+		string(descriptionJSON),
 		resizeDiskJSON,
 		waitResizeJSON,
+		buildSpec.ExportURI != "",
+		string(scopesJSON),
+		string(networkInterfacesJSON),
+		string(serviceAccountsJSON),
+		string(exportServiceAccountsJSON),
+		string(tagsJSON),
+		string(shieldedJSON),
+		string(confidentialJSON),
+		string(guestOSFeaturesJSON),
+		debugFields[0],
+		debugFields[1],
+		debugFields[2],
+		debugFields[3],
 	}); err != nil {
 		w.Close()
 		os.Remove(w.Name())
@@ -164,7 +302,10 @@ func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSp
 	return w.Name(), nil
 }
 
-func writeCIDataImage(files *fs.Files) (path string, err error) {
+// writeCIDataDisk writes the CIDATA vfat disk image containing the provisioner
+// and its config to a temporary file. extraFiles are also copied onto the disk;
+// keys are local files and values are file names on the disk.
+func writeCIDataDisk(files *fs.Files, extraFiles map[string]string) (path string, err error) {
 	img, err := ioutil.TempFile(fs.ScratchDir, "cidata-")
 	if err != nil {
 		return "", err
@@ -180,6 +321,19 @@ func writeCIDataImage(files *fs.Files) (path string, err error) {
 	if err := utils.RunCommand([]string{"mcopy", "-i", img.Name(), files.ProvConfig, "::/config.json"}, "", nil); err != nil {
 		return "", err
 	}
+	for file, name := range extraFiles {
+		if err := utils.RunCommand([]string{"mcopy", "-i", img.Name(), file, "::/" + name}, "", nil); err != nil {
+			return "", err
+		}
+	}
+	return img.Name(), nil
+}
+
+func writeCIDataImage(files *fs.Files) (path string, err error) {
+	img, err := writeCIDataDisk(files, nil)
+	if err != nil {
+		return "", err
+	}
 	out, err := ioutil.TempFile(fs.ScratchDir, "cidata-tar-")
 	if err != nil {
 		return "", err
@@ -192,8 +346,8 @@ func writeCIDataImage(files *fs.Files) (path string, err error) {
 	if err := utils.RunCommand([]string{
 		"tar",
 		"cf", out.Name(),
-		"--transform", fmt.Sprintf("s|%s|disk.raw|g", strings.TrimLeft(img.Name(), "/")),
-		img.Name(),
+		"--transform", fmt.Sprintf("s|%s|disk.raw|g", strings.TrimLeft(img, "/")),
+		img,
 	}, "", nil); err != nil {
 		return "", err
 	}
@@ -203,7 +357,9 @@ func writeCIDataImage(files *fs.Files) (path string, err error) {
 	return out.Name() + ".gz", err
 }
 
-func updateProvConfig(provConfig *provisioner.Config, buildSpec *config.Build, buildContexts map[string]string, gcs *gcsManager, files *fs.Files) error {
+// prepareProvConfig fills in the parts of the provisioner config that are only
+// known at image build time.
+func prepareProvConfig(provConfig *provisioner.Config, buildSpec *config.Build, buildContexts map[string]string, gcsDepsPrefix string) error {
 	if needDiskResize(provConfig, buildSpec) {
 		provConfig.BootDisk.WaitForDiskResize = true
 	}
@@ -215,7 +371,7 @@ func updateProvConfig(provConfig *provisioner.Config, buildSpec *config.Build, b
 				return err
 			}
 			if step.GCSDepsPrefix != "" {
-				step.GCSDepsPrefix = gcs.managedDirURL() + "/gcs_files"
+				step.GCSDepsPrefix = gcsDepsPrefix
 			}
 			buf, err := json.Marshal(&step)
 			if err != nil {
@@ -224,6 +380,13 @@ func updateProvConfig(provConfig *provisioner.Config, buildSpec *config.Build, b
 			provConfig.Steps[idx].Args = json.RawMessage(buf)
 		}
 	}
+	return nil
+}
+
+func updateProvConfig(provConfig *provisioner.Config, buildSpec *config.Build, buildContexts map[string]string, gcsDepsPrefix string, files *fs.Files) error {
+	if err := prepareProvConfig(provConfig, buildSpec, buildContexts, gcsDepsPrefix); err != nil {
+		return err
+	}
 	buf, err := json.Marshal(provConfig)
 	if err != nil {
 		return err
@@ -242,33 +405,82 @@ func sanitize(output *config.Image) {
 	output.Licenses = licenses
 }
 
-// daisyArgs computes the parameters to the cos-customizer Daisy workflow (//data/build_image.wf.json)
-// and uploads dependencies to GCS.
-func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *config.Image, output *config.Image, buildSpec *config.Build, provConfig *provisioner.Config) ([]string, error) {
-	sanitize(output)
-	buildContexts := map[string]string{
-		"user": gcs.managedDirURL() + "/" + filepath.Base(files.UserBuildContextArchive),
+// buildContexts gets the build contexts to provide to the provisioner, keyed by
+// build context name. urls maps local files to their GCS URLs.
+func buildContexts(urls map[string]string, files *fs.Files) map[string]string {
+	return map[string]string{
+		"user": urls[files.UserBuildContextArchive],
+	}
+}
+
+// gcsDepsPrefix gets the GCS URL of the directory holding the GCSFiles of the
+// build config. urls maps local files to their GCS URLs.
+func gcsDepsPrefix(gcs *gcsManager, urls map[string]string, buildSpec *config.Build) string {
+	if len(buildSpec.GCSFiles) == 0 {
+		return gcs.managedDirURL() + "/gcs_files"
 	}
+	return gcsURLDir(urls[buildSpec.GCSFiles[0]])
+}
+
+// gcsUploads gets the local files that need to be uploaded to GCS for the
+// build. Keys are local files and values are paths relative to the GCS managed
+// directory.
+func gcsUploads(files *fs.Files, buildSpec *config.Build) map[string]string {
 	toUpload := map[string]string{
 		files.UserBuildContextArchive: filepath.Base(files.UserBuildContextArchive),
 	}
 	for _, gcsFile := range buildSpec.GCSFiles {
 		toUpload[gcsFile] = path.Join("gcs_files", filepath.Base(gcsFile))
 	}
-	if err := storeInGCS(ctx, gcs, toUpload); err != nil {
-		return nil, err
-	}
-	daisyWorkflow, err := writeDaisyWorkflow(files.DaisyWorkflow, output, buildSpec, provConfig)
+	return toUpload
+}
+
+// uploadArtifacts gets the GCS URLs of the local files that the build needs,
+// keyed by local file. If the build config has an artifact cache TTL, the
+// files are stored in the artifact cache, and otherwise in the managed
+// directory. The files are only uploaded if store is set.
+func uploadArtifacts(ctx context.Context, gcs *gcsManager, files *fs.Files, buildSpec *config.Build, store bool) (map[string]string, error) {
+	ttl, err := cacheTTL(buildSpec.ArtifactCacheTTL)
 	if err != nil {
 		return nil, err
 	}
-	if err := updateProvConfig(provConfig, buildSpec, buildContexts, gcs, files); err != nil {
-		return nil, err
+	urls := make(map[string]string)
+	if ttl == 0 {
+		uploads := gcsUploads(files, buildSpec)
+		if store {
+			if err := storeInGCS(ctx, gcs, uploads, buildSpec.CompositeUploadThreshold); err != nil {
+				return nil, err
+			}
+		}
+		for file, gcsRelPath := range uploads {
+			urls[file] = gcs.url(gcsRelPath)
+		}
+		return urls, nil
 	}
-	ciDataFile, err := writeCIDataImage(files)
+	// The GCSFiles are stored in the same directory, which the provisioner
+	// uses as the prefix for GPU installer dependencies.
+	groups := [][]string{{files.UserBuildContextArchive}}
+	if len(buildSpec.GCSFiles) != 0 {
+		groups = append(groups, buildSpec.GCSFiles)
+	}
+	uploads, hashes, err := cachedUploads(groups)
 	if err != nil {
 		return nil, err
 	}
+	if store {
+		if err := storeInCache(ctx, gcs, uploads, hashes, ttl, buildSpec.CompositeUploadThreshold); err != nil {
+			return nil, err
+		}
+	}
+	for file, cacheRelPath := range uploads {
+		urls[file] = gcs.cacheURL(cacheRelPath)
+	}
+	return urls, nil
+}
+
+// workflowArgs computes the parameters to the cos-customizer Daisy workflow,
+// given the paths to the templated workflow and the CIDATA image.
+func workflowArgs(gcs *gcsManager, input *config.Image, output *config.Image, buildSpec *config.Build, provConfig *provisioner.Config, ciDataFile, daisyWorkflow string) []string {
 	var args []string
 	if provConfig.BootDisk.OEMSize == "" && buildSpec.DiskSize > 10 && !provConfig.BootDisk.ReclaimSDA3 {
 		// If the oem-size is set, or need to reclaim sda3,
@@ -280,8 +492,27 @@ func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *con
 	if output.Family != "" {
 		args = append(args, "-var:output_image_family", output.Family)
 	}
+	if buildSpec.ExportURI != "" {
+		// The export buffer disk holds both a copy of the output image and the
+		// converted disk image.
+		diskSize := 10
+		if buildSpec.DiskSize > diskSize {
+			diskSize = buildSpec.DiskSize
+		}
+		args = append(args, "-var:export_uri", buildSpec.ExportURI, "-var:export_buffer_size_gb", strconv.Itoa(2*diskSize))
+		if buildSpec.ExportFormat != "" {
+			args = append(args, "-var:export_format", buildSpec.ExportFormat)
+		}
+	}
+	if buildSpec.MachineType != "" {
+		args = append(args, "-var:machine_type", buildSpec.MachineType)
+	}
+	if buildSpec.BootDiskType != "" {
+		args = append(args, "-var:boot_disk_type", buildSpec.BootDiskType)
+	}
 	hostMaintenance := "MIGRATE"
-	if buildSpec.GPUType != "" {
+	// VMs with GPUs and Confidential VMs can't be live migrated.
+	if buildSpec.GPUType != "" || buildSpec.ConfidentialVM {
 		hostMaintenance = "TERMINATE"
 	}
 	args = append(
@@ -307,20 +538,94 @@ func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *con
 		"-disable_gcs_logging",
 		daisyWorkflow,
 	)
-	return args, nil
+	return args
+}
+
+// daisyArgs computes the parameters to the cos-customizer Daisy workflow (//data/build_image.wf.json)
+// and uploads dependencies to GCS.
+func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *config.Image, output *config.Image, buildSpec *config.Build, provConfig *provisioner.Config) ([]string, error) {
+	sanitize(output)
+	urls, err := uploadArtifacts(ctx, gcs, files, buildSpec, true)
+	if err != nil {
+		return nil, err
+	}
+	daisyWorkflow, err := writeDaisyWorkflow(files.DaisyWorkflow, output, buildSpec, provConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := updateProvConfig(provConfig, buildSpec, buildContexts(urls, files), gcsDepsPrefix(gcs, urls, buildSpec), files); err != nil {
+		return nil, err
+	}
+	ciDataFile, err := writeCIDataImage(files)
+	if err != nil {
+		return nil, err
+	}
+	return workflowArgs(gcs, input, output, buildSpec, provConfig, ciDataFile, daisyWorkflow), nil
+}
+
+// Plan describes the image build that BuildImage would run for a given
+// configuration.
+type Plan struct {
+	// Workflow is the templated Daisy workflow.
+	Workflow string
+	// ProvConfig is the provisioner config that would be given to the builder
+	// VM.
+	ProvConfig *provisioner.Config
+	// DaisyArgs are the arguments that Daisy would be invoked with. The CIDATA
+	// image and the workflow are referred to by placeholder paths, since they
+	// are not created during planning.
+	DaisyArgs []string
+	// Uploads maps local files to the GCS URLs they would be uploaded to.
+	Uploads map[string]string
+	// DiskResize indicates if the boot disk would be resized during
+	// provisioning.
+	DiskResize bool
 }
 
-// BuildImage builds a customized image using Daisy.
+// PlanImage computes the image build that BuildImage would run for the given
+// configuration, without creating any cloud resources or uploading any files.
+// The given configs are updated in the same way that BuildImage updates them.
+func PlanImage(files *fs.Files, input, output *config.Image, buildSpec *config.Build, provConfig *provisioner.Config) (*Plan, error) {
+	if buildSpec.Backend == config.BackendLocal {
+		return nil, errors.New("planning is only supported for image builds on GCE")
+	}
+	gcs := &gcsManager{nil, buildSpec.GCSBucket, buildSpec.GCSDir}
+	sanitize(output)
+	uploads, err := uploadArtifacts(context.Background(), gcs, files, buildSpec, false)
+	if err != nil {
+		return nil, err
+	}
+	daisyWorkflow, err := writeDaisyWorkflow(files.DaisyWorkflow, output, buildSpec, provConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(daisyWorkflow)
+	workflow, err := ioutil.ReadFile(daisyWorkflow)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareProvConfig(provConfig, buildSpec, buildContexts(uploads, files), gcsDepsPrefix(gcs, uploads, buildSpec)); err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Workflow:   string(workflow),
+		ProvConfig: provConfig,
+		DaisyArgs:  workflowArgs(gcs, input, output, buildSpec, provConfig, "<cidata.tar.gz>", "<workflow.json>"),
+		Uploads:    uploads,
+		DiskResize: needDiskResize(provConfig, buildSpec),
+	}, nil
+}
+
+// BuildImage builds a customized image using the builder backend configured in
+// the build config. Daisy is used by default. The provisioning timeline of the
+// builder VM is returned even if the build fails, unless the builder couldn't
+// be created.
 func BuildImage(ctx context.Context, gcsClient *storage.Client, files *fs.Files, input, output *config.Image,
-	buildSpec *config.Build, provConfig *provisioner.Config) error {
-	gcs := &gcsManager{gcsClient, buildSpec.GCSBucket, buildSpec.GCSDir}
-	defer gcs.cleanup(ctx)
-	args, err := daisyArgs(ctx, gcs, files, input, output, buildSpec, provConfig)
+	buildSpec *config.Build, provConfig *provisioner.Config) (*Timeline, error) {
+	b, err := newBuilder(gcsClient, files, input, output, buildSpec, provConfig)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cmd := exec.Command(files.DaisyBin, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
-	return cmd.Run()
+	err = runBuilder(ctx, b)
+	return b.Timeline(), err
 }
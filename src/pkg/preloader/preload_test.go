@@ -194,6 +194,127 @@ func TestDaisyArgsWorkflowTemplate(t *testing.T) {
 			workflow:    []byte("{{.Accelerators}}"),
 			want:        []byte("[{\"acceleratorCount\":1,\"acceleratorType\":\"projects/p/zones/z/acceleratorTypes/nvidia-tesla-k80\"}]"),
 		},
+		{
+			testName:    "AcceleratorCount",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", GPUType: "nvidia-tesla-t4", GPUCount: 4, Project: "p", Zone: "z"},
+			workflow:    []byte("{{.Accelerators}}"),
+			want:        []byte("[{\"acceleratorCount\":4,\"acceleratorType\":\"projects/p/zones/z/acceleratorTypes/nvidia-tesla-t4\"}]"),
+		},
+		{
+			testName:    "BuiltInAccelerators",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", GPUType: "nvidia-l4", GPUCount: 2, MachineType: "g2-standard-24",
+				Project: "p", Zone: "z"},
+			workflow: []byte("{{.Accelerators}}"),
+			want:     []byte("[]"),
+		},
+		{
+			testName:    "DefaultDescription",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("{{.Description}}"),
+			want:        []byte("\"Derivative of ${source_image}.\""),
+		},
+		{
+			testName:    "Description",
+			outputImage: &config.Image{Image: &compute.Image{Description: `Built by "x"`}, Project: ""},
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("{{.Description}}"),
+			want:        []byte(`"Built by \"x\""`),
+		},
+		{
+			testName:    "NoExport",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("image{{if .Export}},export{{end}}"),
+			want:        []byte("image"),
+		},
+		{
+			testName:    "Export",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", ExportURI: "gs://b/out.tar.gz"},
+			workflow:    []byte("image{{if .Export}},export{{end}}"),
+			want:        []byte("image,export"),
+		},
+		{
+			testName:    "DefaultBuilderVM",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("{{.NetworkInterfaces}} {{.ServiceAccounts}} {{.ExportServiceAccounts}} {{.Tags}} {{.Scopes}}"),
+			want: []byte(`null null null null ["https://www.googleapis.com/auth/devstorage.read_write",` +
+				`"https://www.googleapis.com/auth/cloud-platform"]`),
+		},
+		{
+			testName:    "Network",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", Network: "net", Subnet: "regions/r/subnetworks/sub"},
+			workflow:    []byte("{{.NetworkInterfaces}}"),
+			want:        []byte(`[{"accessConfigs":[{"type":"ONE_TO_ONE_NAT"}],"network":"net","subnetwork":"regions/r/subnetworks/sub"}]`),
+		},
+		{
+			testName:    "NoExternalIP",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", NoExternalIP: true},
+			workflow:    []byte("{{.NetworkInterfaces}}"),
+			want:        []byte(`[{"accessConfigs":[]}]`),
+		},
+		{
+			testName:    "ServiceAccount",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", ServiceAccount: "sa@p.iam.gserviceaccount.com",
+				Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"}},
+			workflow: []byte("{{.ServiceAccounts}} {{.ExportServiceAccounts}} {{.Scopes}}"),
+			want: []byte(`[{"email":"sa@p.iam.gserviceaccount.com","scopes":["https://www.googleapis.com/auth/cloud-platform"]}] ` +
+				`[{"email":"sa@p.iam.gserviceaccount.com","scopes":["https://www.googleapis.com/auth/devstorage.read_write"]}] ` +
+				`["https://www.googleapis.com/auth/cloud-platform"]`),
+		},
+		{
+			testName:    "NetworkTags",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", NetworkTags: []string{"a", "b"}},
+			workflow:    []byte("{{.Tags}}"),
+			want:        []byte(`["a","b"]`),
+		},
+		{
+			testName:    "DefaultSecurity",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("{{.ShieldedInstanceConfig}} {{.ConfidentialInstanceConfig}} {{.GuestOSFeatures}}"),
+			want:        []byte("null null null"),
+		},
+		{
+			testName:    "ShieldedConfidentialVM",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", ShieldedVM: true, ConfidentialVM: true},
+			workflow:    []byte("{{.ShieldedInstanceConfig}} {{.ConfidentialInstanceConfig}}"),
+			want: []byte(`{"enableIntegrityMonitoring":true,"enableSecureBoot":true,"enableVtpm":true} ` +
+				`{"enableConfidentialCompute":true}`),
+		},
+		{
+			testName: "GuestOSFeatures",
+			outputImage: &config.Image{Image: &compute.Image{GuestOsFeatures: []*compute.GuestOsFeature{
+				{Type: "UEFI_COMPATIBLE"}, {Type: "GVNIC"}}}},
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("{{.GuestOSFeatures}}"),
+			want:        []byte(`[{"type":"UEFI_COMPATIBLE"},{"type":"GVNIC"}]`),
+		},
+		{
+			testName:    "NoDebugInstance",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket"},
+			workflow:    []byte("[{{.DebugBootDisk}}{{.DebugCIDataDisk}}{{.DebugInstance}}{{.DebugMetadata}}]"),
+			want:        []byte("[]"),
+		},
+		{
+			testName:    "DebugInstance",
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{GCSBucket: "bucket", GCSDir: "dir", DebugInstance: "dbg"},
+			workflow:    []byte("{{.DebugBootDisk}} {{.DebugCIDataDisk}} {{.DebugInstance}} {{.DebugMetadata}}"),
+			want: []byte(`"NoCleanup":true,"RealName":"dbg-boot", "NoCleanup":true,"RealName":"dbg-cidata", ` +
+				`"NoCleanup":true,"RealName":"dbg","labels":{"cos-customizer-debug":"true"}, ` +
+				`"cos-customizer-debug":"gs://bucket/dir",`),
+		},
 	}
 	gcs := fakes.GCSForTest(t)
 	defer gcs.Close()
@@ -273,6 +394,13 @@ func TestDaisyArgs(t *testing.T) {
 			buildConfig: &config.Build{GPUType: "nvidia-tesla-k80", GCSBucket: "bucket", GCSDir: "dir"},
 			want:        []string{"-var:host_maintenance", "TERMINATE"},
 		},
+		{
+			testName:    "ConfidentialVM",
+			inputImage:  config.NewImage("", ""),
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{ConfidentialVM: true, GCSBucket: "bucket", GCSDir: "dir"},
+			want:        []string{"-var:host_maintenance", "TERMINATE"},
+		},
 		{
 			testName:    "NoGPU",
 			inputImage:  config.NewImage("", ""),
@@ -322,6 +450,34 @@ func TestDaisyArgs(t *testing.T) {
 			buildConfig: &config.Build{DiskSize: 50, GCSBucket: "bucket", GCSDir: "dir"},
 			want:        []string{"-var:disk_size_gb", "50"},
 		},
+		{
+			testName:    "ExportURI",
+			inputImage:  config.NewImage("", ""),
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{ExportURI: "gs://b/out.tar.gz", DiskSize: 50, GCSBucket: "bucket", GCSDir: "dir"},
+			want:        []string{"-var:export_uri", "gs://b/out.tar.gz", "-var:export_buffer_size_gb", "100"},
+		},
+		{
+			testName:    "ExportFormat",
+			inputImage:  config.NewImage("", ""),
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{ExportURI: "gs://b/out.vmdk", ExportFormat: "vmdk", GCSBucket: "bucket", GCSDir: "dir"},
+			want:        []string{"-var:export_format", "vmdk"},
+		},
+		{
+			testName:    "MachineType",
+			inputImage:  config.NewImage("", ""),
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{MachineType: "e2-standard-4", GCSBucket: "bucket", GCSDir: "dir"},
+			want:        []string{"-var:machine_type", "e2-standard-4"},
+		},
+		{
+			testName:    "BootDiskType",
+			inputImage:  config.NewImage("", ""),
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{BootDiskType: "pd-ssd", GCSBucket: "bucket", GCSDir: "dir"},
+			want:        []string{"-var:boot_disk_type", "pd-ssd"},
+		},
 		{
 			testName:    "GCSPath",
 			inputImage:  config.NewImage("", ""),
@@ -458,3 +614,51 @@ func TestDaisyArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestPlanImage(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(files.DaisyWorkflow, []byte("{{.ResizeDisks}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildSpec := &config.Build{
+		GCSBucket: "bucket",
+		GCSDir:    "dir",
+		DiskSize:  20,
+		GCSFiles:  []string{filepath.Join(tmpDir, "test-file")},
+	}
+	provConfig := &provisioner.Config{BootDisk: provisioner.BootDiskConfig{ReclaimSDA3: true}}
+	plan, err := PlanImage(files, config.NewImage("in", "p"), config.NewImage("out", "p"), buildSpec, provConfig)
+	if err != nil {
+		t.Fatalf("PlanImage: %v", err)
+	}
+	if !plan.DiskResize {
+		t.Errorf("PlanImage: got DiskResize false, want true")
+	}
+	if want := `"ResizeDisks": [{"Name": "boot-disk","SizeGb": "20"}]`; plan.Workflow != want {
+		t.Errorf("PlanImage: got workflow %q, want %q", plan.Workflow, want)
+	}
+	if !plan.ProvConfig.BootDisk.WaitForDiskResize {
+		t.Errorf("PlanImage: got WaitForDiskResize false, want true")
+	}
+	wantUploads := map[string]string{
+		files.UserBuildContextArchive:      "gs://bucket/dir/cos-customizer/" + filepath.Base(files.UserBuildContextArchive),
+		filepath.Join(tmpDir, "test-file"): "gs://bucket/dir/cos-customizer/gcs_files/test-file",
+	}
+	if diff := cmp.Diff(plan.Uploads, wantUploads); diff != "" {
+		t.Errorf("PlanImage: uploads mismatch: diff (-got, +want): %s", diff)
+	}
+	if got, _ := getDaisyVarValue("cidata_img", plan.DaisyArgs); got != "<cidata.tar.gz>" {
+		t.Errorf("PlanImage: got cidata_img %q, want placeholder", got)
+	}
+	got, err := ioutil.ReadFile(files.ProvConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("PlanImage: provisioner config was written: %s", string(got))
+	}
+}
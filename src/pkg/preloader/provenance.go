@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fs"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/gce"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+)
+
+const (
+	// ProvenanceLabelPrefix is the prefix of the keys of provenance labels.
+	ProvenanceLabelPrefix = "cos-customizer-"
+	// maxLabelLength is the maximum length of GCE label keys and values.
+	maxLabelLength = 63
+	// shortHashLength is the number of hex digits of a hash that are stored in a
+	// label value.
+	shortHashLength = 16
+	// maxDescriptionLength is the maximum length of GCE image descriptions.
+	maxDescriptionLength = 2048
+)
+
+// invalidLabelChars matches the characters that aren't allowed in GCE label
+// values.
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// StepHash identifies the configuration of a single build step.
+type StepHash struct {
+	Type   string `json:"type"`
+	SHA256 string `json:"sha256"`
+}
+
+// Provenance describes how an image was built. It is attached to output images
+// as labels and as part of the image description.
+type Provenance struct {
+	SourceImage       string     `json:"sourceImage"`
+	SourceBuild       string     `json:"sourceBuild,omitempty"`
+	CustomizerVersion string     `json:"customizerVersion"`
+	Steps             []StepHash `json:"steps,omitempty"`
+	// StepsSHA256 replaces Steps in descriptions that would be too long with
+	// the hash of each step. It is the value of StepsHash.
+	StepsSHA256 string `json:"stepsSHA256,omitempty"`
+	// BuildContext is the SHA256 digest of the user build context archive.
+	BuildContext string `json:"buildContext"`
+	CloudBuildID string `json:"cloudBuildID,omitempty"`
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NewProvenance gathers the provenance of an image build. provConfig must hold
+// the steps as they were configured by the build steps, before the image build
+// adds its own configuration.
+func NewProvenance(files *fs.Files, sourceImage *config.Image, provConfig *provisioner.Config, version,
+	cloudBuildID string) (*Provenance, error) {
+	p := &Provenance{
+		SourceImage:       sourceImage.URL(),
+		CustomizerVersion: version,
+		Steps:             []StepHash{},
+		CloudBuildID:      cloudBuildID,
+	}
+	// The build number is decoded in the same way as for output image name
+	// templates. Images that don't follow the COS naming pattern have none.
+	if _, buildNumber, err := gce.ImageVersion(sourceImage.Name); err == nil {
+		p.SourceBuild = buildNumber
+	}
+	for _, step := range provConfig.Steps {
+		data, err := json.Marshal(step)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		p.Steps = append(p.Steps, StepHash{Type: step.Type, SHA256: hex.EncodeToString(sum[:])})
+	}
+	var err error
+	p.BuildContext, err = sha256File(files.UserBuildContextArchive)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing build context: %v", err)
+	}
+	return p, nil
+}
+
+// labelValue sanitizes a string into a valid GCE label value.
+func labelValue(s string) string {
+	v := invalidLabelChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(v) > maxLabelLength {
+		v = v[:maxLabelLength]
+	}
+	return v
+}
+
+// Labels gets the provenance labels of an image. All label keys start with
+// ProvenanceLabelPrefix. The build steps get a single label, regardless of
+// their number. Hashes are shortened to fit into label values; the full hashes
+// are part of the description.
+func (p *Provenance) Labels() map[string]string {
+	sourceImage := p.SourceImage[strings.LastIndex(p.SourceImage, "/")+1:]
+	labels := map[string]string{
+		ProvenanceLabelPrefix + "source-image":  labelValue(sourceImage),
+		ProvenanceLabelPrefix + "version":       labelValue(p.CustomizerVersion),
+		ProvenanceLabelPrefix + "build-context": p.BuildContext[:shortHashLength],
+	}
+	if p.SourceBuild != "" {
+		labels[ProvenanceLabelPrefix+"source-build"] = labelValue(p.SourceBuild)
+	}
+	if p.CloudBuildID != "" {
+		labels[ProvenanceLabelPrefix+"build-id"] = labelValue(p.CloudBuildID)
+	}
+	if len(p.Steps) != 0 {
+		labels[ProvenanceLabelPrefix+"steps"] = p.StepsHash()[:shortHashLength]
+	}
+	return labels
+}
+
+// StepsHash gets a SHA256 digest of all build steps, in order. It identifies
+// the build steps with a single label; the hash of each step is part of the
+// description.
+func (p *Provenance) StepsHash() string {
+	h := sha256.New()
+	for _, step := range p.Steps {
+		fmt.Fprintf(h, "%s:%s\n", step.Type, step.SHA256)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (p *Provenance) description() (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Derivative of %s. Built by cos-customizer: %s", p.SourceImage, data), nil
+}
+
+// Description gets an image description that includes the provenance as JSON.
+// If listing the hash of each build step would make the description longer
+// than GCE allows, the steps are described by the hash of all steps instead.
+func (p *Provenance) Description() (string, error) {
+	description, err := p.description()
+	if err != nil || len(description) <= maxDescriptionLength {
+		return description, err
+	}
+	short := *p
+	short.Steps = nil
+	short.StepsSHA256 = p.StepsHash()
+	description, err = short.description()
+	if err != nil {
+		return "", err
+	}
+	if len(description) > maxDescriptionLength {
+		return "", fmt.Errorf("image description is longer than %d characters: %s", maxDescriptionLength,
+			description)
+	}
+	return description, nil
+}
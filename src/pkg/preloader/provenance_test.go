@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/config"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProvenance(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(files.UserBuildContextArchive, []byte("context"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	provConfig := &provisioner.Config{Steps: []provisioner.StepConfig{
+		{Type: "RunScript", Args: json.RawMessage(`{"BuildContext":"user","Path":"preload.sh"}`)},
+		{Type: "SealOEM"},
+	}}
+	p, err := NewProvenance(files, config.NewImage("cos-stable-89-16108-403-22", "cos-cloud"), provConfig,
+		"v1.2.3+Dirty", "5c3e0b8e-3b2c-4d6a-9f1e-0a1b2c3d4e5f")
+	if err != nil {
+		t.Fatalf("NewProvenance: %v", err)
+	}
+	// sha256 of "context".
+	const contextHash = "ea7792a26f405e2ae9c6f49ca93bbe6076ceac0a1fc53d83426c7d7f2d9377e4"
+	if p.BuildContext != contextHash {
+		t.Errorf("NewProvenance: got build context digest %q, want %q", p.BuildContext, contextHash)
+	}
+	if len(p.Steps) != 2 || p.Steps[0].Type != "RunScript" || p.Steps[1].Type != "SealOEM" ||
+		p.Steps[0].SHA256 == p.Steps[1].SHA256 {
+		t.Errorf("NewProvenance: got steps %+v, want distinct hashes of RunScript and SealOEM", p.Steps)
+	}
+	wantLabels := map[string]string{
+		"cos-customizer-source-image":  "cos-stable-89-16108-403-22",
+		"cos-customizer-source-build":  "16108-403-22",
+		"cos-customizer-version":       "v1-2-3-dirty",
+		"cos-customizer-build-context": p.BuildContext[:16],
+		"cos-customizer-build-id":      "5c3e0b8e-3b2c-4d6a-9f1e-0a1b2c3d4e5f",
+		"cos-customizer-steps":         p.StepsHash()[:16],
+	}
+	if diff := cmp.Diff(p.Labels(), wantLabels); diff != "" {
+		t.Errorf("Provenance.Labels: diff (-got, +want): %s", diff)
+	}
+	validValue := regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+	for k, v := range p.Labels() {
+		if !validValue.MatchString(v) {
+			t.Errorf("Provenance.Labels: label %s has invalid value %q", k, v)
+		}
+	}
+	description, err := p.Description()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const prefix = "Derivative of projects/cos-cloud/global/images/cos-stable-89-16108-403-22. Built by cos-customizer: "
+	if !strings.HasPrefix(description, prefix) {
+		t.Fatalf("Provenance.Description: got %q, want prefix %q", description, prefix)
+	}
+	var got Provenance
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(description, prefix)), &got); err != nil {
+		t.Fatalf("Provenance.Description: cannot parse provenance: %v", err)
+	}
+	if diff := cmp.Diff(&got, p); diff != "" {
+		t.Errorf("Provenance.Description: diff (-got, +want): %s", diff)
+	}
+}
+
+func TestProvenanceNoBuild(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	p, err := NewProvenance(files, config.NewImage("My_Image", "p"), &provisioner.Config{}, "dev", "")
+	if err != nil {
+		t.Fatalf("NewProvenance: %v", err)
+	}
+	labels := p.Labels()
+	for _, key := range []string{"cos-customizer-source-build", "cos-customizer-build-id", "cos-customizer-steps"} {
+		if _, ok := labels[key]; ok {
+			t.Errorf("Provenance.Labels: got label %s, want no label", key)
+		}
+	}
+	if got := labels["cos-customizer-source-image"]; got != "my_image" {
+		t.Errorf("Provenance.Labels: got source image label %q, want %q", got, "my_image")
+	}
+}
+
+func TestStepsHash(t *testing.T) {
+	a := StepHash{Type: "RunScript", SHA256: "aa"}
+	b := StepHash{Type: "SealOEM", SHA256: "bb"}
+	p1 := &Provenance{Steps: []StepHash{a, b}}
+	p2 := &Provenance{Steps: []StepHash{b, a}}
+	p3 := &Provenance{Steps: []StepHash{a, b}}
+	if p1.StepsHash() == p2.StepsHash() {
+		t.Errorf("StepsHash: got the same hash %q for steps in a different order", p1.StepsHash())
+	}
+	if p1.StepsHash() != p3.StepsHash() {
+		t.Errorf("StepsHash: got %q and %q for the same steps", p1.StepsHash(), p3.StepsHash())
+	}
+}
+
+func TestProvenanceDescriptionManySteps(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	provConfig := &provisioner.Config{}
+	for i := 0; i < 40; i++ {
+		provConfig.Steps = append(provConfig.Steps, provisioner.StepConfig{Type: "RunScript",
+			Args: json.RawMessage(fmt.Sprintf(`{"BuildContext":"user","Path":"step-%d.sh"}`, i))})
+	}
+	p, err := NewProvenance(files, config.NewImage("cos-stable-89-16108-403-22", "cos-cloud"), provConfig, "v1", "")
+	if err != nil {
+		t.Fatalf("NewProvenance: %v", err)
+	}
+	description, err := p.Description()
+	if err != nil {
+		t.Fatalf("Provenance.Description: %v", err)
+	}
+	if len(description) > 2048 {
+		t.Errorf("Provenance.Description: got %d characters, want at most 2048", len(description))
+	}
+	const prefix = "Derivative of projects/cos-cloud/global/images/cos-stable-89-16108-403-22. Built by cos-customizer: "
+	var got Provenance
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(description, prefix)), &got); err != nil {
+		t.Fatalf("Provenance.Description: cannot parse provenance: %v", err)
+	}
+	if len(got.Steps) != 0 || got.StepsSHA256 != p.StepsHash() {
+		t.Errorf("Provenance.Description: got steps %v and steps hash %q, want only the steps hash %q", got.Steps,
+			got.StepsSHA256, p.StepsHash())
+	}
+	if len(p.Steps) != 40 {
+		t.Errorf("Provenance.Description: modified the provenance steps; got %d steps, want 40", len(p.Steps))
+	}
+}
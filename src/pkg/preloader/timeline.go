@@ -0,0 +1,187 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+)
+
+// timelineLogLines is how many lines of output of a failed step are kept in
+// the timeline.
+const timelineLogLines = 20
+
+// Statuses of a build step in the timeline.
+const (
+	StepRunning   = "running"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+)
+
+// StepTiming is the timing of a build step that ran on the builder VM.
+type StepTiming struct {
+	// Step is the 1-based index of the build step.
+	Step   int        `json:"step"`
+	Type   string     `json:"type"`
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"`
+	Status string     `json:"status"`
+	// DurationSeconds is how long the step ran for, if it ended.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	// LastLogLines holds the last lines of output of a failed step.
+	LastLogLines []string `json:"lastLogLines,omitempty"`
+}
+
+// Timeline is the timeline of the provisioning of the builder VM. It is built
+// from the provisioning events that the provisioner prints on the serial port.
+type Timeline struct {
+	Steps []*StepTiming `json:"steps"`
+	// Events holds the reboot, partition and error events.
+	Events []*provisioner.Event `json:"events,omitempty"`
+	// Error is the error that provisioning failed with, if any.
+	Error string `json:"error,omitempty"`
+	// LastLogLines holds the last lines of output before provisioning failed,
+	// if it didn't fail in a build step.
+	LastLogLines []string `json:"lastLogLines,omitempty"`
+}
+
+// Summary formats the timeline for people to read, with one line per step and
+// per event, in chronological order.
+func (t *Timeline) Summary() string {
+	type entry struct {
+		time  time.Time
+		lines []string
+	}
+	var entries []entry
+	for _, s := range t.Steps {
+		line := fmt.Sprintf("step %d (%s): %s", s.Step, s.Type, s.Status)
+		if s.End != nil {
+			line += fmt.Sprintf(" in %v", s.End.Sub(s.Start).Round(time.Second))
+		}
+		if s.Error != "" {
+			line += ": " + s.Error
+		}
+		lines := []string{line}
+		for _, l := range s.LastLogLines {
+			lines = append(lines, "    | "+l)
+		}
+		entries = append(entries, entry{s.Start, lines})
+	}
+	for _, e := range t.Events {
+		message := e.Message
+		if e.Error != "" {
+			message = e.Error
+		}
+		lines := []string{fmt.Sprintf("%s: %s", e.Type, message)}
+		if e.Type == provisioner.EventError {
+			for _, l := range t.LastLogLines {
+				lines = append(lines, "    | "+l)
+			}
+		}
+		entries = append(entries, entry{e.Time, lines})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].time.Before(entries[j].time) })
+	var b strings.Builder
+	b.WriteString("Provisioning timeline:\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "  %s  %s\n", e.time.Format("15:04:05"), e.lines[0])
+		for _, l := range e.lines[1:] {
+			fmt.Fprintf(&b, "  %s\n", l)
+		}
+	}
+	return b.String()
+}
+
+// timelineRecorder builds a Timeline from the output lines of the builder VM.
+// It is safe for concurrent use.
+type timelineRecorder struct {
+	mu       sync.Mutex
+	timeline Timeline
+	current  *StepTiming
+	// logLines holds the last output lines that aren't events.
+	logLines []string
+}
+
+// addLine records an output line of the builder VM.
+func (r *timelineRecorder) addLine(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := provisioner.ParseEvent(line)
+	if e == nil {
+		r.logLines = append(r.logLines, strings.TrimPrefix(strings.TrimSpace(line), "BuildStatus: "))
+		if len(r.logLines) > timelineLogLines {
+			r.logLines = r.logLines[len(r.logLines)-timelineLogLines:]
+		}
+		return
+	}
+	switch e.Type {
+	case provisioner.EventStepStart:
+		r.current = &StepTiming{Step: e.Step, Type: e.StepType, Start: e.Time, Status: StepRunning}
+		r.timeline.Steps = append(r.timeline.Steps, r.current)
+		r.logLines = nil
+	case provisioner.EventStepEnd:
+		if r.current == nil || r.current.Step != e.Step {
+			return
+		}
+		end := e.Time
+		r.current.End = &end
+		r.current.DurationSeconds = end.Sub(r.current.Start).Seconds()
+		r.current.Status = StepSucceeded
+		if e.Error != "" {
+			r.current.Status = StepFailed
+			r.current.Error = e.Error
+			r.current.LastLogLines = append([]string(nil), r.logLines...)
+		}
+		r.current = nil
+	default:
+		r.timeline.Events = append(r.timeline.Events, e)
+		if e.Type == provisioner.EventError {
+			r.timeline.Error = e.Error
+			if !r.stepFailed() {
+				r.timeline.LastLogLines = append([]string(nil), r.logLines...)
+			}
+		}
+	}
+}
+
+// stepFailed checks if a build step in the timeline failed.
+func (r *timelineRecorder) stepFailed() bool {
+	for _, s := range r.timeline.Steps {
+		if s.Status == StepFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// get gets a copy of the timeline recorded so far.
+func (r *timelineRecorder) get() *Timeline {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &Timeline{Error: r.timeline.Error}
+	for _, s := range r.timeline.Steps {
+		step := *s
+		t.Steps = append(t.Steps, &step)
+	}
+	t.Events = append(t.Events, r.timeline.Events...)
+	t.LastLogLines = append(t.LastLogLines, r.timeline.LastLogLines...)
+	return t
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/provisioner"
+	"github.com/google/go-cmp/cmp"
+)
+
+func timeOf(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+func TestTimelineRecorder(t *testing.T) {
+	lines := []string{
+		`BuildStatus: BuildEvent: {"time":"2021-03-04T10:00:00Z","type":"step-start","step":1,"stepType":"InstallGPU"}`,
+		"BuildStatus: installing drivers",
+		`BuildStatus: BuildEvent: {"time":"2021-03-04T10:02:00Z","type":"step-end","step":1,"stepType":"InstallGPU"}`,
+		`BuildStatus: BuildEvent: {"time":"2021-03-04T10:02:01Z","type":"reboot","message":"Rebooting"}`,
+		`BuildStatus: BuildEvent: {"time":"2021-03-04T10:03:00Z","type":"step-start","step":2,"stepType":"RunScript"}`,
+		"BuildStatus: line 1",
+		"BuildStatus: line 2",
+		`BuildStatus: BuildEvent: {"time":"2021-03-04T10:03:30Z","type":"step-end","step":2,"stepType":"RunScript","error":"exit status 1"}`,
+		`BuildStatus: BuildEvent: {"time":"2021-03-04T10:03:31Z","type":"error","error":"error in step 1"}`,
+	}
+	var r timelineRecorder
+	for _, line := range lines {
+		r.addLine(line)
+	}
+	end1 := timeOf("2021-03-04T10:02:00Z")
+	end2 := timeOf("2021-03-04T10:03:30Z")
+	want := &Timeline{
+		Steps: []*StepTiming{
+			{Step: 1, Type: "InstallGPU", Start: timeOf("2021-03-04T10:00:00Z"), End: &end1, Status: StepSucceeded,
+				DurationSeconds: 120},
+			{Step: 2, Type: "RunScript", Start: timeOf("2021-03-04T10:03:00Z"), End: &end2, Status: StepFailed,
+				DurationSeconds: 30, Error: "exit status 1", LastLogLines: []string{"line 1", "line 2"}},
+		},
+		Events: []*provisioner.Event{
+			{Time: timeOf("2021-03-04T10:02:01Z"), Type: provisioner.EventReboot, Message: "Rebooting"},
+			{Time: timeOf("2021-03-04T10:03:31Z"), Type: provisioner.EventError, Error: "error in step 1"},
+		},
+		Error: "error in step 1",
+	}
+	if diff := cmp.Diff(r.get(), want); diff != "" {
+		t.Errorf("timelineRecorder: diff (-got, +want): %s", diff)
+	}
+}
+
+func TestTimelineRecorderLastLogLines(t *testing.T) {
+	var r timelineRecorder
+	for i := 0; i < timelineLogLines+5; i++ {
+		r.addLine("BuildStatus: setting up")
+	}
+	r.addLine(`BuildStatus: BuildEvent: {"time":"2021-03-04T10:00:00Z","type":"error","error":"failed"}`)
+	got := r.get()
+	if len(got.LastLogLines) != timelineLogLines {
+		t.Errorf("timelineRecorder: got %d last log lines, want %d", len(got.LastLogLines), timelineLogLines)
+	}
+	if got.Error != "failed" {
+		t.Errorf("timelineRecorder: got error %q, want %q", got.Error, "failed")
+	}
+}
+
+func TestTimelineSummary(t *testing.T) {
+	end := timeOf("2021-03-04T10:01:30Z")
+	timeline := &Timeline{
+		Steps: []*StepTiming{
+			{Step: 1, Type: "RunScript", Start: timeOf("2021-03-04T10:00:00Z"), End: &end, Status: StepFailed,
+				Error: "exit status 1", LastLogLines: []string{"command not found"}},
+		},
+		Events: []*provisioner.Event{
+			{Time: timeOf("2021-03-04T09:59:00Z"), Type: provisioner.EventPartition, Message: "Shrunk sda3"},
+		},
+	}
+	want := strings.Join([]string{
+		"Provisioning timeline:",
+		"  09:59:00  partition: Shrunk sda3",
+		"  10:00:00  step 1 (RunScript): failed in 1m30s: exit status 1",
+		"      | command not found",
+		"",
+	}, "\n")
+	if got := timeline.Summary(); got != want {
+		t.Errorf("Summary: got %q, want %q", got, want)
+	}
+}
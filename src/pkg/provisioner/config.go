@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/utils"
 )
 
 type StepConfig struct {
@@ -34,13 +35,29 @@ type BootDiskConfig struct {
 	WaitForDiskResize bool
 }
 
+// configMigrations upgrades provisioner configs to the latest schema version.
+// configMigrations[i] upgrades a config from version i to version i+1.
+var configMigrations = []utils.Migration{
+	// Version 1 introduced the SchemaVersion field.
+	nil,
+}
+
+// ConfigSchemaVersion is the schema version of provisioner configs written by
+// this package.
+var ConfigSchemaVersion = len(configMigrations)
+
 // Config defines a provisioning flow.
 type Config struct {
+	// SchemaVersion is the schema version of the config. It is set when the
+	// config is marshalled, and configs are upgraded to the latest version when
+	// they are unmarshalled. Configs with a newer schema version than
+	// ConfigSchemaVersion are rejected.
+	SchemaVersion int
 	// BuildContexts identifies the build contexts that should be used during
 	// provisioning. A build context means the same thing here as it does
 	// elsewhere in cos-customizer. The keys are build context identifiers, and
-	// the values are addresses to fetch the build contexts from. Currently, only
-	// gs:// addresses are supported.
+	// the values are addresses to fetch the build contexts from. gs:// addresses
+	// and file:// addresses with absolute paths on the builder VM are supported.
 	BuildContexts map[string]string
 	// BootDisk defines how the boot disk should be configured.
 	BootDisk BootDiskConfig
@@ -90,6 +107,21 @@ type Config struct {
 	Steps []StepConfig
 }
 
+// MarshalJSON marshals the config into JSON, stamped with the latest schema
+// version.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	c.SchemaVersion = ConfigSchemaVersion
+	return json.Marshal(config(c))
+}
+
+// UnmarshalJSON unmarshals a config from JSON, upgrading it to the latest
+// schema version if necessary.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	return utils.UnmarshalVersioned(data, "provisioner config", configMigrations, (*config)(c))
+}
+
 // stepDeps contains "step" dependencies
 type stepDeps struct {
 	// GCSClient is used to access Google Cloud Storage.
@@ -56,6 +56,7 @@ func switchRoot(deps Deps, runState *state) (err error) {
 		return nil
 	}
 	log.Println("Need to switch root device")
+	emitEvent(Event{Type: EventPartition, Message: "Switching the root device from sda3 to sda5"})
 	log.Println("Copying sda3 to sda5...")
 	in, err := os.Open(sda3Device)
 	if err != nil {
@@ -94,6 +95,7 @@ func shrinkSDA3(deps Deps, runState *state) error {
 		return nil
 	}
 	log.Println("ReclaimSDA3 is set, and /dev/sda3 is not minimal; now shrinking sda3")
+	emitEvent(Event{Type: EventPartition, Message: "Shrinking sda3"})
 	if _, err := partutil.MinimizePartition(device, 3); err != nil {
 		return fmt.Errorf("error minimizing /dev/sda3: %v", err)
 	}
@@ -230,6 +232,7 @@ func relocatePartitions(deps Deps, runState *state) error {
 	// Partition relocation must be done. Prepare for disk relocation to happen on
 	// the next reboot
 	log.Println("Partition relocation is required. Preparing for partition relocation to occur on the next reboot")
+	emitEvent(Event{Type: EventPartition, Message: "Relocating partitions on the next reboot"})
 	if err := setupOnShutdownUnit(deps, runState); err != nil {
 		return err
 	}
@@ -258,6 +261,7 @@ func resizeOEMFileSystem(deps Deps, runState *state) error {
 		return nil
 	}
 	log.Println("Partition relocation appears to have occurred, resizing the OEM file system")
+	emitEvent(Event{Type: EventPartition, Message: "Resizing the OEM file system"})
 	systemd := systemdClient{systemctl: deps.SystemctlCmd}
 	if err := systemd.stop("usr-share-oem.mount"); err != nil {
 		return err
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// EventPrefix is the prefix of the output lines that hold provisioning events.
+// It sets events apart from the logs of the provisioner and of the build
+// steps. Lines can have other prefixes before EventPrefix, like the
+// "BuildStatus: " prefix that the startup script adds to all provisioner
+// output.
+const EventPrefix = "BuildEvent: "
+
+// Types of provisioning events.
+const (
+	// EventStepStart is emitted when a build step starts.
+	EventStepStart = "step-start"
+	// EventStepEnd is emitted when a build step ends. Its Error is set if the
+	// step failed.
+	EventStepEnd = "step-end"
+	// EventReboot is emitted when provisioning stops to reboot the builder VM.
+	EventReboot = "reboot"
+	// EventPartition is emitted when the partitions of the boot disk are
+	// changed.
+	EventPartition = "partition"
+	// EventError is emitted when provisioning fails.
+	EventError = "error"
+)
+
+// Event is a provisioning event. Events are written to stdout as single lines
+// of JSON, prefixed by EventPrefix.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Step is the 1-based index of the build step that the event is about, or
+	// 0 if the event isn't about a build step.
+	Step     int    `json:"step,omitempty"`
+	StepType string `json:"stepType,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// These are mocked in tests, like mountFunc.
+var eventOutput io.Writer = os.Stdout
+var eventNow = time.Now
+
+// emitEvent writes the given event to eventOutput. Events are best effort, so
+// errors are only logged.
+func emitEvent(e Event) {
+	e.Time = eventNow().UTC()
+	data, err := json.Marshal(&e)
+	if err != nil {
+		log.Printf("error encoding provisioning event: %v", err)
+		return
+	}
+	if _, err := fmt.Fprintf(eventOutput, "%s%s\n", EventPrefix, data); err != nil {
+		log.Printf("error writing provisioning event: %v", err)
+	}
+}
+
+// emitResult emits the event that describes how a provisioning run ended.
+func emitResult(err error) {
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, ErrRebootRequired):
+		emitEvent(Event{Type: EventReboot, Message: "Rebooting to continue provisioning"})
+	default:
+		emitEvent(Event{Type: EventError, Error: err.Error()})
+	}
+}
+
+// ParseEvent parses the provisioning event in the given output line. It returns
+// nil if the line doesn't hold an event.
+func ParseEvent(line string) *Event {
+	i := strings.Index(line, EventPrefix)
+	if i < 0 {
+		return nil
+	}
+	e := &Event{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line[i+len(EventPrefix):])), e); err != nil {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func stubEvents(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	eventOutput = &buf
+	eventNow = func() time.Time { return time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() {
+		eventOutput = os.Stdout
+		eventNow = time.Now
+	})
+	return &buf
+}
+
+func TestEmitEvent(t *testing.T) {
+	buf := stubEvents(t)
+	emitEvent(Event{Type: EventStepStart, Step: 1, StepType: "RunScript"})
+	want := `BuildEvent: {"time":"2021-03-04T10:00:00Z","type":"step-start","step":1,"stepType":"RunScript"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("emitEvent: got %q, want %q", got, want)
+	}
+}
+
+func TestEmitResult(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{name: "Success"},
+		{name: "Reboot", err: fmt.Errorf("wrapped: %w", ErrRebootRequired), want: []string{EventReboot}},
+		{name: "Error", err: errors.New("failed"), want: []string{EventError}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := stubEvents(t)
+			emitResult(test.err)
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if e := ParseEvent(line); e != nil {
+					got = append(got, e.Type)
+				}
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("emitResult(%v): diff (-got, +want): %s", test.err, diff)
+			}
+		})
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want *Event
+	}{
+		{
+			name: "Event",
+			line: `BuildEvent: {"time":"2021-03-04T10:00:00Z","type":"step-end","step":2,"stepType":"InstallGPU","error":"failed"}`,
+			want: &Event{Time: time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC), Type: EventStepEnd, Step: 2,
+				StepType: "InstallGPU", Error: "failed"},
+		},
+		{
+			name: "Prefixed",
+			line: `BuildStatus: BuildEvent: {"time":"2021-03-04T10:00:00Z","type":"reboot"}` + "\r",
+			want: &Event{Time: time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC), Type: EventReboot},
+		},
+		{
+			name: "Log",
+			line: "BuildStatus: installing packages",
+		},
+		{
+			name: "Truncated",
+			line: `BuildStatus: BuildEvent: {"time":"2021-03-04T10:00`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(ParseEvent(test.line), test.want); diff != "" {
+				t.Errorf("ParseEvent(%q): diff (-got, +want): %s", test.line, diff)
+			}
+		})
+	}
+}
@@ -305,11 +305,14 @@ func executeSteps(ctx context.Context, s *state, deps stepDeps) error {
 		}
 		abstractStep, err := parseStep(step.Type, step.Args)
 		if err != nil {
-			return fmt.Errorf("error parsing step %d: %v", i, err)
+			return fmt.Errorf("error parsing step %d: %v", i+1, err)
 		}
+		emitEvent(Event{Type: EventStepStart, Step: i + 1, StepType: step.Type})
 		if err := abstractStep.run(ctx, s, &deps); err != nil {
-			return fmt.Errorf("error in step %d: %v", i, err)
+			emitEvent(Event{Type: EventStepEnd, Step: i + 1, StepType: step.Type, Error: err.Error()})
+			return fmt.Errorf("error in step %d: %v", i+1, err)
 		}
+		emitEvent(Event{Type: EventStepEnd, Step: i + 1, StepType: step.Type})
 		// Persist our most recent completed step to disk, so we can resume after a reboot.
 		s.data.CurrentStep++
 		if err := s.write(); err != nil {
@@ -365,8 +368,9 @@ func run(ctx context.Context, deps Deps, runState *state) (err error) {
 // Run runs a full provisioning flow based on the provided config. The stateDir
 // is used for persisting data used as part of provisioning. The stateDir allows
 // the provisioning flow to be interrupted (e.g. by a reboot) and resumed.
-func Run(ctx context.Context, deps Deps, stateDir string, c Config) error {
+func Run(ctx context.Context, deps Deps, stateDir string, c Config) (err error) {
 	log.Println("Provisioning machine...")
+	defer func() { emitResult(err) }()
 	runState, err := initState(ctx, deps, stateDir, c)
 	if err != nil {
 		return err
@@ -377,6 +381,7 @@ func Run(ctx context.Context, deps Deps, stateDir string, c Config) error {
 // Resume resumes provisioning from the state provided at stateDir.
 func Resume(ctx context.Context, deps Deps, stateDir string) (err error) {
 	log.Println("Resuming provisioning...")
+	defer func() { emitResult(err) }()
 	runState, err := loadState(stateDir)
 	if err != nil {
 		return err
@@ -21,9 +21,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/cos-customizer/src/pkg/fakes"
+	"github.com/google/go-cmp/cmp"
 	"golang.org/x/sys/unix"
 )
 
@@ -78,6 +80,61 @@ func TestStateExists(t *testing.T) {
 	}
 }
 
+func TestStateSchemaVersion(t *testing.T) {
+	var testData = []struct {
+		testName string
+		data     string
+		want     stateData
+		wantErr  bool
+	}{
+		{
+			testName: "Unversioned",
+			data:     `{"Config":{"Steps":[{"Type":"SealOEM"}]},"CurrentStep":1}`,
+			want: stateData{
+				SchemaVersion: len(stateMigrations),
+				Config: Config{
+					SchemaVersion: ConfigSchemaVersion,
+					Steps:         []StepConfig{{Type: "SealOEM"}},
+				},
+				CurrentStep: 1,
+			},
+		},
+		{
+			testName: "FutureState",
+			data:     fmt.Sprintf(`{"SchemaVersion":%d}`, len(stateMigrations)+1),
+			wantErr:  true,
+		},
+		{
+			testName: "FutureConfig",
+			data:     fmt.Sprintf(`{"Config":{"SchemaVersion":%d}}`, ConfigSchemaVersion+1),
+			wantErr:  true,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "provisioner-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			if err := ioutil.WriteFile(filepath.Join(dir, "state.json"), []byte(input.data), 0660); err != nil {
+				t.Fatal(err)
+			}
+			s := &state{dir: dir}
+			err = s.read()
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Fatalf("state.read() = %v; want error: %v", err, input.wantErr)
+			}
+			if input.wantErr {
+				return
+			}
+			if diff := cmp.Diff(s.data, input.want); diff != "" {
+				t.Errorf("state.read(): diff (-got, +want): %s", diff)
+			}
+		})
+	}
+}
+
 func TestRunInvalidArgs(t *testing.T) {
 	stubMount()
 	t.Cleanup(restoreMount)
@@ -191,9 +248,14 @@ func TestRunFailure(t *testing.T) {
 				t.Fatal(err)
 			}
 			funcCall := fmt.Sprintf("Run(ctx, %+v, %q, %+v)", deps, stateDir, test.config)
-			if err := Run(ctx, deps, stateDir, test.config); err == nil {
+			err = Run(ctx, deps, stateDir, test.config)
+			if err == nil {
 				t.Fatalf("%s = nil; want err", funcCall)
 			}
+			// Steps are numbered from 1 in errors, like in build events.
+			if !strings.Contains(err.Error(), "error in step 1:") {
+				t.Errorf("%s = %v; want error in step 1", funcCall, err)
+			}
 		})
 	}
 }
@@ -241,6 +303,20 @@ func TestRunSuccess(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "LocalBuildContext",
+			config: Config{
+				BuildContexts: map[string]string{
+					"bc": "file://" + buildCtx,
+				},
+				Steps: []StepConfig{
+					{
+						Type: "RunScript",
+						Args: []byte(`{"BuildContext": "bc", "Path": "run.sh"}`),
+					},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		test := test
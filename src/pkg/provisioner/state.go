@@ -35,12 +35,31 @@ var (
 	errStateAlreadyExists = errors.New("state already exists")
 )
 
+// stateMigrations upgrades state.json files to the latest schema version.
+// stateMigrations[i] upgrades a state file from version i to version i+1.
+var stateMigrations = []utils.Migration{
+	// Version 1 introduced the SchemaVersion field.
+	nil,
+}
+
 type stateData struct {
+	SchemaVersion      int
 	Config             Config
 	CurrentStep        int
 	DiskResizeComplete bool
 }
 
+func (d stateData) MarshalJSON() ([]byte, error) {
+	type data stateData
+	d.SchemaVersion = len(stateMigrations)
+	return json.Marshal(data(d))
+}
+
+func (d *stateData) UnmarshalJSON(b []byte) error {
+	type data stateData
+	return utils.UnmarshalVersioned(b, "provisioner state", stateMigrations, (*data)(d))
+}
+
 type state struct {
 	dir  string
 	data stateData
@@ -90,20 +109,40 @@ func downloadGCSObject(ctx context.Context, gcsClient *storage.Client, bucket, o
 	return nil
 }
 
-func (s *state) unpackBuildContexts(ctx context.Context, deps Deps) (err error) {
-	for name, address := range s.data.Config.BuildContexts {
-		log.Printf("Unpacking build context %q from %q", name, address)
-		if address[:len("gs://")] != "gs://" {
-			return fmt.Errorf("cannot use address %q, only gs:// addresses are supported", address)
-		}
+// fetchBuildContext gets a local tar archive of the build context at the given
+// address. gs:// addresses are downloaded into the state directory, and file://
+// addresses are used in place. The returned bool indicates if the archive is a
+// temporary file that should be removed after it is unpacked.
+func (s *state) fetchBuildContext(ctx context.Context, deps Deps, name, address string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(address, "gs://"):
 		splitAddr := strings.SplitN(address[len("gs://"):], "/", 2)
 		if len(splitAddr) != 2 || splitAddr[0] == "" || splitAddr[1] == "" {
-			return fmt.Errorf("address %q is malformed", address)
+			return "", false, fmt.Errorf("address %q is malformed", address)
 		}
 		bucket, object := splitAddr[0], splitAddr[1]
 		tarPath := filepath.Join(s.dir, name+".tar")
 		if err := downloadGCSObject(ctx, deps.GCSClient, bucket, object, tarPath); err != nil {
-			return fmt.Errorf("error downloading %q to %q: %v", address, tarPath, err)
+			return "", false, fmt.Errorf("error downloading %q to %q: %v", address, tarPath, err)
+		}
+		return tarPath, true, nil
+	case strings.HasPrefix(address, "file://"):
+		tarPath := address[len("file://"):]
+		if !filepath.IsAbs(tarPath) {
+			return "", false, fmt.Errorf("address %q is malformed; file:// addresses must be absolute", address)
+		}
+		return tarPath, false, nil
+	default:
+		return "", false, fmt.Errorf("cannot use address %q, only gs:// and file:// addresses are supported", address)
+	}
+}
+
+func (s *state) unpackBuildContexts(ctx context.Context, deps Deps) (err error) {
+	for name, address := range s.data.Config.BuildContexts {
+		log.Printf("Unpacking build context %q from %q", name, address)
+		tarPath, isTemp, err := s.fetchBuildContext(ctx, deps, name, address)
+		if err != nil {
+			return err
 		}
 		tarDir := filepath.Join(s.dir, name)
 		if err := os.Mkdir(tarDir, 0770); err != nil {
@@ -116,8 +155,10 @@ func (s *state) unpackBuildContexts(ctx context.Context, deps Deps) (err error)
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf(`error in cmd "%s %v", see stderr for details: %v`, deps.TarCmd, args, err)
 		}
-		if err := os.Remove(tarPath); err != nil {
-			return err
+		if isTemp {
+			if err := os.Remove(tarPath); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
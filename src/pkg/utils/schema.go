@@ -0,0 +1,79 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SchemaVersionKey is the JSON key that holds the schema version of a
+// versioned document. Documents written before schema versions were introduced
+// don't have this key, and are treated as version 0.
+const SchemaVersionKey = "SchemaVersion"
+
+// Migration upgrades a JSON document by one schema version. The document is
+// given as a map from top level keys to their raw values, and is modified in
+// place. A nil Migration indicates that documents of the old version are also
+// valid documents of the new version.
+type Migration func(doc map[string]json.RawMessage) error
+
+// UnmarshalVersioned upgrades the given JSON document to the latest schema
+// version and unmarshals it into v. migrations[i] upgrades a document from
+// version i to version i+1, so the latest schema version is len(migrations).
+// Documents with a schema version newer than the latest version are rejected,
+// since they may hold data that would otherwise be silently dropped. kind
+// describes the document in error messages.
+//
+// v must not implement json.Unmarshaler itself; callers usually pass a pointer
+// to an alias type from their own UnmarshalJSON method.
+func UnmarshalVersioned(data []byte, kind string, migrations []Migration, v interface{}) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc == nil {
+		return nil
+	}
+	var version int
+	if raw, ok := doc[SchemaVersionKey]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return fmt.Errorf("invalid schema version %s in %s: %v", string(raw), kind, err)
+		}
+	}
+	latest := len(migrations)
+	if version < 0 || version > latest {
+		return fmt.Errorf("%s has schema version %d, but only versions up to %d are supported; "+
+			"it was probably written by a newer version of cos-customizer", kind, version, latest)
+	}
+	for i := version; i < latest; i++ {
+		if migrations[i] == nil {
+			continue
+		}
+		if err := migrations[i](doc); err != nil {
+			return fmt.Errorf("error upgrading %s from schema version %d to %d: %v", kind, i, i+1, err)
+		}
+	}
+	latestJSON, err := json.Marshal(latest)
+	if err != nil {
+		return err
+	}
+	doc[SchemaVersionKey] = latestJSON
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(upgraded, v)
+}
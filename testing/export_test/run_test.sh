@@ -0,0 +1,37 @@
+#!/bin/bash
+#
+# Copyright 2021 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+RESULT="pass"
+workdir="$(mktemp -d)"
+if ! gsutil -q cp "${EXPORT_URI}" "${EXPORT_URI}.sha256" "${workdir}"; then
+  echo "Exported image or checksum is missing"
+  RESULT="fail"
+elif ! (cd "${workdir}" && sha256sum -c "$(basename "${EXPORT_URI}").sha256"); then
+  echo "Exported image doesn't match its checksum"
+  RESULT="fail"
+elif [[ "$(head -c 4 "${workdir}/$(basename "${EXPORT_URI}")")" != "KDMV" ]]; then
+  echo "Exported image isn't a VMDK disk image"
+  RESULT="fail"
+fi
+
+rm -rf "${workdir}"
+gsutil -q rm "${EXPORT_URI}" "${EXPORT_URI}.sha256"
+gcloud compute images delete "${IMAGE}" --project="${PROJECT}"
+if [[ "${RESULT}" == "fail" ]]; then
+  echo "Tests failed"
+  exit 1
+fi
+echo "Tests passed"